@@ -0,0 +1,110 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package shadowfax
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net/url"
+	"strings"
+
+	"gopkg.in/basen.v1"
+	"gopkg.in/errgo.v1"
+)
+
+// AddressVersion is the version of the address encoding written by Encode.
+const AddressVersion = 1
+
+// addressChecksumLen is the length of the checksum which ends an encoded
+// address.
+const addressChecksumLen = 4
+
+// maxRouterLen is the longest router hint accepted in an address.
+const maxRouterLen = 255
+
+// Address is the public key of a recipient, with an optional hint naming the
+// home router which keeps their mailbox. Messages to an address without a
+// router hint are kept by whichever router they are pushed to.
+type Address struct {
+	Key    *PublicKey
+	Router string
+}
+
+// ParseAddress parses an address. An address is encoded in Base58 as a
+// version byte, the 32-byte public key, the router hint if any, and the first
+// four bytes of the SHA-256 hash of all these, as a checksum.
+//
+// Bare public keys are also accepted, as are those followed by @router for
+// a router hint, the forms used before addresses were versioned.
+func ParseAddress(s string) (*Address, error) {
+	if i := strings.Index(s, "@"); i >= 0 {
+		key, err := DecodePublicKey(s[:i])
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid address %q", s)
+		}
+		router, err := parseRouter(s[i+1:])
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid address %q", s)
+		}
+		return &Address{Key: key, Router: router}, nil
+	}
+	if key, err := DecodePublicKey(s); err == nil {
+		return &Address{Key: key}, nil
+	}
+
+	buf, err := basen.Base58.DecodeString(s)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid address %q", s)
+	}
+	if len(buf) < 1+len(PublicKey{})+addressChecksumLen || len(buf) > 1+len(PublicKey{})+maxRouterLen+addressChecksumLen {
+		return nil, errgo.Newf("invalid address %q: wrong length", s)
+	}
+	if buf[0] != AddressVersion {
+		return nil, errgo.Newf("invalid address %q: unsupported version %d", s, buf[0])
+	}
+	payload, checksum := buf[:len(buf)-addressChecksumLen], buf[len(buf)-addressChecksumLen:]
+	if !bytes.Equal(addressChecksum(payload), checksum) {
+		return nil, errgo.Newf("invalid address %q: checksum mismatch", s)
+	}
+	var key PublicKey
+	copy(key[:], payload[1:])
+	var router string
+	if routerBytes := payload[1+len(key):]; len(routerBytes) > 0 {
+		router, err = parseRouter(string(routerBytes))
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid address %q", s)
+		}
+	}
+	return &Address{Key: &key, Router: router}, nil
+}
+
+// parseRouter validates a router hint, which is a host[:port], returning it
+// in canonical form.
+func parseRouter(router string) (string, error) {
+	if router == "" || len(router) > maxRouterLen {
+		return "", errgo.Newf("invalid router %q", router)
+	}
+	u, err := url.Parse("https://" + router)
+	if err != nil || u.Host != router || u.User != nil {
+		return "", errgo.Newf("invalid router %q", router)
+	}
+	return strings.ToLower(router), nil
+}
+
+func addressChecksum(payload []byte) []byte {
+	sum := sha256.Sum256(payload)
+	return sum[:addressChecksumLen]
+}
+
+// Encode returns the versioned encoding of the address.
+func (a *Address) Encode() string {
+	payload := append([]byte{AddressVersion}, a.Key[:]...)
+	payload = append(payload, a.Router...)
+	return basen.Base58.EncodeToString(append(payload, addressChecksum(payload)...))
+}
@@ -0,0 +1,123 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package shadowfax_test
+
+import (
+	"testing"
+
+	"gopkg.in/basen.v1"
+	gc "gopkg.in/check.v1"
+
+	sf "github.com/cmars/shadowfax"
+	sftesting "github.com/cmars/shadowfax/testing"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type addressSuite struct{}
+
+var _ = gc.Suite(&addressSuite{})
+
+func (s *addressSuite) TestRoundTrip(c *gc.C) {
+	key := sftesting.MustNewKeyPair().PublicKey
+	for _, addr := range []*sf.Address{
+		{Key: key},
+		{Key: key, Router: "router.example.com:8443"},
+	} {
+		parsed, err := sf.ParseAddress(addr.Encode())
+		c.Assert(err, gc.IsNil)
+		c.Assert(parsed, gc.DeepEquals, addr)
+	}
+
+	// A key with leading zero bytes is not shortened.
+	key = new(sf.PublicKey)
+	key[31] = 1
+	parsed, err := sf.ParseAddress((&sf.Address{Key: key}).Encode())
+	c.Assert(err, gc.IsNil)
+	c.Assert(parsed.Key, gc.DeepEquals, key)
+}
+
+func (s *addressSuite) TestLegacy(c *gc.C) {
+	key := sftesting.MustNewKeyPair().PublicKey
+	addr, err := sf.ParseAddress(key.Encode())
+	c.Assert(err, gc.IsNil)
+	c.Assert(addr, gc.DeepEquals, &sf.Address{Key: key})
+
+	addr, err = sf.ParseAddress(key.Encode() + "@Router.Example.com:8443")
+	c.Assert(err, gc.IsNil)
+	c.Assert(addr, gc.DeepEquals, &sf.Address{Key: key, Router: "router.example.com:8443"})
+}
+
+func (s *addressSuite) TestInvalid(c *gc.C) {
+	key := sftesting.MustNewKeyPair().PublicKey
+	encoded := (&sf.Address{Key: key, Router: "example.com"}).Encode()
+	typo := []byte(encoded)
+	if typo[10] == 'z' {
+		typo[10] = 'y'
+	} else {
+		typo[10] = 'z'
+	}
+	var wrongVersion []byte
+	wrongVersion = append(wrongVersion, 2)
+	wrongVersion = append(wrongVersion, key[:]...)
+	wrongVersion = append(wrongVersion, 0, 0, 0, 0)
+
+	for i, test := range []struct {
+		address string
+		err     string
+	}{{
+		address: "work",
+		err:     `invalid address "work": .*`,
+	}, {
+		address: string(typo),
+		err:     `invalid address ".*": checksum mismatch`,
+	}, {
+		address: encoded[:len(encoded)-1],
+		err:     `invalid address ".*": .*`,
+	}, {
+		address: encoded + "1",
+		err:     `invalid address ".*": .*`,
+	}, {
+		address: basen.Base58.EncodeToString(wrongVersion),
+		err:     `invalid address ".*": unsupported version 2`,
+	}, {
+		address: "1" + key.Encode(),
+		err:     `invalid address ".*": .*`,
+	}, {
+		address: key.Encode() + "@",
+		err:     `invalid address ".*": invalid router ""`,
+	}, {
+		address: key.Encode() + "@example.com/inbox",
+		err:     `invalid address ".*": invalid router "example.com/inbox"`,
+	}, {
+		address: key.Encode() + "@user@example.com",
+		err:     `invalid address ".*": invalid router "user@example.com"`,
+	}, {
+		address: "0" + key.Encode()[1:],
+		err:     `invalid address ".*": .*`,
+	}} {
+		c.Logf("test #%d: %s", i, test.address)
+		_, err := sf.ParseAddress(test.address)
+		c.Assert(err, gc.ErrorMatches, test.err)
+	}
+}
+
+func (s *addressSuite) TestDecodePublicKey(c *gc.C) {
+	key := sftesting.MustNewKeyPair().PublicKey
+	decoded, err := sf.DecodePublicKey(key.Encode())
+	c.Assert(err, gc.IsNil)
+	c.Assert(decoded, gc.DeepEquals, key)
+
+	// Bare keys have no checksum, so only those which cannot be the
+	// encoding of a key are rejected.
+	for _, s := range []string{"work", "", "1" + key.Encode(), key.Encode() + "0"} {
+		_, err = sf.DecodePublicKey(s)
+		c.Assert(err, gc.NotNil, gc.Commentf("%q", s))
+	}
+}
@@ -0,0 +1,376 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+// Package backup reads and writes passphrase-encrypted backups of vault key
+// pairs and contacts, for moving identities between machines.
+//
+// A backup is a single ASCII-armoured block. Its headers describe how the
+// encryption key is derived from the passphrase, so that a backup can be
+// read without knowing the parameters it was written with:
+//
+//	-----BEGIN SHADOWFAX VAULT BACKUP-----
+//	KDF: scrypt
+//	Nonce: <base64>
+//	Salt: <base64>
+//	Scrypt-N: 16384
+//	Scrypt-P: 1
+//	Scrypt-R: 8
+//	Version: 1
+//
+//	<base64 secretbox of the JSON contents>
+//	-----END SHADOWFAX VAULT BACKUP-----
+package backup
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/storage"
+)
+
+// Version is the backup format written.
+const Version = 1
+
+const blockType = "SHADOWFAX VAULT BACKUP"
+
+// Key derivation parameters for new backups.
+const (
+	scryptN  = 16384
+	scryptR  = 8
+	scryptP  = 1
+	saltSize = 32
+)
+
+// Limits on the key derivation parameters of backups read, so that a
+// malformed backup cannot exhaust memory.
+const (
+	maxScryptN  = 1 << 20
+	maxScryptRP = 1 << 8
+)
+
+// Backup holds the key pairs, and optionally the contacts, of a vault.
+type Backup struct {
+	KeyPairs []*sf.KeyPair
+
+	// Infos are the labels, retirement and default of the key pairs. Key
+	// pairs without one have no label, and are neither retired nor the
+	// default.
+	Infos []*storage.KeyInfo
+
+	Contacts storage.ContactInfos
+}
+
+// info returns the metadata of a key pair in the backup, or nil if it has
+// none.
+func (b *Backup) info(key *sf.PublicKey) *storage.KeyInfo {
+	for _, info := range b.Infos {
+		if *info.Address == *key {
+			return info
+		}
+	}
+	return nil
+}
+
+type keyPairRecord struct {
+	PublicKey  string `json:"public-key"`
+	PrivateKey []byte `json:"private-key"`
+	Label      string `json:"label,omitempty"`
+	Retired    bool   `json:"retired,omitempty"`
+	Default    bool   `json:"default,omitempty"`
+}
+
+type contactRecord struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+type contents struct {
+	KeyPairs []keyPairRecord `json:"key-pairs"`
+	Contacts []contactRecord `json:"contacts,omitempty"`
+}
+
+// Write writes a backup encrypted with a key derived from the passphrase.
+func Write(w io.Writer, b *Backup, passphrase []byte) error {
+	var c contents
+	for _, keyPair := range b.KeyPairs {
+		record := keyPairRecord{
+			PublicKey:  keyPair.PublicKey.Encode(),
+			PrivateKey: keyPair.PrivateKey[:],
+		}
+		if info := b.info(keyPair.PublicKey); info != nil {
+			record.Label = info.Label
+			record.Retired = info.Retired
+			record.Default = info.Default
+		}
+		c.KeyPairs = append(c.KeyPairs, record)
+	}
+	for _, contact := range b.Contacts {
+		addr := &sf.Address{Key: contact.Address, Router: contact.Router}
+		c.Contacts = append(c.Contacts, contactRecord{
+			Name:    contact.Name,
+			Address: addr.Encode(),
+		})
+	}
+	plaintext, err := json.Marshal(&c)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	// TODO: zeroize plaintext
+
+	salt := make([]byte, saltSize)
+	_, err = io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	nonce, err := sf.NewNonce()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	key, err := deriveKey(passphrase, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+
+	block := &pem.Block{
+		Type: blockType,
+		Headers: map[string]string{
+			"Version":  strconv.Itoa(Version),
+			"KDF":      "scrypt",
+			"Scrypt-N": strconv.Itoa(scryptN),
+			"Scrypt-R": strconv.Itoa(scryptR),
+			"Scrypt-P": strconv.Itoa(scryptP),
+			"Salt":     base64.StdEncoding.EncodeToString(salt),
+			"Nonce":    base64.StdEncoding.EncodeToString(nonce[:]),
+		},
+		Bytes: secretbox.Seal(nil, plaintext, (*[24]byte)(nonce), key),
+	}
+	return errgo.Mask(pem.Encode(w, block))
+}
+
+// Read reads a backup, decrypting it with a key derived from the passphrase.
+func Read(r io.Reader, passphrase []byte) (*Backup, error) {
+	armoured, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	block, _ := pem.Decode(armoured)
+	if block == nil || block.Type != blockType {
+		return nil, errgo.New("not a vault backup")
+	}
+	if block.Headers["Version"] != strconv.Itoa(Version) {
+		return nil, errgo.Newf("unsupported backup version %q", block.Headers["Version"])
+	}
+	if block.Headers["KDF"] != "scrypt" {
+		return nil, errgo.Newf("unsupported key derivation %q", block.Headers["KDF"])
+	}
+	var params [3]int
+	for i, name := range []string{"Scrypt-N", "Scrypt-R", "Scrypt-P"} {
+		params[i], err = strconv.Atoi(block.Headers[name])
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid %s", name)
+		}
+	}
+	if params[0] > maxScryptN || params[1]*params[2] > maxScryptRP {
+		return nil, errgo.New("key derivation parameters too costly")
+	}
+	salt, err := base64.StdEncoding.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid salt")
+	}
+	nonceBytes, err := base64.StdEncoding.DecodeString(block.Headers["Nonce"])
+	if err != nil || len(nonceBytes) != 24 {
+		return nil, errgo.New("invalid nonce")
+	}
+	var nonce [24]byte
+	copy(nonce[:], nonceBytes)
+
+	key, err := deriveKey(passphrase, salt, params[0], params[1], params[2])
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	plaintext, ok := secretbox.Open(nil, block.Bytes, &nonce, key)
+	if !ok {
+		return nil, errgo.New("invalid passphrase or corrupt backup")
+	}
+
+	var c contents
+	err = json.Unmarshal(plaintext, &c)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var b Backup
+	for _, record := range c.KeyPairs {
+		publicKey, err := sf.DecodePublicKey(record.PublicKey)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if len(record.PrivateKey) != 32 {
+			return nil, errgo.Newf("invalid private key for %q", record.PublicKey)
+		}
+		privateKey := new(sf.PrivateKey)
+		copy(privateKey[:], record.PrivateKey)
+		var checkKey sf.PublicKey
+		curve25519.ScalarBaseMult((*[32]byte)(&checkKey), (*[32]byte)(privateKey))
+		if checkKey != *publicKey {
+			return nil, errgo.Newf("private key does not match public key %q", record.PublicKey)
+		}
+		b.KeyPairs = append(b.KeyPairs, &sf.KeyPair{PublicKey: publicKey, PrivateKey: privateKey})
+		if record.Label != "" || record.Retired || record.Default {
+			b.Infos = append(b.Infos, &storage.KeyInfo{
+				Address: publicKey,
+				Label:   record.Label,
+				Retired: record.Retired,
+				Default: record.Default,
+			})
+		}
+	}
+	for _, record := range c.Contacts {
+		addr, err := sf.ParseAddress(record.Address)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		b.Contacts = append(b.Contacts, storage.ContactInfo{Name: record.Name, Address: addr.Key, Router: addr.Router})
+	}
+	return &b, nil
+}
+
+func deriveKey(passphrase, salt []byte, n, r, p int) (*[32]byte, error) {
+	derived, err := scrypt.Key(passphrase, salt, n, r, p, 32)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var key [32]byte
+	copy(key[:], derived)
+	return &key, nil
+}
+
+// Restore merges the backup into a vault, and into contacts if not nil. Key
+// pairs already in the vault are skipped, as are contacts whose name already
+// refers to some key; those which refer to a different key are returned as
+// conflicts rather than overwritten. Key pairs added keep their labels and
+// retirement. The current key pair of the vault, if any, remains current;
+// otherwise the default of the backup becomes current. It returns the number
+// of key pairs and contacts added.
+func (b *Backup) Restore(vault storage.Vault, contacts storage.Contacts) (int, int, storage.ContactInfos, error) {
+	var keysAdded, contactsAdded int
+	var backupDefault *sf.PublicKey
+	current, err := currentKey(vault)
+	if err != nil {
+		return keysAdded, contactsAdded, nil, errgo.Mask(err)
+	}
+	for _, keyPair := range b.KeyPairs {
+		_, err := vault.Get(keyPair.PublicKey)
+		if err == nil {
+			continue
+		} else if errgo.Cause(err) != storage.ErrNotFound {
+			return keysAdded, contactsAdded, nil, errgo.Mask(err)
+		}
+		err = vault.Put(keyPair)
+		if err != nil {
+			return keysAdded, contactsAdded, nil, errgo.Mask(err)
+		}
+		keysAdded++
+		if info := b.info(keyPair.PublicKey); info != nil {
+			err = restoreInfo(vault, info)
+			if err != nil {
+				return keysAdded, contactsAdded, nil, errgo.Mask(err)
+			}
+			if info.Default && !info.Retired && current == nil {
+				backupDefault = info.Address
+			}
+		}
+	}
+	if keysAdded > 0 {
+		// Adding a key pair makes it current, unless a default was chosen.
+		if current == nil {
+			current = backupDefault
+		}
+		restored, err := currentKey(vault)
+		if err != nil {
+			return keysAdded, contactsAdded, nil, errgo.Mask(err)
+		}
+		if current != nil && (restored == nil || *restored != *current) {
+			err = vault.SetDefault(current)
+			if err != nil {
+				return keysAdded, contactsAdded, nil, errgo.Mask(err)
+			}
+		}
+	}
+	if contacts == nil {
+		return keysAdded, contactsAdded, nil, nil
+	}
+
+	var conflicts storage.ContactInfos
+	for _, contact := range b.Contacts {
+		key, err := contacts.Key(contact.Name)
+		if err == nil {
+			if *key != *contact.Address {
+				conflicts = append(conflicts, contact)
+			}
+			continue
+		} else if errgo.Cause(err) != storage.ErrNotFound {
+			return keysAdded, contactsAdded, nil, errgo.Mask(err)
+		}
+		err = contacts.Put(contact.Name, contact.Address)
+		if err != nil {
+			return keysAdded, contactsAdded, nil, errgo.Mask(err)
+		}
+		if contact.Router != "" {
+			err = contacts.SetRouter(contact.Name, contact.Router)
+			if err != nil {
+				return keysAdded, contactsAdded, nil, errgo.Mask(err)
+			}
+		}
+		contactsAdded++
+	}
+	return keysAdded, contactsAdded, conflicts, nil
+}
+
+// restoreInfo applies the label and retirement of a key pair restored into
+// the vault.
+func restoreInfo(vault storage.Vault, info *storage.KeyInfo) error {
+	if info.Label != "" {
+		err := vault.SetLabel(info.Address, info.Label)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if info.Retired {
+		err := vault.Retire(info.Address)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// currentKey returns the public key of the current key pair of the vault, or
+// nil if it has none.
+func currentKey(vault storage.Vault) (*sf.PublicKey, error) {
+	infos, err := vault.Infos()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	for _, info := range infos {
+		if info.Default {
+			return info.Address, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,180 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package backup_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	gc "gopkg.in/check.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/backup"
+	"github.com/cmars/shadowfax/storage"
+	sfbolt "github.com/cmars/shadowfax/storage/bolt"
+	sftesting "github.com/cmars/shadowfax/testing"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type backupSuite struct {
+	db *bolt.DB
+}
+
+var _ = gc.Suite(&backupSuite{})
+
+func (s *backupSuite) SetUpTest(c *gc.C) {
+	var err error
+	s.db, err = bolt.Open(filepath.Join(c.MkDir(), "testdb"), 0600, nil)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *backupSuite) TearDownTest(c *gc.C) {
+	s.db.Close()
+}
+
+func (s *backupSuite) TestRoundTrip(c *gc.C) {
+	b := &backup.Backup{
+		KeyPairs: []*sf.KeyPair{sftesting.MustNewKeyPair(), sftesting.MustNewKeyPair()},
+		Contacts: storage.ContactInfos{
+			{Name: "bob", Address: sftesting.MustNewKeyPair().PublicKey},
+			{Name: "carol", Address: sftesting.MustNewKeyPair().PublicKey, Router: "example.com"},
+		},
+	}
+	var buf bytes.Buffer
+	err := backup.Write(&buf, b, []byte("secret"))
+	c.Assert(err, gc.IsNil)
+	armoured := buf.String()
+	c.Assert(strings.HasPrefix(armoured, "-----BEGIN SHADOWFAX VAULT BACKUP-----\n"), gc.Equals, true)
+	c.Assert(armoured, gc.Matches, "(?s).*\nKDF: scrypt\n.*")
+	c.Assert(strings.Contains(armoured, b.KeyPairs[0].PublicKey.Encode()), gc.Equals, false)
+
+	restored, err := backup.Read(strings.NewReader(armoured), []byte("secret"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(restored, gc.DeepEquals, b)
+
+	_, err = backup.Read(strings.NewReader(armoured), []byte("wrong"))
+	c.Assert(err, gc.ErrorMatches, "invalid passphrase or corrupt backup")
+	_, err = backup.Read(strings.NewReader("hello"), []byte("secret"))
+	c.Assert(err, gc.ErrorMatches, "not a vault backup")
+}
+
+func (s *backupSuite) TestMismatchedKeyPair(c *gc.C) {
+	keyPair := sftesting.MustNewKeyPair()
+	keyPair.PublicKey = sftesting.MustNewKeyPair().PublicKey
+	var buf bytes.Buffer
+	err := backup.Write(&buf, &backup.Backup{KeyPairs: []*sf.KeyPair{keyPair}}, []byte("secret"))
+	c.Assert(err, gc.IsNil)
+
+	_, err = backup.Read(&buf, []byte("secret"))
+	c.Assert(err, gc.ErrorMatches, "private key does not match public key .*")
+}
+
+func (s *backupSuite) TestRestore(c *gc.C) {
+	secretKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+	vault := sfbolt.NewVault(s.db, secretKey)
+	contacts := sfbolt.NewContacts(s.db)
+
+	existing := sftesting.MustNewKeyPair()
+	c.Assert(vault.Put(existing), gc.IsNil)
+	bobKey := sftesting.MustNewKeyPair().PublicKey
+	c.Assert(contacts.Put("bob", bobKey), gc.IsNil)
+
+	added := sftesting.MustNewKeyPair()
+	carolKey := sftesting.MustNewKeyPair().PublicKey
+	b := &backup.Backup{
+		KeyPairs: []*sf.KeyPair{existing, added},
+		Contacts: storage.ContactInfos{
+			{Name: "bob", Address: bobKey},
+			{Name: "carol", Address: carolKey, Router: "example.com"},
+		},
+	}
+	nKeys, nContacts, conflicts, err := b.Restore(vault, contacts)
+	c.Assert(err, gc.IsNil)
+	c.Assert(nKeys, gc.Equals, 1)
+	c.Assert(nContacts, gc.Equals, 1)
+	c.Assert(conflicts, gc.HasLen, 0)
+
+	var n int
+	err = vault.Each(func(*sf.KeyPair) error {
+		n++
+		return nil
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 2)
+	kp, err := vault.Get(added.PublicKey)
+	c.Assert(err, gc.IsNil)
+	c.Assert(kp, gc.DeepEquals, added)
+
+	// The current key pair is unchanged.
+	current, err := vault.Current()
+	c.Assert(err, gc.IsNil)
+	c.Assert(current, gc.DeepEquals, existing)
+	key, err := contacts.Key("carol")
+	c.Assert(err, gc.IsNil)
+	c.Assert(key, gc.DeepEquals, carolKey)
+	router, err := contacts.Router("carol")
+	c.Assert(err, gc.IsNil)
+	c.Assert(router, gc.Equals, "example.com")
+
+	// Restoring again adds nothing, and a name which refers to another key
+	// is not overwritten.
+	b.Contacts[0].Address = sftesting.MustNewKeyPair().PublicKey
+	nKeys, nContacts, conflicts, err = b.Restore(vault, contacts)
+	c.Assert(err, gc.IsNil)
+	c.Assert(nKeys, gc.Equals, 0)
+	c.Assert(nContacts, gc.Equals, 0)
+	c.Assert(conflicts, gc.DeepEquals, b.Contacts[:1])
+	key, err = contacts.Key("bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(key, gc.DeepEquals, bobKey)
+}
+
+func (s *backupSuite) TestRestoreInfos(c *gc.C) {
+	retired, current, latest := sftesting.MustNewKeyPair(), sftesting.MustNewKeyPair(), sftesting.MustNewKeyPair()
+	b := &backup.Backup{
+		KeyPairs: []*sf.KeyPair{retired, current, latest},
+		Infos: []*storage.KeyInfo{
+			{Address: retired.PublicKey, Label: "old", Retired: true},
+			{Address: current.PublicKey, Label: "work", Default: true},
+		},
+	}
+	var buf bytes.Buffer
+	err := backup.Write(&buf, b, []byte("secret"))
+	c.Assert(err, gc.IsNil)
+	restored, err := backup.Read(&buf, []byte("secret"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(restored, gc.DeepEquals, b)
+
+	secretKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+	vault := sfbolt.NewVault(s.db, secretKey)
+	nKeys, _, _, err := restored.Restore(vault, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(nKeys, gc.Equals, 3)
+
+	// Labels and retirement are restored, and the default of the backup
+	// is current in an empty vault, though not the last key pair added.
+	infos, err := vault.Infos()
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos, gc.DeepEquals, []*storage.KeyInfo{
+		{Address: retired.PublicKey, Label: "old", Retired: true},
+		{Address: current.PublicKey, Label: "work", Default: true},
+		{Address: latest.PublicKey},
+	})
+	kp, err := vault.Current()
+	c.Assert(err, gc.IsNil)
+	c.Assert(kp, gc.DeepEquals, current)
+	err = vault.SetDefault(retired.PublicKey)
+	c.Assert(err, gc.ErrorMatches, "key pair .* is retired")
+}
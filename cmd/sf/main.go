@@ -9,18 +9,24 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha512"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/howeyc/gopass"
@@ -29,9 +35,13 @@ import (
 	"gopkg.in/errgo.v1"
 
 	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/backup"
 	sfhttp "github.com/cmars/shadowfax/http"
+	"github.com/cmars/shadowfax/session"
 	"github.com/cmars/shadowfax/storage"
 	sfbolt "github.com/cmars/shadowfax/storage/bolt"
+	"github.com/cmars/shadowfax/transport"
+	"github.com/cmars/shadowfax/wire"
 )
 
 var (
@@ -44,23 +54,68 @@ var (
 
 	nameAddCmd     = nameCmd.Command("add", "add name")
 	nameAddNameArg = nameAddCmd.Arg("name", "contact name").String()
-	nameAddAddrArg = nameAddCmd.Arg("addr", "contact address").String()
+	nameAddAddrArg = nameAddCmd.Arg("addr", "contact address, which may name their home router").String()
 
 	nameListCmd = nameCmd.Command("list", "list names")
 
-	addrCmd        = kingpin.Command("addr", "addresses")
-	addrCreateCmd  = addrCmd.Command("create", "create new address")
-	addrListCmd    = addrCmd.Command("list", "list addresses")
-	addrDefaultCmd = addrCmd.Command("default", "show default address")
+	nameGroupCmd      = nameCmd.Command("group", "set or show group members")
+	nameGroupGroupArg = nameGroupCmd.Arg("group", "group name").Required().String()
+	nameGroupNamesArg = nameGroupCmd.Arg("names", "member contact names").Strings()
+
+	addrCmd       = kingpin.Command("addr", "addresses")
+	addrCreateCmd = addrCmd.Command("create", "create new address")
+	addrListCmd   = addrCmd.Command("list", "list addresses")
+	addrRotateCmd = addrCmd.Command("rotate", "move to a new default address, notifying contacts")
+
+	addrDefaultCmd            = addrCmd.Command("default", "show or set default address")
+	addrDefaultShowCmd        = addrDefaultCmd.Command("show", "show default address").Default()
+	addrDefaultShowRouterFlag = addrDefaultShowCmd.Flag("router", "home router to name in the address").String()
+	addrDefaultSetCmd         = addrDefaultCmd.Command("set", "set default address")
+	addrDefaultSetArg         = addrDefaultSetCmd.Arg("addr", "address or label").Required().String()
+
+	addrLabelCmd      = addrCmd.Command("label", "label an address")
+	addrLabelAddrArg  = addrLabelCmd.Arg("addr", "address or label").Required().String()
+	addrLabelLabelArg = addrLabelCmd.Arg("label", "new label; removes the label if omitted").String()
+
+	addrRetireCmd = addrCmd.Command("retire", "stop using an address by default")
+	addrRetireArg = addrRetireCmd.Arg("addr", "address or label").Required().String()
+
+	addrPrekeysCmd             = addrCmd.Command("prekeys", "one-time prekeys")
+	addrPrekeysRefillCmd       = addrPrekeysCmd.Command("refill", "publish prekeys for the default address")
+	addrPrekeysRefillCountFlag = addrPrekeysRefillCmd.Flag("count", "number of unclaimed prekeys to keep published").Default("100").Int()
+
+	vaultCmd           = kingpin.Command("vault", "key vault")
+	vaultPasswdCmd     = vaultCmd.Command("passwd", "change vault passphrase")
+	vaultPasswdNewFlag = vaultPasswdCmd.Flag("new-passphrase", "file containing new passphrase").ExistingFile()
+
+	vaultExportCmd            = vaultCmd.Command("export", "write an encrypted backup of vault key pairs")
+	vaultExportContactsFlag   = vaultExportCmd.Flag("contacts", "include contacts in the backup").Bool()
+	vaultExportOutputFlag     = vaultExportCmd.Flag("output", "write backup to file instead of stdout").Short('o').String()
+	vaultExportPassphraseFlag = vaultExportCmd.Flag("backup-passphrase", "file containing backup passphrase").ExistingFile()
+
+	vaultImportCmd            = vaultCmd.Command("import", "merge an encrypted backup into the vault")
+	vaultImportFileArg        = vaultImportCmd.Arg("file", "backup file").Required().ExistingFile()
+	vaultImportPassphraseFlag = vaultImportCmd.Flag("backup-passphrase", "file containing backup passphrase").ExistingFile()
 
 	msgCmd = kingpin.Command("msg", "messages")
 
 	msgPushCmd         = msgCmd.Command("push", "push message")
-	msgPushRcptArg     = msgPushCmd.Arg("recipient", "message recipient").Required().String()
+	msgPushRcptArg     = msgPushCmd.Arg("recipient", "message recipients, comma-separated; @name for a group, name@router for a contact at another router").Required().String()
 	msgPushContentsArg = msgPushCmd.Arg("contents", "send file contents").Required().ExistingFile()
 	msgPushSendArg     = msgPushCmd.Arg("sender", "sender address").String()
+	msgPushTTLFlag     = msgPushCmd.Flag("ttl", "discard message if not delivered within this time").Duration()
+	msgPushSealedFlag  = msgPushCmd.Flag("sealed-sender", "hide the sender from the server").Bool()
+	msgPushTypeFlag    = msgPushCmd.Flag("content-type", "content type of the message; detected from its contents if omitted").String()
+	msgPushSubjectFlag = msgPushCmd.Flag("subject", "message subject").String()
+	msgPushReplyFlag   = msgPushCmd.Flag("in-reply-to", "ID of the message replied to").String()
+	msgPushHeaderFlag  = msgPushCmd.Flag("header", "additional message header, as name=value").StringMap()
 
-	msgPopCmd = msgCmd.Command("pop", "pop message")
+	msgPopCmd          = msgCmd.Command("pop", "pop message")
+	msgPopWaitFlag     = msgPopCmd.Flag("wait", "wait for messages to arrive").Bool()
+	msgPopReceiptsFlag = msgPopCmd.Flag("receipts", "send delivery receipts to senders").Default("true").Bool()
+
+	msgStatusCmd   = msgCmd.Command("status", "show delivery status of a sent message")
+	msgStatusIDArg = msgStatusCmd.Arg("id", "message ID").Required().String()
 )
 
 func init() {
@@ -87,7 +142,7 @@ func main() {
 
 	err := os.MkdirAll(*homedirFlagVar, 0700)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "cannot create homedir %q: %v", *homedirFlagVar, err)
+		fmt.Fprintf(os.Stderr, "cannot create homedir %q: %v\n", *homedirFlagVar, err)
 		os.Exit(1)
 	}
 
@@ -98,16 +153,36 @@ func main() {
 		err = nameAdd()
 	case "name list":
 		err = nameList()
+	case "name group":
+		err = nameGroup()
 	case "addr create":
 		err = addrCreate()
 	case "addr list":
 		err = addrList()
-	case "addr default":
+	case "addr default show":
 		err = addrDefault()
+	case "addr default set":
+		err = addrDefaultSet()
+	case "addr label":
+		err = addrLabel()
+	case "addr retire":
+		err = addrRetire()
+	case "addr rotate":
+		err = addrRotate()
+	case "addr prekeys refill":
+		err = addrPrekeysRefill()
+	case "vault passwd":
+		err = vaultPasswd()
+	case "vault export":
+		err = vaultExport()
+	case "vault import":
+		err = vaultImport()
 	case "msg push":
 		err = msgPush()
 	case "msg pop":
 		err = msgPop()
+	case "msg status":
+		err = msgStatus()
 	}
 	if err != nil {
 		if err == noSuchCmdErr {
@@ -125,11 +200,17 @@ func nameAdd() error {
 	if err != nil {
 		return err
 	}
-	addrPk, err := sf.DecodePublicKey(*nameAddAddrArg)
+	addr, err := sf.ParseAddress(*nameAddAddrArg)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = contacts.Put(*nameAddNameArg, addr.Key)
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	err = contacts.Put(*nameAddNameArg, addrPk)
+	if addr.Router != "" {
+		err = contacts.SetRouter(*nameAddNameArg, addr.Router)
+	}
 	return errgo.Mask(err)
 }
 
@@ -143,7 +224,35 @@ func nameList() error {
 		return err
 	}
 	for _, cinfo := range cinfos {
-		_, err = fmt.Printf("%-20s %-50s\n", cinfo.Name, cinfo.Address.Encode())
+		addr := &sf.Address{Key: cinfo.Address, Router: cinfo.Router}
+		_, err = fmt.Printf("%-20s %s\n", cinfo.Name, addr.Encode())
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+func nameGroup() error {
+	contacts, err := newContacts()
+	if err != nil {
+		return err
+	}
+	if len(*nameGroupNamesArg) > 0 {
+		for _, name := range *nameGroupNamesArg {
+			_, err = contacts.Key(name)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		return errgo.Mask(contacts.PutGroup(*nameGroupGroupArg, *nameGroupNamesArg))
+	}
+	names, err := contacts.Group(*nameGroupGroupArg)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, name := range names {
+		_, err = fmt.Println(name)
 		if err != nil {
 			return errgo.Mask(err)
 		}
@@ -151,6 +260,15 @@ func nameList() error {
 	return nil
 }
 
+func newOutbox() (storage.Outbox, error) {
+	outboxPath := filepath.Join(*homedirFlagVar, "outbox")
+	db, err := bolt.Open(outboxPath, 0600, nil)
+	if err != nil {
+		return nil, errgo.WithCausef(nil, err, "cannot open outbox %q", outboxPath)
+	}
+	return sfbolt.NewOutbox(db), nil
+}
+
 func newContacts() (storage.Contacts, error) {
 	contactsPath := filepath.Join(*homedirFlagVar, "contacts")
 	db, err := bolt.Open(contactsPath, 0600, nil)
@@ -173,15 +291,42 @@ func addrCreate() error {
 	if err != nil {
 		return errgo.Mask(err)
 	}
-
 	contacts, err := newContacts()
 	if err != nil {
-		return err
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(updateMe(vault, contacts))
+}
+
+// updateMe names the current address "me" in contacts.
+func updateMe(vault storage.Vault, contacts storage.Contacts) error {
+	keyPair, err := vault.Current()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if key, err := contacts.Key("me"); err == nil && *key == *keyPair.PublicKey {
+		return nil
 	}
 	err = contacts.Put("me", keyPair.PublicKey)
 	return errgo.Mask(err)
 }
 
+// vaultAddress returns the public key of an address in the vault, given by
+// its label or encoded.
+func vaultAddress(vault storage.Vault, arg string) (*sf.PublicKey, error) {
+	infos, err := vault.Infos()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	addr, err := sf.ParseAddress(arg)
+	for _, info := range infos {
+		if info.Label == arg || (err == nil && *info.Address == *addr.Key) {
+			return info.Address, nil
+		}
+	}
+	return nil, errgo.Newf("no address %q in vault", arg)
+}
+
 func addrDefault() error {
 	vault, err := newVault()
 	if err != nil {
@@ -191,37 +336,309 @@ func addrDefault() error {
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	_, err = fmt.Println(keyPair.PublicKey.Encode())
+	addr, err := newAddress(keyPair.PublicKey, *addrDefaultShowRouterFlag)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	_, err = fmt.Println(addr.Encode())
 	return errgo.Mask(err)
 }
 
+// newAddress returns the address of a key at a home router, if not empty.
+func newAddress(key *sf.PublicKey, router string) (*sf.Address, error) {
+	if router == "" {
+		return &sf.Address{Key: key}, nil
+	}
+	addr, err := sf.ParseAddress(key.Encode() + "@" + router)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return addr, nil
+}
+
 func addrList() error {
 	vault, err := newVault()
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	err = vault.Each(func(pk *sf.KeyPair) error {
-		_, err := fmt.Println(pk.PublicKey.Encode())
+	infos, err := vault.Infos()
+	if err != nil {
 		return errgo.Mask(err)
-	})
+	}
+	for _, info := range infos {
+		var status []string
+		if info.Default {
+			status = append(status, "default")
+		}
+		if info.Retired {
+			status = append(status, "retired")
+		}
+		_, err = fmt.Printf("%-50s %-20s %s\n", info.Address.Encode(), info.Label, strings.Join(status, ","))
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+func addrDefaultSet() error {
+	vault, err := newVault()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	key, err := vaultAddress(vault, *addrDefaultSetArg)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = vault.SetDefault(key)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	contacts, err := newContacts()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(updateMe(vault, contacts))
+}
+
+func addrLabel() error {
+	vault, err := newVault()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	key, err := vaultAddress(vault, *addrLabelAddrArg)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if *addrLabelLabelArg != "" {
+		other, err := vaultAddress(vault, *addrLabelLabelArg)
+		if err == nil && *other != *key {
+			return errgo.Newf("label %q already in use", *addrLabelLabelArg)
+		}
+	}
+	return errgo.Mask(vault.SetLabel(key, *addrLabelLabelArg))
+}
+
+func addrRetire() error {
+	vault, err := newVault()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	key, err := vaultAddress(vault, *addrRetireArg)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = vault.Retire(key)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	contacts, err := newContacts()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = updateMe(vault, contacts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "warning: no default address:", err)
+	}
+	return nil
+}
+
+func addrRotate() error {
+	vault, sessions, err := newVaultSessions()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	oldKeyPair, err := vault.Current()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	newKeyPair, err := sf.NewKeyPair()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = vault.Put(&newKeyPair)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = vault.SetDefault(newKeyPair.PublicKey)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	contacts, err := newContacts()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = updateMe(vault, contacts)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	_, err = fmt.Println(newKeyPair.PublicKey.Encode())
+	if err != nil {
+		return errgo.Mask(err)
+	}
+
+	cinfos, err := contacts.Current()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var recipients []string
+	seen := make(map[string]bool)
+	for _, cinfo := range cinfos {
+		if _, err := vault.Get(cinfo.Address); err == nil {
+			// Our own addresses need no notice.
+			continue
+		}
+		if !seen[cinfo.Address.Encode()] {
+			seen[cinfo.Address.Encode()] = true
+			recipients = append(recipients, cinfo.Address.Encode())
+		}
+	}
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	// The rotation is announced from the old address, which contacts know.
+	client, err := newClient(oldKeyPair)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	client.SetSessions(session.NewManager(oldKeyPair, sessions))
+	receipts, err := client.PushRotation(&newKeyPair, recipients)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var failed int
+	for _, receipt := range receipts {
+		if receipt.Err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", receipt.Recipient, receipt.Err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errgo.Newf("failed to notify %d of %d contacts", failed, len(receipts))
+	}
+	return nil
+}
+
+func addrPrekeysRefill() error {
+	vault, sessions, err := newVaultSessions()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	keyPair, err := vault.Current()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	client, err := newClient(keyPair)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	count, err := client.PublishPrekeys(nil, nil)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	manager := session.NewManager(keyPair, sessions)
+	var prekeys []*sf.PublicKey
+	if count.Count < *addrPrekeysRefillCountFlag {
+		prekeys, err = manager.NewPrekeys(*addrPrekeysRefillCountFlag - count.Count)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	// The last-resort prekey is kept until the server loses it, since
+	// senders may start sessions with it at any time.
+	var lastResort *sf.PublicKey
+	if !count.LastResort {
+		lastResort, err = manager.NewLastResortPrekey()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if len(prekeys) > 0 || lastResort != nil {
+		count, err = client.PublishPrekeys(prekeys, lastResort)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	_, err = fmt.Println(count.Count, "prekeys published")
 	return errgo.Mask(err)
 }
 
 func newVault() (storage.Vault, error) {
-	sk, err := getVaultKey()
+	db, sk, err := openVault()
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	return sfbolt.NewVault(db, sk), nil
+}
+
+// newVaultSessions returns the vault and the session state stored alongside
+// it.
+func newVaultSessions() (storage.Vault, storage.Sessions, error) {
+	db, sk, err := openVault()
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	return sfbolt.NewVault(db, sk), sfbolt.NewSessions(db, sk), nil
+}
+
+func openVault() (*bolt.DB, *sf.SecretKey, error) {
+	keys, err := getVaultKeys()
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
 
 	vaultPath := filepath.Join(*homedirFlagVar, "vault")
 	db, err := bolt.Open(vaultPath, 0600, nil)
 	if err != nil {
-		return nil, errgo.WithCausef(nil, err, "cannot open vault %q", vaultPath)
+		return nil, nil, errgo.WithCausef(nil, err, "cannot open vault %q", vaultPath)
 	}
-	return sfbolt.NewVault(db, sk), nil
+	saltPath := filepath.Join(*homedirFlagVar, vaultSaltName)
+	_, err = os.Stat(saltPath + ".new")
+	interrupted := err == nil
+	for _, key := range keys {
+		if !interrupted {
+			return db, key.secretKey, nil
+		}
+		// A passphrase change was interrupted, so the vault may or may not
+		// have been re-encrypted with the key for the new salt.
+		ok, err := sfbolt.NewVault(db, key.secretKey).CheckKey()
+		if err != nil {
+			db.Close()
+			return nil, nil, errgo.Mask(err)
+		}
+		if !ok {
+			continue
+		}
+		if key.saltPath != saltPath {
+			// It was, so finish replacing the salt.
+			err = os.Rename(key.saltPath, saltPath)
+		} else {
+			// It was not, so the new salt will never be used.
+			err = os.Remove(saltPath + ".new")
+		}
+		if err != nil {
+			db.Close()
+			return nil, nil, errgo.Mask(err)
+		}
+		return db, key.secretKey, nil
+	}
+	db.Close()
+	return nil, nil, errgo.New("invalid passphrase")
 }
 
-func getVaultKey() (*sf.SecretKey, error) {
+// vaultKey is a key derived from the vault passphrase, and the salt file it
+// was derived with.
+type vaultKey struct {
+	secretKey *sf.SecretKey
+	saltPath  string
+}
+
+// getVaultKeys reads the vault passphrase and returns the keys derived from
+// it. If a passphrase change was interrupted, the key for the new salt file
+// comes first, if the passphrase matches it; the vault may or may not have
+// been re-encrypted with it.
+func getVaultKeys() ([]*vaultKey, error) {
 	var pass []byte
 	var err error
 	if *passphraseFlag != "" {
@@ -233,7 +650,20 @@ func getVaultKey() (*sf.SecretKey, error) {
 		fmt.Print("Passphrase: ")
 		pass = gopass.GetPasswd()
 	}
-	salt, hash, err := getSaltHash(pass)
+
+	var keys []*vaultKey
+	saltPath := filepath.Join(*homedirFlagVar, vaultSaltName)
+	newSaltPath := saltPath + ".new"
+	salt, hash, err := getSaltHash(newSaltPath)
+	if err == nil && bytes.Equal(hash, calcHash(pass, salt)) {
+		sk, err := deriveVaultKey(pass, salt)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		keys = append(keys, &vaultKey{sk, newSaltPath})
+	}
+
+	salt, hash, err = getSaltHash(saltPath)
 	if os.IsNotExist(errgo.Cause(err)) {
 		if *passphraseFlag == "" {
 			// If the salt file isn't there, we need to confirm a new passphrase
@@ -243,7 +673,7 @@ func getVaultKey() (*sf.SecretKey, error) {
 				return nil, errgo.New("passphrases did not match")
 			}
 		}
-		salt, err = createSaltHash(pass)
+		salt, err = createSaltHash(saltPath, pass)
 		if err != nil {
 			return nil, errgo.Mask(err)
 		}
@@ -252,10 +682,20 @@ func getVaultKey() (*sf.SecretKey, error) {
 	} else {
 		checkHash := calcHash(pass, salt)
 		if !bytes.Equal(hash, checkHash) {
+			if len(keys) > 0 {
+				return keys, nil
+			}
 			return nil, errgo.New("invalid passphrase")
 		}
 	}
+	sk, err := deriveVaultKey(pass, salt)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return append(keys, &vaultKey{sk, saltPath}), nil
+}
 
+func deriveVaultKey(pass, salt []byte) (*sf.SecretKey, error) {
 	var sk sf.SecretKey
 	derived, err := scrypt.Key(pass, salt, 16384, 8, 1, 32)
 	if err != nil {
@@ -280,7 +720,7 @@ func calcHash(pass, salt []byte) []byte {
 	return h.Sum(nil)
 }
 
-func createSaltHash(pass []byte) ([]byte, error) {
+func createSaltHash(saltPath string, pass []byte) ([]byte, error) {
 	// generate a new salt
 	salt := make([]byte, vaultSaltSize)
 	_, err := rand.Reader.Read(salt)
@@ -288,7 +728,6 @@ func createSaltHash(pass []byte) ([]byte, error) {
 		return nil, errgo.Mask(err)
 	}
 
-	saltPath := filepath.Join(*homedirFlagVar, vaultSaltName)
 	f, err := os.OpenFile(saltPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 	if err != nil {
 		return nil, errgo.Mask(err)
@@ -309,11 +748,10 @@ func createSaltHash(pass []byte) ([]byte, error) {
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	return salt, nil
+	return salt, errgo.Mask(f.Sync())
 }
 
-func getSaltHash(pass []byte) ([]byte, []byte, error) {
-	saltPath := filepath.Join(*homedirFlagVar, vaultSaltName)
+func getSaltHash(saltPath string) ([]byte, []byte, error) {
 	saltHash, err := ioutil.ReadFile(saltPath)
 	if err != nil {
 		return nil, nil, errgo.Mask(err, errgo.Any)
@@ -324,56 +762,303 @@ func getSaltHash(pass []byte) ([]byte, []byte, error) {
 	return saltHash[:32], saltHash[34:], nil
 }
 
-func msgPush() error {
-	vault, err := newVault()
-	if err != nil {
-		return errgo.Mask(err)
+func vaultPasswd() error {
+	saltPath := filepath.Join(*homedirFlagVar, vaultSaltName)
+	if _, err := os.Stat(saltPath); err != nil {
+		return errgo.Notef(err, "no vault passphrase to change")
 	}
-	contacts, err := newContacts()
+	// Opening the vault verifies the old passphrase.
+	vault, err := newVault()
 	if err != nil {
 		return errgo.Mask(err)
 	}
 
-	var keyPair *sf.KeyPair
-	if *msgPushSendArg == "" {
-		keyPair, err = vault.Current()
+	var pass []byte
+	if *vaultPasswdNewFlag != "" {
+		pass, err = ioutil.ReadFile(*vaultPasswdNewFlag)
 		if err != nil {
 			return errgo.Mask(err)
 		}
 	} else {
-		sendKey, err := contacts.Key(*msgPushSendArg)
-		if err != nil {
-			return errgo.Mask(err)
-		}
-		keyPair, err = vault.Get(sendKey)
-		if err != nil {
-			return errgo.Mask(err)
+		fmt.Print("New passphrase: ")
+		pass = gopass.GetPasswd()
+		fmt.Print("Confirm: ")
+		confirm := gopass.GetPasswd()
+		if !bytes.Equal(confirm, pass) {
+			return errgo.New("passphrases did not match")
 		}
 	}
 
-	rcptKey, err := contacts.Key(*msgPushRcptArg)
+	// The new salt and hash replace the old only once the vault has been
+	// re-encrypted. If interrupted in between, the new salt file is left
+	// beside the old, and the next time the vault is opened with the new
+	// passphrase, the replacement is finished.
+	newSaltPath := saltPath + ".new"
+	salt, err := createSaltHash(newSaltPath, pass)
 	if err != nil {
 		return errgo.Mask(err)
 	}
-
-	var contents bytes.Buffer
-	f, err := os.Open(*msgPushContentsArg)
+	sk, err := deriveVaultKey(pass, salt)
 	if err != nil {
+		os.Remove(newSaltPath)
 		return errgo.Mask(err)
 	}
-	_, err = io.Copy(&contents, f)
-	f.Close()
+	err = vault.Rekey(sk)
 	if err != nil {
+		os.Remove(newSaltPath)
 		return errgo.Mask(err)
 	}
+	return errgo.Mask(os.Rename(newSaltPath, saltPath))
+}
 
-	client, err := newClient(keyPair)
-	if err != nil {
-		return errgo.Mask(err)
+// readBackupPassphrase reads a backup passphrase from a file if given, or
+// prompts for it, confirming it if a new backup is being written.
+func readBackupPassphrase(path string, confirm bool) ([]byte, error) {
+	if path != "" {
+		pass, err := ioutil.ReadFile(path)
+		return pass, errgo.Mask(err)
+	}
+	fmt.Fprint(os.Stderr, "Backup passphrase: ")
+	pass := gopass.GetPasswd()
+	if confirm {
+		fmt.Fprint(os.Stderr, "Confirm: ")
+		if !bytes.Equal(gopass.GetPasswd(), pass) {
+			return nil, errgo.New("passphrases did not match")
+		}
 	}
+	return pass, nil
+}
 
-	err = client.Push(rcptKey.Encode(), contents.Bytes())
-	return errgo.Mask(err)
+func vaultExport() error {
+	vault, err := newVault()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var b backup.Backup
+	err = vault.Each(func(keyPair *sf.KeyPair) error {
+		b.KeyPairs = append(b.KeyPairs, keyPair)
+		return nil
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	b.Infos, err = vault.Infos()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if *vaultExportContactsFlag {
+		contacts, err := newContacts()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		b.Contacts, err = contacts.Current()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+
+	pass, err := readBackupPassphrase(*vaultExportPassphraseFlag, true)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if *vaultExportOutputFlag == "" {
+		return errgo.Mask(backup.Write(os.Stdout, &b, pass))
+	}
+	f, err := os.OpenFile(*vaultExportOutputFlag, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer f.Close()
+	err = backup.Write(f, &b, pass)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(f.Sync())
+}
+
+func vaultImport() error {
+	pass, err := readBackupPassphrase(*vaultImportPassphraseFlag, false)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	f, err := os.Open(*vaultImportFileArg)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer f.Close()
+	b, err := backup.Read(f, pass)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+
+	vault, err := newVault()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var contacts storage.Contacts
+	if len(b.Contacts) > 0 {
+		contacts, err = newContacts()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	nKeys, nContacts, conflicts, err := b.Restore(vault, contacts)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	fmt.Printf("imported %d of %d addresses, %d of %d contacts\n",
+		nKeys, len(b.KeyPairs), nContacts, len(b.Contacts))
+	for _, cinfo := range conflicts {
+		fmt.Printf("skipped contact %s %s: name already in use\n", cinfo.Name, cinfo.Address.Encode())
+	}
+	return nil
+}
+
+func msgPush() error {
+	vault, sessions, err := newVaultSessions()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	contacts, err := newContacts()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+
+	var keyPair *sf.KeyPair
+	if *msgPushSendArg == "" {
+		keyPair, err = vault.Current()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	} else {
+		sendKey, err := contacts.Key(*msgPushSendArg)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		keyPair, err = vault.Get(sendKey)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+
+	recipients, err := recipientKeys(contacts, *msgPushRcptArg)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+
+	f, err := os.Open(*msgPushContentsArg)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer f.Close()
+
+	client, err := newClient(keyPair)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	client.SetTTL(*msgPushTTLFlag)
+	client.SetSealedSender(*msgPushSealedFlag)
+	client.SetSessions(session.NewManager(keyPair, sessions))
+
+	br := bufio.NewReader(f)
+	contentType := *msgPushTypeFlag
+	if contentType == "" {
+		head, err := br.Peek(512)
+		if err != nil && err != io.EOF {
+			return errgo.Mask(err)
+		}
+		contentType = http.DetectContentType(head)
+	}
+	env := sfhttp.NewEnvelope(contentType)
+	env.Subject = *msgPushSubjectFlag
+	env.InReplyTo = *msgPushReplyFlag
+	env.Headers = *msgPushHeaderFlag
+
+	receipts, err := client.PushEnvelope(recipients, env, br)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	outbox, err := newOutbox()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	now := time.Now()
+	var failed int
+	for _, receipt := range receipts {
+		// Recipients were resolved from valid addresses above.
+		addr, err := sf.ParseAddress(receipt.Recipient)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		err = outbox.Sent(receipt.ID, addr.Key.Encode(), receipt.Err == nil, now)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if receipt.Err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", receipt.Recipient, receipt.Err)
+			failed++
+			continue
+		}
+		_, err = fmt.Println(receipt.ID, receipt.Recipient)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if failed > 0 {
+		return errgo.Newf("failed to push to %d of %d recipients", failed, len(receipts))
+	}
+	return nil
+}
+
+// recipientKeys resolves a comma-separated list of contact names to their
+// encoded addresses, at their home router if known. Names prefixed with '@'
+// are expanded to the members of that group, and names suffixed with @router
+// address the contact at that router instead. Each recipient appears once.
+func recipientKeys(contacts storage.Contacts, arg string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(arg, ",") {
+		name = strings.TrimSpace(name)
+		if strings.HasPrefix(name, "@") {
+			members, err := contacts.Group(name[1:])
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			names = append(names, members...)
+		} else if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	var recipients []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		var router string
+		if i := strings.Index(name, "@"); i > 0 {
+			name, router = name[:i], name[i+1:]
+		}
+		key, err := contacts.Key(name)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if router == "" {
+			router, err = contacts.Router(name)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+		addr, err := newAddress(key, router)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if !seen[addr.Encode()] {
+			seen[addr.Encode()] = true
+			recipients = append(recipients, addr.Encode())
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, errgo.New("no recipients")
+	}
+	return recipients, nil
 }
 
 func newClient(keyPair *sf.KeyPair) (*sfhttp.Client, error) {
@@ -401,24 +1086,411 @@ func newClient(keyPair *sf.KeyPair) (*sfhttp.Client, error) {
 }
 
 func msgPop() error {
-	vault, err := newVault()
+	vault, sessions, err := newVaultSessions()
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	keyPair, err := vault.Current()
+	current, err := vault.Current()
 	if err != nil {
 		return errgo.Mask(err)
 	}
+	infos, err := vault.Infos()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	// Large messages arrive in chunks, which are reassembled into files.
+	receivedDir := filepath.Join(*homedirFlagVar, "received")
+	err = os.MkdirAll(receivedDir, 0700)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	p := &popper{
+		sessions:    sessions,
+		receivedDir: receivedDir,
+		reassembler: sfhttp.NewReassembler(receivedDir),
+	}
+
+	// Messages are also fetched for earlier and retired addresses, since
+	// contacts may still send to them. Only the current address is waited
+	// on, and only if nothing was received for the others.
+	var popErr error
+	for _, info := range infos {
+		if *info.Address == *current.PublicKey {
+			continue
+		}
+		keyPair, err := vault.Get(info.Address)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		err = p.pop(keyPair, false)
+		if err != nil && popErr == nil {
+			popErr = err
+		}
+	}
+	err = p.pop(current, *msgPopWaitFlag && p.n == 0)
+	if err != nil && popErr == nil {
+		popErr = err
+	}
+	return errgo.Mask(popErr, errgo.Any)
+}
+
+// popper pops messages for each address in the vault, numbering them in the
+// order they are shown.
+type popper struct {
+	sessions    storage.Sessions
+	receivedDir string
+	reassembler *sfhttp.Reassembler
+	contacts    storage.Contacts
+	outbox      storage.Outbox
+
+	// n is the number of messages shown.
+	n int
+}
+
+// pop fetches and shows the messages for an address, waiting for them to
+// arrive if wait is set, and acknowledges them.
+func (p *popper) pop(keyPair *sf.KeyPair, wait bool) error {
 	client, err := newClient(keyPair)
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	msgs, err := client.Pop()
+	client.SetSessions(session.NewManager(keyPair, p.sessions))
+	var msgs []*transport.PopMessage
+	var fetchErr error
+	if wait {
+		msgs, _, fetchErr = client.Wait(context.Background())
+	} else {
+		msgs, _, fetchErr = client.Fetch()
+	}
+
+	var pending pendingReceipts
+	var ids []string
+	for _, msg := range msgs {
+		if sfhttp.IsRotation(msg) {
+			if p.contacts == nil {
+				p.contacts, err = newContacts()
+				if err != nil {
+					return errgo.Mask(err)
+				}
+			}
+			name, newKey, err := applyRotation(client, p.contacts, msg)
+			if err != nil {
+				// An invalid rotation will not become valid later.
+				fmt.Fprintln(os.Stderr, errgo.Details(err))
+			} else {
+				_, err = fmt.Println(p.n, msg.ID, msg.Sender, "rotated", name, "to", newKey.Encode())
+				if err != nil {
+					return errgo.Mask(err)
+				}
+				p.n++
+			}
+			ids = append(ids, msg.ID)
+			continue
+		}
+		if sfhttp.IsDeliveryReceipt(msg) {
+			if p.outbox == nil {
+				p.outbox, err = newOutbox()
+				if err != nil {
+					return errgo.Mask(err)
+				}
+			}
+			delivered, err := applyReceipt(p.outbox, msg)
+			if err != nil {
+				// An invalid receipt will not become valid later.
+				fmt.Fprintln(os.Stderr, errgo.Details(err))
+			}
+			for _, id := range delivered {
+				_, err = fmt.Println(p.n, msg.ID, msg.Sender, "delivered", id)
+				if err != nil {
+					return errgo.Mask(err)
+				}
+				p.n++
+			}
+			ids = append(ids, msg.ID)
+			continue
+		}
+		if !sfhttp.IsChunk(msg) {
+			env, body, err := sfhttp.OpenEnvelope(msg.Contents)
+			if err != nil {
+				// An invalid envelope will not become valid later.
+				fmt.Fprintln(os.Stderr, errgo.Details(errgo.Notef(err, "message %q", msg.ID)))
+				ids = append(ids, msg.ID)
+				continue
+			}
+			content := string(body)
+			if env != nil && !isText(env.ContentType) {
+				content, err = receivedPath(p.receivedDir, msg)
+				if err != nil {
+					// The router sent an invalid sender or ID, which
+					// will not become valid later.
+					fmt.Fprintln(os.Stderr, errgo.Details(err))
+					ids = append(ids, msg.ID)
+					continue
+				}
+				err = ioutil.WriteFile(content, body, 0600)
+				if err != nil {
+					return errgo.Mask(err)
+				}
+			}
+			_, err = fmt.Println(p.n, msg.ID, msg.Sender, content)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			err = printEnvelope(env)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			p.n++
+			ids = append(ids, msg.ID)
+			pending.add(msg.Sender, msg.ID, msg.SealedSender)
+			continue
+		}
+		transfer, err := p.reassembler.Add(msg)
+		if err != nil {
+			// Leave the chunk to be fetched again.
+			fmt.Fprintln(os.Stderr, errgo.Details(err))
+			continue
+		}
+		ids = append(ids, msg.ID)
+		if transfer != nil {
+			env, err := unwrapTransfer(transfer.Path)
+			if err != nil {
+				// The payload is left as received.
+				fmt.Fprintln(os.Stderr, errgo.Details(errgo.Notef(err, "transfer %q", transfer.ID)))
+			}
+			_, err = fmt.Println(p.n, transfer.ID, transfer.Sender, transfer.Path)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			err = printEnvelope(env)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			p.n++
+			pending.add(transfer.Sender, transfer.ID, msg.SealedSender)
+		}
+	}
+	if openErr, ok := errgo.Cause(fetchErr).(*transport.OpenError); ok {
+		// Messages which could not be opened never will be, so they are
+		// removed rather than fetched again. The error is reported below.
+		ids = append(ids, openErr.IDs...)
+	}
+	if len(ids) > 0 {
+		err = client.Ack(ids)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if *msgPopReceiptsFlag && len(pending) > 0 {
+		if p.contacts == nil {
+			p.contacts, err = newContacts()
+			if err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		sendReceipts(client, p.contacts, pending)
+	}
+	return errgo.Mask(fetchErr, errgo.Any)
+}
+
+// receivedPath returns the file to which the body of a message is written,
+// named by its ID in a directory named by its sender, as reassembled
+// transfers are. The sender and ID are checked, since the router could
+// otherwise name a file anywhere.
+func receivedPath(receivedDir string, msg *transport.PopMessage) (string, error) {
+	senderKey, err := sf.DecodePublicKey(msg.Sender)
+	if err != nil {
+		return "", errgo.Notef(err, "invalid sender %q of message %q", msg.Sender, msg.ID)
+	}
+	id, err := sf.DecodeNonce(msg.ID)
+	if err != nil {
+		return "", errgo.Notef(err, "invalid message ID %q", msg.ID)
+	}
+	senderDir := filepath.Join(receivedDir, senderKey.Encode())
+	err = os.MkdirAll(senderDir, 0700)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	return filepath.Join(senderDir, id.Encode()), nil
+}
+
+// isText returns whether contents of the given type can be shown in a
+// terminal.
+func isText(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && strings.HasPrefix(mediaType, "text/")
+}
+
+// printEnvelope prints the fields of a message envelope, indented below the
+// message. Messages without an envelope have nothing to print.
+func printEnvelope(env *wire.Envelope) error {
+	if env == nil {
+		return nil
+	}
+	fields := [][2]string{{"Content-Type", env.ContentType}}
+	if !env.Time.IsZero() {
+		fields = append(fields, [2]string{"Date", env.Time.Local().Format(time.RFC3339)})
+	}
+	if env.Subject != "" {
+		fields = append(fields, [2]string{"Subject", env.Subject})
+	}
+	if env.InReplyTo != "" {
+		fields = append(fields, [2]string{"In-Reply-To", env.InReplyTo})
+	}
+	var names []string
+	for name := range env.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fields = append(fields, [2]string{name, env.Headers[name]})
+	}
+	for _, field := range fields {
+		_, err := fmt.Printf("  %s: %s\n", field[0], field[1])
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// unwrapTransfer removes the envelope from the start of a reassembled
+// payload, returning the envelope. Payloads without an envelope are left
+// unchanged.
+func unwrapTransfer(path string) (*wire.Envelope, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer f.Close()
+	env, body, err := sfhttp.ReadEnvelope(f)
+	if err != nil || env == nil {
+		return nil, errgo.Mask(err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, body)
+	if err != nil {
+		tmp.Close()
+		return nil, errgo.Mask(err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return env, nil
+}
+
+// pendingReceipt collects the IDs of messages delivered from a sender, to be
+// acknowledged in a single delivery receipt.
+type pendingReceipt struct {
+	sender string
+	ids    []string
+
+	// sealed is set if any of the messages were pushed with a sealed
+	// sender, so that the receipt does not reveal the sender either.
+	sealed bool
+}
+
+type pendingReceipts []*pendingReceipt
+
+func (p *pendingReceipts) add(sender, id string, sealed bool) {
+	for _, receipt := range *p {
+		if receipt.sender == sender {
+			receipt.ids = append(receipt.ids, id)
+			receipt.sealed = receipt.sealed || sealed
+			return
+		}
+	}
+	*p = append(*p, &pendingReceipt{sender: sender, ids: []string{id}, sealed: sealed})
+}
+
+// sendReceipts sends delivery receipts to the senders of messages, at their
+// home router if they are known contacts. Failures are reported but not
+// retried; the messages have already been delivered.
+func sendReceipts(client *sfhttp.Client, contacts storage.Contacts, pending pendingReceipts) {
+	for _, receipt := range pending {
+		err := sendReceipt(client, contacts, receipt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot send delivery receipt to %s: %v\n", receipt.sender, err)
+		}
+	}
+}
+
+func sendReceipt(client *sfhttp.Client, contacts storage.Contacts, receipt *pendingReceipt) error {
+	key, err := sf.DecodePublicKey(receipt.sender)
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	for i, msg := range msgs {
-		_, err = fmt.Println(i, msg.ID, msg.Sender, string(msg.Contents))
+	var router string
+	if name, err := contacts.Name(key); err == nil {
+		router, err = contacts.Router(name)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	addr, err := newAddress(key, router)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	client.SetSealedSender(receipt.sealed)
+	return errgo.Mask(client.PushDeliveryReceipt(addr.Encode(), receipt.ids), errgo.Any)
+}
+
+// applyReceipt records the messages acknowledged by a delivery receipt as
+// delivered, returning their IDs. IDs of messages which were not sent to the
+// sender of the receipt are reported and skipped.
+func applyReceipt(outbox storage.Outbox, msg *transport.PopMessage) ([]string, error) {
+	receipt, err := sfhttp.ParseDeliveryReceipt(msg)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var delivered []string
+	for _, id := range receipt.IDs {
+		err = outbox.Delivered(id, msg.Sender, receipt.Time)
+		if errgo.Cause(err) == storage.ErrNotFound {
+			fmt.Fprintln(os.Stderr, errgo.Details(err))
+			continue
+		} else if err != nil {
+			return delivered, errgo.Mask(err)
+		}
+		delivered = append(delivered, id)
+	}
+	return delivered, nil
+}
+
+func msgStatus() error {
+	outbox, err := newOutbox()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	statuses, err := outbox.Status(*msgStatusIDArg)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	contacts, err := newContacts()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, status := range statuses {
+		recipient := status.Recipient
+		if key, err := sf.DecodePublicKey(status.Recipient); err == nil {
+			if name, err := contacts.Name(key); err == nil {
+				recipient = name
+			}
+		}
+		at := status.Sent
+		if status.Status == storage.StatusDelivered {
+			at = status.Delivered
+		}
+		_, err = fmt.Printf("%-20s %-10s %s\n", recipient, status.Status, at.Local().Format(time.RFC3339))
 		if err != nil {
 			return errgo.Mask(err)
 		}
@@ -426,6 +1498,37 @@ func msgPop() error {
 	return nil
 }
 
+// applyRotation verifies a key rotation announced by a contact, and appends
+// their new key to the contact's history. It returns the contact name and new
+// key.
+func applyRotation(client *sfhttp.Client, contacts storage.Contacts, msg *transport.PopMessage) (string, *sf.PublicKey, error) {
+	newKey, err := client.OpenRotation(msg)
+	if err != nil {
+		return "", nil, errgo.Mask(err)
+	}
+	oldKey, err := sf.DecodePublicKey(msg.Sender)
+	if err != nil {
+		return "", nil, errgo.Mask(err)
+	}
+	name, err := contacts.Name(oldKey)
+	if err != nil {
+		return "", nil, errgo.Notef(err, "key rotation from unknown sender")
+	}
+	currentKey, err := contacts.Key(name)
+	if err != nil {
+		return "", nil, errgo.Mask(err)
+	}
+	if *currentKey != *oldKey {
+		// A stale announcement must not undo a later rotation.
+		return "", nil, errgo.Newf("contact %q has already moved from %q", name, msg.Sender)
+	}
+	err = contacts.Put(name, newKey)
+	if err != nil {
+		return "", nil, errgo.Mask(err)
+	}
+	return name, newKey, nil
+}
+
 func notImplemented() error {
 	return errgo.New("not implemented yet")
 }
@@ -13,6 +13,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -23,16 +25,45 @@ import (
 
 	sf "github.com/cmars/shadowfax"
 	sfhttp "github.com/cmars/shadowfax/http"
+	"github.com/cmars/shadowfax/storage"
 	boltstorage "github.com/cmars/shadowfax/storage/bolt"
+	memstorage "github.com/cmars/shadowfax/storage/memory"
+	"github.com/cmars/shadowfax/tcp"
+	"github.com/cmars/shadowfax/transport"
 )
 
 var (
 	httpFlag    = kingpin.Flag("http", "http port").Default(":8080").String()
 	httpsFlag   = kingpin.Flag("https", "https port").String()
+	tcpFlag     = kingpin.Flag("tcp", "tcp port").String()
 	certFlag    = kingpin.Flag("cert", "tls certificate").ExistingFile()
 	keyFlag     = kingpin.Flag("key", "tls keyfile").ExistingFile()
 	keypairFlag = kingpin.Flag("keypair", "curve25519 keypair file").Default("sfd.keypair").String()
 	dbFileFlag  = kingpin.Flag("dbfile", "path to database file").Default("sfd.db").String()
+	storageFlag = kingpin.Flag("storage", "storage backend; memory keeps nothing across restarts").Default("bolt").Enum("bolt", "memory")
+
+	maxSkewFlag     = kingpin.Flag("max-skew", "maximum allowed request clock skew").Default(transport.DefaultMaxSkew.String()).Duration()
+	nonceCacheFlag  = kingpin.Flag("nonce-cache", "number of request nonces remembered to detect replays").Default("65536").Int()
+	allowV1Flag     = kingpin.Flag("allow-v1", "accept protocol version 1 clients").Bool()
+	maxTTLFlag      = kingpin.Flag("max-ttl", "maximum time undelivered messages are kept").Default(transport.DefaultMaxTTL.String()).Duration()
+	reapFlag        = kingpin.Flag("reap-interval", "how often expired messages are removed, or 0 to never remove them").Default("1m").Duration()
+	maxMessagesFlag = kingpin.Flag("max-messages", "maximum messages stored per recipient").Int()
+	maxBytesFlag    = kingpin.Flag("max-bytes", "maximum message bytes stored per recipient").Bytes()
+	keyRateFlag     = kingpin.Flag("key-rate", "requests per second allowed per client key").Float64()
+	keyBurstFlag    = kingpin.Flag("key-burst", "request burst allowed per client key").Default("10").Int()
+	addrRateFlag    = kingpin.Flag("addr-rate", "requests per second allowed per remote address").Float64()
+	addrBurstFlag   = kingpin.Flag("addr-burst", "request burst allowed per remote address").Default("20").Int()
+	maxWaitFlag     = kingpin.Flag("max-wait", "maximum time a fetch may wait for messages").Default(sfhttp.DefaultMaxWait.String()).Duration()
+	maxLeaseFlag    = kingpin.Flag("max-lease-bytes", "maximum message bytes returned by one fetch").Default("16MB").Bytes()
+	maxPrekeysFlag  = kingpin.Flag("max-prekeys", "maximum unclaimed prekeys published per recipient").Default(strconv.Itoa(sfhttp.DefaultMaxPrekeys)).Int()
+	claimFlag       = kingpin.Flag("prekey-claim-interval", "how often a sender may claim one-time prekeys of each recipient, or 0 for no limit").Default(sfhttp.DefaultClaimInterval.String()).Duration()
+
+	routerNameFlag    = kingpin.Flag("router-name", "host[:port] naming this server in addresses; enables relay between routers").String()
+	peerFlag          = kingpin.Flag("peer", "url and optional public key of a peer router, as router=url[,key]").StringMap()
+	openRelayFlag     = kingpin.Flag("open-relay", "relay to any router named in an address, not only peers").Bool()
+	relayRetryFlag    = kingpin.Flag("relay-retry", "wait before retrying a message which could not be relayed").Default(sfhttp.DefaultRelayRetry.String()).Duration()
+	relayMaxRetryFlag = kingpin.Flag("relay-max-retry", "longest wait between attempts to relay a message").Default(sfhttp.DefaultRelayMaxRetry.String()).Duration()
+	relayMaxFlag      = kingpin.Flag("relay-max-per-sender", "maximum messages queued for relay per sender, or 0 for no limit").Default(strconv.Itoa(sfhttp.DefaultRelayMaxPerSender)).Int()
 )
 
 var (
@@ -58,21 +89,60 @@ func main() {
 func run() error {
 	kingpin.Parse()
 
-	db, err := newDB()
+	keyPair, err := loadKeyPair()
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	keyPair, err := loadKeyPair()
+	backend, err := newStorage()
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	service := boltstorage.NewService(db)
+	service := backend.service
+	service.SetLimits(*maxMessagesFlag, int64(*maxBytesFlag))
+	service.SetMaxLeaseBytes(int64(*maxLeaseFlag))
+	notifier := storage.NewNotifier()
+	service.SetNotifier(notifier)
 	handler := sfhttp.NewHandler(keyPair, service)
+	handler.SetNotifier(notifier)
+	handler.SetMaxWait(*maxWaitFlag)
+	handler.SetMaxSkew(*maxSkewFlag)
+	handler.SetNonceCache(backend.nonceCache)
+	handler.SetAllowV1(*allowV1Flag)
+	handler.SetMaxTTL(*maxTTLFlag)
+	handler.SetPrekeys(backend.prekeys)
+	handler.SetMaxPrekeys(*maxPrekeysFlag)
+	handler.SetClaimInterval(*claimFlag)
+	// Rate limits are shared by the HTTP and TCP transports.
+	var keyLimit, addrLimit *transport.RateLimiter
+	if *keyRateFlag > 0 {
+		keyLimit = transport.NewRateLimiter(*keyRateFlag, *keyBurstFlag)
+	}
+	if *addrRateFlag > 0 {
+		addrLimit = transport.NewRateLimiter(*addrRateFlag, *addrBurstFlag)
+	}
+	handler.SetKeyRateLimit(keyLimit)
+	handler.SetAddrRateLimit(addrLimit)
+
+	var relay *sfhttp.Relay
+	if *routerNameFlag != "" {
+		relay, err = newRelay(keyPair, backend.relayQueue)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		handler.SetRouterName(*routerNameFlag)
+		handler.SetRelay(relay)
+	}
 
 	r := httprouter.New()
 	handler.Register(r)
 
 	var t tomb.Tomb
+	if relay != nil {
+		t.Go(func() error {
+			relay.Run(t.Dying())
+			return nil
+		})
+	}
 	if *httpFlag != "" {
 		t.Go(func() error {
 			return http.ListenAndServe(*httpFlag, r)
@@ -83,11 +153,112 @@ func run() error {
 			return http.ListenAndServeTLS(*httpsFlag, *certFlag, *keyFlag, r)
 		})
 	}
+	if *tcpFlag != "" {
+		tcpServer := tcp.NewServer(keyPair, service)
+		tcpServer.SetMaxSkew(*maxSkewFlag)
+		tcpServer.SetNonceCache(backend.nonceCache)
+		tcpServer.SetMaxTTL(*maxTTLFlag)
+		tcpServer.SetKeyRateLimit(keyLimit)
+		tcpServer.SetAddrRateLimit(addrLimit)
+		tcpServer.SetRouterName(*routerNameFlag)
+		t.Go(func() error {
+			return tcpServer.ListenAndServe(*tcpFlag)
+		})
+	}
+
+	if *reapFlag > 0 {
+		t.Go(func() error {
+			reap(&t, service)
+			return nil
+		})
+	}
 
 	log.Printf("public key: %s", keyPair.PublicKey.Encode())
 	return t.Wait()
 }
 
+// reap periodically removes expired messages until the tomb is killed.
+func reap(t *tomb.Tomb, service storage.Service) {
+	ticker := time.NewTicker(*reapFlag)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n, err := service.Expire()
+			if err != nil {
+				log.Println(errgo.Details(err))
+			} else if n > 0 {
+				log.Printf("expired %d messages", n)
+			}
+		case <-t.Dying():
+			return
+		}
+	}
+}
+
+// routerService is a storage.Service with the limits configured by sfd.
+type routerService interface {
+	storage.Service
+	SetLimits(maxMessages int, maxBytes int64)
+	SetMaxLeaseBytes(maxLease int64)
+	SetNotifier(notifier *storage.Notifier)
+}
+
+// backend is the storage of the selected backend.
+type backend struct {
+	service    routerService
+	nonceCache storage.NonceCache
+	prekeys    storage.Prekeys
+	relayQueue storage.RelayQueue
+}
+
+// newStorage returns the message, nonce, prekey and relay queue storage of
+// the selected backend.
+func newStorage() (*backend, error) {
+	if *storageFlag == "memory" {
+		return &backend{
+			service:    memstorage.NewService(),
+			nonceCache: memstorage.NewNonceCache(*nonceCacheFlag),
+			prekeys:    memstorage.NewPrekeys(),
+			relayQueue: memstorage.NewRelayQueue(),
+		}, nil
+	}
+	db, err := newDB()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &backend{
+		service:    boltstorage.NewService(db),
+		nonceCache: boltstorage.NewNonceCache(db, *nonceCacheFlag),
+		prekeys:    boltstorage.NewPrekeys(db),
+		relayQueue: boltstorage.NewRelayQueue(db),
+	}, nil
+}
+
+// newRelay returns a relay to other routers, with the peers given by flags.
+func newRelay(keyPair *sf.KeyPair, queue storage.RelayQueue) (*sfhttp.Relay, error) {
+	queue.SetMaxPerSender(*relayMaxFlag)
+	relay := sfhttp.NewRelay(keyPair, queue, nil)
+	relay.SetRetry(*relayRetryFlag, *relayMaxRetryFlag)
+	relay.SetOpenRelay(*openRelayFlag)
+	for router, peer := range *peerFlag {
+		fields := strings.SplitN(peer, ",", 2)
+		serverURL := fields[0]
+		var serverKey *sf.PublicKey
+		var err error
+		if len(fields) > 1 {
+			serverKey, err = sf.DecodePublicKey(fields[1])
+		} else {
+			serverKey, err = sfhttp.PublicKey(serverURL, nil)
+		}
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot get public key of peer %q", router)
+		}
+		relay.SetPeer(router, serverURL, serverKey)
+	}
+	return relay, nil
+}
+
 func newDB() (*bolt.DB, error) {
 	db, err := bolt.Open(*dbFileFlag, 0600, &boltOptions)
 	if err != nil {
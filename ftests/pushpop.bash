@@ -61,8 +61,12 @@ ALICE_MSG=$(mktemp)
 TRAPEXIT="$TRAPEXIT;rm -f $ALICE_MSG"
 trap "$TRAPEXIT" EXIT
 echo "hello" > $ALICE_MSG
-$GOPATH/bin/sf --server-key ${SFD_KEY} --url http://localhost:8080 --homedir .alice --passphrase /dev/null msg push bob $ALICE_MSG
+MSG_ID=$($GOPATH/bin/sf --server-key ${SFD_KEY} --url http://localhost:8080 --homedir .alice --passphrase /dev/null msg push bob $ALICE_MSG | cut -d' ' -f1)
 
 # Bob checks messages
 $GOPATH/bin/sf --server-key ${SFD_KEY} --url http://localhost:8080 --homedir .bob --passphrase /dev/null msg pop
 
+
+# Alice learns that Bob received it
+$GOPATH/bin/sf --server-key ${SFD_KEY} --url http://localhost:8080 --homedir .alice --passphrase /dev/null msg pop
+$GOPATH/bin/sf --homedir .alice --passphrase /dev/null msg status $MSG_ID | grep -q delivered
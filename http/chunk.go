@@ -0,0 +1,402 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/transport"
+	"github.com/cmars/shadowfax/wire"
+)
+
+// DefaultChunkSize is the largest payload PushLarge sends as a single
+// message.
+const DefaultChunkSize = 256 * 1024
+
+// maxChunks is the most chunks a Reassembler accepts in one transfer.
+const maxChunks = 1 << 24
+
+// chunkMagic begins the plaintext of every chunk and manifest message.
+var chunkMagic = []byte("\x00sfchunk")
+
+// Kinds of chunk message.
+const (
+	chunkData     = 'd'
+	chunkManifest = 'm'
+)
+
+// chunkHeaderLen is the length of the magic, kind, transfer ID and index
+// which precede the chunk data.
+const chunkHeaderLen = 8 + 1 + 24 + 4
+
+type chunk struct {
+	kind     byte
+	transfer sf.Nonce
+	index    uint32
+	data     []byte
+}
+
+func (ch *chunk) marshal() []byte {
+	buf := make([]byte, chunkHeaderLen+len(ch.data))
+	copy(buf, chunkMagic)
+	buf[8] = ch.kind
+	copy(buf[9:33], ch.transfer[:])
+	binary.BigEndian.PutUint32(buf[33:37], ch.index)
+	copy(buf[chunkHeaderLen:], ch.data)
+	return buf
+}
+
+func parseChunk(b []byte) (*chunk, bool) {
+	if len(b) < chunkHeaderLen || !bytes.Equal(b[:8], chunkMagic) {
+		return nil, false
+	}
+	ch := &chunk{
+		kind:  b[8],
+		index: binary.BigEndian.Uint32(b[33:37]),
+		data:  b[chunkHeaderLen:],
+	}
+	if ch.kind != chunkData && ch.kind != chunkManifest {
+		return nil, false
+	}
+	copy(ch.transfer[:], b[9:33])
+	return ch, true
+}
+
+// SetChunkSize sets the largest payload PushLarge sends as a single message.
+func (c *Client) SetChunkSize(chunkSize int) {
+	c.chunkSize = chunkSize
+}
+
+// PushLarge pushes a payload of any size, read from r, to several
+// recipients. Payloads larger than the chunk size are split into separately
+// sealed chunks, followed by a manifest from which the recipient's
+// Reassembler reassembles and verifies the payload. The receipt ID of a
+// chunked payload is its transfer ID.
+//
+// Once a chunk is rejected for a recipient, no further chunks are sent to
+// them.
+func (c *Client) PushLarge(recipients []string, r io.Reader) ([]PushReceipt, error) {
+	br := bufio.NewReader(r)
+	buf := make([]byte, c.chunkSize)
+	n, err := io.ReadFull(br, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return c.PushMany(recipients, buf[:n])
+	} else if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if _, err := br.Peek(1); err == io.EOF {
+		return c.PushMany(recipients, buf[:n])
+	}
+
+	transfer, err := sf.NewNonce()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	receipts := make([]PushReceipt, len(recipients))
+	for i := range recipients {
+		receipts[i] = PushReceipt{
+			Recipient: recipients[i],
+			ID:        transfer.Encode(),
+		}
+	}
+
+	h := sha256.New()
+	var size int64
+	var index uint32
+	for n > 0 {
+		h.Write(buf[:n])
+		size += int64(n)
+		ch := &chunk{kind: chunkData, transfer: *transfer, index: index, data: buf[:n]}
+		err = c.pushChunk(receipts, ch)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		index++
+
+		n, err = io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, errgo.Mask(err)
+		}
+	}
+
+	manifest, err := json.Marshal(&wire.ChunkManifest{
+		Size:   size,
+		Chunks: int(index),
+		SHA256: h.Sum(nil),
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	err = c.pushChunk(receipts, &chunk{kind: chunkManifest, transfer: *transfer, index: index, data: manifest})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return receipts, nil
+}
+
+// pushChunk pushes a chunk to each recipient which has not yet failed,
+// recording any failures in their receipts.
+func (c *Client) pushChunk(receipts []PushReceipt, ch *chunk) error {
+	var recipients []string
+	var active []int
+	for i := range receipts {
+		if receipts[i].Err == nil {
+			recipients = append(recipients, receipts[i].Recipient)
+			active = append(active, i)
+		}
+	}
+	if len(recipients) == 0 {
+		return nil
+	}
+	chunkReceipts, err := c.PushMany(recipients, ch.marshal())
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for i, chunkReceipt := range chunkReceipts {
+		if chunkReceipt.Err != nil {
+			receipts[active[i]].Err = errgo.NoteMask(chunkReceipt.Err,
+				"chunk "+strconv.Itoa(int(ch.index)), errgo.Is(transport.ErrMailboxFull))
+		}
+	}
+	return nil
+}
+
+// IsChunk returns whether a message is part of a chunked payload, which
+// should be added to a Reassembler rather than used directly.
+func IsChunk(msg *transport.PopMessage) bool {
+	_, ok := parseChunk(msg.Contents)
+	return ok
+}
+
+// Transfer is a payload which has been reassembled from chunks.
+type Transfer struct {
+	ID       string
+	Sender   string
+	Size     int64
+	Received time.Time
+
+	// Path is the file containing the payload.
+	Path string
+}
+
+// Reassembler reassembles payloads sent with PushLarge. Chunks are spooled to
+// files in a directory until the transfer they belong to is complete, so
+// payloads need not fit in memory.
+type Reassembler struct {
+	dir string
+}
+
+// NewReassembler returns a new Reassembler which spools chunks and writes
+// reassembled payloads in dir.
+func NewReassembler(dir string) *Reassembler {
+	return &Reassembler{dir: dir}
+}
+
+const (
+	spoolDirName     = ".chunks"
+	manifestFileName = "manifest"
+	completeFileName = "complete"
+)
+
+type spooledManifest struct {
+	wire.ChunkManifest
+	Received time.Time `json:"received"`
+}
+
+// Add spools a chunk received from a sender. Once all chunks and the manifest
+// of a transfer have been added, the payload is verified and written to a
+// file named by the transfer ID, in a directory named by the sender's key,
+// and Add returns the transfer. Otherwise it
+// returns nil. A chunk may be acknowledged once it has been added.
+func (r *Reassembler) Add(msg *transport.PopMessage) (*Transfer, error) {
+	ch, ok := parseChunk(msg.Contents)
+	if !ok {
+		return nil, errgo.Newf("message %q is not a chunk", msg.ID)
+	}
+	senderKey, err := sf.DecodePublicKey(msg.Sender)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	sender := senderKey.Encode()
+	transferID := ch.transfer.Encode()
+	spoolDir := filepath.Join(r.dir, spoolDirName, sender, transferID)
+
+	if _, err := os.Stat(filepath.Join(spoolDir, completeFileName)); err == nil {
+		// A chunk of a transfer already reassembled was redelivered.
+		return nil, nil
+	}
+	err = os.MkdirAll(spoolDir, 0700)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	switch ch.kind {
+	case chunkData:
+		if ch.index >= maxChunks {
+			return nil, errgo.Newf("chunk index %d out of range", ch.index)
+		}
+		err = writeFileAtomic(filepath.Join(spoolDir, strconv.Itoa(int(ch.index))), ch.data)
+	case chunkManifest:
+		var manifest spooledManifest
+		err = json.Unmarshal(ch.data, &manifest.ChunkManifest)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid manifest for transfer %q", transferID)
+		}
+		if manifest.Chunks < 1 || manifest.Chunks > maxChunks || manifest.Size < 0 {
+			return nil, errgo.Newf("invalid manifest for transfer %q", transferID)
+		}
+		manifest.Received = msg.Received
+		var out []byte
+		out, err = json.Marshal(&manifest)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		err = writeFileAtomic(filepath.Join(spoolDir, manifestFileName), out)
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return r.complete(spoolDir, sender, transferID)
+}
+
+// complete reassembles a transfer if all of its chunks have been spooled.
+func (r *Reassembler) complete(spoolDir, sender, transferID string) (*Transfer, error) {
+	manifestBytes, err := ioutil.ReadFile(filepath.Join(spoolDir, manifestFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var manifest spooledManifest
+	err = json.Unmarshal(manifestBytes, &manifest)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	for i := 0; i < manifest.Chunks; i++ {
+		_, err := os.Stat(filepath.Join(spoolDir, strconv.Itoa(i)))
+		if os.IsNotExist(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+
+	// Transfer IDs are chosen by senders, so payloads are kept apart by
+	// sender; one cannot replace another's.
+	outDir := filepath.Join(r.dir, sender)
+	err = os.MkdirAll(outDir, 0700)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	f, err := ioutil.TempFile(outDir, "."+transferID)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	h := sha256.New()
+	w := io.MultiWriter(f, h)
+	var size int64
+	for i := 0; i < manifest.Chunks; i++ {
+		n, err := copyFile(w, filepath.Join(spoolDir, strconv.Itoa(i)))
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		size += n
+	}
+	err = f.Close()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	verified := size == manifest.Size && bytes.Equal(h.Sum(nil), manifest.SHA256)
+	if verified {
+		path := filepath.Join(outDir, transferID)
+		err = os.Rename(f.Name(), path)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		err = r.finish(spoolDir)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return &Transfer{
+			ID:       transferID,
+			Sender:   sender,
+			Size:     size,
+			Received: manifest.Received,
+			Path:     path,
+		}, nil
+	}
+	err = r.finish(spoolDir)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return nil, errgo.Newf("transfer %q from %q failed verification", transferID, sender)
+}
+
+// finish removes the spooled chunks of a transfer, leaving a marker so that
+// redelivered chunks are ignored.
+func (r *Reassembler) finish(spoolDir string) error {
+	err := os.RemoveAll(spoolDir)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = os.MkdirAll(spoolDir, 0700)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(ioutil.WriteFile(filepath.Join(spoolDir, completeFileName), nil, 0600))
+}
+
+func copyFile(w io.Writer, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	defer f.Close()
+	n, err := io.Copy(w, f)
+	return n, errgo.Mask(err)
+}
+
+// writeFileAtomic writes a file such that it either exists with all of its
+// contents, or not at all.
+func writeFileAtomic(path string, contents []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	_, err = f.Write(contents)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errgo.Mask(err)
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(os.Rename(f.Name(), path))
+}
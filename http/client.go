@@ -10,17 +10,20 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"strings"
+	"time"
 
 	"golang.org/x/crypto/nacl/box"
 	"gopkg.in/errgo.v1"
 
 	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/session"
+	"github.com/cmars/shadowfax/transport"
 	"github.com/cmars/shadowfax/wire"
 )
 
@@ -30,6 +33,10 @@ type Client struct {
 	serverURL string
 	serverKey *sf.PublicKey
 	client    *http.Client
+	ttl       time.Duration
+	chunkSize int
+	sealed    bool
+	sessions  *session.Manager
 }
 
 // PublicKey requests a shadowfax server's public key. An error is returned
@@ -80,24 +87,60 @@ func NewClient(keyPair *sf.KeyPair, serverURL string, serverKey *sf.PublicKey, c
 		serverURL: serverURL,
 		serverKey: serverKey,
 		client:    client,
+		chunkSize: DefaultChunkSize,
 	}
 }
 
+// SetTTL sets the time-to-live requested for pushed messages. The server may
+// expire messages sooner. If zero, the server's maximum is used. The TTL is
+// sent in whole seconds, rounded up.
+func (c *Client) SetTTL(ttl time.Duration) {
+	c.ttl = ttl
+}
+
+// ttlSeconds returns a time-to-live in whole seconds, rounded up so that a
+// TTL of less than a second is not mistaken for the server's maximum.
+func ttlSeconds(ttl time.Duration) int64 {
+	return int64((ttl + time.Second - 1) / time.Second)
+}
+
+// SetSealedSender sets whether pushed messages hide the sender from the
+// server. The sender is sealed inside each message, known only to the
+// recipient, and push requests are authenticated with a new ephemeral key
+// rather than the client key. Messages pushed in the same request share the
+// ephemeral key.
+func (c *Client) SetSealedSender(sealed bool) {
+	c.sealed = sealed
+}
+
+// SetSessions sets the manager of forward-secret sessions for the client key.
+// Messages pushed are sealed in a session with each recipient, started with
+// one of their published prekeys if need be, and popped messages sealed in a
+// session are opened. Recipients without prekeys are sent messages sealed
+// with the client key alone.
+func (c *Client) SetSessions(sessions *session.Manager) {
+	c.sessions = sessions
+}
+
 // Request encrypts a request to the server and decrypts the response.
 //
+// The request is timestamped so that the server can reject stale or replayed
+// requests.
+//
 // If the client and server have securely exchanged keys out of band,
 // confidentiality does not depend on TLS.
 func (c *Client) Request(method string, path string, contents []byte) ([]byte, error) {
-	nonce, err := sf.NewNonce()
+	return c.requestAs(context.Background(), c.keyPair, method, path, contents)
+}
+
+// requestAs makes a request authenticated by the given key pair, which is
+// abandoned if the context is done first.
+func (c *Client) requestAs(ctx context.Context, keyPair *sf.KeyPair, method string, path string, contents []byte) ([]byte, error) {
+	reqMessage, nonce, err := transport.SealRequest(keyPair, c.serverKey, contents)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	encReq := box.Seal(nil, contents, (*[24]byte)(nonce), (*[32]byte)(c.serverKey), (*[32]byte)(c.keyPair.PrivateKey))
-	reqMessage := wire.Message{
-		ID:       nonce.Encode(),
-		Contents: encReq,
-	}
-	reqContents, err := json.Marshal(&reqMessage)
+	reqContents, err := json.Marshal(reqMessage)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -105,6 +148,7 @@ func (c *Client) Request(method string, path string, contents []byte) ([]byte, e
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := c.client.Do(req)
@@ -117,13 +161,20 @@ func (c *Client) Request(method string, path string, contents []byte) ([]byte, e
 		return nil, errgo.Mask(err)
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, errgo.Mask(newHTTPClientError(resp.StatusCode, string(respContents)))
+		return nil, errgo.Mask(newHTTPClientError(resp.StatusCode, string(respContents)), errgo.Any)
 	}
-	decResp, ok := box.Open(nil, respContents, (*[24]byte)(nonce), (*[32]byte)(c.serverKey), (*[32]byte)(c.keyPair.PrivateKey))
-	if !ok {
-		return nil, errgo.New("failed to authenticate response from server")
+	return c.openResponse(keyPair, respContents, nonce)
+}
+
+// openResponse decrypts and authenticates a response from the server to a
+// request sealed with reqNonce.
+func (c *Client) openResponse(keyPair *sf.KeyPair, respContents []byte, reqNonce *sf.Nonce) ([]byte, error) {
+	var respMessage wire.Message
+	err := json.Unmarshal(respContents, &respMessage)
+	if err != nil {
+		return nil, errgo.Mask(err)
 	}
-	return decResp, nil
+	return transport.OpenResponse(keyPair, c.serverKey, &respMessage, reqNonce)
 }
 
 type httpClientError struct {
@@ -142,64 +193,142 @@ func (err *httpClientError) Error() string {
 
 // Push pushes a message to a recipient.
 func (c *Client) Push(recipient string, contents []byte) error {
-	nonce, err := sf.NewNonce()
+	receipts, err := c.PushMany([]string{recipient}, contents)
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	rcptKey, err := sf.DecodePublicKey(recipient)
-	if err != nil {
-		return errgo.Mask(err)
+	return errgo.Mask(receipts[0].Err, errgo.Is(transport.ErrMailboxFull))
+}
+
+// PushReceipt is the outcome of pushing a message to one recipient.
+type PushReceipt struct {
+	Recipient string
+	ID        string
+
+	// Err is nil if the server accepted the message. If the recipient's
+	// mailbox is full, its cause is transport.ErrMailboxFull.
+	Err error
+}
+
+// PushMany pushes a message to several recipients in a single request. The
+// message is sealed separately for each recipient. A receipt is returned for
+// each recipient, in the same order. Recipients are addresses, which may name
+// a home router to which the server relays the message.
+func (c *Client) PushMany(recipients []string, contents []byte) ([]PushReceipt, error) {
+	requestKey := c.keyPair
+	if c.sealed {
+		ephemeral, err := sf.NewKeyPair()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		requestKey = &ephemeral
+	}
+
+	var pushWire []wire.PushMessage
+	for _, recipient := range recipients {
+		nonce, err := sf.NewNonce()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		rcptAddr, err := sf.ParseAddress(recipient)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		rcptKey := rcptAddr.Key
+		rcptContents, err := c.sealSession(requestKey, rcptKey, contents)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		var encMsg []byte
+		if c.sealed {
+			encMsg, err = transport.SealSender(c.keyPair, requestKey, nonce, rcptKey, rcptContents)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+		} else {
+			encMsg = box.Seal(nil, rcptContents, (*[24]byte)(nonce), (*[32]byte)(rcptKey), (*[32]byte)(c.keyPair.PrivateKey))
+		}
+		pushWire = append(pushWire, wire.PushMessage{
+			Message: wire.Message{
+				ID:       nonce.Encode(),
+				Contents: encMsg,
+			},
+			Recipient:    recipient,
+			TTL:          ttlSeconds(c.ttl),
+			SealedSender: c.sealed,
+		})
 	}
-	encMsg := box.Seal(nil, contents, (*[24]byte)(nonce), (*[32]byte)(rcptKey), (*[32]byte)(c.keyPair.PrivateKey))
-	pushWire := []wire.PushMessage{{
-		Message: wire.Message{
-			ID:       nonce.Encode(),
-			Contents: encMsg,
-		},
-		Recipient: recipient,
-	}}
 	reqContents, err := json.Marshal(&pushWire)
 	if err != nil {
-		return errgo.Mask(err)
+		return nil, errgo.Mask(err)
 	}
 
-	respContents, err := c.Request("POST", "/outbox/"+c.keyPair.PublicKey.Encode(), reqContents)
+	respContents, err := c.requestAs(context.Background(), requestKey, "POST", "/outbox/"+requestKey.PublicKey.Encode(), reqContents)
 	if err != nil {
-		return errgo.Mask(err)
+		return nil, errgo.Mask(err)
 	}
 	var pushReceipts []wire.PushReceipt
 	err = json.Unmarshal(respContents, &pushReceipts)
 	if err != nil {
-		return errgo.Mask(err)
+		return nil, errgo.Mask(err)
 	}
+	wireReceipts := make(map[string]wire.PushReceipt)
 	for _, receipt := range pushReceipts {
-		if receipt.OK && receipt.ID == nonce.Encode() {
-			return nil
-		}
+		wireReceipts[receipt.ID] = receipt
 	}
-	return errgo.New("not acknowledged")
-}
 
-// PopMessage contains a message received.
-type PopMessage struct {
-	ID       string
-	Sender   string
-	Contents []byte
+	receipts := make([]PushReceipt, len(pushWire))
+	for i, msg := range pushWire {
+		receipts[i] = PushReceipt{
+			Recipient: msg.Recipient,
+			ID:        msg.ID,
+		}
+		var receipt *wire.PushReceipt
+		if wireReceipt, ok := wireReceipts[msg.ID]; ok {
+			receipt = &wireReceipt
+		}
+		receipts[i].Err = transport.ReceiptError(msg.Recipient, receipt)
+	}
+	return receipts, nil
 }
 
-type errorSlice []error
-
-// Error implements the error interface.
-func (errs errorSlice) Error() string {
-	var errmsgs []string
-	for _, err := range errs {
-		errmsgs = append(errmsgs, errgo.Details(err))
+// sealSession seals contents in the session for sending to the recipient.
+// If there is no session yet, one is started with a prekey claimed from the
+// server, in a request authenticated by requestKey, which must be signed by
+// the recipient. If the recipient has no prekeys, the contents are returned
+// unchanged.
+func (c *Client) sealSession(requestKey *sf.KeyPair, rcptKey *sf.PublicKey, contents []byte) ([]byte, error) {
+	if c.sessions == nil {
+		return contents, nil
+	}
+	ok, err := c.sessions.HasSession(rcptKey)
+	if err != nil {
+		return nil, errgo.Mask(err)
 	}
-	return strings.Join(errmsgs, "\n")
+	if !ok {
+		signed, err := c.claimPrekeyAs(requestKey, rcptKey)
+		if errgo.Cause(err) == ErrNoPrekeys {
+			return contents, nil
+		} else if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		// The server could substitute a prekey of its own, so it must be
+		// checked before any message is sealed with it.
+		prekey, err := openPrekey(rcptKey, signed)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		err = c.sessions.Start(rcptKey, prekey.Key)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	return c.sessions.Seal(rcptKey, contents)
 }
 
-// Pop retrieves messages addressed to the client.
-func (c *Client) Pop() ([]*PopMessage, error) {
+// Pop retrieves messages addressed to the client and removes them from the
+// server.
+func (c *Client) Pop() ([]*transport.PopMessage, error) {
 	respContents, err := c.Request("DELETE", "/inbox/"+c.keyPair.PublicKey.Encode(), nil)
 	if err != nil {
 		return nil, errgo.Mask(err)
@@ -209,35 +338,106 @@ func (c *Client) Pop() ([]*PopMessage, error) {
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	return c.openMessages(wireMessages)
+}
 
-	var popMessages []*PopMessage
-	var errors errorSlice
-	for _, msg := range wireMessages {
-		nonce, err := sf.DecodeNonce(msg.ID)
-		if err != nil {
-			errors = append(errors, errgo.Notef(err, "ID=%q Sender=%q", msg.ID, msg.Sender))
-			continue
+// Fetch retrieves messages addressed to the client without removing them
+// from the server. The messages are leased to the client until the returned
+// expiration time. Messages which are not acknowledged with Ack before then
+// will be returned again by a later Fetch. If some messages could not be
+// opened, the others are returned along with a *transport.OpenError.
+func (c *Client) Fetch() ([]*transport.PopMessage, time.Time, error) {
+	return c.fetch(context.Background(), nil)
+}
+
+// DefaultWait is the longest time a single request made by Client.Wait will
+// wait for messages to arrive.
+const DefaultWait = 30 * time.Second
+
+// pollInterval is how often Client.Wait polls servers which do not support
+// waiting for messages.
+const pollInterval = 5 * time.Second
+
+// Wait waits until messages addressed to the client arrive, and fetches them
+// as with Fetch. Wait returns when messages are received, or when the context
+// is done.
+func (c *Client) Wait(ctx context.Context) ([]*transport.PopMessage, time.Time, error) {
+	for {
+		wait := DefaultWait
+		if deadline, ok := ctx.Deadline(); ok && deadline.Sub(time.Now()) < wait {
+			wait = deadline.Sub(time.Now())
+		}
+		if wait < time.Second {
+			wait = time.Second
+		}
+		// Messages fetched by a cancelled request are redelivered once
+		// their lease expires.
+		start := time.Now()
+		msgs, expires, err := c.fetch(ctx, &wire.FetchRequest{Wait: int64(wait / time.Second)})
+		if ctx.Err() != nil {
+			return nil, time.Time{}, ctx.Err()
+		}
+		if err != nil || len(msgs) > 0 {
+			return msgs, expires, err
+		}
+		if time.Since(start) < wait/2 {
+			// The server did not wait for messages, so poll.
+			select {
+			case <-ctx.Done():
+				return nil, time.Time{}, ctx.Err()
+			case <-time.After(pollInterval):
+			}
 		}
-		senderKey, err := sf.DecodePublicKey(msg.Sender)
+	}
+}
+
+func (c *Client) fetch(ctx context.Context, fetchReq *wire.FetchRequest) ([]*transport.PopMessage, time.Time, error) {
+	var fail time.Time
+	var reqContents []byte
+	if fetchReq != nil {
+		var err error
+		reqContents, err = json.Marshal(fetchReq)
 		if err != nil {
-			errors = append(errors, errgo.Notef(err, "ID=%q Sender=%q", msg.ID, msg.Sender))
-			continue
-		}
-		contents, ok := box.Open(nil, msg.Contents, (*[24]byte)(nonce), (*[32]byte)(senderKey), (*[32]byte)(c.keyPair.PrivateKey))
-		if !ok {
-			errors = append(errors, errgo.Newf("invalid message contents: ID=%q Sender=%q", msg.ID, msg.Sender))
-			continue
-		}
-		popMessages = append(popMessages, &PopMessage{
-			ID:       msg.ID,
-			Contents: contents,
-			Sender:   msg.Sender,
-		})
+			return nil, fail, errgo.Mask(err)
+		}
+	}
+	respContents, err := c.requestAs(ctx, c.keyPair, "POST", "/inbox/"+c.keyPair.PublicKey.Encode()+"/fetch", reqContents)
+	if err != nil {
+		return nil, fail, errgo.Mask(err)
+	}
+	var fetchResp wire.FetchResponse
+	err = json.Unmarshal(respContents, &fetchResp)
+	if err != nil {
+		return nil, fail, errgo.Mask(err)
+	}
+	popMessages, err := c.openMessages(fetchResp.Messages)
+	return popMessages, fetchResp.Expires, err
+}
+
+// Ack acknowledges receipt of fetched messages, removing them from the
+// server.
+func (c *Client) Ack(ids []string) error {
+	reqContents, err := json.Marshal(&wire.AckRequest{IDs: ids})
+	if err != nil {
+		return errgo.Mask(err)
 	}
-	if len(errors) > 0 {
-		return popMessages, errors
+	respContents, err := c.Request("POST", "/inbox/"+c.keyPair.PublicKey.Encode()+"/ack", reqContents)
+	if err != nil {
+		return errgo.Mask(err)
 	}
-	return popMessages, nil
+	var ackResp wire.Error
+	err = json.Unmarshal(respContents, &ackResp)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if !ackResp.OK {
+		return errgo.New("not acknowledged")
+	}
+	return nil
+}
+
+func (c *Client) openMessages(wireMessages []wire.PopMessage) ([]*transport.PopMessage, error) {
+	return transport.OpenMessages(c.keyPair, c.sessions, wireMessages)
 }
 
 // PublicKey returns the public key identity of the client.
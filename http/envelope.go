@@ -0,0 +1,145 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/cmars/shadowfax/wire"
+)
+
+// envelopeMagic begins the plaintext of every message with an envelope. It is
+// followed by the envelope version, the length of the envelope and the
+// envelope itself, then the body.
+var envelopeMagic = []byte("\x00sfenv")
+
+// envelopePrefixLen is the length of the magic, version and envelope length
+// which precede the envelope.
+const envelopePrefixLen = 6 + 1 + 4
+
+// maxEnvelopeLen is the longest envelope accepted.
+const maxEnvelopeLen = 64 * 1024
+
+// NewEnvelope returns an envelope for contents of the given type, timestamped
+// now.
+func NewEnvelope(contentType string) *wire.Envelope {
+	return &wire.Envelope{
+		ContentType: contentType,
+		Time:        time.Now(),
+	}
+}
+
+func marshalEnvelope(env *wire.Envelope) ([]byte, error) {
+	envBytes, err := json.Marshal(env)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(envBytes) > maxEnvelopeLen {
+		return nil, errgo.New("envelope too long")
+	}
+	buf := make([]byte, envelopePrefixLen, envelopePrefixLen+len(envBytes))
+	copy(buf, envelopeMagic)
+	buf[6] = wire.EnvelopeVersion1
+	binary.BigEndian.PutUint32(buf[7:envelopePrefixLen], uint32(len(envBytes)))
+	return append(buf, envBytes...), nil
+}
+
+// WrapEnvelope returns message contents carrying an envelope and body.
+func WrapEnvelope(env *wire.Envelope, body []byte) ([]byte, error) {
+	contents, err := marshalEnvelope(env)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return append(contents, body...), nil
+}
+
+// EnvelopeReader returns a reader of an envelope followed by the body read
+// from r, for pushing with PushLarge.
+func EnvelopeReader(env *wire.Envelope, r io.Reader) (io.Reader, error) {
+	envBytes, err := marshalEnvelope(env)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return io.MultiReader(bytes.NewReader(envBytes), r), nil
+}
+
+// PushEnvelope pushes a body of any size with an envelope describing it, as
+// with PushLarge.
+func (c *Client) PushEnvelope(recipients []string, env *wire.Envelope, r io.Reader) ([]PushReceipt, error) {
+	er, err := EnvelopeReader(env, r)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return c.PushLarge(recipients, er)
+}
+
+// OpenEnvelope returns the envelope and body of message contents. Contents
+// without an envelope, such as those sent by older clients, are returned as
+// the body with a nil envelope.
+func OpenEnvelope(contents []byte) (*wire.Envelope, []byte, error) {
+	env, r, err := ReadEnvelope(bytes.NewReader(contents))
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	if env == nil {
+		return nil, contents, nil
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	return env, body, nil
+}
+
+// ReadEnvelope reads the envelope from the start of a payload, such as a
+// reassembled transfer, and returns a reader of its body. A payload without
+// an envelope is returned as the body with a nil envelope.
+func ReadEnvelope(r io.Reader) (*wire.Envelope, io.Reader, error) {
+	br := bufio.NewReader(r)
+	prefix, err := br.Peek(envelopePrefixLen)
+	if err != nil && err != io.EOF {
+		return nil, nil, errgo.Mask(err)
+	}
+	if !bytes.HasPrefix(prefix, envelopeMagic) {
+		return nil, br, nil
+	}
+	if len(prefix) < envelopePrefixLen {
+		return nil, nil, errgo.New("truncated envelope")
+	}
+	if version := prefix[6]; version != wire.EnvelopeVersion1 {
+		return nil, nil, errgo.Newf("unsupported envelope version %d", version)
+	}
+	n := binary.BigEndian.Uint32(prefix[7:envelopePrefixLen])
+	if n > maxEnvelopeLen {
+		return nil, nil, errgo.New("envelope too long")
+	}
+	_, err = br.Discard(envelopePrefixLen)
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	envBytes := make([]byte, n)
+	_, err = io.ReadFull(br, envBytes)
+	if err != nil {
+		return nil, nil, errgo.Notef(err, "truncated envelope")
+	}
+	var env wire.Envelope
+	err = json.Unmarshal(envBytes, &env)
+	if err != nil {
+		return nil, nil, errgo.Notef(err, "invalid envelope")
+	}
+	return &env, br, nil
+}
@@ -9,39 +9,126 @@
 package http
 
 import (
-	"bytes"
 	"encoding/json"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
-	"golang.org/x/crypto/nacl/box"
 	"gopkg.in/errgo.v1"
 
 	sf "github.com/cmars/shadowfax"
 	"github.com/cmars/shadowfax/storage"
+	"github.com/cmars/shadowfax/transport"
 	"github.com/cmars/shadowfax/wire"
 )
 
+// DefaultMaxWait is the longest time a fetch request may wait for messages to
+// arrive.
+const DefaultMaxWait = 60 * time.Second
+
 // Handler handles HTTP requests as a shadowfax server.
 type Handler struct {
-	keyPair *sf.KeyPair
-	service storage.Service
+	keyPair       *sf.KeyPair
+	service       storage.Service
+	authenticator *transport.Authenticator
+	leaseTime     time.Duration
+	maxTTL        time.Duration
+	addrLimit     *transport.RateLimiter
+	notifier      *storage.Notifier
+	maxWait       time.Duration
+	prekeys       storage.Prekeys
+	maxPrekeys    int
+	claimLimit    *transport.RateLimiter
+	routerName    string
+	relay         *Relay
 }
 
 // NewHandler returns a new Handler with public key pair and service backend.
 func NewHandler(keyPair *sf.KeyPair, service storage.Service) *Handler {
 	return &Handler{
-		keyPair: keyPair,
-		service: service,
+		keyPair:       keyPair,
+		service:       service,
+		authenticator: transport.NewAuthenticator(keyPair),
+		leaseTime:     transport.DefaultLeaseTime,
+		maxTTL:        transport.DefaultMaxTTL,
+		maxWait:       DefaultMaxWait,
+		maxPrekeys:    DefaultMaxPrekeys,
+		claimLimit:    newClaimLimit(DefaultClaimInterval),
 	}
 }
 
+// SetLeaseTime sets how long fetched messages are reserved before they may be
+// fetched again if not acknowledged.
+func (h *Handler) SetLeaseTime(leaseTime time.Duration) {
+	h.leaseTime = leaseTime
+}
+
+// SetMaxTTL sets the longest time a message is kept before it expires. Senders
+// may request a shorter time-to-live. If zero, messages only expire when
+// requested by the sender.
+func (h *Handler) SetMaxTTL(maxTTL time.Duration) {
+	h.maxTTL = maxTTL
+}
+
+// SetMaxSkew sets how far the timestamp of a request may differ from the
+// server's clock before the request is rejected.
+func (h *Handler) SetMaxSkew(maxSkew time.Duration) {
+	h.authenticator.SetMaxSkew(maxSkew)
+}
+
+// SetNonceCache sets the cache used to reject requests which reuse the nonce
+// of a prior request. If not set, requests are only checked for timestamp
+// skew.
+func (h *Handler) SetNonceCache(nonceCache storage.NonceCache) {
+	h.authenticator.SetNonceCache(nonceCache)
+}
+
+// SetAllowV1 sets whether requests using protocol version 1 are accepted.
+// Version 1 seals responses with the request nonce, and should only be
+// allowed while migrating older clients.
+func (h *Handler) SetAllowV1(allowV1 bool) {
+	h.authenticator.SetAllowV1(allowV1)
+}
+
+// SetKeyRateLimit sets the rate limiter applied to each authenticated client
+// public key. If not set, authenticated requests are not rate limited.
+func (h *Handler) SetKeyRateLimit(l *transport.RateLimiter) {
+	h.authenticator.SetKeyRateLimit(l)
+}
+
+// SetAddrRateLimit sets the rate limiter applied to each remote IP address,
+// before authentication. If not set, requests are not limited by address.
+func (h *Handler) SetAddrRateLimit(l *transport.RateLimiter) {
+	h.addrLimit = l
+}
+
+// SetNotifier sets the notifier signalled by the service backend when
+// messages are pushed. If not set, fetch requests do not wait for messages to
+// arrive.
+func (h *Handler) SetNotifier(notifier *storage.Notifier) {
+	h.notifier = notifier
+}
+
+// SetMaxWait sets the longest time a fetch request may wait for messages to
+// arrive.
+func (h *Handler) SetMaxWait(maxWait time.Duration) {
+	h.maxWait = maxWait
+}
+
 // Register sets up endpoint routing for a shadowfax server.
 func (h *Handler) Register(r *httprouter.Router) {
 	r.GET("/publickey", h.publicKey)
 	r.DELETE("/inbox/:recipient", h.pop)
+	r.POST("/inbox/:recipient/fetch", h.fetch)
+	r.POST("/inbox/:recipient/ack", h.ack)
 	r.POST("/outbox/:sender", h.push)
+	r.POST("/outbox/:sender/prekey", h.claimPrekey)
+	r.POST("/prekeys/:recipient", h.putPrekeys)
+	r.GET("/stream/:recipient", h.stream)
+	r.POST("/relay/:server", h.relayIn)
 }
 
 func logError(err error) {
@@ -54,11 +141,29 @@ func httpError(w http.ResponseWriter, wireError wire.Error, err error) {
 	enc := json.NewEncoder(w)
 	encErr := enc.Encode(&wireError)
 	if encErr != nil {
-		log.Println("failed to encode error response: %v", encErr)
+		log.Printf("failed to encode error response: %v", encErr)
 	}
 	logError(err)
 }
 
+// statusTooManyRequests is the HTTP status for rate-limited requests (RFC
+// 6585).
+const statusTooManyRequests = 429
+
+// authError responds to a request which failed authentication.
+func authError(w http.ResponseWriter, err error) {
+	if rlErr, ok := errgo.Cause(err).(*transport.RateLimitError); ok {
+		retryAfter := int64(math.Ceil(rlErr.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+		httpError(w, wire.Error{
+			Code:    statusTooManyRequests,
+			Message: "rate limit exceeded",
+		}, err)
+		return
+	}
+	httpError(w, wire.Error{Code: http.StatusBadRequest}, errgo.Mask(err))
+}
+
 func (h *Handler) publicKey(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 	resp := wire.PublicKeyResponse{
@@ -73,66 +178,74 @@ func (h *Handler) publicKey(w http.ResponseWriter, r *http.Request, p httprouter
 }
 
 type authRequest struct {
-	*Handler
-	ClientKey *sf.PublicKey
-	Nonce     *sf.Nonce
-	Contents  []byte
+	*transport.Request
+}
+
+// allowAddr applies the per-address rate limit to the remote address of a
+// request.
+func (h *Handler) allowAddr(r *http.Request) error {
+	return errgo.Mask(transport.AllowAddr(h.addrLimit, r.RemoteAddr), errgo.Any)
 }
 
 func (h *Handler) auth(r *http.Request, client string) (*authRequest, error) {
-	var msg wire.Message
-	dec := json.NewDecoder(r.Body)
-	err := dec.Decode(&msg)
+	err := h.allowAddr(r)
 	if err != nil {
-		return nil, errgo.Mask(err)
+		return nil, errgo.Mask(err, errgo.Any)
 	}
 
-	clientKey, err := sf.DecodePublicKey(client)
+	var msg wire.Message
+	dec := json.NewDecoder(r.Body)
+	err = dec.Decode(&msg)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	return h.authMessage(&msg, client)
+}
 
-	nonce, err := sf.DecodeNonce(msg.ID)
+// authMessage authenticates a request message sealed by the client.
+func (h *Handler) authMessage(msg *wire.Message, client string) (*authRequest, error) {
+	req, err := h.authenticator.Open(msg, client)
 	if err != nil {
-		return nil, errgo.Mask(err)
-	}
-
-	out, ok := box.Open(nil, msg.Contents, (*[24]byte)(nonce), (*[32]byte)(clientKey), (*[32]byte)(h.keyPair.PrivateKey))
-	if !ok {
-		return nil, errgo.New("authentication failed")
+		return nil, errgo.Mask(err, errgo.Any)
 	}
-
-	return &authRequest{
-		Handler:   h,
-		ClientKey: clientKey,
-		Nonce:     nonce,
-		Contents:  out,
-	}, nil
+	return &authRequest{req}, nil
 }
 
 func (a *authRequest) resp(w http.ResponseWriter, data interface{}) {
-	var msg bytes.Buffer
-
-	enc := json.NewEncoder(&msg)
-	err := enc.Encode(data)
+	out, err := a.seal(data)
 	if err != nil {
 		httpError(w, wire.Error{Code: http.StatusInternalServerError}, errgo.Mask(err))
 		return
 	}
-
-	out := box.Seal(nil, msg.Bytes(), (*[24]byte)(a.Nonce), (*[32]byte)(a.ClientKey), (*[32]byte)(a.keyPair.PrivateKey))
 	_, err = w.Write(out)
 	if err != nil {
 		logError(errgo.Mask(err))
 	}
 }
 
+// seal encodes and encrypts a response to the client. A version 1 response
+// is the sealed contents alone.
+func (a *authRequest) seal(data interface{}) ([]byte, error) {
+	respMessage, err := a.Seal(data)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if a.Version == wire.Version1 {
+		return respMessage.Contents, nil
+	}
+	out, err := json.Marshal(respMessage)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return out, nil
+}
+
 func (h *Handler) pop(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 
 	auth, err := h.auth(r, p.ByName("recipient"))
 	if err != nil {
-		httpError(w, wire.Error{Code: http.StatusBadRequest}, errgo.Mask(err))
+		authError(w, err)
 		return
 	}
 
@@ -142,74 +255,123 @@ func (h *Handler) pop(w http.ResponseWriter, r *http.Request, p httprouter.Param
 		return
 	}
 
-	var wireMessages []wire.PopMessage
-	for _, entityMessage := range messages {
-		wireMessages = append(wireMessages, wire.PopMessage{
-			Message: wire.Message{
-				ID:       entityMessage.ID,
-				Contents: entityMessage.Contents,
-			},
-			Sender: entityMessage.Sender,
-		})
+	auth.resp(w, transport.PopMessages(messages))
+}
+
+func (h *Handler) fetch(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	auth, err := h.auth(r, p.ByName("recipient"))
+	if err != nil {
+		authError(w, err)
+		return
+	}
+
+	var fetchRequest wire.FetchRequest
+	if len(auth.Contents) > 0 {
+		err = json.Unmarshal(auth.Contents, &fetchRequest)
+		if err != nil {
+			httpError(w, wire.Error{Code: http.StatusBadRequest}, errgo.Mask(err))
+			return
+		}
+	}
+	wait := time.Duration(fetchRequest.Wait) * time.Second
+	if wait > h.maxWait {
+		wait = h.maxWait
 	}
 
-	auth.resp(w, wireMessages)
+	recipient := auth.ClientKey.Encode()
+	var notify <-chan struct{}
+	if wait > 0 && h.notifier != nil {
+		var stop func()
+		// Wait for notification before fetching, so that a message pushed
+		// in between is not missed.
+		notify, stop = h.notifier.Wait(recipient)
+		defer stop()
+	}
+
+	lease, err := h.service.Fetch(recipient, h.leaseTime)
+	if err != nil {
+		httpError(w, wire.Error{Code: http.StatusInternalServerError}, errgo.Mask(err))
+		return
+	}
+	if len(lease.Messages) == 0 && notify != nil {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-notify:
+			lease, err = h.service.Fetch(recipient, h.leaseTime)
+			if err != nil {
+				httpError(w, wire.Error{Code: http.StatusInternalServerError}, errgo.Mask(err))
+				return
+			}
+		case <-timer.C:
+		case <-r.Context().Done():
+			// The client has gone away, so leave any messages for its
+			// next fetch rather than leasing them to no one.
+			return
+		}
+	}
+
+	auth.resp(w, wire.FetchResponse{
+		Messages: transport.PopMessages(lease.Messages),
+		Expires:  lease.Expires,
+	})
 }
 
-func (h *Handler) push(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+func (h *Handler) ack(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 
-	auth, err := h.auth(r, p.ByName("sender"))
+	auth, err := h.auth(r, p.ByName("recipient"))
 	if err != nil {
-		httpError(w, wire.Error{Code: http.StatusBadRequest}, errgo.Mask(err))
+		authError(w, err)
 		return
 	}
 
-	var wireMessages []wire.PushMessage
-	err = json.Unmarshal(auth.Contents, &wireMessages)
+	var ackRequest wire.AckRequest
+	err = json.Unmarshal(auth.Contents, &ackRequest)
 	if err != nil {
 		httpError(w, wire.Error{Code: http.StatusBadRequest}, errgo.Mask(err))
 		return
 	}
 
-	var entityMessages []*storage.AddressedMessage
-	for _, wireMessage := range wireMessages {
-		if wireMessage.Recipient != "" {
-			entityMessages = append(entityMessages, &storage.AddressedMessage{
-				Recipient: wireMessage.Recipient,
-				Sender:    auth.ClientKey.Encode(),
-				Message: storage.Message{
-					ID:       wireMessage.ID,
-					Contents: wireMessage.Contents,
-				},
-			})
-		}
+	err = h.service.Ack(auth.ClientKey.Encode(), ackRequest.IDs)
+	if err != nil {
+		httpError(w, wire.Error{Code: http.StatusInternalServerError}, errgo.Mask(err))
+		return
 	}
 
-	receipts := make(map[string]wire.PushReceipt)
-	for _, entityMessage := range entityMessages {
-		if receipt, ok := receipts[entityMessage.ID]; ok && receipt.OK {
-			continue
-		}
+	auth.resp(w, wire.Error{OK: true})
+}
 
-		err := h.service.Push(entityMessage)
-		if err != nil {
-			receipts[entityMessage.ID] = wire.PushReceipt{
-				ID: entityMessage.ID,
-				OK: false,
-			}
-		} else {
-			receipts[entityMessage.ID] = wire.PushReceipt{
-				ID: entityMessage.ID,
-				OK: true,
-			}
-		}
+func (h *Handler) push(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	auth, err := h.auth(r, p.ByName("sender"))
+	if err != nil {
+		authError(w, err)
+		return
 	}
 
-	var pushReceipts []wire.PushReceipt
-	for _, receipt := range receipts {
-		pushReceipts = append(pushReceipts, receipt)
+	var wireMessages []wire.PushMessage
+	err = json.Unmarshal(auth.Contents, &wireMessages)
+	if err != nil {
+		httpError(w, wire.Error{Code: http.StatusBadRequest}, errgo.Mask(err))
+		return
 	}
 
+	pushReceipts := auth.Push(wireMessages, h.maxTTL, func(msg *storage.AddressedMessage) error {
+		recipient, router := transport.Route(msg.Recipient, h.routerName)
+		msg.Recipient = recipient
+		switch {
+		case router == "":
+			return h.service.Push(msg)
+		case h.relay == nil || h.routerName == "":
+			return errgo.WithCausef(nil, transport.ErrNoRoute, "cannot relay to %q", router)
+		default:
+			return h.relay.Enqueue(router, msg)
+		}
+	})
+
 	auth.resp(w, pushReceipts)
 }
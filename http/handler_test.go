@@ -9,12 +9,18 @@
 package http_test
 
 import (
+	"sync"
 	"testing"
+	"time"
 
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
 
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/session"
 	"github.com/cmars/shadowfax/storage"
 	sftesting "github.com/cmars/shadowfax/testing"
+	"github.com/cmars/shadowfax/transport"
 )
 
 func Test(t *testing.T) { gc.TestingT(t) }
@@ -26,30 +32,183 @@ type mockHandlerSuite struct {
 var _ = gc.Suite(&mockHandlerSuite{&sftesting.HTTPHandlerSuite{}})
 
 type mockService struct {
-	msgs   []*storage.AddressedMessage
-	onPush func(msg *storage.AddressedMessage)
-	onPop  func(msgs []*storage.AddressedMessage)
+	mu       sync.Mutex
+	msgs     []*storage.AddressedMessage
+	pushErr  error
+	notifier *storage.Notifier
+	onPush   func(msg *storage.AddressedMessage)
+	onPop    func(msgs []*storage.AddressedMessage)
 }
 
 func (s *mockService) Push(msg *storage.AddressedMessage) error {
+	s.mu.Lock()
+	if s.pushErr != nil {
+		s.mu.Unlock()
+		return s.pushErr
+	}
 	if s.onPush != nil {
 		s.onPush(msg)
 	}
 	s.msgs = append(s.msgs, msg)
+	s.mu.Unlock()
+	if s.notifier != nil {
+		s.notifier.Notify(msg.Recipient)
+	}
 	return nil
 }
 
-func (s *mockService) Pop(_ string) ([]*storage.AddressedMessage, error) {
-	result := s.msgs
-	s.msgs = nil
+func (s *mockService) Pop(recipient string) ([]*storage.AddressedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result, rest []*storage.AddressedMessage
+	for _, msg := range s.msgs {
+		if msg.Recipient == recipient {
+			result = append(result, msg)
+		} else {
+			rest = append(rest, msg)
+		}
+	}
+	s.msgs = rest
 	if s.onPop != nil {
 		s.onPop(result)
 	}
 	return result, nil
 }
 
+func (s *mockService) Fetch(recipient string, leaseTime time.Duration) (*storage.Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []*storage.AddressedMessage
+	for _, msg := range s.msgs {
+		if msg.Recipient == recipient {
+			result = append(result, msg)
+		}
+	}
+	return &storage.Lease{
+		Messages: result,
+		Expires:  time.Now().Add(leaseTime),
+	}, nil
+}
+
+func (s *mockService) Ack(_ string, ids []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	acked := make(map[string]bool)
+	for _, id := range ids {
+		acked[id] = true
+	}
+	var msgs []*storage.AddressedMessage
+	for _, msg := range s.msgs {
+		if !acked[msg.ID] {
+			msgs = append(msgs, msg)
+		}
+	}
+	s.msgs = msgs
+	return nil
+}
+
+func (s *mockService) Expire() (int, error) {
+	return 0, nil
+}
+
+type mockNonceCache struct {
+	mu   sync.Mutex
+	seen map[sf.Nonce]bool
+}
+
+func (nc *mockNonceCache) Seen(nonce *sf.Nonce, _ time.Time) (bool, error) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	seen := nc.seen[*nonce]
+	nc.seen[*nonce] = true
+	return seen, nil
+}
+
+type mockSessions struct {
+	mu         sync.Mutex
+	prekeys    map[sf.PublicKey]*sf.KeyPair
+	lastResort map[sf.PublicKey]*sf.KeyPair
+	states     map[string][]byte
+}
+
+func newMockSessions() *mockSessions {
+	return &mockSessions{
+		prekeys:    make(map[sf.PublicKey]*sf.KeyPair),
+		lastResort: make(map[sf.PublicKey]*sf.KeyPair),
+		states:     make(map[string][]byte),
+	}
+}
+
+func (ms *mockSessions) PutPrekey(keyPair *sf.KeyPair) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.prekeys[*keyPair.PublicKey] = keyPair
+	return nil
+}
+
+func (ms *mockSessions) PutLastResortPrekey(keyPair *sf.KeyPair) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.lastResort[*keyPair.PublicKey] = keyPair
+	return nil
+}
+
+func (ms *mockSessions) GetPrekey(key *sf.PublicKey) (*sf.KeyPair, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	keyPair, ok := ms.prekeys[*key]
+	if !ok {
+		keyPair, ok = ms.lastResort[*key]
+	}
+	if !ok {
+		return nil, errgo.WithCausef(nil, storage.ErrNotFound, "prekey not found")
+	}
+	return keyPair, nil
+}
+
+func (ms *mockSessions) Get(id string) ([]byte, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	state, ok := ms.states[id]
+	if !ok {
+		return nil, errgo.WithCausef(nil, storage.ErrNotFound, "session not found")
+	}
+	return state, nil
+}
+
+func (ms *mockSessions) Update(id string, f func([]byte) ([]byte, error)) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	state, err := f(ms.states[id])
+	if err != nil {
+		return err
+	}
+	ms.states[id] = state
+	return nil
+}
+
+func (ms *mockSessions) UpdatePrekey(id string, prekey *sf.PublicKey, f func([]byte) ([]byte, error)) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	_, ok := ms.prekeys[*prekey]
+	_, lastResort := ms.lastResort[*prekey]
+	if !ok && !lastResort && ms.states[id] == nil {
+		return errgo.WithCausef(nil, storage.ErrNotFound, "prekey not found")
+	}
+	state, err := f(ms.states[id])
+	if err != nil {
+		return err
+	}
+	ms.states[id] = state
+	delete(ms.prekeys, *prekey)
+	return nil
+}
+
 func (s *mockHandlerSuite) SetUpTest(c *gc.C) {
-	s.HTTPHandlerSuite.SetStorage(&mockService{})
+	notifier := storage.NewNotifier()
+	s.HTTPHandlerSuite.SetStorage(&mockService{notifier: notifier})
+	s.HTTPHandlerSuite.SetNonceCache(&mockNonceCache{seen: make(map[sf.Nonce]bool)})
+	s.HTTPHandlerSuite.SetNotifier(notifier)
 	s.HTTPHandlerSuite.SetUpTest(c)
 }
 
@@ -85,3 +244,71 @@ func (s *mockHandlerSuite) TestPushPop(c *gc.C) {
 	c.Assert(msgs, gc.HasLen, 1)
 	c.Assert(msgs[0].Contents, gc.DeepEquals, []byte("hello world"))
 }
+
+func (s *mockHandlerSuite) TestTTL(c *gc.C) {
+	alice := s.NewClient(c)
+	bob := s.NewClient(c)
+
+	st := s.Storage().(*mockService)
+	var expires []time.Duration
+	st.onPush = func(msg *storage.AddressedMessage) {
+		c.Assert(msg.Received.IsZero(), gc.Equals, false)
+		expires = append(expires, msg.Expires.Sub(msg.Received))
+	}
+
+	for _, ttl := range []time.Duration{0, 500 * time.Millisecond, time.Hour, 30 * 24 * time.Hour} {
+		alice.SetTTL(ttl)
+		err := alice.Push(bob.PublicKey().Encode(), []byte("hello world"))
+		c.Assert(err, gc.IsNil)
+	}
+	c.Assert(expires, gc.DeepEquals, []time.Duration{transport.DefaultMaxTTL, time.Second, time.Hour, transport.DefaultMaxTTL})
+}
+
+func (s *mockHandlerSuite) TestMailboxFull(c *gc.C) {
+	alice := s.NewClient(c)
+	bob := s.NewClient(c)
+
+	st := s.Storage().(*mockService)
+	st.pushErr = errgo.WithCausef(nil, storage.ErrMailboxFull, "too many messages")
+	err := alice.Push(bob.PublicKey().Encode(), []byte("hello world"))
+	c.Assert(errgo.Cause(err), gc.Equals, transport.ErrMailboxFull)
+
+	st.pushErr = errgo.New("something else")
+	err = alice.Push(bob.PublicKey().Encode(), []byte("hello world"))
+	c.Assert(err, gc.ErrorMatches, "not acknowledged")
+}
+
+func (s *mockHandlerSuite) TestSession(c *gc.C) {
+	aliceKey, bobKey := sftesting.MustNewKeyPair(), sftesting.MustNewKeyPair()
+	aliceSessions := session.NewManager(aliceKey, newMockSessions())
+	bobSessions := session.NewManager(bobKey, newMockSessions())
+	alice := s.NewClientWithKey(c, aliceKey)
+	alice.SetSessions(aliceSessions)
+	bob := s.NewClientWithKey(c, bobKey)
+	bob.SetSessions(bobSessions)
+
+	// Without a session, messages are sealed with the long-term keys only.
+	err := alice.Push(bob.PublicKey().Encode(), []byte("hello world"))
+	c.Assert(err, gc.IsNil)
+	msgs, err := bob.Pop()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	c.Assert(msgs[0].Session, gc.Equals, false)
+
+	prekeys, err := bobSessions.NewPrekeys(1)
+	c.Assert(err, gc.IsNil)
+	err = aliceSessions.Start(bob.PublicKey(), prekeys[0])
+	c.Assert(err, gc.IsNil)
+
+	for _, sealed := range []bool{false, true} {
+		alice.SetSealedSender(sealed)
+		err = alice.Push(bob.PublicKey().Encode(), []byte("hello world"))
+		c.Assert(err, gc.IsNil)
+		msgs, err = bob.Pop()
+		c.Assert(err, gc.IsNil)
+		c.Assert(msgs, gc.HasLen, 1)
+		c.Assert(msgs[0].Contents, gc.DeepEquals, []byte("hello world"))
+		c.Assert(msgs[0].Sender, gc.Equals, alice.PublicKey().Encode())
+		c.Assert(msgs[0].Session, gc.Equals, true)
+	}
+}
@@ -0,0 +1,328 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/storage"
+	"github.com/cmars/shadowfax/transport"
+	"github.com/cmars/shadowfax/wire"
+)
+
+// DefaultMaxPrekeys is the most unclaimed prekeys kept for each recipient.
+const DefaultMaxPrekeys = 100
+
+// DefaultClaimInterval is how often a sender may claim one of a recipient's
+// one-time prekeys.
+const DefaultClaimInterval = time.Hour
+
+// ErrNoPrekeys is the cause of a failure to claim a prekey because the
+// recipient has none left, or the server does not publish prekeys.
+var ErrNoPrekeys = errgo.New("no prekeys available")
+
+// prekeyMagic begins the statement signed for each published prekey.
+var prekeyMagic = []byte("\x00sfprekey")
+
+// prekeyStatement is what a recipient signs to publish a prekey.
+func prekeyStatement(prekey *sf.PublicKey) []byte {
+	return append(append([]byte(nil), prekeyMagic...), prekey[:]...)
+}
+
+// signPrekey signs a prekey for publishing with the recipient key pair.
+func signPrekey(keyPair *sf.KeyPair, prekey *sf.PublicKey) (*wire.SignedPrekey, error) {
+	signature, err := keyPair.Sign(prekeyStatement(prekey))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &wire.SignedPrekey{Prekey: prekey.Encode(), Signature: signature}, nil
+}
+
+// openPrekey decodes a prekey published by the recipient, and checks that
+// the recipient signed it.
+func openPrekey(recipient *sf.PublicKey, signed *wire.SignedPrekey) (*storage.Prekey, error) {
+	prekey, err := sf.DecodePublicKey(signed.Prekey)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if !recipient.Verify(prekeyStatement(prekey), signed.Signature) {
+		return nil, errgo.Newf("invalid signature on prekey %q from %q", signed.Prekey, recipient.Encode())
+	}
+	return &storage.Prekey{Key: prekey, Signature: signed.Signature}, nil
+}
+
+// SetPrekeys sets the storage of published prekeys. If not set, the server
+// does not publish prekeys.
+func (h *Handler) SetPrekeys(prekeys storage.Prekeys) {
+	h.prekeys = prekeys
+}
+
+// SetMaxPrekeys sets the most unclaimed prekeys kept for each recipient.
+func (h *Handler) SetMaxPrekeys(maxPrekeys int) {
+	h.maxPrekeys = maxPrekeys
+}
+
+// SetClaimInterval sets how often a sender may claim one of a recipient's
+// one-time prekeys. Until then, the sender is given the recipient's
+// last-resort prekey, so that a sender cannot use up all of a recipient's
+// prekeys. If zero, claims are not limited.
+func (h *Handler) SetClaimInterval(interval time.Duration) {
+	h.claimLimit = newClaimLimit(interval)
+}
+
+func newClaimLimit(interval time.Duration) *transport.RateLimiter {
+	if interval <= 0 {
+		return nil
+	}
+	return transport.NewRateLimiter(1/interval.Seconds(), 1)
+}
+
+// putPrekeys adds a batch of prekeys uploaded by a recipient, responding with
+// how many they have left to be claimed. An empty batch may be uploaded just
+// to learn the count.
+func (h *Handler) putPrekeys(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	auth, err := h.auth(r, p.ByName("recipient"))
+	if err != nil {
+		authError(w, err)
+		return
+	}
+	if h.prekeys == nil {
+		httpError(w, wire.Error{Code: http.StatusNotImplemented}, errgo.New("prekeys not supported"))
+		return
+	}
+
+	var batch wire.PrekeyBatch
+	err = json.Unmarshal(auth.Contents, &batch)
+	if err != nil {
+		httpError(w, wire.Error{Code: http.StatusBadRequest}, errgo.Mask(err))
+		return
+	}
+	var prekeys []*storage.Prekey
+	for i := range batch.Prekeys {
+		prekey, err := openPrekey(auth.ClientKey, &batch.Prekeys[i])
+		if err != nil {
+			httpError(w, wire.Error{Code: http.StatusBadRequest}, errgo.Mask(err))
+			return
+		}
+		prekeys = append(prekeys, prekey)
+	}
+	var lastResort *storage.Prekey
+	if batch.LastResort != nil {
+		lastResort, err = openPrekey(auth.ClientKey, batch.LastResort)
+		if err != nil {
+			httpError(w, wire.Error{Code: http.StatusBadRequest}, errgo.Mask(err))
+			return
+		}
+	}
+
+	recipient := auth.ClientKey.Encode()
+	count, err := h.prekeys.CountPrekeys(recipient)
+	if err != nil {
+		httpError(w, wire.Error{Code: http.StatusInternalServerError}, errgo.Mask(err))
+		return
+	}
+	if h.maxPrekeys > 0 && count+len(prekeys) > h.maxPrekeys {
+		httpError(w, wire.Error{
+			Code:    http.StatusBadRequest,
+			Message: "too many prekeys",
+		}, errgo.Newf("%q has %d prekeys, cannot add %d more", recipient, count, len(prekeys)))
+		return
+	}
+	if len(prekeys) > 0 {
+		err = h.prekeys.PutPrekeys(recipient, prekeys)
+		if err != nil {
+			httpError(w, wire.Error{Code: http.StatusInternalServerError}, errgo.Mask(err))
+			return
+		}
+	}
+	hasLastResort := lastResort != nil
+	if hasLastResort {
+		err = h.prekeys.PutLastResortPrekey(recipient, lastResort)
+	} else {
+		_, err = h.prekeys.LastResortPrekey(recipient)
+		hasLastResort = err == nil
+		if errgo.Cause(err) == storage.ErrNotFound {
+			err = nil
+		}
+	}
+	if err != nil {
+		httpError(w, wire.Error{Code: http.StatusInternalServerError}, errgo.Mask(err))
+		return
+	}
+
+	auth.resp(w, wire.PrekeyCount{
+		Count:      count + len(prekeys),
+		LastResort: hasLastResort,
+	})
+}
+
+// claimPrekey gives one of a recipient's prekeys to a sender. The sender
+// need not be known to the recipient, and may use an ephemeral key. A sender
+// which has claimed a one-time prekey of the recipient too recently, or
+// finds none left, is given the recipient's last-resort prekey.
+func (h *Handler) claimPrekey(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	auth, err := h.auth(r, p.ByName("sender"))
+	if err != nil {
+		authError(w, err)
+		return
+	}
+	if h.prekeys == nil {
+		httpError(w, wire.Error{Code: http.StatusNotImplemented}, errgo.New("prekeys not supported"))
+		return
+	}
+
+	var claimRequest wire.PrekeyClaimRequest
+	err = json.Unmarshal(auth.Contents, &claimRequest)
+	if err != nil {
+		httpError(w, wire.Error{Code: http.StatusBadRequest}, errgo.Mask(err))
+		return
+	}
+	recipientKey, err := sf.DecodePublicKey(claimRequest.Recipient)
+	if err != nil {
+		httpError(w, wire.Error{Code: http.StatusBadRequest}, errgo.Mask(err))
+		return
+	}
+	recipient := recipientKey.Encode()
+
+	var prekey *storage.Prekey
+	if h.allowClaim(auth.ClientKey.Encode() + "/" + recipient) {
+		prekey, err = h.prekeys.ClaimPrekey(recipient)
+		if err != nil && errgo.Cause(err) != storage.ErrNotFound {
+			httpError(w, wire.Error{Code: http.StatusInternalServerError}, errgo.Mask(err))
+			return
+		}
+	}
+	if prekey == nil {
+		prekey, err = h.prekeys.LastResortPrekey(recipient)
+	}
+	if errgo.Cause(err) == storage.ErrNotFound {
+		httpError(w, wire.Error{Code: http.StatusNotFound}, errgo.Mask(err))
+		return
+	} else if err != nil {
+		httpError(w, wire.Error{Code: http.StatusInternalServerError}, errgo.Mask(err))
+		return
+	}
+
+	auth.resp(w, wire.PrekeyClaim{SignedPrekey: wire.SignedPrekey{
+		Prekey:    prekey.Key.Encode(),
+		Signature: prekey.Signature,
+	}})
+}
+
+// allowClaim returns whether a one-time prekey may be claimed for the given
+// sender and recipient pair.
+func (h *Handler) allowClaim(pair string) bool {
+	if h.claimLimit == nil {
+		return true
+	}
+	ok, _ := h.claimLimit.Allow(pair)
+	return ok
+}
+
+// PrekeyCount describes the prekeys a client has published which are left
+// for senders to claim.
+type PrekeyCount struct {
+	// Count is how many one-time prekeys are left.
+	Count int
+
+	// LastResort is whether a last-resort prekey has been published.
+	LastResort bool
+}
+
+// PublishPrekeys uploads one-time prekeys for senders to start sessions
+// with, and replaces the client's last-resort prekey if lastResort is not
+// nil. It returns the prekeys the client has left on the server. Publishing
+// no prekeys just returns the count.
+//
+// Each prekey is signed by the client key, so that senders can check that
+// the server gives them a genuine prekey of the recipient.
+func (c *Client) PublishPrekeys(prekeys []*sf.PublicKey, lastResort *sf.PublicKey) (*PrekeyCount, error) {
+	batch := wire.PrekeyBatch{Prekeys: []wire.SignedPrekey{}}
+	for _, prekey := range prekeys {
+		signed, err := signPrekey(c.keyPair, prekey)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		batch.Prekeys = append(batch.Prekeys, *signed)
+	}
+	if lastResort != nil {
+		var err error
+		batch.LastResort, err = signPrekey(c.keyPair, lastResort)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	reqContents, err := json.Marshal(&batch)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	respContents, err := c.Request("POST", "/prekeys/"+c.keyPair.PublicKey.Encode(), reqContents)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var count wire.PrekeyCount
+	err = json.Unmarshal(respContents, &count)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &PrekeyCount{Count: count.Count, LastResort: count.LastResort}, nil
+}
+
+// ClaimPrekey claims one of a recipient's published prekeys, with which a
+// session may be started. If none are available, the cause of the error
+// returned is ErrNoPrekeys. An error is returned if the prekey was not
+// signed by the recipient.
+func (c *Client) ClaimPrekey(recipient string) (*sf.PublicKey, error) {
+	rcptKey, err := sf.DecodePublicKey(recipient)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	signed, err := c.claimPrekeyAs(c.keyPair, rcptKey)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrNoPrekeys))
+	}
+	prekey, err := openPrekey(rcptKey, signed)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return prekey.Key, nil
+}
+
+// claimPrekeyAs claims a prekey in a request authenticated by the given key
+// pair. Its signature is not checked.
+func (c *Client) claimPrekeyAs(keyPair *sf.KeyPair, rcptKey *sf.PublicKey) (*wire.SignedPrekey, error) {
+	reqContents, err := json.Marshal(&wire.PrekeyClaimRequest{Recipient: rcptKey.Encode()})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	respContents, err := c.requestAs(context.Background(), keyPair, "POST", "/outbox/"+keyPair.PublicKey.Encode()+"/prekey", reqContents)
+	if httpErr, ok := errgo.Cause(err).(*httpClientError); ok &&
+		(httpErr.code == http.StatusNotFound || httpErr.code == http.StatusNotImplemented) {
+		return nil, errgo.WithCausef(err, ErrNoPrekeys, "cannot claim prekey for %q", rcptKey.Encode())
+	} else if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var claim wire.PrekeyClaim
+	err = json.Unmarshal(respContents, &claim)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &claim.SignedPrekey, nil
+}
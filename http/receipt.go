@@ -0,0 +1,63 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/cmars/shadowfax/transport"
+	"github.com/cmars/shadowfax/wire"
+)
+
+// receiptMagic begins the plaintext of every delivery receipt.
+var receiptMagic = []byte("\x00sfrcpt")
+
+// PushDeliveryReceipt tells the sender of messages that they have been
+// delivered. The IDs are those of the messages popped, or the transfer ID of
+// a reassembled payload. Like any other message, the receipt is sealed to the
+// recipient, so the server only learns that a message was sent.
+func (c *Client) PushDeliveryReceipt(recipient string, ids []string) error {
+	receipt, err := json.Marshal(&wire.DeliveryReceipt{
+		IDs:  ids,
+		Time: time.Now(),
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	receipts, err := c.PushMany([]string{recipient}, append(append([]byte(nil), receiptMagic...), receipt...))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(receipts[0].Err, errgo.Is(transport.ErrMailboxFull))
+}
+
+// IsDeliveryReceipt returns whether a message is a delivery receipt, which
+// should be read with ParseDeliveryReceipt. Delivery receipts should not
+// themselves be acknowledged with a receipt.
+func IsDeliveryReceipt(msg *transport.PopMessage) bool {
+	return bytes.HasPrefix(msg.Contents, receiptMagic)
+}
+
+// ParseDeliveryReceipt returns the delivery receipt carried by a message. The
+// messages it acknowledges were delivered to the sender of the receipt.
+func ParseDeliveryReceipt(msg *transport.PopMessage) (*wire.DeliveryReceipt, error) {
+	if !IsDeliveryReceipt(msg) {
+		return nil, errgo.Newf("message %q is not a delivery receipt", msg.ID)
+	}
+	var receipt wire.DeliveryReceipt
+	err := json.Unmarshal(msg.Contents[len(receiptMagic):], &receipt)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid delivery receipt %q", msg.ID)
+	}
+	return &receipt, nil
+}
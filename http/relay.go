@@ -0,0 +1,378 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package http
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/storage"
+	"github.com/cmars/shadowfax/transport"
+	"github.com/cmars/shadowfax/wire"
+)
+
+// DefaultRelayRetry is how long a message which could not be relayed waits
+// before it is retried. The wait doubles after each failed attempt, up to
+// DefaultRelayMaxRetry.
+const DefaultRelayRetry = 30 * time.Second
+
+// DefaultRelayMaxRetry is the longest wait between attempts to relay a
+// message.
+const DefaultRelayMaxRetry = time.Hour
+
+// DefaultRelayMaxPerSender is the most messages each sender may have queued
+// for relay.
+const DefaultRelayMaxPerSender = 1000
+
+// SetRouterName sets the name by which addresses refer to this server as
+// their home router, usually its host[:port]. Messages pushed to an address
+// naming another router are relayed there, and messages relayed by the peers
+// of the relay are accepted. If not set, the server neither relays nor
+// accepts relayed messages.
+func (h *Handler) SetRouterName(name string) {
+	h.routerName = name
+}
+
+// SetRelay sets the relay which forwards messages pushed to addresses whose
+// home router is elsewhere. If not set, such messages are rejected.
+func (h *Handler) SetRelay(relay *Relay) {
+	h.relay = relay
+}
+
+// relayIn stores messages relayed by a peer router for recipients whose
+// mailboxes are kept here. Messages are only relayed once; those for
+// recipients elsewhere are rejected.
+//
+// The relaying router vouches for the sender of each message, so only the
+// configured peers of the relay are trusted to relay. Since messages are
+// sealed from the sender's key, the recipient also detects a false claim
+// when opening it.
+func (h *Handler) relayIn(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	auth, err := h.auth(r, p.ByName("server"))
+	if err != nil {
+		authError(w, err)
+		return
+	}
+	if h.routerName == "" {
+		httpError(w, wire.Error{Code: http.StatusNotImplemented}, errgo.New("relay not supported"))
+		return
+	}
+	if h.relay == nil || !h.relay.isPeer(auth.ClientKey) {
+		httpError(w, wire.Error{Code: http.StatusForbidden}, errgo.Newf("relay from %q is not a peer", auth.ClientKey.Encode()))
+		return
+	}
+
+	var wireMessages []wire.RelayMessage
+	err = json.Unmarshal(auth.Contents, &wireMessages)
+	if err != nil {
+		httpError(w, wire.Error{Code: http.StatusBadRequest}, errgo.Mask(err))
+		return
+	}
+
+	now := time.Now()
+	var receipts []wire.PushReceipt
+	for _, wireMessage := range wireMessages {
+		recipient, router := transport.Route(wireMessage.Recipient, h.routerName)
+		err := errgo.WithCausef(nil, transport.ErrNoRoute, "relayed message for %q", wireMessage.Recipient)
+		if router == "" {
+			err = h.service.Push(&storage.AddressedMessage{
+				Recipient: recipient,
+				Sender:    wireMessage.Sender,
+				Message: storage.Message{
+					ID:       wireMessage.ID,
+					Contents: wireMessage.Contents,
+				},
+				Received: now,
+				Expires:  transport.Expires(now, wireMessage.TTL, h.maxTTL),
+			})
+		}
+		receipts = append(receipts, transport.PushReceipt(wireMessage.ID, err))
+	}
+	auth.resp(w, receipts)
+}
+
+// Relay forwards messages to the home routers of their recipients. Messages
+// are queued until delivered, so that delivery is retried while a router
+// cannot be reached. Requests are authenticated by the key pair of the
+// relaying server, and each router relays a message at most once.
+//
+// Messages are only relayed to, and accepted from, the routers set as peers,
+// unless open relay is enabled.
+type Relay struct {
+	keyPair  *sf.KeyPair
+	queue    storage.RelayQueue
+	client   *http.Client
+	retry    time.Duration
+	maxRetry time.Duration
+	open     bool
+	wake     chan struct{}
+
+	mu         sync.Mutex
+	peers      map[string]*relayPeer
+	discovered map[string]*relayPeer
+}
+
+type relayPeer struct {
+	url string
+	key *sf.PublicKey
+}
+
+// NewRelay returns a new Relay which authenticates as the server key pair,
+// and queues messages in the given storage.
+func NewRelay(keyPair *sf.KeyPair, queue storage.RelayQueue, client *http.Client) *Relay {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Relay{
+		keyPair:    keyPair,
+		queue:      queue,
+		client:     client,
+		retry:      DefaultRelayRetry,
+		maxRetry:   DefaultRelayMaxRetry,
+		wake:       make(chan struct{}, 1),
+		peers:      make(map[string]*relayPeer),
+		discovered: make(map[string]*relayPeer),
+	}
+}
+
+// SetRetry sets how long a message which could not be relayed waits before
+// it is first retried, and the longest wait between later attempts.
+func (r *Relay) SetRetry(retry, maxRetry time.Duration) {
+	r.retry = retry
+	r.maxRetry = maxRetry
+}
+
+// SetPeer sets the URL and public key of a peer router, to which messages
+// are relayed and from which relayed messages are accepted.
+func (r *Relay) SetPeer(router string, serverURL string, serverKey *sf.PublicKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peers[router] = &relayPeer{url: serverURL, key: serverKey}
+}
+
+// SetOpenRelay sets whether messages are relayed to routers which are not
+// peers. The URL of such a router is https://<router>, and its public key is
+// requested from it. Since clients name the router, this lets them make the
+// server connect to any host it can reach; it should only be enabled where
+// that is harmless. Messages relayed by routers which are not peers are
+// still rejected.
+func (r *Relay) SetOpenRelay(open bool) {
+	r.open = open
+}
+
+// isPeer returns whether a key is the public key of a peer router.
+func (r *Relay) isPeer(key *sf.PublicKey) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, peer := range r.peers {
+		if peer.key != nil && *peer.key == *key {
+			return true
+		}
+	}
+	return false
+}
+
+// canRelay returns whether messages may be relayed to a router.
+func (r *Relay) canRelay(router string) bool {
+	if r.open {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.peers[router]
+	return ok
+}
+
+// peer returns the URL and public key of a router.
+func (r *Relay) peer(router string) (*relayPeer, error) {
+	r.mu.Lock()
+	peer, ok := r.peers[router]
+	if !ok {
+		peer, ok = r.discovered[router]
+	}
+	r.mu.Unlock()
+	if ok {
+		return peer, nil
+	}
+	if !r.open {
+		return nil, errgo.WithCausef(nil, transport.ErrNoRoute, "router %q is not a peer", router)
+	}
+	serverURL := "https://" + router
+	key, err := PublicKey(serverURL, r.client)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get public key of router %q", router)
+	}
+	peer = &relayPeer{url: serverURL, key: key}
+	r.mu.Lock()
+	r.discovered[router] = peer
+	r.mu.Unlock()
+	return peer, nil
+}
+
+// Enqueue queues a message to be relayed to a router. If the router is not a
+// peer and open relay is not enabled, the cause of the error returned is
+// transport.ErrNoRoute. If the sender has too many messages queued, it is
+// storage.ErrMailboxFull.
+func (r *Relay) Enqueue(router string, msg *storage.AddressedMessage) error {
+	if !r.canRelay(router) {
+		return errgo.WithCausef(nil, transport.ErrNoRoute, "router %q is not a peer", router)
+	}
+	err := r.queue.Enqueue(router, msg)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(storage.ErrMailboxFull))
+	}
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run relays queued messages as they become due, until stop is closed.
+func (r *Relay) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(r.retry)
+	defer ticker.Stop()
+	for {
+		err := r.Flush()
+		if err != nil {
+			logError(err)
+		}
+		select {
+		case <-r.wake:
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Flush makes an attempt to relay each queued message which is due. Expired
+// messages are discarded, as are those refused by their router. Messages
+// which cannot be delivered, or whose recipient's mailbox is full, are
+// retried later; only a failure to update the queue is returned.
+func (r *Relay) Flush() error {
+	now := time.Now()
+	msgs, err := r.queue.Due(now)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var routers []string
+	batches := make(map[string][]*storage.RelayMessage)
+	for _, msg := range msgs {
+		if !msg.Expires.IsZero() && !msg.Expires.After(now) {
+			err = r.queue.Remove(msg.Router, []string{msg.ID})
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			continue
+		}
+		if _, ok := batches[msg.Router]; !ok {
+			routers = append(routers, msg.Router)
+		}
+		batches[msg.Router] = append(batches[msg.Router], msg)
+	}
+
+	for _, router := range routers {
+		batch := batches[router]
+		receipts, err := r.deliver(router, batch)
+		if err != nil {
+			log.Printf("cannot relay %d messages to %q: %v", len(batch), router, err)
+		}
+		var done []string
+		for _, msg := range batch {
+			receipt, ok := receipts[msg.ID]
+			switch {
+			case ok && receipt.OK:
+				done = append(done, msg.ID)
+			case ok && receipt.Failure != wire.PushMailboxFull:
+				// Refused by the router, so another attempt would fare no
+				// better.
+				log.Printf("router %q refused message %s: %s", router, msg.ID, receipt.Failure)
+				done = append(done, msg.ID)
+			default:
+				err = r.queue.Retry(router, []string{msg.ID}, now.Add(r.backoff(msg.Attempts)))
+				if err != nil {
+					return errgo.Mask(err)
+				}
+			}
+		}
+		err = r.queue.Remove(router, done)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// backoff returns how long to wait before the next attempt to relay a
+// message, given how many attempts have already failed.
+func (r *Relay) backoff(attempts int) time.Duration {
+	wait := r.retry
+	for i := 0; i < attempts && wait < r.maxRetry; i++ {
+		wait *= 2
+	}
+	if wait > r.maxRetry {
+		wait = r.maxRetry
+	}
+	return wait
+}
+
+// deliver relays a batch of messages to a router, returning the receipts by
+// message ID.
+func (r *Relay) deliver(router string, batch []*storage.RelayMessage) (map[string]wire.PushReceipt, error) {
+	peer, err := r.peer(router)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	now := time.Now()
+	var wireMessages []wire.RelayMessage
+	for _, msg := range batch {
+		var ttl int64
+		if !msg.Expires.IsZero() {
+			ttl = int64(msg.Expires.Sub(now)/time.Second) + 1
+		}
+		wireMessages = append(wireMessages, wire.RelayMessage{
+			Message: wire.Message{
+				ID:       msg.ID,
+				Contents: msg.Contents,
+			},
+			Recipient: msg.Recipient,
+			Sender:    msg.Sender,
+			TTL:       ttl,
+		})
+	}
+	reqContents, err := json.Marshal(&wireMessages)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	client := NewClient(r.keyPair, peer.url, peer.key, r.client)
+	respContents, err := client.Request("POST", "/relay/"+r.keyPair.PublicKey.Encode(), reqContents)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var wireReceipts []wire.PushReceipt
+	err = json.Unmarshal(respContents, &wireReceipts)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	receipts := make(map[string]wire.PushReceipt)
+	for _, receipt := range wireReceipts {
+		receipts[receipt.ID] = receipt
+	}
+	return receipts, nil
+}
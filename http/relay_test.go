@@ -0,0 +1,323 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package http_test
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	sfhttp "github.com/cmars/shadowfax/http"
+	"github.com/cmars/shadowfax/storage"
+	"github.com/cmars/shadowfax/storage/memory"
+	sftesting "github.com/cmars/shadowfax/testing"
+	"github.com/cmars/shadowfax/transport"
+	"github.com/cmars/shadowfax/wire"
+)
+
+type relaySuite struct {
+	a, b *testRouter
+}
+
+var _ = gc.Suite(&relaySuite{})
+
+// testRouter is a server which relays messages to its peers.
+type testRouter struct {
+	name    string
+	keyPair *sf.KeyPair
+	queue   storage.RelayQueue
+	relay   *sfhttp.Relay
+	service limitedService
+	handler *sfhttp.Handler
+	server  *httptest.Server
+}
+
+// limitedService is a service whose mailboxes may be limited.
+type limitedService interface {
+	storage.Service
+	SetLimits(maxMessages int, maxBytes int64)
+}
+
+func newTestRouter(name string) *testRouter {
+	keyPair := sftesting.MustNewKeyPair()
+	queue := memory.NewRelayQueue()
+	relay := sfhttp.NewRelay(keyPair, queue, nil)
+	service := memory.NewService()
+	handler := sfhttp.NewHandler(keyPair, service)
+	handler.SetRouterName(name)
+	handler.SetRelay(relay)
+	r := httprouter.New()
+	handler.Register(r)
+	return &testRouter{
+		name:    name,
+		keyPair: keyPair,
+		queue:   queue,
+		relay:   relay,
+		service: service,
+		handler: handler,
+		server:  httptest.NewServer(r),
+	}
+}
+
+func (r *testRouter) newClient(kp *sf.KeyPair) *sfhttp.Client {
+	return sfhttp.NewClient(kp, r.server.URL, r.keyPair.PublicKey, nil)
+}
+
+func (s *relaySuite) SetUpTest(c *gc.C) {
+	s.a = newTestRouter("a.example.com")
+	s.b = newTestRouter("b.example.com")
+	s.a.relay.SetPeer(s.b.name, s.b.server.URL, s.b.keyPair.PublicKey)
+	s.b.relay.SetPeer(s.a.name, s.a.server.URL, s.a.keyPair.PublicKey)
+}
+
+func (s *relaySuite) TearDownTest(c *gc.C) {
+	s.a.server.Close()
+	s.b.server.Close()
+}
+
+func (s *relaySuite) TestRelay(c *gc.C) {
+	aliceKey, bobKey := sftesting.MustNewKeyPair(), sftesting.MustNewKeyPair()
+	alice, bob := s.a.newClient(aliceKey), s.b.newClient(bobKey)
+	bobAddr := &sf.Address{Key: bobKey.PublicKey, Router: s.b.name}
+	aliceAddr := &sf.Address{Key: aliceKey.PublicKey, Router: s.a.name}
+
+	err := alice.Push(bobAddr.Encode(), []byte("hello bob"))
+	c.Assert(err, gc.IsNil)
+
+	// The message is held by Alice's router until relayed.
+	msgs, err := bob.Pop()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 0)
+	c.Assert(s.a.relay.Flush(), gc.IsNil)
+	msgs, err = bob.Pop()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	c.Assert(msgs[0].Sender, gc.Equals, aliceKey.PublicKey.Encode())
+	c.Assert(string(msgs[0].Contents), gc.Equals, "hello bob")
+	due, err := s.a.queue.Due(time.Now())
+	c.Assert(err, gc.IsNil)
+	c.Assert(due, gc.HasLen, 0)
+
+	// Bob replies through his own router.
+	err = bob.Push(aliceAddr.Encode(), []byte("hello alice"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.b.relay.Flush(), gc.IsNil)
+	msgs, err = alice.Pop()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	c.Assert(string(msgs[0].Contents), gc.Equals, "hello alice")
+
+	// Addresses naming the router itself are kept locally.
+	err = alice.Push(aliceAddr.Encode(), []byte("note to self"))
+	c.Assert(err, gc.IsNil)
+	msgs, err = alice.Pop()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	c.Assert(string(msgs[0].Contents), gc.Equals, "note to self")
+}
+
+func (s *relaySuite) TestRetry(c *gc.C) {
+	s.a.relay.SetRetry(50*time.Millisecond, 150*time.Millisecond)
+	bobKey := sftesting.MustNewKeyPair()
+	alice := s.a.newClient(sftesting.MustNewKeyPair())
+	bobAddr := &sf.Address{Key: bobKey.PublicKey, Router: s.b.name}
+	s.b.server.Close()
+
+	err := alice.Push(bobAddr.Encode(), []byte("hello bob"))
+	c.Assert(err, gc.IsNil)
+
+	// Attempts back off, up to the maximum wait.
+	for i, wait := range []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 150 * time.Millisecond} {
+		before := time.Now()
+		c.Assert(s.a.relay.Flush(), gc.IsNil)
+		after := time.Now()
+		due, err := s.a.queue.Due(time.Now().Add(time.Second))
+		c.Assert(err, gc.IsNil)
+		c.Assert(due, gc.HasLen, 1)
+		c.Assert(due[0].Attempts, gc.Equals, i+1)
+		c.Assert(due[0].Next.Before(before.Add(wait)), gc.Equals, false)
+		c.Assert(due[0].Next.After(after.Add(wait)), gc.Equals, false)
+		time.Sleep(due[0].Next.Sub(time.Now()))
+	}
+}
+
+func (s *relaySuite) TestExpired(c *gc.C) {
+	bobKey := sftesting.MustNewKeyPair()
+	msg := &storage.AddressedMessage{
+		Message: storage.Message{
+			ID:       sftesting.MustNewNonce().Encode(),
+			Contents: []byte("hello bob"),
+		},
+		Recipient: bobKey.PublicKey.Encode(),
+		Sender:    sftesting.MustNewKeyPair().PublicKey.Encode(),
+		Received:  time.Now().Add(-time.Hour),
+		Expires:   time.Now().Add(-time.Minute),
+	}
+	c.Assert(s.a.relay.Enqueue(s.b.name, msg), gc.IsNil)
+	c.Assert(s.a.relay.Flush(), gc.IsNil)
+	due, err := s.a.queue.Due(time.Now().Add(time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(due, gc.HasLen, 0)
+	msgs, err := s.b.newClient(bobKey).Pop()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 0)
+}
+
+func (s *relaySuite) TestNoRoute(c *gc.C) {
+	aliceKey, bobKey := sftesting.MustNewKeyPair(), sftesting.MustNewKeyPair()
+	bobAddr := &sf.Address{Key: bobKey.PublicKey, Router: "c.example.com"}
+
+	// A router which does not relay rejects messages for other routers.
+	s.a.handler.SetRelay(nil)
+	err := s.a.newClient(aliceKey).Push(bobAddr.Encode(), []byte("hello bob"))
+	c.Assert(err, gc.ErrorMatches, `server does not relay to ".*"`)
+
+	// Relayed messages are not relayed again.
+	s.a.handler.SetRelay(s.a.relay)
+	s.b.relay.SetPeer("a.example.com", s.a.server.URL, s.a.keyPair.PublicKey)
+	msg := &storage.AddressedMessage{
+		Message: storage.Message{
+			ID:       sftesting.MustNewNonce().Encode(),
+			Contents: []byte("hello bob"),
+		},
+		Recipient: bobAddr.Encode(),
+		Sender:    aliceKey.PublicKey.Encode(),
+	}
+	c.Assert(s.b.relay.Enqueue("a.example.com", msg), gc.IsNil)
+	c.Assert(s.b.relay.Flush(), gc.IsNil)
+
+	// The refused message is not retried.
+	due, err := s.b.queue.Due(time.Now().Add(time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(due, gc.HasLen, 0)
+	due, err = s.a.queue.Due(time.Now().Add(time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(due, gc.HasLen, 0)
+}
+
+func (s *relaySuite) TestMailboxFull(c *gc.C) {
+	s.a.relay.SetRetry(time.Millisecond, time.Millisecond)
+	s.b.service.SetLimits(1, 0)
+	bobKey := sftesting.MustNewKeyPair()
+	bob := s.b.newClient(bobKey)
+	alice := s.a.newClient(sftesting.MustNewKeyPair())
+	bobAddr := &sf.Address{Key: bobKey.PublicKey, Router: s.b.name}
+
+	for _, text := range []string{"one", "two"} {
+		err := alice.Push(bobAddr.Encode(), []byte(text))
+		c.Assert(err, gc.IsNil)
+	}
+	c.Assert(s.a.relay.Flush(), gc.IsNil)
+
+	// The message which did not fit is retried.
+	due, err := s.a.queue.Due(time.Now().Add(time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(due, gc.HasLen, 1)
+	c.Assert(due[0].Attempts, gc.Equals, 1)
+
+	msgs, err := bob.Pop()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(s.a.relay.Flush(), gc.IsNil)
+	msgs, err = bob.Pop()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	due, err = s.a.queue.Due(time.Now().Add(time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(due, gc.HasLen, 0)
+}
+
+func (s *relaySuite) TestNotPeer(c *gc.C) {
+	bobKey := sftesting.MustNewKeyPair()
+	bob := s.b.newClient(bobKey)
+	bobAddr := &sf.Address{Key: bobKey.PublicKey, Router: s.b.name}
+
+	// Router c knows b, but b does not know c.
+	rc := newTestRouter("c.example.com")
+	defer rc.server.Close()
+	rc.relay.SetPeer(s.b.name, s.b.server.URL, s.b.keyPair.PublicKey)
+	err := rc.newClient(sftesting.MustNewKeyPair()).Push(bobAddr.Encode(), []byte("hello bob"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(rc.relay.Flush(), gc.IsNil)
+	due, err := rc.queue.Due(time.Now().Add(time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(due, gc.HasLen, 1)
+	c.Assert(due[0].Attempts, gc.Equals, 1)
+	msgs, err := bob.Pop()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 0)
+
+	// Relayed messages are refused from any key but a peer's.
+	reqContents, err := json.Marshal([]wire.RelayMessage{{
+		Message: wire.Message{
+			ID:       sftesting.MustNewNonce().Encode(),
+			Contents: []byte("hello bob"),
+		},
+		Recipient: bobKey.PublicKey.Encode(),
+		Sender:    sftesting.MustNewKeyPair().PublicKey.Encode(),
+	}})
+	c.Assert(err, gc.IsNil)
+	mallory := sftesting.MustNewKeyPair()
+	_, err = s.b.newClient(mallory).Request("POST", "/relay/"+mallory.PublicKey.Encode(), reqContents)
+	c.Assert(err, gc.ErrorMatches, `server response: 403 Forbidden.*`)
+	msgs, err = bob.Pop()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 0)
+}
+
+func (s *relaySuite) TestOpenRelay(c *gc.C) {
+	alice := s.a.newClient(sftesting.MustNewKeyPair())
+	bobAddr := &sf.Address{Key: sftesting.MustNewKeyPair().PublicKey, Router: "127.0.0.1:1"}
+
+	// Only peers are relayed to by default.
+	err := alice.Push(bobAddr.Encode(), []byte("hello bob"))
+	c.Assert(err, gc.ErrorMatches, `server does not relay to ".*"`)
+	due, err := s.a.queue.Due(time.Now())
+	c.Assert(err, gc.IsNil)
+	c.Assert(due, gc.HasLen, 0)
+
+	// An open relay queues messages for any router.
+	s.a.relay.SetOpenRelay(true)
+	err = alice.Push(bobAddr.Encode(), []byte("hello bob"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.a.relay.Flush(), gc.IsNil)
+	due, err = s.a.queue.Due(time.Now().Add(time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(due, gc.HasLen, 1)
+	c.Assert(due[0].Router, gc.Equals, "127.0.0.1:1")
+	c.Assert(due[0].Attempts, gc.Equals, 1)
+}
+
+func (s *relaySuite) TestMaxPerSender(c *gc.C) {
+	s.a.queue.SetMaxPerSender(2)
+	alice := s.a.newClient(sftesting.MustNewKeyPair())
+	bobAddr := &sf.Address{Key: sftesting.MustNewKeyPair().PublicKey, Router: s.b.name}
+
+	for i := 0; i < 2; i++ {
+		err := alice.Push(bobAddr.Encode(), []byte("hello bob"))
+		c.Assert(err, gc.IsNil)
+	}
+	err := alice.Push(bobAddr.Encode(), []byte("hello bob"))
+	c.Assert(errgo.Cause(err), gc.Equals, transport.ErrMailboxFull)
+
+	// Other senders are not affected.
+	err = s.a.newClient(sftesting.MustNewKeyPair()).Push(bobAddr.Encode(), []byte("hello bob"))
+	c.Assert(err, gc.IsNil)
+
+	// Once relayed, the sender may queue more.
+	c.Assert(s.a.relay.Flush(), gc.IsNil)
+	err = alice.Push(bobAddr.Encode(), []byte("hello bob"))
+	c.Assert(err, gc.IsNil)
+}
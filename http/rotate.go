@@ -0,0 +1,104 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/transport"
+	"github.com/cmars/shadowfax/wire"
+)
+
+// rotationMagic begins the plaintext of every key rotation message.
+var rotationMagic = []byte("\x00sfrekey")
+
+// rotationStatement is what the new key proves to the recipient: that it
+// succeeds the old key.
+func rotationStatement(oldKey, newKey *sf.PublicKey) []byte {
+	statement := append([]byte(nil), rotationMagic...)
+	statement = append(statement, oldKey[:]...)
+	return append(statement, newKey[:]...)
+}
+
+// PushRotation announces to several recipients that the client has moved to
+// a new key pair. The announcement is sent from the client key, which
+// authenticates it, and carries proof sealed from the new key to each
+// recipient, so that a key cannot be claimed without its private key.
+func (c *Client) PushRotation(newKeyPair *sf.KeyPair, recipients []string) ([]PushReceipt, error) {
+	receipts := make([]PushReceipt, len(recipients))
+	for i, recipient := range recipients {
+		rcptAddr, err := sf.ParseAddress(recipient)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		rcptKey := rcptAddr.Key
+		nonce, err := sf.NewNonce()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		rotation, err := json.Marshal(&wire.KeyRotation{
+			NewKey: newKeyPair.PublicKey.Encode(),
+			Time:   time.Now(),
+			Nonce:  nonce.Encode(),
+			Proof: box.Seal(nil, rotationStatement(c.keyPair.PublicKey, newKeyPair.PublicKey),
+				(*[24]byte)(nonce), (*[32]byte)(rcptKey), (*[32]byte)(newKeyPair.PrivateKey)),
+		})
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		rcptReceipts, err := c.PushMany([]string{recipient}, append(append([]byte(nil), rotationMagic...), rotation...))
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		receipts[i] = rcptReceipts[0]
+	}
+	return receipts, nil
+}
+
+// IsRotation returns whether a message announces a key rotation, which
+// should be verified with OpenRotation.
+func IsRotation(msg *transport.PopMessage) bool {
+	return bytes.HasPrefix(msg.Contents, rotationMagic)
+}
+
+// OpenRotation verifies a key rotation announced by the sender of a message,
+// returning the sender's new key.
+func (c *Client) OpenRotation(msg *transport.PopMessage) (*sf.PublicKey, error) {
+	if !IsRotation(msg) {
+		return nil, errgo.Newf("message %q is not a key rotation", msg.ID)
+	}
+	oldKey, err := sf.DecodePublicKey(msg.Sender)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var rotation wire.KeyRotation
+	err = json.Unmarshal(msg.Contents[len(rotationMagic):], &rotation)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid key rotation %q", msg.ID)
+	}
+	newKey, err := sf.DecodePublicKey(rotation.NewKey)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	nonce, err := sf.DecodeNonce(rotation.Nonce)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	statement, ok := box.Open(nil, rotation.Proof, (*[24]byte)(nonce), (*[32]byte)(newKey), (*[32]byte)(c.keyPair.PrivateKey))
+	if !ok || !bytes.Equal(statement, rotationStatement(oldKey, newKey)) {
+		return nil, errgo.Newf("key rotation %q from %q failed verification", msg.ID, msg.Sender)
+	}
+	return newKey, nil
+}
@@ -0,0 +1,326 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package http
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/net/websocket"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/tomb.v2"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/transport"
+	"github.com/cmars/shadowfax/wire"
+)
+
+// streamPollInterval is how often a stream checks for messages when the
+// handler has no notifier.
+const streamPollInterval = 5 * time.Second
+
+// stream delivers messages to a recipient over a WebSocket connection as they
+// arrive.
+//
+// The first frame sent by the client is a request message, authenticated in
+// the same way as any other request. The server then sends each batch of
+// newly leased messages as a sealed wire.FetchResponse, and the client
+// acknowledges them with sealed wire.AckRequest frames. Messages which are not
+// acknowledged are sent again once their lease expires.
+func (h *Handler) stream(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	err := h.allowAddr(r)
+	if err != nil {
+		authError(w, err)
+		return
+	}
+
+	client := p.ByName("recipient")
+	server := websocket.Server{
+		// Clients are authenticated by their public key, not their origin.
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			err := h.streamConn(ws, client)
+			if err != nil {
+				logError(err)
+			}
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+func (h *Handler) streamConn(ws *websocket.Conn, client string) error {
+	defer ws.Close()
+
+	var msg wire.Message
+	err := websocket.JSON.Receive(ws, &msg)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	auth, err := h.authMessage(&msg, client)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if auth.Version != wire.Version2 {
+		return errgo.Newf("protocol version %d not supported by stream", auth.Version)
+	}
+	recipient := auth.ClientKey.Encode()
+
+	acksDone := make(chan error, 1)
+	go func() {
+		acksDone <- h.streamAcks(ws, client)
+	}()
+
+	interval := h.leaseTime
+	if h.notifier == nil && interval > streamPollInterval {
+		interval = streamPollInterval
+	}
+	for {
+		var notify <-chan struct{}
+		stop := func() {}
+		if h.notifier != nil {
+			// Wait for notification before fetching, so that a message pushed
+			// in between is not missed.
+			notify, stop = h.notifier.Wait(recipient)
+		}
+
+		err := h.streamLease(ws, auth)
+		if err != nil {
+			stop()
+			return errgo.Mask(err)
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-notify:
+		case <-timer.C:
+		case err := <-acksDone:
+			stop()
+			timer.Stop()
+			return errgo.Mask(err)
+		}
+		stop()
+		timer.Stop()
+	}
+}
+
+// streamLease leases messages for the stream recipient and sends them, if
+// there are any.
+func (h *Handler) streamLease(ws *websocket.Conn, auth *authRequest) error {
+	lease, err := h.service.Fetch(auth.ClientKey.Encode(), h.leaseTime)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if len(lease.Messages) == 0 {
+		return nil
+	}
+	out, err := auth.seal(wire.FetchResponse{
+		Messages: transport.PopMessages(lease.Messages),
+		Expires:  lease.Expires,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(websocket.Message.Send(ws, string(out)))
+}
+
+// streamAcks receives acknowledgements from the stream client until the
+// connection is closed.
+func (h *Handler) streamAcks(ws *websocket.Conn, client string) error {
+	for {
+		var msg wire.Message
+		err := websocket.JSON.Receive(ws, &msg)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errgo.Mask(err)
+		}
+
+		auth, err := h.authMessage(&msg, client)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		var ackRequest wire.AckRequest
+		err = json.Unmarshal(auth.Contents, &ackRequest)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		err = h.service.Ack(auth.ClientKey.Encode(), ackRequest.IDs)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+}
+
+// Stream receives messages addressed to a client as they arrive, over a
+// WebSocket connection to the server.
+type Stream struct {
+	client   *Client
+	conn     *websocket.Conn
+	nonce    *sf.Nonce
+	messages chan *transport.PopMessage
+	t        tomb.Tomb
+
+	mu      sync.Mutex
+	openErr error
+}
+
+// Stream opens a stream of messages addressed to the client. Each message is
+// acknowledged once it has been received from the Messages channel.
+func (c *Client) Stream() (*Stream, error) {
+	u, err := url.Parse(c.serverURL)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+		return nil, errgo.Newf("unsupported server URL scheme %q", u.Scheme)
+	}
+	config, err := websocket.NewConfig(u.String()+"/stream/"+c.keyPair.PublicKey.Encode(), c.serverURL)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if transport, ok := c.client.Transport.(*http.Transport); ok {
+		config.TlsConfig = transport.TLSClientConfig
+	}
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	reqMessage, nonce, err := transport.SealRequest(c.keyPair, c.serverKey, nil)
+	if err != nil {
+		conn.Close()
+		return nil, errgo.Mask(err)
+	}
+	err = websocket.JSON.Send(conn, reqMessage)
+	if err != nil {
+		conn.Close()
+		return nil, errgo.Mask(err)
+	}
+
+	s := &Stream{
+		client:   c,
+		conn:     conn,
+		nonce:    nonce,
+		messages: make(chan *transport.PopMessage),
+	}
+	s.t.Go(s.loop)
+	return s, nil
+}
+
+// Messages returns the channel on which messages are delivered. The channel
+// is closed when the stream ends.
+func (s *Stream) Messages() <-chan *transport.PopMessage {
+	return s.messages
+}
+
+// Err returns the error which ended the stream, if any. Otherwise it returns
+// the *transport.OpenError of the last messages received which could not be
+// opened. They never will be, so they are acknowledged rather than delivered.
+func (s *Stream) Err() error {
+	err := s.t.Err()
+	if err != nil && err != tomb.ErrStillAlive {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.openErr
+}
+
+// Close closes the stream. Messages already delivered are acknowledged before
+// the connection is closed; those received but not yet delivered are sent
+// again by the server once their lease expires.
+func (s *Stream) Close() error {
+	s.t.Kill(nil)
+	// Interrupt a pending receive, but leave the connection open for any
+	// acknowledgement in progress.
+	s.conn.SetReadDeadline(time.Now())
+	err := s.t.Wait()
+	s.conn.Close()
+	return err
+}
+
+func (s *Stream) loop() error {
+	defer close(s.messages)
+	for {
+		var frame string
+		err := websocket.Message.Receive(s.conn, &frame)
+		if err != nil {
+			select {
+			case <-s.t.Dying():
+				return nil
+			default:
+			}
+			return errgo.Mask(err)
+		}
+
+		respContents, err := s.client.openResponse(s.client.keyPair, []byte(frame), s.nonce)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		var fetchResp wire.FetchResponse
+		err = json.Unmarshal(respContents, &fetchResp)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		popMessages, err := s.client.openMessages(fetchResp.Messages)
+		var ids []string
+		if openErr, ok := err.(*transport.OpenError); ok {
+			// Messages which cannot be opened are acknowledged along with
+			// those delivered, so that they are not streamed again.
+			ids = append(ids, openErr.IDs...)
+			s.mu.Lock()
+			s.openErr = openErr
+			s.mu.Unlock()
+		} else if err != nil {
+			return errgo.Mask(err)
+		}
+		for _, msg := range popMessages {
+			select {
+			case s.messages <- msg:
+				ids = append(ids, msg.ID)
+			case <-s.t.Dying():
+				// Acknowledge the messages already delivered before the
+				// stream was closed.
+				if len(ids) == 0 {
+					return nil
+				}
+				return errgo.Mask(s.ack(ids))
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		err = s.ack(ids)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+}
+
+func (s *Stream) ack(ids []string) error {
+	reqContents, err := json.Marshal(&wire.AckRequest{IDs: ids})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	reqMessage, _, err := transport.SealRequest(s.client.keyPair, s.client.serverKey, reqContents)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(websocket.JSON.Send(s.conn, reqMessage))
+}
@@ -42,14 +42,26 @@ func NewKeyPair() (KeyPair, error) {
 	return KeyPair{(*PublicKey)(pub), (*PrivateKey)(priv)}, nil
 }
 
+// minPublicKeyLen is the length of the shortest encoded public key accepted.
+// Random keys are shorter with negligible probability, so shorter strings
+// are taken to be mistakes rather than keys.
+const minPublicKeyLen = 40
+
 // DecodePublicKey decodes a public key from its Base58 string representation.
+// The string must be the exact encoding of a key, as returned by Encode.
 func DecodePublicKey(s string) (*PublicKey, error) {
+	if len(s) < minPublicKeyLen {
+		return nil, errgo.Newf("public key %q too short", s)
+	}
 	var publicKey PublicKey
-	buf, err := basen.Base58.DecodeString(s)
+	buf, err := basen.Base58.DecodeStringN(s, 32)
 	if err != nil {
-		return nil, err
+		return nil, errgo.Notef(err, "invalid public key %q", s)
 	}
 	copy(publicKey[:], buf)
+	if publicKey.Encode() != s {
+		return nil, errgo.Newf("invalid public key %q", s)
+	}
 	return &publicKey, nil
 }
 
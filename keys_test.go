@@ -0,0 +1,36 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package shadowfax_test
+
+import (
+	gc "gopkg.in/check.v1"
+
+	sf "github.com/cmars/shadowfax"
+	sftesting "github.com/cmars/shadowfax/testing"
+)
+
+type keysSuite struct{}
+
+var _ = gc.Suite(&keysSuite{})
+
+func (s *keysSuite) TestDecodeLeadingZero(c *gc.C) {
+	// Leading zero bytes are dropped by the encoding, and restored when
+	// decoded.
+	key := sftesting.MustNewKeyPair().PublicKey
+	key[0] = 0
+	decodedKey, err := sf.DecodePublicKey(key.Encode())
+	c.Assert(err, gc.IsNil)
+	c.Assert(decodedKey, gc.DeepEquals, key)
+
+	nonce := sftesting.MustNewNonce()
+	nonce[0], nonce[1] = 0, 0
+	decodedNonce, err := sf.DecodeNonce(nonce.Encode())
+	c.Assert(err, gc.IsNil)
+	c.Assert(decodedNonce, gc.DeepEquals, nonce)
+}
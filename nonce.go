@@ -22,7 +22,7 @@ type Nonce [24]byte
 // DecodeNonce decodes a nonce from its Base58 string representation.
 func DecodeNonce(s string) (*Nonce, error) {
 	var nonce Nonce
-	buf, err := basen.Base58.DecodeString(s)
+	buf, err := basen.Base58.DecodeStringN(s, 24)
 	if err != nil {
 		return nil, err
 	}
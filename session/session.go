@@ -0,0 +1,344 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+// Package session provides forward-secret sessions between shadowfax
+// addresses, layered inside the messages sealed with their long-term keys.
+//
+// A sender starts a session with one of the recipient's one-time prekeys and
+// an ephemeral key of its own. Both sides derive a root key from the
+// Diffie-Hellman agreements between these and the long-term keys, and then
+// advance a symmetric hash ratchet with each message. Prekey, ephemeral and
+// used message keys are discarded, so messages captured from the router stay
+// protected even if a long-term key is later compromised.
+//
+// When no one-time prekey is available, a session may be started with the
+// recipient's last-resort prekey instead. It is kept for every session it
+// starts, so those sessions are not protected from its later compromise.
+//
+// Sessions are one-way; a reply is sent in a session started by the
+// recipient with one of the sender's prekeys.
+package session
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/secretbox"
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/storage"
+)
+
+// ErrNoSession is the cause of a failure to seal a message to a peer for
+// which no session has been started, or to open a message from a session
+// which is unknown and cannot be established.
+var ErrNoSession = errgo.New("no session")
+
+// MaxSkip is the most message keys kept for messages which have not yet
+// arrived from a session, so that they may be opened out of order.
+const MaxSkip = 1000
+
+// magic begins every message sealed in a session.
+var magic = []byte("\x00sfsess1")
+
+// headerLen is the length of the magic, ephemeral key, prekey, message index
+// and nonce which precede the sealed contents.
+const headerLen = 8 + 32 + 32 + 4 + 24
+
+// rootLabel keys the derivation of a session root key.
+var rootLabel = []byte("shadowfax session root v1")
+
+// Manager seals and opens messages in sessions between a local key pair and
+// its peers, keeping their state in a storage.Sessions.
+type Manager struct {
+	keyPair *sf.KeyPair
+	store   storage.Sessions
+}
+
+// NewManager returns a new Manager for the local key pair.
+func NewManager(keyPair *sf.KeyPair, store storage.Sessions) *Manager {
+	return &Manager{keyPair: keyPair, store: store}
+}
+
+// NewPrekeys generates n one-time prekeys and stores their private keys. The
+// public keys returned should be published for peers to start sessions with.
+func (m *Manager) NewPrekeys(n int) ([]*sf.PublicKey, error) {
+	var prekeys []*sf.PublicKey
+	for i := 0; i < n; i++ {
+		keyPair, err := sf.NewKeyPair()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		err = m.store.PutPrekey(&keyPair)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		prekeys = append(prekeys, keyPair.PublicKey)
+	}
+	return prekeys, nil
+}
+
+// NewLastResortPrekey generates a last-resort prekey and stores its private
+// key. Unlike a one-time prekey, it may start any number of sessions, so it
+// should only be published for peers to use when no one-time prekey is
+// available.
+func (m *Manager) NewLastResortPrekey() (*sf.PublicKey, error) {
+	keyPair, err := sf.NewKeyPair()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	err = m.store.PutLastResortPrekey(&keyPair)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return keyPair.PublicKey, nil
+}
+
+type sendState struct {
+	Ephemeral []byte `json:"ephemeral"`
+	Prekey    []byte `json:"prekey"`
+	ChainKey  []byte `json:"chain-key"`
+	Index     uint32 `json:"index"`
+}
+
+type recvState struct {
+	ChainKey []byte            `json:"chain-key"`
+	Index    uint32            `json:"index"`
+	Skipped  map[uint32][]byte `json:"skipped,omitempty"`
+}
+
+func (m *Manager) sendID(peer *sf.PublicKey) string {
+	return "send/" + m.keyPair.PublicKey.Encode() + "/" + peer.Encode()
+}
+
+func (m *Manager) recvID(peer, ephemeral *sf.PublicKey) string {
+	return "recv/" + m.keyPair.PublicKey.Encode() + "/" + peer.Encode() + "/" + ephemeral.Encode()
+}
+
+// Start starts a new session for sending to peer, with one of the peer's
+// prekeys. Any prior session for sending to peer is replaced.
+func (m *Manager) Start(peer, prekey *sf.PublicKey) error {
+	ephemeral, err := sf.NewKeyPair()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	root := rootKey(
+		dh(m.keyPair.PrivateKey, prekey),
+		dh(ephemeral.PrivateKey, peer),
+		dh(ephemeral.PrivateKey, prekey),
+	)
+	state, err := json.Marshal(&sendState{
+		Ephemeral: ephemeral.PublicKey[:],
+		Prekey:    prekey[:],
+		ChainKey:  root,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return m.store.Update(m.sendID(peer), func([]byte) ([]byte, error) {
+		return state, nil
+	})
+}
+
+// HasSession returns whether a session has been started for sending to peer.
+func (m *Manager) HasSession(peer *sf.PublicKey) (bool, error) {
+	_, err := m.store.Get(m.sendID(peer))
+	if errgo.Cause(err) == storage.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return true, nil
+}
+
+// Seal encrypts a message to peer with the next key in the session for
+// sending to them, which must have been started. If not, the cause of the
+// error returned is ErrNoSession.
+func (m *Manager) Seal(peer *sf.PublicKey, contents []byte) ([]byte, error) {
+	nonce, err := sf.NewNonce()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var sealed []byte
+	err = m.store.Update(m.sendID(peer), func(stateBytes []byte) ([]byte, error) {
+		if stateBytes == nil {
+			return nil, errgo.WithCausef(nil, ErrNoSession, "no session for sending to %q", peer.Encode())
+		}
+		var state sendState
+		err := json.Unmarshal(stateBytes, &state)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		messageKey, chainKey := ratchet(state.ChainKey)
+
+		header := make([]byte, headerLen, headerLen+len(contents)+secretbox.Overhead)
+		copy(header, magic)
+		copy(header[8:40], state.Ephemeral)
+		copy(header[40:72], state.Prekey)
+		binary.BigEndian.PutUint32(header[72:76], state.Index)
+		copy(header[76:100], nonce[:])
+		sealed = secretbox.Seal(header, contents, (*[24]byte)(nonce), messageKey)
+
+		state.ChainKey = chainKey
+		state.Index++
+		return json.Marshal(&state)
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrNoSession))
+	}
+	return sealed, nil
+}
+
+// IsSealed returns whether a message was sealed in a session, and should be
+// opened with Open.
+func IsSealed(b []byte) bool {
+	return len(b) >= headerLen && bytes.Equal(b[:8], magic)
+}
+
+// Open decrypts a message sealed in a session by peer. The first message
+// opened from a session establishes it, consuming the one-time prekey it was
+// started with; a message which fails to open leaves the prekey for the
+// genuine one. Messages may be opened out of order, but only once.
+func (m *Manager) Open(peer *sf.PublicKey, b []byte) ([]byte, error) {
+	if !IsSealed(b) {
+		return nil, errgo.New("message not sealed in a session")
+	}
+	var ephemeral, prekey sf.PublicKey
+	var nonce sf.Nonce
+	copy(ephemeral[:], b[8:40])
+	copy(prekey[:], b[40:72])
+	index := binary.BigEndian.Uint32(b[72:76])
+	copy(nonce[:], b[76:100])
+	id := m.recvID(peer, &ephemeral)
+
+	var initial *recvState
+	_, err := m.store.Get(id)
+	if errgo.Cause(err) == storage.ErrNotFound {
+		prekeyPair, err := m.store.GetPrekey(&prekey)
+		if errgo.Cause(err) == storage.ErrNotFound {
+			return nil, errgo.WithCausef(nil, ErrNoSession, "unknown session from %q", peer.Encode())
+		} else if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		initial = &recvState{
+			ChainKey: rootKey(
+				dh(prekeyPair.PrivateKey, peer),
+				dh(m.keyPair.PrivateKey, &ephemeral),
+				dh(prekeyPair.PrivateKey, &ephemeral),
+			),
+		}
+	} else if err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	var contents []byte
+	update := func(stateBytes []byte) ([]byte, error) {
+		var state recvState
+		if stateBytes != nil {
+			err := json.Unmarshal(stateBytes, &state)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+		} else if initial != nil {
+			state = *initial
+		} else {
+			return nil, errgo.Newf("session from %q lost", peer.Encode())
+		}
+
+		messageKey, err := state.messageKey(index)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		var ok bool
+		contents, ok = secretbox.Open(nil, b[headerLen:], (*[24]byte)(&nonce), messageKey)
+		if !ok {
+			return nil, errgo.Newf("invalid message %d in session from %q", index, peer.Encode())
+		}
+		return json.Marshal(&state)
+	}
+	if initial != nil {
+		// The prekey is only consumed if the message opens.
+		err = m.store.UpdatePrekey(id, &prekey, update)
+		if errgo.Cause(err) == storage.ErrNotFound {
+			return nil, errgo.WithCausef(nil, ErrNoSession, "unknown session from %q", peer.Encode())
+		}
+	} else {
+		err = m.store.Update(id, update)
+	}
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrNoSession))
+	}
+	return contents, nil
+}
+
+// messageKey returns the key for the message at index, removing it from the
+// state. The chain is advanced past index, keeping the keys skipped on the
+// way.
+func (s *recvState) messageKey(index uint32) (*[32]byte, error) {
+	if index < s.Index {
+		key, ok := s.Skipped[index]
+		if !ok {
+			return nil, errgo.Newf("message %d already opened", index)
+		}
+		delete(s.Skipped, index)
+		var messageKey [32]byte
+		copy(messageKey[:], key)
+		return &messageKey, nil
+	}
+	if int(index-s.Index)+len(s.Skipped) > MaxSkip {
+		return nil, errgo.Newf("too many skipped messages")
+	}
+	for s.Index < index {
+		if s.Skipped == nil {
+			s.Skipped = make(map[uint32][]byte)
+		}
+		messageKey, chainKey := ratchet(s.ChainKey)
+		s.Skipped[s.Index] = messageKey[:]
+		s.ChainKey = chainKey
+		s.Index++
+	}
+	messageKey, chainKey := ratchet(s.ChainKey)
+	s.ChainKey = chainKey
+	s.Index++
+	return messageKey, nil
+}
+
+// dh returns the curve25519 shared secret of a private and public key.
+func dh(priv *sf.PrivateKey, pub *sf.PublicKey) []byte {
+	var shared [32]byte
+	curve25519.ScalarMult(&shared, (*[32]byte)(priv), (*[32]byte)(pub))
+	return shared[:]
+}
+
+// rootKey derives a session root key from the shared secrets agreed between
+// the initiator's long-term and ephemeral keys and the responder's prekey and
+// long-term key.
+func rootKey(secrets ...[]byte) []byte {
+	mac := hmac.New(sha256.New, rootLabel)
+	for _, secret := range secrets {
+		mac.Write(secret)
+	}
+	return mac.Sum(nil)
+}
+
+// ratchet derives a message key from a chain key, and the next chain key.
+func ratchet(chainKey []byte) (*[32]byte, []byte) {
+	var messageKey [32]byte
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{1})
+	copy(messageKey[:], mac.Sum(nil))
+
+	mac = hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{2})
+	return &messageKey, mac.Sum(nil)
+}
@@ -0,0 +1,184 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package session_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/session"
+	sfbolt "github.com/cmars/shadowfax/storage/bolt"
+	sftesting "github.com/cmars/shadowfax/testing"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type sessionSuite struct {
+	aliceDB, bobDB *bolt.DB
+	aliceKey       *sf.KeyPair
+	bobKey         *sf.KeyPair
+	alice, bob     *session.Manager
+}
+
+var _ = gc.Suite(&sessionSuite{})
+
+func (s *sessionSuite) newManager(c *gc.C, keyPair *sf.KeyPair) (*bolt.DB, *session.Manager) {
+	db, err := bolt.Open(filepath.Join(c.MkDir(), "vault"), 0600, nil)
+	c.Assert(err, gc.IsNil)
+	secretKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+	return db, session.NewManager(keyPair, sfbolt.NewSessions(db, secretKey))
+}
+
+func (s *sessionSuite) SetUpTest(c *gc.C) {
+	s.aliceKey = sftesting.MustNewKeyPair()
+	s.bobKey = sftesting.MustNewKeyPair()
+	s.aliceDB, s.alice = s.newManager(c, s.aliceKey)
+	s.bobDB, s.bob = s.newManager(c, s.bobKey)
+}
+
+func (s *sessionSuite) TearDownTest(c *gc.C) {
+	s.aliceDB.Close()
+	s.bobDB.Close()
+}
+
+func (s *sessionSuite) start(c *gc.C) {
+	prekeys, err := s.bob.NewPrekeys(2)
+	c.Assert(err, gc.IsNil)
+	c.Assert(prekeys, gc.HasLen, 2)
+	err = s.alice.Start(s.bobKey.PublicKey, prekeys[0])
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *sessionSuite) TestSealOpen(c *gc.C) {
+	ok, err := s.alice.HasSession(s.bobKey.PublicKey)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, false)
+	_, err = s.alice.Seal(s.bobKey.PublicKey, []byte("hello"))
+	c.Assert(errgo.Cause(err), gc.Equals, session.ErrNoSession)
+
+	s.start(c)
+	ok, err = s.alice.HasSession(s.bobKey.PublicKey)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+
+	var sealed [][]byte
+	for i := 0; i < 3; i++ {
+		b, err := s.alice.Seal(s.bobKey.PublicKey, []byte(fmt.Sprintf("hello %d", i)))
+		c.Assert(err, gc.IsNil)
+		c.Assert(session.IsSealed(b), gc.Equals, true)
+		sealed = append(sealed, b)
+	}
+	c.Assert(sealed[0], gc.Not(gc.DeepEquals), sealed[1])
+
+	// Messages may be opened out of order.
+	for _, i := range []int{2, 0, 1} {
+		contents, err := s.bob.Open(s.aliceKey.PublicKey, sealed[i])
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(contents), gc.Equals, fmt.Sprintf("hello %d", i))
+	}
+
+	// Message keys are discarded once used.
+	for i := range sealed {
+		_, err = s.bob.Open(s.aliceKey.PublicKey, sealed[i])
+		c.Assert(err, gc.ErrorMatches, fmt.Sprintf("message %d already opened", i))
+	}
+}
+
+func (s *sessionSuite) TestWrongPeer(c *gc.C) {
+	s.start(c)
+	b, err := s.alice.Seal(s.bobKey.PublicKey, []byte("hello"))
+	c.Assert(err, gc.IsNil)
+
+	// The session is bound to the long-term key of its initiator.
+	_, err = s.bob.Open(sftesting.MustNewKeyPair().PublicKey, b)
+	c.Assert(err, gc.ErrorMatches, "invalid message 0 in session from .*")
+}
+
+func (s *sessionSuite) TestPrekeyUsedOnce(c *gc.C) {
+	prekeys, err := s.bob.NewPrekeys(1)
+	c.Assert(err, gc.IsNil)
+	err = s.alice.Start(s.bobKey.PublicKey, prekeys[0])
+	c.Assert(err, gc.IsNil)
+	b1, err := s.alice.Seal(s.bobKey.PublicKey, []byte("hello"))
+	c.Assert(err, gc.IsNil)
+	_, err = s.bob.Open(s.aliceKey.PublicKey, b1)
+	c.Assert(err, gc.IsNil)
+
+	// A new session with the same prekey cannot be established.
+	err = s.alice.Start(s.bobKey.PublicKey, prekeys[0])
+	c.Assert(err, gc.IsNil)
+	b2, err := s.alice.Seal(s.bobKey.PublicKey, []byte("hello again"))
+	c.Assert(err, gc.IsNil)
+	_, err = s.bob.Open(s.aliceKey.PublicKey, b2)
+	c.Assert(errgo.Cause(err), gc.Equals, session.ErrNoSession)
+}
+
+func (s *sessionSuite) TestLastResortPrekey(c *gc.C) {
+	prekey, err := s.bob.NewLastResortPrekey()
+	c.Assert(err, gc.IsNil)
+
+	// The last-resort prekey may start any number of sessions.
+	for i := 0; i < 2; i++ {
+		err = s.alice.Start(s.bobKey.PublicKey, prekey)
+		c.Assert(err, gc.IsNil)
+		b, err := s.alice.Seal(s.bobKey.PublicKey, []byte(fmt.Sprintf("hello %d", i)))
+		c.Assert(err, gc.IsNil)
+		contents, err := s.bob.Open(s.aliceKey.PublicKey, b)
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(contents), gc.Equals, fmt.Sprintf("hello %d", i))
+
+		// Each message still opens only once.
+		_, err = s.bob.Open(s.aliceKey.PublicKey, b)
+		c.Assert(err, gc.ErrorMatches, "message 0 already opened")
+	}
+}
+
+func (s *sessionSuite) TestTamperedFirstMessage(c *gc.C) {
+	prekeys, err := s.bob.NewPrekeys(1)
+	c.Assert(err, gc.IsNil)
+	err = s.alice.Start(s.bobKey.PublicKey, prekeys[0])
+	c.Assert(err, gc.IsNil)
+	b, err := s.alice.Seal(s.bobKey.PublicKey, []byte("hello"))
+	c.Assert(err, gc.IsNil)
+
+	tampered := append([]byte(nil), b...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = s.bob.Open(s.aliceKey.PublicKey, tampered)
+	c.Assert(err, gc.ErrorMatches, "invalid message 0 in session from .*")
+
+	// The prekey was not consumed, so the genuine message still opens.
+	contents, err := s.bob.Open(s.aliceKey.PublicKey, b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(contents), gc.Equals, "hello")
+}
+
+func (s *sessionSuite) TestMaxSkip(c *gc.C) {
+	s.start(c)
+	var last []byte
+	for i := 0; i <= session.MaxSkip+1; i++ {
+		var err error
+		last, err = s.alice.Seal(s.bobKey.PublicKey, []byte("hello"))
+		c.Assert(err, gc.IsNil)
+	}
+	_, err := s.bob.Open(s.aliceKey.PublicKey, last)
+	c.Assert(err, gc.ErrorMatches, "too many skipped messages")
+}
+
+func (s *sessionSuite) TestNotSealed(c *gc.C) {
+	c.Assert(session.IsSealed([]byte("hello")), gc.Equals, false)
+	_, err := s.bob.Open(s.aliceKey.PublicKey, []byte("hello"))
+	c.Assert(err, gc.ErrorMatches, "message not sealed in a session")
+}
@@ -0,0 +1,136 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package shadowfax
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/curve25519"
+	"gopkg.in/errgo.v1"
+)
+
+// Signatures are made with curve25519 keys as in XEdDSA: a signature is an
+// Ed25519 signature under the Edwards form of the public key, taking the
+// sign of its x coordinate to be positive, so that it can be verified with
+// the curve25519 public key alone.
+
+var (
+	// fieldPrime is 2^255-19, the order of the field of curve25519.
+	fieldPrime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+	// groupOrder is the order of the curve25519 base point.
+	groupOrder, _ = new(big.Int).SetString("7237005577332262213973186563042994240857116359379907606001950938285454250989", 10)
+)
+
+// SignatureSize is the length of a signature made by Sign.
+const SignatureSize = ed25519.SignatureSize
+
+// Sign signs a message with the key pair, such that the signature can be
+// verified with its public key.
+func (k *KeyPair) Sign(message []byte) ([]byte, error) {
+	edKey, ok := edwardsKey(k.PublicKey)
+	if !ok {
+		return nil, errgo.New("invalid public key")
+	}
+	var nonceKey [32]byte
+	_, err := io.ReadFull(rand.Reader, nonceKey[:])
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var nonceMont [32]byte
+	curve25519.ScalarBaseMult(&nonceMont, &nonceKey)
+	nonceEd, ok := edwardsKey((*PublicKey)(&nonceMont))
+	if !ok {
+		return nil, errgo.New("invalid signature nonce")
+	}
+
+	h := sha512.New()
+	h.Write(nonceEd)
+	h.Write(edKey)
+	h.Write(message)
+	digest := littleEndianInt(h.Sum(nil))
+	digest.Mod(digest, groupOrder)
+
+	// Only the x coordinate of a curve25519 point is known, so the private
+	// key and nonce may each be the negation of the scalars whose Edwards
+	// points are positive. Only one combination produces a valid signature.
+	a, r := clampedScalar((*[32]byte)(k.PrivateKey)), clampedScalar(&nonceKey)
+	for _, a := range []*big.Int{a, new(big.Int).Neg(a)} {
+		for _, r := range []*big.Int{r, new(big.Int).Neg(r)} {
+			s := new(big.Int).Mul(digest, a)
+			s.Add(s, r)
+			s.Mod(s, groupOrder)
+			sig := append(append([]byte(nil), nonceEd...), littleEndianBytes(s)...)
+			if ed25519.Verify(edKey, message, sig) {
+				return sig, nil
+			}
+		}
+	}
+	return nil, errgo.New("private key does not match public key")
+}
+
+// Verify returns whether sig is a signature of message made by Sign with the
+// private key of pk.
+func (pk PublicKey) Verify(message []byte, sig []byte) bool {
+	edKey, ok := edwardsKey(&pk)
+	if !ok {
+		return false
+	}
+	return ed25519.Verify(edKey, message, sig)
+}
+
+// edwardsKey returns the encoding of the Edwards point equivalent to a
+// curve25519 public key, with a positive x coordinate.
+func edwardsKey(pk *PublicKey) ([]byte, bool) {
+	u := littleEndianInt(pk[:])
+	u.SetBit(u, 255, 0)
+	u.Mod(u, fieldPrime)
+	// y = (u - 1) / (u + 1)
+	den := new(big.Int).Add(u, big.NewInt(1))
+	den.Mod(den, fieldPrime)
+	if den.Sign() == 0 {
+		return nil, false
+	}
+	y := new(big.Int).Sub(u, big.NewInt(1))
+	y.Mul(y, den.ModInverse(den, fieldPrime))
+	y.Mod(y, fieldPrime)
+	return littleEndianBytes(y), true
+}
+
+// clampedScalar returns the scalar by which curve25519 multiplies for the
+// given private key.
+func clampedScalar(priv *[32]byte) *big.Int {
+	k := *priv
+	k[0] &= 248
+	k[31] &= 127
+	k[31] |= 64
+	return littleEndianInt(k[:])
+}
+
+func littleEndianInt(b []byte) *big.Int {
+	rev := make([]byte, len(b))
+	for i := range b {
+		rev[len(b)-1-i] = b[i]
+	}
+	return new(big.Int).SetBytes(rev)
+}
+
+// littleEndianBytes encodes a field element or scalar in 32 bytes.
+func littleEndianBytes(n *big.Int) []byte {
+	b := n.Bytes()
+	out := make([]byte, 32)
+	for i := range b {
+		out[i] = b[len(b)-1-i]
+	}
+	return out
+}
@@ -0,0 +1,44 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package shadowfax_test
+
+import (
+	gc "gopkg.in/check.v1"
+
+	sf "github.com/cmars/shadowfax"
+	sftesting "github.com/cmars/shadowfax/testing"
+)
+
+type signSuite struct{}
+
+var _ = gc.Suite(&signSuite{})
+
+func (s *signSuite) TestSignVerify(c *gc.C) {
+	for i := 0; i < 20; i++ {
+		keyPair := sftesting.MustNewKeyPair()
+		msg := []byte("hello world")
+		sig, err := keyPair.Sign(msg)
+		c.Assert(err, gc.IsNil)
+		c.Assert(sig, gc.HasLen, sf.SignatureSize)
+		c.Assert(keyPair.PublicKey.Verify(msg, sig), gc.Equals, true)
+
+		c.Assert(keyPair.PublicKey.Verify([]byte("hello world!"), sig), gc.Equals, false)
+		c.Assert(sftesting.MustNewKeyPair().PublicKey.Verify(msg, sig), gc.Equals, false)
+		c.Assert(keyPair.PublicKey.Verify(msg, sig[:len(sig)-1]), gc.Equals, false)
+		sig[0] ^= 1
+		c.Assert(keyPair.PublicKey.Verify(msg, sig), gc.Equals, false)
+	}
+}
+
+func (s *signSuite) TestSignMismatchedKeys(c *gc.C) {
+	keyPair := sftesting.MustNewKeyPair()
+	keyPair.PublicKey = sftesting.MustNewKeyPair().PublicKey
+	_, err := keyPair.Sign([]byte("hello world"))
+	c.Assert(err, gc.ErrorMatches, "private key does not match public key")
+}
@@ -20,6 +20,10 @@ import (
 
 var (
 	bigOne = big.NewInt(1)
+
+	// routersBucketName holds the home router of each contact name which has
+	// one.
+	routersBucketName = []byte("routers")
 )
 
 type contacts struct {
@@ -37,15 +41,15 @@ func (c *contacts) Key(name string) (*sf.PublicKey, error) {
 	err := c.db.View(func(tx *bolt.Tx) error {
 		contactsBucket := tx.Bucket([]byte("contacts"))
 		if contactsBucket == nil {
-			return errgo.Newf("key not found for %q", name)
+			return errgo.WithCausef(nil, storage.ErrNotFound, "key not found for %q", name)
 		}
 		keysBucket := contactsBucket.Bucket([]byte(name))
 		if keysBucket == nil {
-			return errgo.Newf("key not found for %q", name)
+			return errgo.WithCausef(nil, storage.ErrNotFound, "key not found for %q", name)
 		}
 		seqBytes, pkBytes := keysBucket.Cursor().Last()
 		if seqBytes == nil {
-			return errgo.Newf("key not found for %q", name)
+			return errgo.WithCausef(nil, storage.ErrNotFound, "key not found for %q", name)
 		}
 		copy(pk[:], pkBytes)
 		return nil
@@ -108,6 +112,7 @@ func (c *contacts) Put(name string, key *sf.PublicKey) error {
 	})
 }
 
+// Current implements storage.Contacts.
 func (c *contacts) Current() (storage.ContactInfos, error) {
 	var result storage.ContactInfos
 	err := c.db.View(func(tx *bolt.Tx) error {
@@ -130,9 +135,14 @@ func (c *contacts) Current() (storage.ContactInfos, error) {
 			}
 			pk := new(sf.PublicKey)
 			copy(pk[:], pkBytes)
+			var router string
+			if routersBucket := tx.Bucket(routersBucketName); routersBucket != nil {
+				router = string(routersBucket.Get(name))
+			}
 			result = append(result, storage.ContactInfo{
 				Name:    string(name),
 				Address: pk,
+				Router:  router,
 			})
 		}
 		return nil
@@ -142,3 +152,108 @@ func (c *contacts) Current() (storage.ContactInfos, error) {
 	}
 	return result, nil
 }
+
+// Group implements storage.Contacts.
+func (c *contacts) Group(group string) ([]string, error) {
+	var names []string
+	err := c.db.View(func(tx *bolt.Tx) error {
+		groupsBucket := tx.Bucket([]byte("groups"))
+		if groupsBucket == nil {
+			return errgo.Newf("group %q not found", group)
+		}
+		groupBucket := groupsBucket.Bucket([]byte(group))
+		if groupBucket == nil {
+			return errgo.Newf("group %q not found", group)
+		}
+		return groupBucket.ForEach(func(name, _ []byte) error {
+			names = append(names, string(name))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// PutGroup implements storage.Contacts.
+func (c *contacts) PutGroup(group string, names []string) error {
+	if len(group) == 0 {
+		return errgo.New("empty group name")
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		groupsBucket, err := tx.CreateBucketIfNotExists([]byte("groups"))
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if groupsBucket.Bucket([]byte(group)) != nil {
+			err = groupsBucket.DeleteBucket([]byte(group))
+			if err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		if len(names) == 0 {
+			return nil
+		}
+		groupBucket, err := groupsBucket.CreateBucket([]byte(group))
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		for _, name := range names {
+			if len(name) == 0 {
+				return errgo.New("empty key name")
+			}
+			err = groupBucket.Put([]byte(name), nil)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		return nil
+	})
+}
+
+// hasContact returns whether a contact name has a key.
+func hasContact(tx *bolt.Tx, name string) bool {
+	contactsBucket := tx.Bucket([]byte("contacts"))
+	if contactsBucket == nil {
+		return false
+	}
+	keysBucket := contactsBucket.Bucket([]byte(name))
+	return keysBucket != nil && keysBucket.Stats().KeyN > 0
+}
+
+// Router implements storage.Contacts.
+func (c *contacts) Router(name string) (string, error) {
+	var router string
+	err := c.db.View(func(tx *bolt.Tx) error {
+		if !hasContact(tx, name) {
+			return errgo.WithCausef(nil, storage.ErrNotFound, "key not found for %q", name)
+		}
+		if routersBucket := tx.Bucket(routersBucketName); routersBucket != nil {
+			router = string(routersBucket.Get([]byte(name)))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Is(storage.ErrNotFound))
+	}
+	return router, nil
+}
+
+// SetRouter implements storage.Contacts.
+func (c *contacts) SetRouter(name string, router string) error {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		if !hasContact(tx, name) {
+			return errgo.WithCausef(nil, storage.ErrNotFound, "key not found for %q", name)
+		}
+		routersBucket, err := tx.CreateBucketIfNotExists(routersBucketName)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if router == "" {
+			return errgo.Mask(routersBucket.Delete([]byte(name)))
+		}
+		return errgo.Mask(routersBucket.Put([]byte(name), []byte(router)))
+	})
+	return errgo.Mask(err, errgo.Is(storage.ErrNotFound))
+}
@@ -109,3 +109,32 @@ func (s *contactsSuite) TestSameKey(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 	c.Assert(key, gc.DeepEquals, alice.PublicKey)
 }
+
+func (s *contactsSuite) TestGroups(c *gc.C) {
+	testContacts := sfbolt.NewContacts(s.db)
+
+	_, err := testContacts.Group("friends")
+	c.Assert(err, gc.ErrorMatches, `group "friends" not found`)
+
+	err = testContacts.PutGroup("friends", []string{"carol", "bob"})
+	c.Assert(err, gc.IsNil)
+	names, err := testContacts.Group("friends")
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, gc.DeepEquals, []string{"bob", "carol"})
+
+	// Members are replaced.
+	err = testContacts.PutGroup("friends", []string{"dave"})
+	c.Assert(err, gc.IsNil)
+	names, err = testContacts.Group("friends")
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, gc.DeepEquals, []string{"dave"})
+
+	// Groups without members are removed.
+	err = testContacts.PutGroup("friends", nil)
+	c.Assert(err, gc.IsNil)
+	_, err = testContacts.Group("friends")
+	c.Assert(err, gc.ErrorMatches, `group "friends" not found`)
+
+	err = testContacts.PutGroup("", []string{"bob"})
+	c.Assert(err, gc.ErrorMatches, `empty group name`)
+}
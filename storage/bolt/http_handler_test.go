@@ -15,6 +15,9 @@ import (
 	"github.com/boltdb/bolt"
 	gc "gopkg.in/check.v1"
 
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/session"
+	"github.com/cmars/shadowfax/storage"
 	sfbolt "github.com/cmars/shadowfax/storage/bolt"
 	sftesting "github.com/cmars/shadowfax/testing"
 )
@@ -31,10 +34,89 @@ func (s *boltHandlerSuite) SetUpTest(c *gc.C) {
 	dir := c.MkDir()
 	db, err := bolt.Open(filepath.Join(dir, "testdb"), 0600, nil)
 	c.Assert(err, gc.IsNil)
-	s.HTTPHandlerSuite.SetStorage(sfbolt.NewService(db))
+	notifier := storage.NewNotifier()
+	service := sfbolt.NewService(db)
+	service.SetNotifier(notifier)
+	s.HTTPHandlerSuite.SetStorage(service)
+	s.HTTPHandlerSuite.SetNonceCache(sfbolt.NewNonceCache(db, 1024))
+	s.HTTPHandlerSuite.SetNotifier(notifier)
+	s.HTTPHandlerSuite.SetPrekeys(sfbolt.NewPrekeys(db))
 	s.HTTPHandlerSuite.SetUpTest(c)
 }
 
 func (s *boltHandlerSuite) TearDownTest(c *gc.C) {
 	s.HTTPHandlerSuite.TearDownTest(c)
 }
+
+func (s *boltHandlerSuite) TestSessionPrekeys(c *gc.C) {
+	db, err := bolt.Open(filepath.Join(c.MkDir(), "vault"), 0600, nil)
+	c.Assert(err, gc.IsNil)
+	defer db.Close()
+	secretKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+	sessions := sfbolt.NewSessions(db, secretKey)
+
+	aliceKey, bobKey := sftesting.MustNewKeyPair(), sftesting.MustNewKeyPair()
+	aliceSessions := session.NewManager(aliceKey, sessions)
+	bobSessions := session.NewManager(bobKey, sessions)
+	alice := s.NewClientWithKey(c, aliceKey)
+	alice.SetSessions(aliceSessions)
+	bob := s.NewClientWithKey(c, bobKey)
+	bob.SetSessions(bobSessions)
+
+	prekeys, err := bobSessions.NewPrekeys(2)
+	c.Assert(err, gc.IsNil)
+	n, err := bob.PublishPrekeys(prekeys, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n.Count, gc.Equals, 2)
+
+	// The first push starts a session with one of Bob's prekeys, which is
+	// used for later pushes.
+	for i := 0; i < 2; i++ {
+		err = alice.Push(bob.PublicKey().Encode(), []byte("hello world"))
+		c.Assert(err, gc.IsNil)
+		msgs, err := bob.Pop()
+		c.Assert(err, gc.IsNil)
+		c.Assert(msgs, gc.HasLen, 1)
+		c.Assert(msgs[0].Contents, gc.DeepEquals, []byte("hello world"))
+		c.Assert(msgs[0].Session, gc.Equals, true)
+	}
+	n, err = bob.PublishPrekeys(nil, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n.Count, gc.Equals, 1)
+
+	// Bob has not claimed any of Alice's prekeys, and she has none, so his
+	// reply is sealed without a session.
+	err = bob.Push(alice.PublicKey().Encode(), []byte("hi"))
+	c.Assert(err, gc.IsNil)
+	msgs, err := alice.Pop()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	c.Assert(msgs[0].Session, gc.Equals, false)
+}
+
+func (s *boltHandlerSuite) TestSessionForgedPrekey(c *gc.C) {
+	db, err := bolt.Open(filepath.Join(c.MkDir(), "vault"), 0600, nil)
+	c.Assert(err, gc.IsNil)
+	defer db.Close()
+	secretKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+
+	aliceKey, bobKey := sftesting.MustNewKeyPair(), sftesting.MustNewKeyPair()
+	aliceSessions := session.NewManager(aliceKey, sfbolt.NewSessions(db, secretKey))
+	alice := s.NewClientWithKey(c, aliceKey)
+	alice.SetSessions(aliceSessions)
+
+	// A prekey substituted by the server is refused, rather than used to
+	// seal the message.
+	err = s.Prekeys().PutPrekeys(bobKey.PublicKey.Encode(), []*storage.Prekey{{
+		Key:       sftesting.MustNewKeyPair().PublicKey,
+		Signature: make([]byte, sf.SignatureSize),
+	}})
+	c.Assert(err, gc.IsNil)
+	err = alice.Push(bobKey.PublicKey.Encode(), []byte("hello world"))
+	c.Assert(err, gc.ErrorMatches, "invalid signature on prekey .*")
+	ok, err := aliceSessions.HasSession(bobKey.PublicKey)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, false)
+}
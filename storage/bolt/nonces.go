@@ -0,0 +1,145 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package bolt
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+)
+
+var (
+	noncesBucketName = []byte("nonces")
+	seenBucketName   = []byte("seen")
+	expiryBucketName = []byte("expiry")
+	countKey         = []byte("count")
+
+	// evictedKey holds the latest expiration time of a nonce evicted before
+	// it expired.
+	evictedKey = []byte("evicted")
+)
+
+type nonceCache struct {
+	db       *bolt.DB
+	capacity int
+}
+
+// NewNonceCache returns a new storage.NonceCache backed by bolt DB, which
+// remembers at most capacity nonces. When full, the nonces closest to
+// expiration are forgotten first, and from then on any nonce which expires no
+// later than one forgotten is reported as seen, since it could be a replay.
+func NewNonceCache(db *bolt.DB, capacity int) *nonceCache {
+	return &nonceCache{db, capacity}
+}
+
+// Seen implements storage.NonceCache.
+func (c *nonceCache) Seen(nonce *sf.Nonce, expires time.Time) (bool, error) {
+	now := time.Now()
+	var seen bool
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		noncesBucket, err := tx.CreateBucketIfNotExists(noncesBucketName)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		seenBucket, err := noncesBucket.CreateBucketIfNotExists(seenBucketName)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		expiryBucket, err := noncesBucket.CreateBucketIfNotExists(expiryBucketName)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		var count uint64
+		if countBytes := noncesBucket.Get(countKey); countBytes != nil {
+			count = binary.BigEndian.Uint64(countBytes)
+		}
+		var evicted []byte
+		if evictedBytes := noncesBucket.Get(evictedKey); evictedBytes != nil {
+			evicted = append(evicted, evictedBytes...)
+			if !expires.After(decodeTime(evicted)) {
+				seen = true
+				return nil
+			}
+		}
+
+		if prevExpires := seenBucket.Get(nonce[:]); prevExpires != nil {
+			if decodeTime(prevExpires).After(now) {
+				seen = true
+				return nil
+			}
+			err = expiryBucket.Delete(expiryKey(prevExpires, nonce[:]))
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			count--
+		}
+
+		// Forget expired nonces, and the nonces closest to expiring if still
+		// at capacity.
+		var evict [][]byte
+		cur := expiryBucket.Cursor()
+		for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
+			if decodeTime(k[:8]).After(now) {
+				if count-uint64(len(evict)) < uint64(c.capacity) {
+					break
+				}
+				// Keys are ordered by expiration time, so this is the
+				// latest yet evicted.
+				evicted = append([]byte(nil), k[:8]...)
+			}
+			evict = append(evict, append([]byte(nil), k...))
+		}
+		if evicted != nil {
+			err = noncesBucket.Put(evictedKey, evicted)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		for _, k := range evict {
+			err = expiryBucket.Delete(k)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			err = seenBucket.Delete(k[8:])
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			count--
+		}
+
+		expiresBytes := encodeTime(expires)
+		err = seenBucket.Put(nonce[:], expiresBytes)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		err = expiryBucket.Put(expiryKey(expiresBytes, nonce[:]), []byte{})
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		count++
+
+		countBytes := make([]byte, 8)
+		binary.BigEndian.PutUint64(countBytes, count)
+		return errgo.Mask(noncesBucket.Put(countKey, countBytes))
+	})
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return seen, nil
+}
+
+func expiryKey(expiresBytes, nonceBytes []byte) []byte {
+	k := make([]byte, 0, len(expiresBytes)+len(nonceBytes))
+	k = append(k, expiresBytes...)
+	return append(k, nonceBytes...)
+}
@@ -0,0 +1,59 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package bolt_test
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+	gc "gopkg.in/check.v1"
+
+	sfbolt "github.com/cmars/shadowfax/storage/bolt"
+	sftesting "github.com/cmars/shadowfax/testing"
+)
+
+type nonceCacheSuite struct {
+	db *bolt.DB
+}
+
+var _ = gc.Suite(&nonceCacheSuite{})
+
+func (s *nonceCacheSuite) SetUpTest(c *gc.C) {
+	dir := c.MkDir()
+	var err error
+	s.db, err = bolt.Open(filepath.Join(dir, "testdb"), 0600, nil)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *nonceCacheSuite) TearDownTest(c *gc.C) {
+	s.db.Close()
+}
+
+func (s *nonceCacheSuite) TestPersistent(c *gc.C) {
+	n := sftesting.MustNewNonce()
+	seen, err := sfbolt.NewNonceCache(s.db, 10).Seen(n, time.Now().Add(time.Minute))
+	c.Assert(err, gc.IsNil)
+	c.Assert(seen, gc.Equals, false)
+
+	seen, err = sfbolt.NewNonceCache(s.db, 10).Seen(n, time.Now().Add(time.Minute))
+	c.Assert(err, gc.IsNil)
+	c.Assert(seen, gc.Equals, true)
+
+	// Evictions are remembered too.
+	expires := time.Now().Add(2 * time.Minute)
+	for i := 0; i < 2; i++ {
+		seen, err = sfbolt.NewNonceCache(s.db, 1).Seen(sftesting.MustNewNonce(), expires.Add(time.Duration(i)*time.Second))
+		c.Assert(err, gc.IsNil)
+		c.Assert(seen, gc.Equals, false)
+	}
+	seen, err = sfbolt.NewNonceCache(s.db, 1).Seen(sftesting.MustNewNonce(), expires)
+	c.Assert(err, gc.IsNil)
+	c.Assert(seen, gc.Equals, true)
+}
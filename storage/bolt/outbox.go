@@ -0,0 +1,128 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package bolt
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"gopkg.in/errgo.v1"
+
+	"github.com/cmars/shadowfax/storage"
+)
+
+// outboxBucketName holds the delivery status of sent messages, keyed by
+// message ID and recipient so that the recipients of a message are adjacent.
+var outboxBucketName = []byte("outbox")
+
+type outboxRecord struct {
+	Status    string    `json:"status"`
+	Sent      time.Time `json:"sent"`
+	Delivered time.Time `json:"delivered"`
+}
+
+type outbox struct {
+	db *bolt.DB
+}
+
+// NewOutbox returns a new storage.Outbox backed by bolt DB.
+func NewOutbox(db *bolt.DB) *outbox {
+	return &outbox{db}
+}
+
+func outboxKey(id, recipient string) []byte {
+	return []byte(id + "\x00" + recipient)
+}
+
+// Sent implements storage.Outbox.
+func (o *outbox) Sent(id, recipient string, stored bool, at time.Time) error {
+	rec := &outboxRecord{Status: storage.StatusSent, Sent: at}
+	if stored {
+		rec.Status = storage.StatusStored
+	}
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return o.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(outboxBucketName)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return errgo.Mask(bucket.Put(outboxKey(id, recipient), buf))
+	})
+}
+
+// Delivered implements storage.Outbox.
+func (o *outbox) Delivered(id, recipient string, at time.Time) error {
+	return o.db.Update(func(tx *bolt.Tx) error {
+		notFound := errgo.WithCausef(nil, storage.ErrNotFound, "message %q not sent to %q", id, recipient)
+		bucket := tx.Bucket(outboxBucketName)
+		if bucket == nil {
+			return notFound
+		}
+		key := outboxKey(id, recipient)
+		buf := bucket.Get(key)
+		if buf == nil {
+			return notFound
+		}
+		var rec outboxRecord
+		err := json.Unmarshal(buf, &rec)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if rec.Status == storage.StatusDelivered {
+			return nil
+		}
+		rec.Status = storage.StatusDelivered
+		rec.Delivered = at
+		buf, err = json.Marshal(&rec)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return errgo.Mask(bucket.Put(key, buf))
+	})
+}
+
+// Status implements storage.Outbox.
+func (o *outbox) Status(id string) ([]*storage.DeliveryStatus, error) {
+	var result []*storage.DeliveryStatus
+	err := o.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(outboxBucketName)
+		if bucket == nil {
+			return nil
+		}
+		prefix := outboxKey(id, "")
+		c := bucket.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var rec outboxRecord
+			err := json.Unmarshal(v, &rec)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			result = append(result, &storage.DeliveryStatus{
+				ID:        id,
+				Recipient: string(k[len(prefix):]),
+				Status:    rec.Status,
+				Sent:      rec.Sent,
+				Delivered: rec.Delivered,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(result) == 0 {
+		return nil, errgo.WithCausef(nil, storage.ErrNotFound, "message %q not found", id)
+	}
+	return result, nil
+}
@@ -0,0 +1,141 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package bolt
+
+import (
+	"github.com/boltdb/bolt"
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/storage"
+)
+
+var (
+	// publishedBucketName holds a bucket of published prekeys for each
+	// recipient, with their signatures. It is distinct from the private
+	// prekeys bucket of Sessions, so both may share a DB.
+	publishedBucketName = []byte("published-prekeys")
+
+	// publishedLastResortBucketName holds the published last-resort prekey
+	// of each recipient, followed by its signature.
+	publishedLastResortBucketName = []byte("published-last-resort-prekeys")
+)
+
+type prekeys struct {
+	db *bolt.DB
+}
+
+// NewPrekeys returns a new storage.Prekeys backed by bolt DB.
+func NewPrekeys(db *bolt.DB) *prekeys {
+	return &prekeys{db}
+}
+
+// PutPrekeys implements storage.Prekeys.
+func (p *prekeys) PutPrekeys(recipient string, keys []*storage.Prekey) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		publishedBucket, err := tx.CreateBucketIfNotExists(publishedBucketName)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		recipientBucket, err := publishedBucket.CreateBucketIfNotExists([]byte(recipient))
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		for _, key := range keys {
+			err = recipientBucket.Put(key.Key[:], key.Signature)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		return nil
+	})
+}
+
+// ClaimPrekey implements storage.Prekeys.
+func (p *prekeys) ClaimPrekey(recipient string) (*storage.Prekey, error) {
+	var key sf.PublicKey
+	var signature []byte
+	err := p.db.Update(func(tx *bolt.Tx) error {
+		publishedBucket := tx.Bucket(publishedBucketName)
+		if publishedBucket == nil {
+			return errgo.WithCausef(nil, storage.ErrNotFound, "no prekeys for %q", recipient)
+		}
+		recipientBucket := publishedBucket.Bucket([]byte(recipient))
+		if recipientBucket == nil {
+			return errgo.WithCausef(nil, storage.ErrNotFound, "no prekeys for %q", recipient)
+		}
+		keyBytes, sigBytes := recipientBucket.Cursor().First()
+		if keyBytes == nil {
+			return errgo.WithCausef(nil, storage.ErrNotFound, "no prekeys for %q", recipient)
+		}
+		copy(key[:], keyBytes)
+		signature = append([]byte(nil), sigBytes...)
+		return errgo.Mask(recipientBucket.Delete(key[:]))
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(storage.ErrNotFound))
+	}
+	return &storage.Prekey{Key: &key, Signature: signature}, nil
+}
+
+// CountPrekeys implements storage.Prekeys.
+func (p *prekeys) CountPrekeys(recipient string) (int, error) {
+	var count int
+	err := p.db.View(func(tx *bolt.Tx) error {
+		publishedBucket := tx.Bucket(publishedBucketName)
+		if publishedBucket == nil {
+			return nil
+		}
+		recipientBucket := publishedBucket.Bucket([]byte(recipient))
+		if recipientBucket == nil {
+			return nil
+		}
+		count = recipientBucket.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	return count, nil
+}
+
+// PutLastResortPrekey implements storage.Prekeys.
+func (p *prekeys) PutLastResortPrekey(recipient string, key *storage.Prekey) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		lastResortBucket, err := tx.CreateBucketIfNotExists(publishedLastResortBucketName)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		value := append(append([]byte(nil), key.Key[:]...), key.Signature...)
+		return errgo.Mask(lastResortBucket.Put([]byte(recipient), value))
+	})
+}
+
+// LastResortPrekey implements storage.Prekeys.
+func (p *prekeys) LastResortPrekey(recipient string) (*storage.Prekey, error) {
+	var prekey storage.Prekey
+	err := p.db.View(func(tx *bolt.Tx) error {
+		lastResortBucket := tx.Bucket(publishedLastResortBucketName)
+		if lastResortBucket == nil {
+			return errgo.WithCausef(nil, storage.ErrNotFound, "no last-resort prekey for %q", recipient)
+		}
+		value := lastResortBucket.Get([]byte(recipient))
+		if len(value) < 32 {
+			return errgo.WithCausef(nil, storage.ErrNotFound, "no last-resort prekey for %q", recipient)
+		}
+		prekey.Key = new(sf.PublicKey)
+		copy(prekey.Key[:], value[:32])
+		prekey.Signature = append([]byte(nil), value[32:]...)
+		return nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(storage.ErrNotFound))
+	}
+	return &prekey, nil
+}
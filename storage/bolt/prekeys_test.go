@@ -0,0 +1,109 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package bolt_test
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/storage"
+	sfbolt "github.com/cmars/shadowfax/storage/bolt"
+	sftesting "github.com/cmars/shadowfax/testing"
+)
+
+type prekeysSuite struct {
+	db *bolt.DB
+}
+
+var _ = gc.Suite(&prekeysSuite{})
+
+func (s *prekeysSuite) SetUpTest(c *gc.C) {
+	var err error
+	s.db, err = bolt.Open(filepath.Join(c.MkDir(), "testdb"), 0600, nil)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *prekeysSuite) TearDownTest(c *gc.C) {
+	s.db.Close()
+}
+
+func (s *prekeysSuite) TestClaim(c *gc.C) {
+	p := sfbolt.NewPrekeys(s.db)
+	bob := sftesting.MustNewKeyPair().PublicKey.Encode()
+
+	n, err := p.CountPrekeys(bob)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+	_, err = p.ClaimPrekey(bob)
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrNotFound)
+
+	published := map[sf.PublicKey][]byte{}
+	var keys []*storage.Prekey
+	for i := 0; i < 3; i++ {
+		key := sftesting.MustNewKeyPair().PublicKey
+		signature := []byte(fmt.Sprintf("signature %d", i))
+		keys = append(keys, &storage.Prekey{Key: key, Signature: signature})
+		published[*key] = signature
+	}
+	err = p.PutPrekeys(bob, keys)
+	c.Assert(err, gc.IsNil)
+	n, err = p.CountPrekeys(bob)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 3)
+
+	// Prekeys are only given out once, with their signatures.
+	for i := 0; i < 3; i++ {
+		key, err := p.ClaimPrekey(bob)
+		c.Assert(err, gc.IsNil)
+		c.Assert(published[*key.Key], gc.NotNil)
+		c.Assert(key.Signature, gc.DeepEquals, published[*key.Key])
+		delete(published, *key.Key)
+	}
+	_, err = p.ClaimPrekey(bob)
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrNotFound)
+	n, err = p.CountPrekeys(bob)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+}
+
+func (s *prekeysSuite) TestLastResort(c *gc.C) {
+	p := sfbolt.NewPrekeys(s.db)
+	bob := sftesting.MustNewKeyPair().PublicKey.Encode()
+
+	_, err := p.LastResortPrekey(bob)
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrNotFound)
+
+	for i := 0; i < 2; i++ {
+		key := &storage.Prekey{
+			Key:       sftesting.MustNewKeyPair().PublicKey,
+			Signature: []byte(fmt.Sprintf("signature %d", i)),
+		}
+		err = p.PutLastResortPrekey(bob, key)
+		c.Assert(err, gc.IsNil)
+
+		// The last-resort prekey is replaced, but never given out.
+		for j := 0; j < 2; j++ {
+			lastResort, err := p.LastResortPrekey(bob)
+			c.Assert(err, gc.IsNil)
+			c.Assert(lastResort, gc.DeepEquals, key)
+		}
+	}
+
+	// It is not a one-time prekey.
+	n, err := p.CountPrekeys(bob)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+	_, err = p.ClaimPrekey(bob)
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrNotFound)
+}
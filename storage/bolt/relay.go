@@ -0,0 +1,262 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package bolt
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"gopkg.in/errgo.v1"
+
+	"github.com/cmars/shadowfax/storage"
+)
+
+var (
+	// relayBucketName holds queued messages by sequence number, so that
+	// they are kept in the order queued.
+	relayBucketName = []byte("relay")
+
+	// relayIndexBucketName maps the router and ID of each queued message to
+	// its sequence number.
+	relayIndexBucketName = []byte("relay-index")
+
+	// relaySendersBucketName counts the messages queued from each sender.
+	relaySendersBucketName = []byte("relay-senders")
+)
+
+type relayRecord struct {
+	Router    string    `json:"router"`
+	ID        string    `json:"id"`
+	Recipient string    `json:"recipient"`
+	Sender    string    `json:"sender,omitempty"`
+	Contents  []byte    `json:"contents"`
+	Received  time.Time `json:"received"`
+	Expires   time.Time `json:"expires"`
+	Attempts  int       `json:"attempts,omitempty"`
+	Next      time.Time `json:"next"`
+}
+
+type relayQueue struct {
+	db           *bolt.DB
+	maxPerSender int
+}
+
+// NewRelayQueue returns a new storage.RelayQueue backed by bolt DB.
+func NewRelayQueue(db *bolt.DB) *relayQueue {
+	return &relayQueue{db: db}
+}
+
+// SetMaxPerSender implements storage.RelayQueue.
+func (q *relayQueue) SetMaxPerSender(maxMessages int) {
+	q.maxPerSender = maxMessages
+}
+
+func relayIndexKey(router, id string) []byte {
+	return []byte(router + "\x00" + id)
+}
+
+// relaySenderKey returns the key counting messages queued from a sender.
+// Messages from anonymous senders are counted together, as in the service.
+func relaySenderKey(sender string) []byte {
+	if sender == "" {
+		return sealedSenderBucketName
+	}
+	return []byte(sender)
+}
+
+// addSenderCount adds n to the number of messages queued from a sender, and
+// returns the previous count.
+func addSenderCount(tx *bolt.Tx, sender string, n int) (int, error) {
+	sendersBucket, err := tx.CreateBucketIfNotExists(relaySendersBucketName)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	key := relaySenderKey(sender)
+	var count int
+	if v := sendersBucket.Get(key); len(v) == 8 {
+		count = int(binary.BigEndian.Uint64(v))
+	}
+	if count+n <= 0 {
+		return count, errgo.Mask(sendersBucket.Delete(key))
+	}
+	return count, errgo.Mask(sendersBucket.Put(key, seqKey(uint64(count+n))))
+}
+
+// Enqueue implements storage.RelayQueue.
+func (q *relayQueue) Enqueue(router string, msg *storage.AddressedMessage) error {
+	buf, err := json.Marshal(&relayRecord{
+		Router:    router,
+		ID:        msg.ID,
+		Recipient: msg.Recipient,
+		Sender:    msg.Sender,
+		Contents:  msg.Contents,
+		Received:  msg.Received,
+		Expires:   msg.Expires,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return q.db.Update(func(tx *bolt.Tx) error {
+		relayBucket, err := tx.CreateBucketIfNotExists(relayBucketName)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		indexBucket, err := tx.CreateBucketIfNotExists(relayIndexBucketName)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		indexKey := relayIndexKey(router, msg.ID)
+		seq := indexBucket.Get(indexKey)
+		if seq == nil {
+			count, err := addSenderCount(tx, msg.Sender, 1)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			if q.maxPerSender > 0 && count >= q.maxPerSender {
+				return errgo.WithCausef(nil, storage.ErrMailboxFull, "sender has %d messages queued for relay", count)
+			}
+			n, err := relayBucket.NextSequence()
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			seq = seqKey(n)
+			err = indexBucket.Put(indexKey, seq)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+		} else {
+			// The replaced message is no longer counted for its sender.
+			var record relayRecord
+			err := json.Unmarshal(relayBucket.Get(seq), &record)
+			if err != nil {
+				return errgo.Notef(err, "invalid queued message #%s", seqString(seq))
+			}
+			if record.Sender != msg.Sender {
+				_, err = addSenderCount(tx, record.Sender, -1)
+				if err != nil {
+					return errgo.Mask(err)
+				}
+				_, err = addSenderCount(tx, msg.Sender, 1)
+				if err != nil {
+					return errgo.Mask(err)
+				}
+			}
+		}
+		return errgo.Mask(relayBucket.Put(seq, buf))
+	})
+}
+
+// Due implements storage.RelayQueue.
+func (q *relayQueue) Due(now time.Time) ([]*storage.RelayMessage, error) {
+	var result []*storage.RelayMessage
+	err := q.db.View(func(tx *bolt.Tx) error {
+		relayBucket := tx.Bucket(relayBucketName)
+		if relayBucket == nil {
+			return nil
+		}
+		return relayBucket.ForEach(func(k, v []byte) error {
+			var record relayRecord
+			err := json.Unmarshal(v, &record)
+			if err != nil {
+				return errgo.Notef(err, "invalid queued message #%s", seqString(k))
+			}
+			if record.Next.After(now) {
+				return nil
+			}
+			result = append(result, &storage.RelayMessage{
+				AddressedMessage: storage.AddressedMessage{
+					Message: storage.Message{
+						ID:       record.ID,
+						Contents: record.Contents,
+					},
+					Recipient: record.Recipient,
+					Sender:    record.Sender,
+					Received:  record.Received,
+					Expires:   record.Expires,
+				},
+				Router:   record.Router,
+				Attempts: record.Attempts,
+				Next:     record.Next,
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return result, nil
+}
+
+// Retry implements storage.RelayQueue.
+func (q *relayQueue) Retry(router string, ids []string, next time.Time) error {
+	return q.update(router, ids, func(tx *bolt.Tx, relayBucket *bolt.Bucket, seq []byte) error {
+		var record relayRecord
+		err := json.Unmarshal(relayBucket.Get(seq), &record)
+		if err != nil {
+			return errgo.Notef(err, "invalid queued message #%s", seqString(seq))
+		}
+		record.Attempts++
+		record.Next = next
+		buf, err := json.Marshal(&record)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return errgo.Mask(relayBucket.Put(seq, buf))
+	})
+}
+
+// Remove implements storage.RelayQueue.
+func (q *relayQueue) Remove(router string, ids []string) error {
+	return q.update(router, ids, func(tx *bolt.Tx, relayBucket *bolt.Bucket, seq []byte) error {
+		var record relayRecord
+		err := json.Unmarshal(relayBucket.Get(seq), &record)
+		if err != nil {
+			return errgo.Notef(err, "invalid queued message #%s", seqString(seq))
+		}
+		_, err = addSenderCount(tx, record.Sender, -1)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return errgo.Mask(relayBucket.Delete(seq))
+	})
+}
+
+// update calls f in a read-write transaction with the sequence number of
+// each message queued for the router with one of the given IDs. Messages
+// are removed from the index if f deletes them.
+func (q *relayQueue) update(router string, ids []string, f func(tx *bolt.Tx, relayBucket *bolt.Bucket, seq []byte) error) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		relayBucket := tx.Bucket(relayBucketName)
+		indexBucket := tx.Bucket(relayIndexBucketName)
+		if relayBucket == nil || indexBucket == nil {
+			return nil
+		}
+		for _, id := range ids {
+			indexKey := relayIndexKey(router, id)
+			seq := indexBucket.Get(indexKey)
+			if seq == nil {
+				continue
+			}
+			seq = append([]byte(nil), seq...)
+			err := f(tx, relayBucket, seq)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			if relayBucket.Get(seq) == nil {
+				err = indexBucket.Delete(indexKey)
+				if err != nil {
+					return errgo.Mask(err)
+				}
+			}
+		}
+		return nil
+	})
+}
@@ -9,6 +9,10 @@
 package bolt
 
 import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
 	"github.com/boltdb/bolt"
 	"gopkg.in/basen.v1"
 	"gopkg.in/errgo.v1"
@@ -17,13 +21,67 @@ import (
 	"github.com/cmars/shadowfax/storage"
 )
 
+var (
+	leasesBucketName = []byte("leases")
+	metaBucketName   = []byte("meta")
+	versionKey       = []byte("version")
+
+	// sealedSenderBucketName is the sender bucket holding messages pushed
+	// with a sealed sender. It cannot be mistaken for a public key.
+	sealedSenderBucketName = []byte("sealed")
+)
+
+// serviceVersion is the layout of stored messages. Since version 2, message
+// contents are prefixed with the time received and the expiration time.
+const serviceVersion = 2
+
+// messageHeaderLen is the length of the times prefixed to stored message
+// contents.
+const messageHeaderLen = 16
+
 type service struct {
-	db *bolt.DB
+	db          *bolt.DB
+	maxMessages int
+	maxBytes    int64
+	maxLease    int64
+	notifier    *storage.Notifier
 }
 
 // NewService returns a new storage.Service backed by bolt DB.
 func NewService(db *bolt.DB) *service {
-	return &service{db}
+	return &service{db: db}
+}
+
+// SetLimits sets the maximum number of messages and total bytes of message
+// contents stored for each recipient. Zero means no limit.
+func (s *service) SetLimits(maxMessages int, maxBytes int64) {
+	s.maxMessages = maxMessages
+	s.maxBytes = maxBytes
+}
+
+// SetMaxLeaseBytes sets the most message bytes leased by a single Fetch.
+// Messages beyond the limit are left for later fetches, though at least one
+// message is always leased if available. If zero, all available messages are
+// leased.
+func (s *service) SetMaxLeaseBytes(maxLease int64) {
+	s.maxLease = maxLease
+}
+
+// SetNotifier sets a notifier which is signalled when messages are pushed.
+func (s *service) SetNotifier(notifier *storage.Notifier) {
+	s.notifier = notifier
+}
+
+// update runs a read-write transaction on a database migrated to the current
+// layout.
+func (s *service) update(f func(tx *bolt.Tx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := migrateService(tx)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return f(tx)
+	})
 }
 
 // Push implements storage.Service.
@@ -32,88 +90,444 @@ func (s *service) Push(msg *storage.AddressedMessage) error {
 	if err != nil {
 		return errgo.Notef(err, "invalid recipient %q", msg.Recipient)
 	}
-	senderKey, err := sf.DecodePublicKey(msg.Sender)
-	if err != nil {
-		return errgo.Notef(err, "invalid sender %q", msg.Sender)
+	senderName := sealedSenderBucketName
+	if msg.Sender != "" {
+		senderKey, err := sf.DecodePublicKey(msg.Sender)
+		if err != nil {
+			return errgo.Notef(err, "invalid sender %q", msg.Sender)
+		}
+		senderName = senderKey[:]
 	}
 	nonce, err := sf.DecodeNonce(msg.ID)
 	if err != nil {
 		return errgo.Notef(err, "invalid nonce %q", msg.ID)
 	}
+	received := msg.Received
+	if received.IsZero() {
+		received = time.Now()
+	}
 
-	return s.db.Update(func(tx *bolt.Tx) error {
+	err = s.update(func(tx *bolt.Tx) error {
 		rcptBucket, err := tx.CreateBucketIfNotExists(rcptKey[:])
 		if err != nil {
 			return errgo.Mask(err)
 		}
-		senderBucket, err := rcptBucket.CreateBucketIfNotExists(senderKey[:])
+		err = s.checkLimits(rcptBucket, len(msg.Contents))
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(storage.ErrMailboxFull))
+		}
+		senderBucket, err := rcptBucket.CreateBucketIfNotExists(senderName)
 		if err != nil {
 			return errgo.Mask(err)
 		}
-		err = senderBucket.Put(nonce[:], msg.Contents)
+		err = senderBucket.Put(nonce[:], encodeMessage(received, msg.Expires, msg.Contents))
 		if err != nil {
 			return errgo.Mask(err)
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	if s.notifier != nil {
+		s.notifier.Notify(rcptKey.Encode())
+	}
+	return nil
+}
+
+// checkLimits returns an error with cause storage.ErrMailboxFull if storing a
+// message of the given size would exceed the recipient's limits.
+func (s *service) checkLimits(rcptBucket *bolt.Bucket, size int) error {
+	if s.maxMessages <= 0 && s.maxBytes <= 0 {
+		return nil
+	}
+	if s.maxBytes > 0 && int64(size) > s.maxBytes {
+		return errgo.WithCausef(nil, storage.ErrMailboxFull, "message exceeds %d bytes", s.maxBytes)
+	}
+	senders, err := senderNames(rcptBucket)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	count, total := 0, int64(size)
+	for _, sender := range senders {
+		err = rcptBucket.Bucket(sender).ForEach(func(_, v []byte) error {
+			count++
+			if len(v) > messageHeaderLen {
+				total += int64(len(v) - messageHeaderLen)
+			}
+			return nil
+		})
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if s.maxMessages > 0 && count >= s.maxMessages {
+		return errgo.WithCausef(nil, storage.ErrMailboxFull, "mailbox has %d messages", count)
+	}
+	if s.maxBytes > 0 && total > s.maxBytes {
+		return errgo.WithCausef(nil, storage.ErrMailboxFull, "mailbox would exceed %d bytes", s.maxBytes)
+	}
+	return nil
 }
 
 // Pop implements storage.Service.
-func (s *service) Pop(recipient string) (_ []*storage.AddressedMessage, popErr error) {
+func (s *service) Pop(recipient string) ([]*storage.AddressedMessage, error) {
 	rcptKey, err := sf.DecodePublicKey(recipient)
 	if err != nil {
 		return nil, errgo.Notef(err, "invalid recipient %q", recipient)
 	}
 
-	tx, err := s.db.Begin(true)
+	now := time.Now()
+	var result []*storage.AddressedMessage
+	err = s.update(func(tx *bolt.Tx) error {
+		rcptBucket := tx.Bucket(rcptKey[:])
+		if rcptBucket == nil {
+			return nil
+		}
+		err := deleteLeases(tx, rcptKey)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+
+		senders, err := senderNames(rcptBucket)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		for _, sender := range senders {
+			senderStr := senderString(sender)
+			err = rcptBucket.Bucket(sender).ForEach(func(id, v []byte) error {
+				msg := decodeMessage(id, v)
+				if msg.expired(now) {
+					return nil
+				}
+				msg.Recipient = recipient
+				msg.Sender = senderStr
+				result = append(result, msg.AddressedMessage)
+				return nil
+			})
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			err = rcptBucket.DeleteBucket(sender)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	defer func() {
-		if popErr == nil {
-			popErr = errgo.Mask(tx.Commit())
-		} else {
-			tx.Rollback()
+	return result, nil
+}
+
+// Fetch implements storage.Service.
+func (s *service) Fetch(recipient string, leaseTime time.Duration) (*storage.Lease, error) {
+	rcptKey, err := sf.DecodePublicKey(recipient)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid recipient %q", recipient)
+	}
+
+	now := time.Now()
+	lease := &storage.Lease{Expires: now.Add(leaseTime)}
+	expiresBytes := encodeTime(lease.Expires)
+	err = s.update(func(tx *bolt.Tx) error {
+		rcptBucket := tx.Bucket(rcptKey[:])
+		if rcptBucket == nil {
+			return nil
+		}
+		leasesBucket, err := tx.CreateBucketIfNotExists(leasesBucketName)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		rcptLeases, err := leasesBucket.CreateBucketIfNotExists(rcptKey[:])
+		if err != nil {
+			return errgo.Mask(err)
 		}
-	}()
 
-	var result []*storage.AddressedMessage
-	rcptBucket, err := tx.CreateBucketIfNotExists(rcptKey[:])
+		senders, err := senderNames(rcptBucket)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		var leased [][]byte
+		var leasedBytes int64
+		for _, sender := range senders {
+			senderStr := senderString(sender)
+			err = rcptBucket.Bucket(sender).ForEach(func(id, v []byte) error {
+				if leaseBytes := rcptLeases.Get(id); leaseBytes != nil && decodeTime(leaseBytes).After(now) {
+					return nil
+				}
+				msg := decodeMessage(id, v)
+				if msg.expired(now) {
+					return nil
+				}
+				size := int64(len(msg.Contents))
+				if s.maxLease > 0 && len(leased) > 0 && leasedBytes+size > s.maxLease {
+					return errLeaseFull
+				}
+				msg.Recipient = recipient
+				msg.Sender = senderStr
+				lease.Messages = append(lease.Messages, msg.AddressedMessage)
+				leased = append(leased, append([]byte(nil), id...))
+				leasedBytes += size
+				return nil
+			})
+			if err == errLeaseFull {
+				break
+			} else if err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		for _, id := range leased {
+			err = rcptLeases.Put(id, expiresBytes)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	senderCursor := rcptBucket.Cursor()
-	for sender, v := senderCursor.First(); sender != nil; sender, v = senderCursor.Next() {
-		if v != nil {
-			continue
+	return lease, nil
+}
+
+// errLeaseFull stops iteration once a lease reaches its size limit.
+var errLeaseFull = errgo.New("lease full")
+
+// Ack implements storage.Service.
+func (s *service) Ack(recipient string, ids []string) error {
+	rcptKey, err := sf.DecodePublicKey(recipient)
+	if err != nil {
+		return errgo.Notef(err, "invalid recipient %q", recipient)
+	}
+	var nonces []*sf.Nonce
+	for _, id := range ids {
+		nonce, err := sf.DecodeNonce(id)
+		if err != nil {
+			return errgo.Notef(err, "invalid nonce %q", id)
+		}
+		nonces = append(nonces, nonce)
+	}
+
+	return s.update(func(tx *bolt.Tx) error {
+		rcptBucket := tx.Bucket(rcptKey[:])
+		if rcptBucket == nil {
+			return nil
 		}
-		senderBucket := rcptBucket.Bucket(sender)
-		if senderBucket == nil {
-			err = senderCursor.Delete()
+		senders, err := senderNames(rcptBucket)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		for _, sender := range senders {
+			senderBucket := rcptBucket.Bucket(sender)
+			for _, nonce := range nonces {
+				err := senderBucket.Delete(nonce[:])
+				if err != nil {
+					return errgo.Mask(err)
+				}
+			}
+		}
+		for _, nonce := range nonces {
+			err := deleteLease(tx, rcptKey[:], nonce[:])
 			if err != nil {
-				return nil, errgo.Mask(err)
+				return errgo.Mask(err)
 			}
-			continue
-		}
-		senderStr := basen.Base58.EncodeToString(sender)
-		msgCursor := senderBucket.Cursor()
-		for id, msg := msgCursor.First(); id != nil; id, msg = msgCursor.Next() {
-			idStr := basen.Base58.EncodeToString(id)
-			msgContents := make([]byte, len(msg))
-			copy(msgContents, msg)
-			result = append(result, &storage.AddressedMessage{
-				Recipient: recipient,
-				Sender:    senderStr,
-				Message: storage.Message{
-					ID:       idStr,
-					Contents: msgContents,
-				},
+		}
+		return nil
+	})
+}
+
+// Expire implements storage.Service.
+func (s *service) Expire() (int, error) {
+	now := time.Now()
+	var n int
+	err := s.update(func(tx *bolt.Tx) error {
+		recipients, err := recipientNames(tx)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		for _, rcpt := range recipients {
+			rcptBucket := tx.Bucket(rcpt)
+			senders, err := senderNames(rcptBucket)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			for _, sender := range senders {
+				senderBucket := rcptBucket.Bucket(sender)
+				var expired [][]byte
+				err = senderBucket.ForEach(func(id, v []byte) error {
+					if decodeMessage(id, v).expired(now) {
+						expired = append(expired, append([]byte(nil), id...))
+					}
+					return nil
+				})
+				if err != nil {
+					return errgo.Mask(err)
+				}
+				for _, id := range expired {
+					err = senderBucket.Delete(id)
+					if err != nil {
+						return errgo.Mask(err)
+					}
+					err = deleteLease(tx, rcpt, id)
+					if err != nil {
+						return errgo.Mask(err)
+					}
+					n++
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	return n, nil
+}
+
+// migrateService converts stored messages to the current layout, if
+// necessary.
+func migrateService(tx *bolt.Tx) error {
+	metaBucket, err := tx.CreateBucketIfNotExists(metaBucketName)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if version := metaBucket.Get(versionKey); len(version) == 1 && version[0] >= serviceVersion {
+		return nil
+	}
+
+	// Messages stored before version 2 have no time received, so they are
+	// considered received now, and never expire.
+	now := time.Now()
+	recipients, err := recipientNames(tx)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, rcpt := range recipients {
+		rcptBucket := tx.Bucket(rcpt)
+		senders, err := senderNames(rcptBucket)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		for _, sender := range senders {
+			senderBucket := rcptBucket.Bucket(sender)
+			var ids, contents [][]byte
+			err = senderBucket.ForEach(func(id, v []byte) error {
+				ids = append(ids, append([]byte(nil), id...))
+				contents = append(contents, append([]byte(nil), v...))
+				return nil
 			})
-			msgCursor.Delete()
 			if err != nil {
-				return nil, errgo.Mask(err)
+				return errgo.Mask(err)
+			}
+			for i := range ids {
+				err = senderBucket.Put(ids[i], encodeMessage(now, time.Time{}, contents[i]))
+				if err != nil {
+					return errgo.Mask(err)
+				}
 			}
 		}
 	}
-	return result, nil
+	return errgo.Mask(metaBucket.Put(versionKey, []byte{serviceVersion}))
+}
+
+// recipientNames returns the names of all recipient buckets.
+func recipientNames(tx *bolt.Tx) ([][]byte, error) {
+	var result [][]byte
+	err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if len(name) == len(sf.PublicKey{}) {
+			result = append(result, append([]byte(nil), name...))
+		}
+		return nil
+	})
+	return result, errgo.Mask(err)
+}
+
+// senderString returns the encoded sender for a sender bucket name.
+func senderString(name []byte) string {
+	if bytes.Equal(name, sealedSenderBucketName) {
+		return ""
+	}
+	return basen.Base58.EncodeToString(name)
+}
+
+// senderNames returns the names of all sender buckets within a recipient
+// bucket.
+func senderNames(rcptBucket *bolt.Bucket) ([][]byte, error) {
+	var result [][]byte
+	err := rcptBucket.ForEach(func(sender, v []byte) error {
+		if v == nil && rcptBucket.Bucket(sender) != nil {
+			result = append(result, append([]byte(nil), sender...))
+		}
+		return nil
+	})
+	return result, errgo.Mask(err)
+}
+
+type storedMessage struct {
+	*storage.AddressedMessage
+}
+
+func (m storedMessage) expired(now time.Time) bool {
+	return !m.Expires.IsZero() && !m.Expires.After(now)
+}
+
+func encodeMessage(received, expires time.Time, contents []byte) []byte {
+	buf := make([]byte, 0, messageHeaderLen+len(contents))
+	buf = append(buf, encodeTime(received)...)
+	buf = append(buf, encodeTime(expires)...)
+	return append(buf, contents...)
+}
+
+func decodeMessage(id, v []byte) storedMessage {
+	msg := &storage.AddressedMessage{
+		Message: storage.Message{
+			ID: basen.Base58.EncodeToString(id),
+		},
+	}
+	if len(v) >= messageHeaderLen {
+		msg.Received = decodeTime(v[:8])
+		msg.Expires = decodeTime(v[8:16])
+		msg.Contents = append([]byte(nil), v[messageHeaderLen:]...)
+	}
+	return storedMessage{msg}
+}
+
+func deleteLeases(tx *bolt.Tx, rcptKey *sf.PublicKey) error {
+	leasesBucket := tx.Bucket(leasesBucketName)
+	if leasesBucket == nil || leasesBucket.Bucket(rcptKey[:]) == nil {
+		return nil
+	}
+	return errgo.Mask(leasesBucket.DeleteBucket(rcptKey[:]))
+}
+
+func deleteLease(tx *bolt.Tx, rcpt, id []byte) error {
+	leasesBucket := tx.Bucket(leasesBucketName)
+	if leasesBucket == nil {
+		return nil
+	}
+	rcptLeases := leasesBucket.Bucket(rcpt)
+	if rcptLeases == nil {
+		return nil
+	}
+	return errgo.Mask(rcptLeases.Delete(id))
+}
+
+// encodeTime encodes a time as big-endian Unix nanoseconds. The zero time is
+// encoded as zero.
+func encodeTime(t time.Time) []byte {
+	buf := make([]byte, 8)
+	if !t.IsZero() {
+		binary.BigEndian.PutUint64(buf, uint64(t.UnixNano()))
+	}
+	return buf
+}
+
+func decodeTime(buf []byte) time.Time {
+	n := int64(binary.BigEndian.Uint64(buf))
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
 }
@@ -0,0 +1,271 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package bolt_test
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/cmars/shadowfax/storage"
+	sfbolt "github.com/cmars/shadowfax/storage/bolt"
+	sftesting "github.com/cmars/shadowfax/testing"
+)
+
+type serviceSuite struct {
+	db *bolt.DB
+}
+
+var _ = gc.Suite(&serviceSuite{})
+
+func (s *serviceSuite) SetUpTest(c *gc.C) {
+	dir := c.MkDir()
+	var err error
+	s.db, err = bolt.Open(filepath.Join(dir, "testdb"), 0600, nil)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *serviceSuite) TearDownTest(c *gc.C) {
+	s.db.Close()
+}
+
+func (s *serviceSuite) push(c *gc.C, service storage.Service, sender, recipient string) string {
+	return s.pushExpires(c, service, sender, recipient, time.Time{})
+}
+
+func (s *serviceSuite) pushExpires(c *gc.C, service storage.Service, sender, recipient string, expires time.Time) string {
+	id := sftesting.MustNewNonce().Encode()
+	err := service.Push(&storage.AddressedMessage{
+		Sender:    sender,
+		Recipient: recipient,
+		Message: storage.Message{
+			ID:       id,
+			Contents: []byte("hello"),
+		},
+		Expires: expires,
+	})
+	c.Assert(err, gc.IsNil)
+	return id
+}
+
+func (s *serviceSuite) TestFetchAck(c *gc.C) {
+	alice := sftesting.MustNewKeyPair().PublicKey.Encode()
+	bob := sftesting.MustNewKeyPair().PublicKey.Encode()
+	service := sfbolt.NewService(s.db)
+
+	id1 := s.push(c, service, alice, bob)
+	id2 := s.push(c, service, alice, bob)
+
+	lease, err := service.Fetch(bob, time.Minute)
+	c.Assert(err, gc.IsNil)
+	c.Assert(lease.Messages, gc.HasLen, 2)
+
+	// Leased messages are not fetched again.
+	lease, err = service.Fetch(bob, time.Minute)
+	c.Assert(err, gc.IsNil)
+	c.Assert(lease.Messages, gc.HasLen, 0)
+
+	// Newly pushed messages are.
+	id3 := s.push(c, service, alice, bob)
+	lease, err = service.Fetch(bob, time.Minute)
+	c.Assert(err, gc.IsNil)
+	c.Assert(lease.Messages, gc.HasLen, 1)
+	c.Assert(lease.Messages[0].ID, gc.Equals, id3)
+
+	err = service.Ack(bob, []string{id1, id3})
+	c.Assert(err, gc.IsNil)
+
+	msgs, err := service.Pop(bob)
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	c.Assert(msgs[0].ID, gc.Equals, id2)
+}
+
+func (s *serviceSuite) TestLeaseExpires(c *gc.C) {
+	alice := sftesting.MustNewKeyPair().PublicKey.Encode()
+	bob := sftesting.MustNewKeyPair().PublicKey.Encode()
+	service := sfbolt.NewService(s.db)
+
+	id := s.push(c, service, alice, bob)
+
+	lease, err := service.Fetch(bob, time.Millisecond)
+	c.Assert(err, gc.IsNil)
+	c.Assert(lease.Messages, gc.HasLen, 1)
+	time.Sleep(10 * time.Millisecond)
+
+	lease, err = service.Fetch(bob, time.Minute)
+	c.Assert(err, gc.IsNil)
+	c.Assert(lease.Messages, gc.HasLen, 1)
+	c.Assert(lease.Messages[0].ID, gc.Equals, id)
+	c.Assert(lease.Messages[0].Sender, gc.Equals, alice)
+	c.Assert(lease.Messages[0].Contents, gc.DeepEquals, []byte("hello"))
+}
+
+func (s *serviceSuite) TestFetchEmpty(c *gc.C) {
+	bob := sftesting.MustNewKeyPair().PublicKey.Encode()
+	service := sfbolt.NewService(s.db)
+
+	lease, err := service.Fetch(bob, time.Minute)
+	c.Assert(err, gc.IsNil)
+	c.Assert(lease.Messages, gc.HasLen, 0)
+	err = service.Ack(bob, nil)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *serviceSuite) TestExpire(c *gc.C) {
+	alice := sftesting.MustNewKeyPair().PublicKey.Encode()
+	bob := sftesting.MustNewKeyPair().PublicKey.Encode()
+	carol := sftesting.MustNewKeyPair().PublicKey.Encode()
+	service := sfbolt.NewService(s.db)
+
+	now := time.Now()
+	s.pushExpires(c, service, alice, bob, now.Add(-time.Second))
+	s.pushExpires(c, service, alice, carol, now.Add(-time.Second))
+	id1 := s.pushExpires(c, service, alice, bob, now.Add(time.Hour))
+	id2 := s.push(c, service, carol, bob)
+
+	// Expired messages are not delivered, even before they are removed.
+	lease, err := service.Fetch(bob, time.Minute)
+	c.Assert(err, gc.IsNil)
+	c.Assert(lease.Messages, gc.HasLen, 2)
+
+	n, err := service.Expire()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 2)
+	n, err = service.Expire()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+
+	msgs, err := service.Pop(bob)
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 2)
+	ids := map[string]bool{msgs[0].ID: true, msgs[1].ID: true}
+	c.Assert(ids, gc.DeepEquals, map[string]bool{id1: true, id2: true})
+	for _, msg := range msgs {
+		c.Assert(msg.Received.IsZero(), gc.Equals, false)
+		c.Assert(msg.Received.After(now.Add(time.Second)), gc.Equals, false)
+	}
+}
+
+func (s *serviceSuite) TestMigrateLegacy(c *gc.C) {
+	alice := sftesting.MustNewKeyPair().PublicKey
+	bob := sftesting.MustNewKeyPair().PublicKey
+	nonce := sftesting.MustNewNonce()
+
+	// Messages were stored as their contents alone, prior to version 2.
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		rcptBucket, err := tx.CreateBucket(bob[:])
+		c.Assert(err, gc.IsNil)
+		senderBucket, err := rcptBucket.CreateBucket(alice[:])
+		c.Assert(err, gc.IsNil)
+		return senderBucket.Put(nonce[:], []byte("legacy"))
+	})
+	c.Assert(err, gc.IsNil)
+
+	service := sfbolt.NewService(s.db)
+	n, err := service.Expire()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+	msgs, err := service.Pop(bob.Encode())
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	c.Assert(msgs[0].ID, gc.Equals, nonce.Encode())
+	c.Assert(msgs[0].Sender, gc.Equals, alice.Encode())
+	c.Assert(msgs[0].Contents, gc.DeepEquals, []byte("legacy"))
+	c.Assert(msgs[0].Expires.IsZero(), gc.Equals, true)
+}
+
+func (s *serviceSuite) pushContents(service storage.Service, sender, recipient string, contents []byte) error {
+	return service.Push(&storage.AddressedMessage{
+		Sender:    sender,
+		Recipient: recipient,
+		Message: storage.Message{
+			ID:       sftesting.MustNewNonce().Encode(),
+			Contents: contents,
+		},
+	})
+}
+
+func (s *serviceSuite) TestMessageLimit(c *gc.C) {
+	alice := sftesting.MustNewKeyPair().PublicKey.Encode()
+	bob := sftesting.MustNewKeyPair().PublicKey.Encode()
+	carol := sftesting.MustNewKeyPair().PublicKey.Encode()
+	service := sfbolt.NewService(s.db)
+	service.SetLimits(2, 0)
+
+	c.Assert(s.pushContents(service, alice, bob, []byte("one")), gc.IsNil)
+	c.Assert(s.pushContents(service, carol, bob, []byte("two")), gc.IsNil)
+	err := s.pushContents(service, alice, bob, []byte("three"))
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrMailboxFull)
+
+	// Limits are per recipient.
+	c.Assert(s.pushContents(service, alice, carol, []byte("one")), gc.IsNil)
+
+	msgs, err := service.Pop(bob)
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 2)
+	c.Assert(s.pushContents(service, alice, bob, []byte("three")), gc.IsNil)
+}
+
+func (s *serviceSuite) TestByteLimit(c *gc.C) {
+	alice := sftesting.MustNewKeyPair().PublicKey.Encode()
+	bob := sftesting.MustNewKeyPair().PublicKey.Encode()
+	service := sfbolt.NewService(s.db)
+	service.SetLimits(0, 10)
+
+	err := s.pushContents(service, alice, bob, make([]byte, 11))
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrMailboxFull)
+	c.Assert(s.pushContents(service, alice, bob, make([]byte, 6)), gc.IsNil)
+	err = s.pushContents(service, alice, bob, make([]byte, 5))
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrMailboxFull)
+	c.Assert(s.pushContents(service, alice, bob, make([]byte, 4)), gc.IsNil)
+}
+
+func (s *serviceSuite) TestMaxLeaseBytes(c *gc.C) {
+	alice := sftesting.MustNewKeyPair().PublicKey.Encode()
+	bob := sftesting.MustNewKeyPair().PublicKey.Encode()
+	service := sfbolt.NewService(s.db)
+	service.SetMaxLeaseBytes(10)
+
+	c.Assert(s.pushContents(service, alice, bob, make([]byte, 6)), gc.IsNil)
+	c.Assert(s.pushContents(service, alice, bob, make([]byte, 6)), gc.IsNil)
+	c.Assert(s.pushContents(service, alice, bob, make([]byte, 20)), gc.IsNil)
+
+	// Each lease stays within the limit, unless a single message exceeds it.
+	for _, n := range []int{1, 1, 1, 0} {
+		lease, err := service.Fetch(bob, time.Minute)
+		c.Assert(err, gc.IsNil)
+		c.Assert(lease.Messages, gc.HasLen, n)
+	}
+}
+
+func (s *serviceSuite) TestSealedSender(c *gc.C) {
+	alice := sftesting.MustNewKeyPair().PublicKey.Encode()
+	bob := sftesting.MustNewKeyPair().PublicKey.Encode()
+	service := sfbolt.NewService(s.db)
+
+	s.push(c, service, alice, bob)
+	id := s.push(c, service, "", bob)
+
+	lease, err := service.Fetch(bob, time.Minute)
+	c.Assert(err, gc.IsNil)
+	c.Assert(lease.Messages, gc.HasLen, 2)
+	senders := map[string]string{}
+	for _, msg := range lease.Messages {
+		senders[msg.ID] = msg.Sender
+	}
+	c.Assert(senders[id], gc.Equals, "")
+
+	msgs, err := service.Pop(bob)
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 2)
+}
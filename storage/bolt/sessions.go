@@ -0,0 +1,238 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package bolt
+
+import (
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/nacl/secretbox"
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/storage"
+)
+
+var (
+	prekeysBucketName           = []byte("prekeys")
+	lastResortPrekeysBucketName = []byte("last-resort-prekeys")
+	sessionsBucketName          = []byte("sessions")
+)
+
+type sessions struct {
+	db        *bolt.DB
+	secretKey *sf.SecretKey
+}
+
+// NewSessions returns a new storage.Sessions backed by bolt DB. Prekeys and
+// session state are sealed with the secret key, and may be kept in the same
+// DB as the vault.
+func NewSessions(db *bolt.DB, secretKey *sf.SecretKey) *sessions {
+	return &sessions{db, secretKey}
+}
+
+func (s *sessions) seal(value []byte) ([]byte, error) {
+	return sealRandom(value, s.secretKey)
+}
+
+func (s *sessions) open(encBytes []byte) ([]byte, bool) {
+	return openRandom(encBytes, s.secretKey)
+}
+
+// sealRandom encrypts a value with a random nonce, which is prepended to it.
+func sealRandom(value []byte, secretKey *sf.SecretKey) ([]byte, error) {
+	nonce, err := sf.NewNonce()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return secretbox.Seal(nonce[:], value, (*[24]byte)(nonce), (*[32]byte)(secretKey)), nil
+}
+
+// openRandom decrypts a value sealed by sealRandom.
+func openRandom(encBytes []byte, secretKey *sf.SecretKey) ([]byte, bool) {
+	if len(encBytes) < 24 {
+		return nil, false
+	}
+	var nonce sf.Nonce
+	copy(nonce[:], encBytes[:24])
+	return secretbox.Open(nil, encBytes[24:], (*[24]byte)(&nonce), (*[32]byte)(secretKey))
+}
+
+// rekeySessions re-encrypts all prekeys and session state in a transaction
+// with a new secret key.
+func rekeySessions(tx *bolt.Tx, oldKey, newKey *sf.SecretKey) error {
+	for _, name := range [][]byte{prekeysBucketName, lastResortPrekeysBucketName, sessionsBucketName} {
+		b := tx.Bucket(name)
+		if b == nil {
+			continue
+		}
+		// Collect the re-encrypted values first; the bucket must not be
+		// changed while a cursor traverses it.
+		resealed := make(map[string][]byte)
+		err := b.ForEach(func(k, encBytes []byte) error {
+			value, ok := openRandom(encBytes, oldKey)
+			if !ok {
+				return errgo.Newf("error opening %s %q", name, k)
+			}
+			encBytes, err := sealRandom(value, newKey)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			resealed[string(k)] = encBytes
+			return nil
+		})
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		for k, encBytes := range resealed {
+			err = b.Put([]byte(k), encBytes)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+		}
+	}
+	return nil
+}
+
+// PutPrekey implements storage.Sessions.
+func (s *sessions) PutPrekey(keyPair *sf.KeyPair) error {
+	return s.putPrekey(prekeysBucketName, keyPair)
+}
+
+// PutLastResortPrekey implements storage.Sessions.
+func (s *sessions) PutLastResortPrekey(keyPair *sf.KeyPair) error {
+	return s.putPrekey(lastResortPrekeysBucketName, keyPair)
+}
+
+func (s *sessions) putPrekey(bucketName []byte, keyPair *sf.KeyPair) error {
+	encBytes, err := s.seal(keyPair.PrivateKey[:])
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		prekeysBucket, err := tx.CreateBucketIfNotExists(bucketName)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return errgo.Mask(prekeysBucket.Put(keyPair.PublicKey[:], encBytes))
+	})
+}
+
+// GetPrekey implements storage.Sessions.
+func (s *sessions) GetPrekey(key *sf.PublicKey) (*sf.KeyPair, error) {
+	var keyPair sf.KeyPair
+	err := s.db.View(func(tx *bolt.Tx) error {
+		encBytes := getPrekey(tx, prekeysBucketName, key)
+		if encBytes == nil {
+			encBytes = getPrekey(tx, lastResortPrekeysBucketName, key)
+		}
+		if encBytes == nil {
+			return errgo.WithCausef(nil, storage.ErrNotFound, "prekey not found for %q", key.Encode())
+		}
+		privBytes, ok := s.open(encBytes)
+		if !ok || len(privBytes) != 32 {
+			return errgo.Newf("error opening prekey %q", key.Encode())
+		}
+		keyPair.PublicKey = new(sf.PublicKey)
+		copy(keyPair.PublicKey[:], key[:])
+		keyPair.PrivateKey = new(sf.PrivateKey)
+		copy(keyPair.PrivateKey[:], privBytes)
+		return nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(storage.ErrNotFound))
+	}
+	return &keyPair, nil
+}
+
+// getPrekey returns the sealed private key of a prekey in the named bucket,
+// or nil if there is none.
+func getPrekey(tx *bolt.Tx, bucketName []byte, key *sf.PublicKey) []byte {
+	prekeysBucket := tx.Bucket(bucketName)
+	if prekeysBucket == nil {
+		return nil
+	}
+	return prekeysBucket.Get(key[:])
+}
+
+// Get implements storage.Sessions.
+func (s *sessions) Get(id string) ([]byte, error) {
+	var state []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		sessionsBucket := tx.Bucket(sessionsBucketName)
+		if sessionsBucket == nil {
+			return errgo.WithCausef(nil, storage.ErrNotFound, "session %q not found", id)
+		}
+		encBytes := sessionsBucket.Get([]byte(id))
+		if encBytes == nil {
+			return errgo.WithCausef(nil, storage.ErrNotFound, "session %q not found", id)
+		}
+		var ok bool
+		state, ok = s.open(encBytes)
+		if !ok {
+			return errgo.Newf("error opening session %q", id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(storage.ErrNotFound))
+	}
+	return state, nil
+}
+
+// Update implements storage.Sessions.
+func (s *sessions) Update(id string, f func(state []byte) ([]byte, error)) error {
+	return s.update(id, nil, f)
+}
+
+// UpdatePrekey implements storage.Sessions.
+func (s *sessions) UpdatePrekey(id string, prekey *sf.PublicKey, f func(state []byte) ([]byte, error)) error {
+	return s.update(id, prekey, f)
+}
+
+// update updates the state of a session, removing the one-time prekey it was
+// started with, if any, in the same transaction.
+func (s *sessions) update(id string, prekey *sf.PublicKey, f func(state []byte) ([]byte, error)) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		sessionsBucket, err := tx.CreateBucketIfNotExists(sessionsBucketName)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		var state []byte
+		if encBytes := sessionsBucket.Get([]byte(id)); encBytes != nil {
+			var ok bool
+			state, ok = s.open(encBytes)
+			if !ok {
+				return errgo.Newf("error opening session %q", id)
+			}
+		}
+		if prekey != nil {
+			prekeysBucket, err := tx.CreateBucketIfNotExists(prekeysBucketName)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			if prekeysBucket.Get(prekey[:]) != nil {
+				err = prekeysBucket.Delete(prekey[:])
+				if err != nil {
+					return errgo.Mask(err)
+				}
+			} else if state == nil && getPrekey(tx, lastResortPrekeysBucketName, prekey) == nil {
+				return errgo.WithCausef(nil, storage.ErrNotFound, "prekey not found for %q", prekey.Encode())
+			}
+		}
+		state, err = f(state)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		encBytes, err := s.seal(state)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return errgo.Mask(sessionsBucket.Put([]byte(id), encBytes))
+	})
+	return errgo.Mask(err, errgo.Any)
+}
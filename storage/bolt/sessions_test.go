@@ -0,0 +1,147 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package bolt_test
+
+import (
+	"bytes"
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/storage"
+	sfbolt "github.com/cmars/shadowfax/storage/bolt"
+	sftesting "github.com/cmars/shadowfax/testing"
+)
+
+type sessionsSuite struct {
+	db *bolt.DB
+}
+
+var _ = gc.Suite(&sessionsSuite{})
+
+func (s *sessionsSuite) SetUpTest(c *gc.C) {
+	var err error
+	s.db, err = bolt.Open(filepath.Join(c.MkDir(), "testdb"), 0600, nil)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *sessionsSuite) TearDownTest(c *gc.C) {
+	s.db.Close()
+}
+
+func (s *sessionsSuite) TestPrekeys(c *gc.C) {
+	secKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+	sessions := sfbolt.NewSessions(s.db, secKey)
+
+	kp := sftesting.MustNewKeyPair()
+	_, err = sessions.GetPrekey(kp.PublicKey)
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrNotFound)
+
+	err = sessions.PutPrekey(kp)
+	c.Assert(err, gc.IsNil)
+	prekey, err := sessions.GetPrekey(kp.PublicKey)
+	c.Assert(err, gc.IsNil)
+	c.Assert(prekey, gc.DeepEquals, kp)
+
+	// The prekey is kept if the session is not updated.
+	err = sessions.UpdatePrekey("foo", kp.PublicKey, func(state []byte) ([]byte, error) {
+		return nil, errgo.New("nope")
+	})
+	c.Assert(err, gc.ErrorMatches, "nope")
+	_, err = sessions.GetPrekey(kp.PublicKey)
+	c.Assert(err, gc.IsNil)
+
+	// The prekey is removed along with the first update of the session.
+	err = sessions.UpdatePrekey("foo", kp.PublicKey, func(state []byte) ([]byte, error) {
+		c.Assert(state, gc.IsNil)
+		return []byte("state"), nil
+	})
+	c.Assert(err, gc.IsNil)
+	_, err = sessions.GetPrekey(kp.PublicKey)
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrNotFound)
+
+	// The session can still be updated, but no other can be started with
+	// the prekey.
+	err = sessions.UpdatePrekey("foo", kp.PublicKey, func(state []byte) ([]byte, error) {
+		c.Assert(string(state), gc.Equals, "state")
+		return state, nil
+	})
+	c.Assert(err, gc.IsNil)
+	err = sessions.UpdatePrekey("bar", kp.PublicKey, func(state []byte) ([]byte, error) {
+		c.Fatalf("session updated without prekey")
+		return nil, nil
+	})
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrNotFound)
+}
+
+func (s *sessionsSuite) TestLastResortPrekey(c *gc.C) {
+	secKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+	sessions := sfbolt.NewSessions(s.db, secKey)
+
+	kp := sftesting.MustNewKeyPair()
+	err = sessions.PutLastResortPrekey(kp)
+	c.Assert(err, gc.IsNil)
+
+	// The last-resort prekey is kept as it starts each session.
+	for _, id := range []string{"foo", "bar"} {
+		err = sessions.UpdatePrekey(id, kp.PublicKey, func(state []byte) ([]byte, error) {
+			c.Assert(state, gc.IsNil)
+			return []byte("state"), nil
+		})
+		c.Assert(err, gc.IsNil)
+		prekey, err := sessions.GetPrekey(kp.PublicKey)
+		c.Assert(err, gc.IsNil)
+		c.Assert(prekey, gc.DeepEquals, kp)
+	}
+}
+
+func (s *sessionsSuite) TestUpdate(c *gc.C) {
+	secKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+	sessions := sfbolt.NewSessions(s.db, secKey)
+
+	_, err = sessions.Get("foo")
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrNotFound)
+
+	err = sessions.Update("foo", func(state []byte) ([]byte, error) {
+		c.Assert(state, gc.IsNil)
+		return []byte("secret state 1"), nil
+	})
+	c.Assert(err, gc.IsNil)
+	err = sessions.Update("foo", func(state []byte) ([]byte, error) {
+		c.Assert(string(state), gc.Equals, "secret state 1")
+		return nil, errgo.New("nope")
+	})
+	c.Assert(err, gc.ErrorMatches, "nope")
+	state, err := sessions.Get("foo")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(state), gc.Equals, "secret state 1")
+
+	// State is stored encrypted.
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return b.ForEach(func(k, v []byte) error {
+				c.Assert(bytes.Contains(v, []byte("secret state")), gc.Equals, false)
+				return nil
+			})
+		})
+	})
+	c.Assert(err, gc.IsNil)
+
+	// State cannot be opened with another key.
+	otherKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+	_, err = sfbolt.NewSessions(s.db, otherKey).Get("foo")
+	c.Assert(err, gc.ErrorMatches, `error opening session "foo"`)
+}
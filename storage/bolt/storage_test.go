@@ -0,0 +1,139 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package bolt_test
+
+import (
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+	gc "gopkg.in/check.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/storage"
+	sfbolt "github.com/cmars/shadowfax/storage/bolt"
+	sftesting "github.com/cmars/shadowfax/testing"
+)
+
+func openTestDB(c *gc.C) *bolt.DB {
+	db, err := bolt.Open(filepath.Join(c.MkDir(), "testdb"), 0600, nil)
+	c.Assert(err, gc.IsNil)
+	return db
+}
+
+type boltServiceSuite struct {
+	*sftesting.ServiceSuite
+	db *bolt.DB
+}
+
+var _ = gc.Suite(&boltServiceSuite{ServiceSuite: &sftesting.ServiceSuite{}})
+
+func (s *boltServiceSuite) SetUpTest(c *gc.C) {
+	s.db = openTestDB(c)
+	s.ServiceSuite.SetService(sfbolt.NewService(s.db))
+	s.ServiceSuite.SetUpTest(c)
+}
+
+func (s *boltServiceSuite) TearDownTest(c *gc.C) {
+	s.ServiceSuite.TearDownTest(c)
+	s.db.Close()
+}
+
+type boltVaultSuite struct {
+	*sftesting.VaultSuite
+	db *bolt.DB
+}
+
+var _ = gc.Suite(&boltVaultSuite{VaultSuite: &sftesting.VaultSuite{}})
+
+func (s *boltVaultSuite) SetUpTest(c *gc.C) {
+	s.db = openTestDB(c)
+	secretKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+	s.VaultSuite.SetVault(sfbolt.NewVault(s.db, secretKey))
+	s.VaultSuite.SetUpTest(c)
+}
+
+func (s *boltVaultSuite) TearDownTest(c *gc.C) {
+	s.VaultSuite.TearDownTest(c)
+	s.db.Close()
+}
+
+type boltContactsSuite struct {
+	*sftesting.ContactsSuite
+	db *bolt.DB
+}
+
+var _ = gc.Suite(&boltContactsSuite{ContactsSuite: &sftesting.ContactsSuite{}})
+
+func (s *boltContactsSuite) SetUpTest(c *gc.C) {
+	s.db = openTestDB(c)
+	s.ContactsSuite.SetContacts(sfbolt.NewContacts(s.db))
+	s.ContactsSuite.SetUpTest(c)
+}
+
+func (s *boltContactsSuite) TearDownTest(c *gc.C) {
+	s.ContactsSuite.TearDownTest(c)
+	s.db.Close()
+}
+
+type boltRelayQueueSuite struct {
+	*sftesting.RelayQueueSuite
+	db *bolt.DB
+}
+
+var _ = gc.Suite(&boltRelayQueueSuite{RelayQueueSuite: &sftesting.RelayQueueSuite{}})
+
+func (s *boltRelayQueueSuite) SetUpTest(c *gc.C) {
+	s.db = openTestDB(c)
+	s.RelayQueueSuite.SetRelayQueue(sfbolt.NewRelayQueue(s.db))
+	s.RelayQueueSuite.SetUpTest(c)
+}
+
+func (s *boltRelayQueueSuite) TearDownTest(c *gc.C) {
+	s.RelayQueueSuite.TearDownTest(c)
+	s.db.Close()
+}
+
+type boltOutboxSuite struct {
+	*sftesting.OutboxSuite
+	db *bolt.DB
+}
+
+var _ = gc.Suite(&boltOutboxSuite{OutboxSuite: &sftesting.OutboxSuite{}})
+
+func (s *boltOutboxSuite) SetUpTest(c *gc.C) {
+	s.db = openTestDB(c)
+	s.OutboxSuite.SetOutbox(sfbolt.NewOutbox(s.db))
+	s.OutboxSuite.SetUpTest(c)
+}
+
+func (s *boltOutboxSuite) TearDownTest(c *gc.C) {
+	s.OutboxSuite.TearDownTest(c)
+	s.db.Close()
+}
+
+type boltNonceCacheSuite struct {
+	*sftesting.NonceCacheSuite
+	db *bolt.DB
+}
+
+var _ = gc.Suite(&boltNonceCacheSuite{NonceCacheSuite: &sftesting.NonceCacheSuite{}})
+
+func (s *boltNonceCacheSuite) SetUpTest(c *gc.C) {
+	s.db = openTestDB(c)
+	s.NonceCacheSuite.SetNewNonceCache(func(capacity int) storage.NonceCache {
+		return sfbolt.NewNonceCache(s.db, capacity)
+	})
+	s.NonceCacheSuite.SetUpTest(c)
+}
+
+func (s *boltNonceCacheSuite) TearDownTest(c *gc.C) {
+	s.NonceCacheSuite.TearDownTest(c)
+	s.db.Close()
+}
@@ -10,6 +10,8 @@ package bolt
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"math/big"
 
 	"github.com/boltdb/bolt"
@@ -17,92 +19,248 @@ import (
 	"gopkg.in/errgo.v1"
 
 	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/storage"
 )
 
+var (
+	keysBucketName      = []byte("keys")
+	logBucketName       = []byte("log")
+	vaultMetaBucketName = []byte("vault-meta")
+
+	defaultKeyName = []byte("default")
+
+	// keyInfoBucketName held key pair metadata before version 2.
+	keyInfoBucketName = []byte("keyinfo")
+)
+
+// vaultVersion is the layout of stored key pairs. Since version 2, each key
+// pair is stored in a vaultRecord sealed with a random nonce, under an 8-byte
+// big-endian sequence number. Before, the sequence number was also used as
+// the nonce, so that re-sealing a key pair would reuse it.
+const vaultVersion = 2
+
+// recordVersion is the version of vaultRecord written.
+const recordVersion = 1
+
+// vaultRecord is the stored form of a key pair. The public key and metadata
+// are not secret, and are kept outside the sealed key pair so that they can
+// be read without opening it.
+type vaultRecord struct {
+	Version   int    `json:"version"`
+	PublicKey []byte `json:"public-key"`
+	Nonce     []byte `json:"nonce"`
+	Sealed    []byte `json:"sealed"`
+	Label     string `json:"label,omitempty"`
+	Retired   bool   `json:"retired,omitempty"`
+}
+
 type vault struct {
 	db        *bolt.DB
 	secretKey *sf.SecretKey
 }
 
-// NewVault returns a new storage.Vault backed by bolt DB.
+// NewVault returns a new storage.Vault backed by bolt DB. A vault stored in
+// an earlier layout is migrated to the current layout when first used.
 func NewVault(db *bolt.DB, secretKey *sf.SecretKey) *vault {
 	return &vault{db, secretKey}
 }
 
+// update runs a read-write transaction on a vault migrated to the current
+// layout.
+func (v *vault) update(f func(tx *bolt.Tx) error) error {
+	return v.db.Update(func(tx *bolt.Tx) error {
+		err := migrateVault(tx, v.secretKey)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return f(tx)
+	})
+}
+
+// view runs a read-only transaction on a vault migrated to the current
+// layout. If the vault needs migrating, f is run in the read-write
+// transaction which migrates it.
+func (v *vault) view(f func(tx *bolt.Tx) error) error {
+	var current bool
+	err := v.db.View(func(tx *bolt.Tx) error {
+		current = isVaultCurrent(tx)
+		if !current {
+			return nil
+		}
+		return f(tx)
+	})
+	if err != nil || current {
+		return err
+	}
+	return v.update(f)
+}
+
+func isVaultCurrent(tx *bolt.Tx) bool {
+	metaBucket := tx.Bucket(vaultMetaBucketName)
+	if metaBucket == nil {
+		return false
+	}
+	version := metaBucket.Get(versionKey)
+	return len(version) == 1 && version[0] >= vaultVersion
+}
+
+func seqKey(seq uint64) []byte {
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], seq)
+	return key[:]
+}
+
+func seqString(seqBytes []byte) string {
+	var seq big.Int
+	seq.SetBytes(seqBytes)
+	return seq.String()
+}
+
+// sealRecord seals a key pair into a new record, with a random nonce.
+func sealRecord(keyPair *sf.KeyPair, secretKey *sf.SecretKey) (*vaultRecord, error) {
+	nonce, err := sf.NewNonce()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var kpBuf bytes.Buffer
+	kpBuf.Write(keyPair.PublicKey[:])
+	kpBuf.Write(keyPair.PrivateKey[:])
+	sealed := secretbox.Seal(nil, kpBuf.Bytes(), (*[24]byte)(nonce), (*[32]byte)(secretKey))
+	// TODO: zeroize kpBuf
+	return &vaultRecord{
+		Version:   recordVersion,
+		PublicKey: keyPair.PublicKey[:],
+		Nonce:     nonce[:],
+		Sealed:    sealed,
+	}, nil
+}
+
+// open returns the key pair sealed in the record.
+func (r *vaultRecord) open(secretKey *sf.SecretKey) (*sf.KeyPair, bool) {
+	if len(r.Nonce) != 24 {
+		return nil, false
+	}
+	var nonce [24]byte
+	copy(nonce[:], r.Nonce)
+	keyPairBytes, ok := secretbox.Open(nil, r.Sealed, &nonce, (*[32]byte)(secretKey))
+	if !ok || len(keyPairBytes) != 64 || !bytes.Equal(keyPairBytes[:32], r.PublicKey) {
+		return nil, false
+	}
+	var keyPair sf.KeyPair
+	keyPair.PublicKey = new(sf.PublicKey)
+	copy(keyPair.PublicKey[:], keyPairBytes[:32])
+	keyPair.PrivateKey = new(sf.PrivateKey)
+	copy(keyPair.PrivateKey[:], keyPairBytes[32:])
+	// TODO: mprotect private key
+	// TODO: zeroize keyPairBytes
+	return &keyPair, true
+}
+
+func getRecord(logBucket *bolt.Bucket, seqBytes []byte) (*vaultRecord, error) {
+	recBytes := logBucket.Get(seqBytes)
+	if recBytes == nil {
+		return nil, errgo.Newf("missing expected key #%s", seqString(seqBytes))
+	}
+	return decodeRecord(seqBytes, recBytes)
+}
+
+func decodeRecord(seqBytes, recBytes []byte) (*vaultRecord, error) {
+	var rec vaultRecord
+	err := json.Unmarshal(recBytes, &rec)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid key pair #%s", seqString(seqBytes))
+	}
+	if rec.Version != recordVersion {
+		return nil, errgo.Newf("unsupported version %d of key pair #%s", rec.Version, seqString(seqBytes))
+	}
+	return &rec, nil
+}
+
+func putRecord(logBucket *bolt.Bucket, seqBytes []byte, rec *vaultRecord) error {
+	recBytes, err := json.Marshal(rec)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(logBucket.Put(seqBytes, recBytes))
+}
+
+// currentKey returns the public key of the current key pair, or nil if
+// there is none.
+func currentKey(tx *bolt.Tx) ([]byte, error) {
+	if metaBucket := tx.Bucket(vaultMetaBucketName); metaBucket != nil {
+		if key := metaBucket.Get(defaultKeyName); key != nil {
+			return key, nil
+		}
+	}
+	logBucket := tx.Bucket(logBucketName)
+	if logBucket == nil {
+		return nil, nil
+	}
+	c := logBucket.Cursor()
+	for seqBytes, recBytes := c.Last(); seqBytes != nil; seqBytes, recBytes = c.Prev() {
+		rec, err := decodeRecord(seqBytes, recBytes)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if !rec.Retired {
+			return rec.PublicKey, nil
+		}
+	}
+	return nil, nil
+}
+
 // Current implements storage.Vault.
 func (v *vault) Current() (*sf.KeyPair, error) {
-	var keyPair sf.KeyPair
-	err := v.db.View(func(tx *bolt.Tx) error {
-		logBucket := tx.Bucket([]byte("log"))
+	var keyPair *sf.KeyPair
+	err := v.view(func(tx *bolt.Tx) error {
+		logBucket := tx.Bucket(logBucketName)
 		if logBucket == nil {
 			return errgo.New("empty vault")
 		}
-
-		seqBytes, encBytes := logBucket.Cursor().Last()
-		if seqBytes == nil {
+		if seqBytes, _ := logBucket.Cursor().First(); seqBytes == nil {
 			return errgo.New("empty vault")
 		}
-		seq := new(sf.Nonce)
-		copy(seq[:], seqBytes)
-		keyPairBytes, ok := secretbox.Open(nil, encBytes, (*[24]byte)(seq), (*[32]byte)(v.secretKey))
-		if !ok {
-			seq := new(big.Int)
-			seq.SetBytes(seqBytes)
-			return errgo.Newf("error opening key pair #%s", seq.String())
-		}
-		keyPair.PublicKey = new(sf.PublicKey)
-		copy(keyPair.PublicKey[:], keyPairBytes[:32])
-		keyPair.PrivateKey = new(sf.PrivateKey)
-		copy(keyPair.PrivateKey[:], keyPairBytes[32:])
-		// TODO: mprotect private key
-		// TODO: zeroize keyPairBytes
-
-		return nil
+		key, err := currentKey(tx)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if key == nil {
+			return errgo.New("all key pairs retired")
+		}
+		var publicKey sf.PublicKey
+		copy(publicKey[:], key)
+		keyPair, err = v.get(tx, &publicKey)
+		return errgo.Mask(err)
 	})
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	return &keyPair, nil
+	return keyPair, nil
 }
 
 // Each implements storage.Each.
 func (v *vault) Each(kpf func(keyPair *sf.KeyPair) error) error {
-	err := v.db.View(func(tx *bolt.Tx) error {
-		logBucket := tx.Bucket([]byte("log"))
+	err := v.view(func(tx *bolt.Tx) error {
+		logBucket := tx.Bucket(logBucketName)
 		if logBucket == nil {
 			return errgo.New("empty vault")
 		}
 
 		c := logBucket.Cursor()
-		for seqBytes, encBytes := c.First(); seqBytes != nil; seqBytes, encBytes = c.Next() {
-			if v == nil {
-				// TODO: warning, empty value for key not expected
-				continue
+		for seqBytes, recBytes := c.First(); seqBytes != nil; seqBytes, recBytes = c.Next() {
+			rec, err := decodeRecord(seqBytes, recBytes)
+			if err != nil {
+				return errgo.Mask(err)
 			}
-			// TODO: mprotect private key?
-			var keyPair sf.KeyPair
-
-			seq := new(sf.Nonce)
-			copy(seq[:], seqBytes)
-			keyPairBytes, ok := secretbox.Open(nil, encBytes, (*[24]byte)(seq), (*[32]byte)(v.secretKey))
+			keyPair, ok := rec.open(v.secretKey)
 			if !ok {
-				seq := new(big.Int)
-				seq.SetBytes(seqBytes)
-				return errgo.Newf("error opening key pair #%s", seq.String())
+				return errgo.Newf("error opening key pair #%s", seqString(seqBytes))
 			}
-			keyPair.PublicKey = new(sf.PublicKey)
-			copy(keyPair.PublicKey[:], keyPairBytes[:32])
-			keyPair.PrivateKey = new(sf.PrivateKey)
-			copy(keyPair.PrivateKey[:], keyPairBytes[32:])
-
-			err := kpf(&keyPair)
+			err = kpf(keyPair)
 			if err != nil {
 				return errgo.Mask(err)
 			}
-
-			// TODO: zeroize keyPairBytes
 		}
-
 		return nil
 	})
 	return errgo.Mask(err)
@@ -110,88 +268,368 @@ func (v *vault) Each(kpf func(keyPair *sf.KeyPair) error) error {
 
 // Get implements storage.Vault.
 func (v *vault) Get(key *sf.PublicKey) (*sf.KeyPair, error) {
-	var keyPair sf.KeyPair
-	err := v.db.View(func(tx *bolt.Tx) error {
-		keysBucket := tx.Bucket([]byte("keys"))
-		if keysBucket == nil {
-			return errgo.New("empty vault")
+	var keyPair *sf.KeyPair
+	err := v.view(func(tx *bolt.Tx) error {
+		var err error
+		keyPair, err = v.get(tx, key)
+		return errgo.Mask(err, errgo.Is(storage.ErrNotFound))
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(storage.ErrNotFound))
+	}
+	return keyPair, nil
+}
+
+func (v *vault) get(tx *bolt.Tx, key *sf.PublicKey) (*sf.KeyPair, error) {
+	keysBucket := tx.Bucket(keysBucketName)
+	if keysBucket == nil {
+		return nil, errgo.WithCausef(nil, storage.ErrNotFound, "empty vault")
+	}
+	logBucket := tx.Bucket(logBucketName)
+	if logBucket == nil {
+		return nil, errgo.WithCausef(nil, storage.ErrNotFound, "empty vault")
+	}
+
+	seqBytes := keysBucket.Get(key[:])
+	if seqBytes == nil {
+		return nil, errgo.WithCausef(nil, storage.ErrNotFound, "key pair not found for %q", key.Encode())
+	}
+	rec, err := getRecord(logBucket, seqBytes)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	keyPair, ok := rec.open(v.secretKey)
+	if !ok {
+		return nil, errgo.Newf("error opening key pair #%s", seqString(seqBytes))
+	}
+	return keyPair, nil
+}
+
+// Put implements storage.Vault.
+func (v *vault) Put(keyPair *sf.KeyPair) error {
+	rec, err := sealRecord(keyPair, v.secretKey)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return v.update(func(tx *bolt.Tx) error {
+		keysBucket, err := tx.CreateBucketIfNotExists(keysBucketName)
+		if err != nil {
+			return errgo.Mask(err)
 		}
-		logBucket := tx.Bucket([]byte("log"))
-		if logBucket == nil {
-			return errgo.New("empty vault")
+		logBucket, err := tx.CreateBucketIfNotExists(logBucketName)
+		if err != nil {
+			return errgo.Mask(err)
 		}
 
-		seqBytes := keysBucket.Get(key[:])
-		if seqBytes == nil {
-			return errgo.Newf("key pair not found for %q", key.Encode())
+		var seq uint64
+		if lastBytes, _ := logBucket.Cursor().Last(); lastBytes != nil {
+			seq = binary.BigEndian.Uint64(lastBytes)
 		}
-		seqInt := new(big.Int)
-		seqInt.SetBytes(seqBytes)
-		encBytes := logBucket.Get(seqBytes)
-		if encBytes == nil {
-			return errgo.Newf("missing expected key #%s", seqInt.String())
+		seqBytes := seqKey(seq + 1)
+		err = keysBucket.Put(keyPair.PublicKey[:], seqBytes)
+		if err != nil {
+			return errgo.Mask(err)
 		}
-		seq := new(sf.Nonce)
-		copy(seq[:], seqBytes)
+		return errgo.Mask(putRecord(logBucket, seqBytes, rec))
+	})
+}
 
-		keyPairBytes, ok := secretbox.Open(nil, encBytes, (*[24]byte)(seq), (*[32]byte)(v.secretKey))
-		if !ok {
-			return errgo.Newf("error opening key pair #%s", seqInt.String())
+// CheckKey returns whether the secret key of the vault opens the key pairs
+// it holds. Any key opens an empty vault. A vault in an earlier layout is
+// checked without migrating it, so a wrong key is reported rather than
+// failing the migration.
+func (v *vault) CheckKey() (bool, error) {
+	opens := true
+	err := v.db.View(func(tx *bolt.Tx) error {
+		logBucket := tx.Bucket(logBucketName)
+		if logBucket == nil {
+			return nil
 		}
-		keyPair.PublicKey = new(sf.PublicKey)
-		copy(keyPair.PublicKey[:], keyPairBytes[:32])
-		keyPair.PrivateKey = new(sf.PrivateKey)
-		copy(keyPair.PrivateKey[:], keyPairBytes[32:])
-		// TODO: mprotect private key
-		// TODO: zeroize keyPairBytes
+		legacy := !isVaultCurrent(tx)
+		return logBucket.ForEach(func(seqBytes, recBytes []byte) error {
+			if legacy {
+				if _, ok := openLegacyRecord(seqBytes, recBytes, v.secretKey); !ok {
+					opens = false
+				}
+				return nil
+			}
+			rec, err := decodeRecord(seqBytes, recBytes)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			if _, ok := rec.open(v.secretKey); !ok {
+				opens = false
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return opens, nil
+}
 
-		return nil
+// Rekey implements storage.Vault. Each key pair is sealed with a new random
+// nonce. Session state kept in the same DB by Sessions is re-encrypted in
+// the same transaction.
+func (v *vault) Rekey(secretKey *sf.SecretKey) error {
+	err := v.update(func(tx *bolt.Tx) error {
+		logBucket := tx.Bucket(logBucketName)
+		if logBucket != nil {
+			resealed := make(map[string]*vaultRecord)
+			err := logBucket.ForEach(func(seqBytes, recBytes []byte) error {
+				rec, err := decodeRecord(seqBytes, recBytes)
+				if err != nil {
+					return errgo.Mask(err)
+				}
+				keyPair, ok := rec.open(v.secretKey)
+				if !ok {
+					return errgo.Newf("error opening key pair #%s", seqString(seqBytes))
+				}
+				newRec, err := sealRecord(keyPair, secretKey)
+				if err != nil {
+					return errgo.Mask(err)
+				}
+				newRec.Label, newRec.Retired = rec.Label, rec.Retired
+				resealed[string(seqBytes)] = newRec
+				return nil
+			})
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			for seqBytes, rec := range resealed {
+				err = putRecord(logBucket, []byte(seqBytes), rec)
+				if err != nil {
+					return errgo.Mask(err)
+				}
+			}
+		}
+		return errgo.Mask(rekeySessions(tx, v.secretKey, secretKey))
 	})
 	if err != nil {
-		return nil, errgo.Mask(err)
+		return errgo.Mask(err)
 	}
-	return &keyPair, nil
+	v.secretKey = secretKey
+	return nil
 }
 
-// Put implements storage.Vault.
-func (v *vault) Put(keyPair *sf.KeyPair) error {
-	return v.db.Update(func(tx *bolt.Tx) error {
-		keysBucket, err := tx.CreateBucketIfNotExists([]byte("keys"))
+// Info implements storage.Vault.
+func (v *vault) Info(key *sf.PublicKey) (*storage.KeyInfo, error) {
+	var info *storage.KeyInfo
+	err := v.view(func(tx *bolt.Tx) error {
+		keysBucket := tx.Bucket(keysBucketName)
+		logBucket := tx.Bucket(logBucketName)
+		if keysBucket == nil || logBucket == nil || keysBucket.Get(key[:]) == nil {
+			return errgo.WithCausef(nil, storage.ErrNotFound, "key pair not found for %q", key.Encode())
+		}
+		rec, err := getRecord(logBucket, keysBucket.Get(key[:]))
 		if err != nil {
 			return errgo.Mask(err)
 		}
-		logBucket, err := tx.CreateBucketIfNotExists([]byte("log"))
+		current, err := currentKey(tx)
 		if err != nil {
 			return errgo.Mask(err)
 		}
+		info = rec.keyInfo(current)
+		return nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(storage.ErrNotFound))
+	}
+	return info, nil
+}
 
-		seqBytes, _ := logBucket.Cursor().Last()
-		seqInt := new(big.Int)
-		seqInt.SetBytes(seqBytes)
-		seqInt.Add(seqInt, bigOne)
-		seq := new(sf.Nonce)
-		copy(seq[:], seqInt.Bytes())
-
-		var kpBuf bytes.Buffer
-		_, err = kpBuf.Write(keyPair.PublicKey[:])
-		if err != nil {
-			return errgo.Mask(err)
+// Infos implements storage.Vault.
+func (v *vault) Infos() ([]*storage.KeyInfo, error) {
+	var infos []*storage.KeyInfo
+	err := v.view(func(tx *bolt.Tx) error {
+		logBucket := tx.Bucket(logBucketName)
+		if logBucket == nil {
+			return nil
 		}
-		_, err = kpBuf.Write(keyPair.PrivateKey[:])
+		current, err := currentKey(tx)
 		if err != nil {
 			return errgo.Mask(err)
 		}
-		encBytes := secretbox.Seal(nil, kpBuf.Bytes(), (*[24]byte)(seq), (*[32]byte)(v.secretKey))
-		// TODO: zeroize kpBuf
-		err = keysBucket.Put(keyPair.PublicKey[:], seq[:])
+		return logBucket.ForEach(func(seqBytes, recBytes []byte) error {
+			rec, err := decodeRecord(seqBytes, recBytes)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			infos = append(infos, rec.keyInfo(current))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return infos, nil
+}
+
+func (r *vaultRecord) keyInfo(current []byte) *storage.KeyInfo {
+	info := &storage.KeyInfo{
+		Address: new(sf.PublicKey),
+		Label:   r.Label,
+		Default: bytes.Equal(r.PublicKey, current),
+		Retired: r.Retired,
+	}
+	copy(info.Address[:], r.PublicKey)
+	return info
+}
+
+// updateRecord changes the metadata in the record of a key pair in a
+// transaction.
+func (v *vault) updateRecord(key *sf.PublicKey, f func(tx *bolt.Tx, rec *vaultRecord) error) error {
+	err := v.update(func(tx *bolt.Tx) error {
+		keysBucket := tx.Bucket(keysBucketName)
+		logBucket := tx.Bucket(logBucketName)
+		if keysBucket == nil || logBucket == nil || keysBucket.Get(key[:]) == nil {
+			return errgo.WithCausef(nil, storage.ErrNotFound, "key pair not found for %q", key.Encode())
+		}
+		seqBytes := keysBucket.Get(key[:])
+		rec, err := getRecord(logBucket, seqBytes)
 		if err != nil {
 			return errgo.Mask(err)
 		}
-		err = logBucket.Put(seq[:], encBytes)
+		err = f(tx, rec)
 		if err != nil {
 			return errgo.Mask(err)
 		}
+		return errgo.Mask(putRecord(logBucket, seqBytes, rec))
+	})
+	return errgo.Mask(err, errgo.Is(storage.ErrNotFound))
+}
+
+// SetLabel implements storage.Vault.
+func (v *vault) SetLabel(key *sf.PublicKey, label string) error {
+	return v.updateRecord(key, func(_ *bolt.Tx, rec *vaultRecord) error {
+		rec.Label = label
+		return nil
+	})
+}
+
+// SetDefault implements storage.Vault.
+func (v *vault) SetDefault(key *sf.PublicKey) error {
+	return v.updateRecord(key, func(tx *bolt.Tx, rec *vaultRecord) error {
+		if rec.Retired {
+			return errgo.Newf("key pair %q is retired", key.Encode())
+		}
+		return errgo.Mask(tx.Bucket(vaultMetaBucketName).Put(defaultKeyName, key[:]))
+	})
+}
 
+// Retire implements storage.Vault. If the key pair had been chosen as the
+// default, the latest key pair which is not retired becomes current.
+func (v *vault) Retire(key *sf.PublicKey) error {
+	return v.updateRecord(key, func(tx *bolt.Tx, rec *vaultRecord) error {
+		rec.Retired = true
+		metaBucket := tx.Bucket(vaultMetaBucketName)
+		if bytes.Equal(metaBucket.Get(defaultKeyName), key[:]) {
+			return errgo.Mask(metaBucket.Delete(defaultKeyName))
+		}
 		return nil
 	})
 }
+
+// legacyEntry is a key pair stored before version 2.
+type legacyEntry struct {
+	keyPair  *sf.KeyPair
+	metaJSON []byte
+}
+
+// openLegacyRecord opens a key pair sealed in the layout before version 2,
+// returning its public and private keys.
+func openLegacyRecord(seqBytes, encBytes []byte, secretKey *sf.SecretKey) ([]byte, bool) {
+	var nonce [24]byte
+	copy(nonce[:], seqBytes)
+	keyPairBytes, ok := secretbox.Open(nil, encBytes, &nonce, (*[32]byte)(secretKey))
+	if !ok || len(keyPairBytes) != 64 {
+		return nil, false
+	}
+	return keyPairBytes, true
+}
+
+// migrateVault converts stored key pairs to the current layout, if
+// necessary. Migrating from version 1 requires the secret key, as every key
+// pair is re-sealed with a random nonce.
+func migrateVault(tx *bolt.Tx, secretKey *sf.SecretKey) error {
+	metaBucket, err := tx.CreateBucketIfNotExists(vaultMetaBucketName)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if version := metaBucket.Get(versionKey); len(version) == 1 && version[0] >= vaultVersion {
+		return nil
+	}
+
+	// Before version 2, metadata was kept separately from the key pairs.
+	var entries []*legacyEntry
+	if logBucket := tx.Bucket(logBucketName); logBucket != nil {
+		keyInfoBucket := tx.Bucket(keyInfoBucketName)
+		err = logBucket.ForEach(func(seqBytes, encBytes []byte) error {
+			keyPairBytes, ok := openLegacyRecord(seqBytes, encBytes, secretKey)
+			if !ok {
+				return errgo.Newf("error opening key pair #%s", seqString(seqBytes))
+			}
+			entry := &legacyEntry{
+				keyPair: &sf.KeyPair{PublicKey: new(sf.PublicKey), PrivateKey: new(sf.PrivateKey)},
+			}
+			copy(entry.keyPair.PublicKey[:], keyPairBytes[:32])
+			copy(entry.keyPair.PrivateKey[:], keyPairBytes[32:])
+			// TODO: zeroize keyPairBytes
+			if keyInfoBucket != nil {
+				entry.metaJSON = keyInfoBucket.Get(keyPairBytes[:32])
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	for _, name := range [][]byte{keysBucketName, logBucketName, keyInfoBucketName} {
+		if tx.Bucket(name) != nil {
+			err = tx.DeleteBucket(name)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+		}
+	}
+	if len(entries) > 0 {
+		keysBucket, err := tx.CreateBucket(keysBucketName)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		logBucket, err := tx.CreateBucket(logBucketName)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		for i, entry := range entries {
+			rec, err := sealRecord(entry.keyPair, secretKey)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			if entry.metaJSON != nil {
+				var meta struct {
+					Label   string `json:"label"`
+					Retired bool   `json:"retired"`
+				}
+				err = json.Unmarshal(entry.metaJSON, &meta)
+				if err != nil {
+					return errgo.Mask(err)
+				}
+				rec.Label, rec.Retired = meta.Label, meta.Retired
+			}
+			// A key pair stored more than once is found by its latest entry.
+			seqBytes := seqKey(uint64(i + 1))
+			err = keysBucket.Put(entry.keyPair.PublicKey[:], seqBytes)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			err = putRecord(logBucket, seqBytes, rec)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+		}
+	}
+	return errgo.Mask(metaBucket.Put(versionKey, []byte{vaultVersion}))
+}
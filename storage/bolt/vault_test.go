@@ -9,13 +9,19 @@
 package bolt_test
 
 import (
+	"encoding/json"
+	"math/big"
 	"path/filepath"
 
 	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/nacl/secretbox"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
 
 	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/storage"
 	sfbolt "github.com/cmars/shadowfax/storage/bolt"
+	sftesting "github.com/cmars/shadowfax/testing"
 )
 
 type vaultSuite struct {
@@ -67,3 +73,328 @@ func (s *vaultSuite) TestVault(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 	c.Assert(kp, gc.DeepEquals, &kp1)
 }
+
+func (s *vaultSuite) TestRekey(c *gc.C) {
+	oldKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+	v := sfbolt.NewVault(s.db, oldKey)
+	sessions := sfbolt.NewSessions(s.db, oldKey)
+
+	var keyPairs []sf.KeyPair
+	for i := 0; i < 3; i++ {
+		kp, err := sf.NewKeyPair()
+		c.Assert(err, gc.IsNil)
+		c.Assert(v.Put(&kp), gc.IsNil)
+		keyPairs = append(keyPairs, kp)
+	}
+	prekey, err := sf.NewKeyPair()
+	c.Assert(err, gc.IsNil)
+	c.Assert(sessions.PutPrekey(&prekey), gc.IsNil)
+	err = sessions.Update("foo", func([]byte) ([]byte, error) {
+		return []byte("state"), nil
+	})
+	c.Assert(err, gc.IsNil)
+
+	newKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+	err = v.Rekey(newKey)
+	c.Assert(err, gc.IsNil)
+
+	// Everything can be opened with the new key, and nothing with the old.
+	for _, secretKey := range []*sf.SecretKey{newKey, oldKey} {
+		ok := secretKey == newKey
+		v := sfbolt.NewVault(s.db, secretKey)
+		for i := range keyPairs {
+			kp, err := v.Get(keyPairs[i].PublicKey)
+			if ok {
+				c.Assert(err, gc.IsNil)
+				c.Assert(kp, gc.DeepEquals, &keyPairs[i])
+			} else {
+				c.Assert(err, gc.ErrorMatches, "error opening key pair #.*")
+			}
+		}
+		state, err := sfbolt.NewSessions(s.db, secretKey).Get("foo")
+		if ok {
+			c.Assert(err, gc.IsNil)
+			c.Assert(string(state), gc.Equals, "state")
+		} else {
+			c.Assert(err, gc.ErrorMatches, "error opening session .*")
+		}
+	}
+	kp, err := sfbolt.NewSessions(s.db, newKey).GetPrekey(prekey.PublicKey)
+	c.Assert(err, gc.IsNil)
+	c.Assert(kp, gc.DeepEquals, &prekey)
+
+	// The vault keeps working with the new key.
+	kp, err = v.Current()
+	c.Assert(err, gc.IsNil)
+	c.Assert(kp, gc.DeepEquals, &keyPairs[2])
+}
+
+func (s *vaultSuite) TestCheckKey(c *gc.C) {
+	oldKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+	newKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+
+	// Any key opens an empty vault.
+	ok, err := sfbolt.NewVault(s.db, newKey).CheckKey()
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+
+	v := sfbolt.NewVault(s.db, oldKey)
+	kp := sftesting.MustNewKeyPair()
+	c.Assert(v.Put(kp), gc.IsNil)
+	ok, err = sfbolt.NewVault(s.db, oldKey).CheckKey()
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+	ok, err = sfbolt.NewVault(s.db, newKey).CheckKey()
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, false)
+
+	c.Assert(v.Rekey(newKey), gc.IsNil)
+	ok, err = sfbolt.NewVault(s.db, oldKey).CheckKey()
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, false)
+	ok, err = sfbolt.NewVault(s.db, newKey).CheckKey()
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+}
+
+func (s *vaultSuite) TestCheckKeyLegacy(c *gc.C) {
+	oldKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+	newKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		logBucket, err := tx.CreateBucket([]byte("log"))
+		c.Assert(err, gc.IsNil)
+		kp := sftesting.MustNewKeyPair()
+		var nonce [24]byte
+		copy(nonce[:], big.NewInt(1).Bytes())
+		kpBytes := append(kp.PublicKey[:], kp.PrivateKey[:]...)
+		return logBucket.Put(nonce[:], secretbox.Seal(nil, kpBytes, &nonce, (*[32]byte)(oldKey)))
+	})
+	c.Assert(err, gc.IsNil)
+
+	// A vault in the version 1 layout is checked without migrating it.
+	ok, err := sfbolt.NewVault(s.db, newKey).CheckKey()
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, false)
+	ok, err = sfbolt.NewVault(s.db, oldKey).CheckKey()
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		c.Assert(tx.Bucket([]byte("vault-meta")), gc.IsNil)
+		return nil
+	})
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *vaultSuite) TestRekeyWrongKey(c *gc.C) {
+	secKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+	kp, err := sf.NewKeyPair()
+	c.Assert(err, gc.IsNil)
+	c.Assert(sfbolt.NewVault(s.db, secKey).Put(&kp), gc.IsNil)
+
+	wrongKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+	newKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+	err = sfbolt.NewVault(s.db, wrongKey).Rekey(newKey)
+	c.Assert(err, gc.ErrorMatches, "error opening key pair #.*")
+
+	// Nothing was changed.
+	got, err := sfbolt.NewVault(s.db, secKey).Current()
+	c.Assert(err, gc.IsNil)
+	c.Assert(got, gc.DeepEquals, &kp)
+}
+
+func (s *vaultSuite) TestKeyInfo(c *gc.C) {
+	secKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+	v := sfbolt.NewVault(s.db, secKey)
+
+	infos, err := v.Infos()
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos, gc.HasLen, 0)
+
+	var keyPairs []sf.KeyPair
+	for i := 0; i < 3; i++ {
+		kp, err := sf.NewKeyPair()
+		c.Assert(err, gc.IsNil)
+		c.Assert(v.Put(&kp), gc.IsNil)
+		keyPairs = append(keyPairs, kp)
+	}
+	assertCurrent := func(i int) {
+		kp, err := v.Current()
+		c.Assert(err, gc.IsNil)
+		c.Assert(kp, gc.DeepEquals, &keyPairs[i])
+		infos, err := v.Infos()
+		c.Assert(err, gc.IsNil)
+		c.Assert(infos, gc.HasLen, len(keyPairs))
+		for j, info := range infos {
+			c.Assert(info.Address, gc.DeepEquals, keyPairs[j].PublicKey)
+			c.Assert(info.Default, gc.Equals, i == j)
+		}
+	}
+	assertCurrent(2)
+
+	err = v.SetLabel(keyPairs[0].PublicKey, "work")
+	c.Assert(err, gc.IsNil)
+	info, err := v.Info(keyPairs[0].PublicKey)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info, gc.DeepEquals, &storage.KeyInfo{Address: keyPairs[0].PublicKey, Label: "work"})
+
+	// An explicit default stays current when key pairs are added.
+	err = v.SetDefault(keyPairs[0].PublicKey)
+	c.Assert(err, gc.IsNil)
+	assertCurrent(0)
+	kp, err := sf.NewKeyPair()
+	c.Assert(err, gc.IsNil)
+	c.Assert(v.Put(&kp), gc.IsNil)
+	keyPairs = append(keyPairs, kp)
+	assertCurrent(0)
+
+	// Retiring the default falls back to the latest key pair not retired.
+	err = v.Retire(keyPairs[3].PublicKey)
+	c.Assert(err, gc.IsNil)
+	assertCurrent(0)
+	err = v.Retire(keyPairs[0].PublicKey)
+	c.Assert(err, gc.IsNil)
+	assertCurrent(2)
+	err = v.SetDefault(keyPairs[0].PublicKey)
+	c.Assert(err, gc.ErrorMatches, "key pair .* is retired")
+	info, err = v.Info(keyPairs[0].PublicKey)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info, gc.DeepEquals, &storage.KeyInfo{Address: keyPairs[0].PublicKey, Label: "work", Retired: true})
+
+	// Retired key pairs can still be used to open messages.
+	kp2, err := v.Get(keyPairs[0].PublicKey)
+	c.Assert(err, gc.IsNil)
+	c.Assert(kp2, gc.DeepEquals, &keyPairs[0])
+
+	for i := 1; i < 3; i++ {
+		c.Assert(v.Retire(keyPairs[i].PublicKey), gc.IsNil)
+	}
+	_, err = v.Current()
+	c.Assert(err, gc.ErrorMatches, "all key pairs retired")
+
+	unknown := sftesting.MustNewKeyPair()
+	_, err = v.Info(unknown.PublicKey)
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrNotFound)
+	for _, f := range []func(*sf.PublicKey) error{
+		func(key *sf.PublicKey) error { return v.SetLabel(key, "foo") },
+		v.SetDefault,
+		v.Retire,
+	} {
+		c.Assert(errgo.Cause(f(unknown.PublicKey)), gc.Equals, storage.ErrNotFound)
+	}
+}
+
+func (s *vaultSuite) TestMigrateLegacy(c *gc.C) {
+	secKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+
+	// Key pairs were sealed with their big integer sequence number as the
+	// nonce, prior to version 2.
+	var keyPairs []*sf.KeyPair
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		keysBucket, err := tx.CreateBucket([]byte("keys"))
+		c.Assert(err, gc.IsNil)
+		logBucket, err := tx.CreateBucket([]byte("log"))
+		c.Assert(err, gc.IsNil)
+		keyInfoBucket, err := tx.CreateBucket([]byte("keyinfo"))
+		c.Assert(err, gc.IsNil)
+		for _, seq := range []int64{1, 2, 3} {
+			kp := sftesting.MustNewKeyPair()
+			keyPairs = append(keyPairs, kp)
+			seqBytes := big.NewInt(seq).Bytes()
+			var nonce [24]byte
+			copy(nonce[:], seqBytes)
+			kpBytes := append(kp.PublicKey[:], kp.PrivateKey[:]...)
+			c.Assert(keysBucket.Put(kp.PublicKey[:], nonce[:]), gc.IsNil)
+			c.Assert(logBucket.Put(nonce[:], secretbox.Seal(nil, kpBytes, &nonce, (*[32]byte)(secKey))), gc.IsNil)
+		}
+		return keyInfoBucket.Put(keyPairs[0].PublicKey[:], []byte(`{"label":"work"}`))
+	})
+	c.Assert(err, gc.IsNil)
+
+	v := sfbolt.NewVault(s.db, secKey)
+	kp, err := v.Current()
+	c.Assert(err, gc.IsNil)
+	c.Assert(kp, gc.DeepEquals, keyPairs[2])
+	infos, err := v.Infos()
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos, gc.DeepEquals, []*storage.KeyInfo{
+		{Address: keyPairs[0].PublicKey, Label: "work"},
+		{Address: keyPairs[1].PublicKey},
+		{Address: keyPairs[2].PublicKey, Default: true},
+	})
+	for _, want := range keyPairs {
+		kp, err := v.Get(want.PublicKey)
+		c.Assert(err, gc.IsNil)
+		c.Assert(kp, gc.DeepEquals, want)
+	}
+
+	// Records are sealed with random nonces under fixed length sequence
+	// numbers, which sort in order.
+	err = s.db.View(func(tx *bolt.Tx) error {
+		c.Assert(tx.Bucket([]byte("keyinfo")), gc.IsNil)
+		var nonces []string
+		err := tx.Bucket([]byte("log")).ForEach(func(k, v []byte) error {
+			c.Assert(k, gc.HasLen, 8)
+			var rec struct {
+				Version int    `json:"version"`
+				Nonce   []byte `json:"nonce"`
+			}
+			c.Assert(json.Unmarshal(v, &rec), gc.IsNil)
+			c.Assert(rec.Version, gc.Equals, 1)
+			c.Assert(rec.Nonce, gc.HasLen, 24)
+			nonces = append(nonces, string(rec.Nonce))
+			return nil
+		})
+		c.Assert(err, gc.IsNil)
+		c.Assert(nonces, gc.HasLen, 3)
+		c.Assert(nonces[0], gc.Not(gc.Equals), nonces[1])
+		return nil
+	})
+	c.Assert(err, gc.IsNil)
+
+	// The migrated vault can be added to and re-keyed.
+	kp4 := sftesting.MustNewKeyPair()
+	c.Assert(v.Put(kp4), gc.IsNil)
+	newKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+	c.Assert(v.Rekey(newKey), gc.IsNil)
+	kp, err = sfbolt.NewVault(s.db, newKey).Current()
+	c.Assert(err, gc.IsNil)
+	c.Assert(kp, gc.DeepEquals, kp4)
+}
+
+func (s *vaultSuite) TestRekeyNonces(c *gc.C) {
+	secKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+	v := sfbolt.NewVault(s.db, secKey)
+	c.Assert(v.Put(sftesting.MustNewKeyPair()), gc.IsNil)
+
+	// Re-keying never reuses a nonce.
+	record := func() []byte {
+		var recBytes []byte
+		err := s.db.View(func(tx *bolt.Tx) error {
+			_, recBytes = tx.Bucket([]byte("log")).Cursor().First()
+			recBytes = append([]byte(nil), recBytes...)
+			return nil
+		})
+		c.Assert(err, gc.IsNil)
+		var rec struct {
+			Nonce []byte `json:"nonce"`
+		}
+		c.Assert(json.Unmarshal(recBytes, &rec), gc.IsNil)
+		return rec.Nonce
+	}
+	before := record()
+	c.Assert(v.Rekey(secKey), gc.IsNil)
+	c.Assert(record(), gc.Not(gc.DeepEquals), before)
+}
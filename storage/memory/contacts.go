@@ -0,0 +1,152 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package memory
+
+import (
+	"sort"
+	"sync"
+
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/storage"
+)
+
+type contacts struct {
+	mu      sync.Mutex
+	keys    map[string][]sf.PublicKey
+	names   map[sf.PublicKey]string
+	groups  map[string]map[string]bool
+	routers map[string]string
+}
+
+// NewContacts returns a new storage.Contacts kept in memory.
+func NewContacts() *contacts {
+	return &contacts{
+		keys:    make(map[string][]sf.PublicKey),
+		names:   make(map[sf.PublicKey]string),
+		groups:  make(map[string]map[string]bool),
+		routers: make(map[string]string),
+	}
+}
+
+// Key implements storage.Contacts.
+func (c *contacts) Key(name string) (*sf.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := c.keys[name]
+	if len(keys) == 0 {
+		return nil, errgo.WithCausef(nil, storage.ErrNotFound, "key not found for %q", name)
+	}
+	key := keys[len(keys)-1]
+	return &key, nil
+}
+
+// Name implements storage.Contacts.
+func (c *contacts) Name(key *sf.PublicKey) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name, ok := c.names[*key]
+	if !ok {
+		return "", errgo.Newf("no contact found for %q", key.Encode())
+	}
+	return name, nil
+}
+
+// Put implements storage.Contacts.
+func (c *contacts) Put(name string, key *sf.PublicKey) error {
+	if len(name) == 0 {
+		return errgo.New("empty key name")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.names[*key] = name
+	c.keys[name] = append(c.keys[name], *key)
+	return nil
+}
+
+// Current implements storage.Contacts.
+func (c *contacts) Current() (storage.ContactInfos, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var result storage.ContactInfos
+	for name, keys := range c.keys {
+		key := keys[len(keys)-1]
+		result = append(result, storage.ContactInfo{
+			Name:    name,
+			Address: &key,
+			Router:  c.routers[name],
+		})
+	}
+	sort.Sort(result)
+	return result, nil
+}
+
+// Group implements storage.Contacts.
+func (c *contacts) Group(group string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	members, ok := c.groups[group]
+	if !ok {
+		return nil, errgo.Newf("group %q not found", group)
+	}
+	var names []string
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// PutGroup implements storage.Contacts.
+func (c *contacts) PutGroup(group string, names []string) error {
+	if len(group) == 0 {
+		return errgo.New("empty group name")
+	}
+	members := make(map[string]bool)
+	for _, name := range names {
+		if len(name) == 0 {
+			return errgo.New("empty key name")
+		}
+		members[name] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(members) == 0 {
+		delete(c.groups, group)
+	} else {
+		c.groups[group] = members
+	}
+	return nil
+}
+
+// Router implements storage.Contacts.
+func (c *contacts) Router(name string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.keys[name]) == 0 {
+		return "", errgo.WithCausef(nil, storage.ErrNotFound, "key not found for %q", name)
+	}
+	return c.routers[name], nil
+}
+
+// SetRouter implements storage.Contacts.
+func (c *contacts) SetRouter(name string, router string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.keys[name]) == 0 {
+		return errgo.WithCausef(nil, storage.ErrNotFound, "key not found for %q", name)
+	}
+	if router == "" {
+		delete(c.routers, name)
+	} else {
+		c.routers[name] = router
+	}
+	return nil
+}
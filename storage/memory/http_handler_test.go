@@ -0,0 +1,42 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package memory_test
+
+import (
+	"testing"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/shadowfax/storage"
+	"github.com/cmars/shadowfax/storage/memory"
+	sftesting "github.com/cmars/shadowfax/testing"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type memoryHandlerSuite struct {
+	*sftesting.HTTPHandlerSuite
+}
+
+var _ = gc.Suite(&memoryHandlerSuite{&sftesting.HTTPHandlerSuite{}})
+
+func (s *memoryHandlerSuite) SetUpTest(c *gc.C) {
+	notifier := storage.NewNotifier()
+	service := memory.NewService()
+	service.SetNotifier(notifier)
+	s.HTTPHandlerSuite.SetStorage(service)
+	s.HTTPHandlerSuite.SetNonceCache(memory.NewNonceCache(1024))
+	s.HTTPHandlerSuite.SetNotifier(notifier)
+	s.HTTPHandlerSuite.SetPrekeys(memory.NewPrekeys())
+	s.HTTPHandlerSuite.SetUpTest(c)
+}
+
+func (s *memoryHandlerSuite) TearDownTest(c *gc.C) {
+	s.HTTPHandlerSuite.TearDownTest(c)
+}
@@ -0,0 +1,97 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package memory
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	sf "github.com/cmars/shadowfax"
+)
+
+type nonceExpiry struct {
+	nonce   sf.Nonce
+	expires time.Time
+}
+
+// expiryHeap orders nonces by expiration time, soonest first.
+type expiryHeap []nonceExpiry
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(i, j int) bool  { return h[i].expires.Before(h[j].expires) }
+func (h expiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(nonceExpiry)) }
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+type nonceCache struct {
+	mu       sync.Mutex
+	capacity int
+	seen     map[sf.Nonce]time.Time
+	expiry   expiryHeap
+
+	// evicted is the latest expiration time of a nonce evicted before it
+	// expired.
+	evicted time.Time
+}
+
+// NewNonceCache returns a new storage.NonceCache kept in memory, which
+// remembers at most capacity nonces. When full, the nonces closest to
+// expiration are forgotten first, and from then on any nonce which expires no
+// later than one forgotten is reported as seen, since it could be a replay.
+func NewNonceCache(capacity int) *nonceCache {
+	return &nonceCache{
+		capacity: capacity,
+		seen:     make(map[sf.Nonce]time.Time),
+	}
+}
+
+// Seen implements storage.NonceCache.
+func (c *nonceCache) Seen(nonce *sf.Nonce, expires time.Time) (bool, error) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.evicted.IsZero() && !expires.After(c.evicted) {
+		return true, nil
+	}
+	if prevExpires, ok := c.seen[*nonce]; ok {
+		if prevExpires.After(now) {
+			return true, nil
+		}
+		delete(c.seen, *nonce)
+	}
+
+	// Forget expired nonces, and the nonces closest to expiring if still at
+	// capacity. Heap entries for nonces since forgotten or re-recorded are
+	// discarded along the way.
+	for c.expiry.Len() > 0 {
+		next := c.expiry[0]
+		prevExpires, ok := c.seen[next.nonce]
+		if ok && prevExpires.Equal(next.expires) && next.expires.After(now) && len(c.seen) < c.capacity {
+			break
+		}
+		heap.Pop(&c.expiry)
+		if ok && prevExpires.Equal(next.expires) {
+			delete(c.seen, next.nonce)
+			if next.expires.After(now) {
+				c.evicted = next.expires
+			}
+		}
+	}
+
+	c.seen[*nonce] = expires
+	heap.Push(&c.expiry, nonceExpiry{*nonce, expires})
+	return false, nil
+}
@@ -0,0 +1,89 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package memory
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/cmars/shadowfax/storage"
+)
+
+type outbox struct {
+	mu       sync.Mutex
+	messages map[string]map[string]*storage.DeliveryStatus
+}
+
+// NewOutbox returns a new storage.Outbox kept in memory.
+func NewOutbox() *outbox {
+	return &outbox{
+		messages: make(map[string]map[string]*storage.DeliveryStatus),
+	}
+}
+
+// Sent implements storage.Outbox.
+func (o *outbox) Sent(id, recipient string, stored bool, at time.Time) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	status := storage.StatusSent
+	if stored {
+		status = storage.StatusStored
+	}
+	recipients, ok := o.messages[id]
+	if !ok {
+		recipients = make(map[string]*storage.DeliveryStatus)
+		o.messages[id] = recipients
+	}
+	recipients[recipient] = &storage.DeliveryStatus{
+		ID:        id,
+		Recipient: recipient,
+		Status:    status,
+		Sent:      at,
+	}
+	return nil
+}
+
+// Delivered implements storage.Outbox.
+func (o *outbox) Delivered(id, recipient string, at time.Time) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	status, ok := o.messages[id][recipient]
+	if !ok {
+		return errgo.WithCausef(nil, storage.ErrNotFound, "message %q not sent to %q", id, recipient)
+	}
+	if status.Status != storage.StatusDelivered {
+		status.Status = storage.StatusDelivered
+		status.Delivered = at
+	}
+	return nil
+}
+
+// Status implements storage.Outbox.
+func (o *outbox) Status(id string) ([]*storage.DeliveryStatus, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	recipients, ok := o.messages[id]
+	if !ok {
+		return nil, errgo.WithCausef(nil, storage.ErrNotFound, "message %q not found", id)
+	}
+	var keys []string
+	for recipient := range recipients {
+		keys = append(keys, recipient)
+	}
+	sort.Strings(keys)
+	var result []*storage.DeliveryStatus
+	for _, recipient := range keys {
+		status := *recipients[recipient]
+		result = append(result, &status)
+	}
+	return result, nil
+}
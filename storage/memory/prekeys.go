@@ -0,0 +1,87 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package memory
+
+import (
+	"sync"
+
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/storage"
+)
+
+type prekeys struct {
+	mu         sync.Mutex
+	published  map[string]map[sf.PublicKey][]byte
+	lastResort map[string]*storage.Prekey
+}
+
+// NewPrekeys returns a new storage.Prekeys kept in memory.
+func NewPrekeys() *prekeys {
+	return &prekeys{
+		published:  make(map[string]map[sf.PublicKey][]byte),
+		lastResort: make(map[string]*storage.Prekey),
+	}
+}
+
+// PutPrekeys implements storage.Prekeys.
+func (p *prekeys) PutPrekeys(recipient string, keys []*storage.Prekey) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rcptKeys, ok := p.published[recipient]
+	if !ok {
+		rcptKeys = make(map[sf.PublicKey][]byte)
+		p.published[recipient] = rcptKeys
+	}
+	for _, key := range keys {
+		rcptKeys[*key.Key] = key.Signature
+	}
+	return nil
+}
+
+// ClaimPrekey implements storage.Prekeys.
+func (p *prekeys) ClaimPrekey(recipient string) (*storage.Prekey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, signature := range p.published[recipient] {
+		delete(p.published[recipient], key)
+		if len(p.published[recipient]) == 0 {
+			delete(p.published, recipient)
+		}
+		return &storage.Prekey{Key: &key, Signature: signature}, nil
+	}
+	return nil, errgo.WithCausef(nil, storage.ErrNotFound, "no prekeys for %q", recipient)
+}
+
+// CountPrekeys implements storage.Prekeys.
+func (p *prekeys) CountPrekeys(recipient string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.published[recipient]), nil
+}
+
+// PutLastResortPrekey implements storage.Prekeys.
+func (p *prekeys) PutLastResortPrekey(recipient string, key *storage.Prekey) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastResort[recipient] = key
+	return nil
+}
+
+// LastResortPrekey implements storage.Prekeys.
+func (p *prekeys) LastResortPrekey(recipient string) (*storage.Prekey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.lastResort[recipient]
+	if !ok {
+		return nil, errgo.WithCausef(nil, storage.ErrNotFound, "no last-resort prekey for %q", recipient)
+	}
+	return key, nil
+}
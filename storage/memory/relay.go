@@ -0,0 +1,114 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package memory
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/cmars/shadowfax/storage"
+)
+
+type relayQueue struct {
+	mu           sync.Mutex
+	messages     []*storage.RelayMessage
+	maxPerSender int
+}
+
+// NewRelayQueue returns a new storage.RelayQueue kept in memory.
+func NewRelayQueue() *relayQueue {
+	return &relayQueue{}
+}
+
+// SetMaxPerSender implements storage.RelayQueue.
+func (q *relayQueue) SetMaxPerSender(maxMessages int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.maxPerSender = maxMessages
+}
+
+// find returns the index of a queued message, or -1 if not queued.
+func (q *relayQueue) find(router, id string) int {
+	for i, msg := range q.messages {
+		if msg.Router == router && msg.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Enqueue implements storage.RelayQueue.
+func (q *relayQueue) Enqueue(router string, msg *storage.AddressedMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	relayMsg := &storage.RelayMessage{
+		AddressedMessage: *msg,
+		Router:           router,
+	}
+	relayMsg.Contents = append([]byte(nil), msg.Contents...)
+	if i := q.find(router, msg.ID); i >= 0 {
+		q.messages[i] = relayMsg
+		return nil
+	}
+	if q.maxPerSender > 0 {
+		var count int
+		for _, queued := range q.messages {
+			if queued.Sender == msg.Sender {
+				count++
+			}
+		}
+		if count >= q.maxPerSender {
+			return errgo.WithCausef(nil, storage.ErrMailboxFull, "sender has %d messages queued for relay", count)
+		}
+	}
+	q.messages = append(q.messages, relayMsg)
+	return nil
+}
+
+// Due implements storage.RelayQueue.
+func (q *relayQueue) Due(now time.Time) ([]*storage.RelayMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var result []*storage.RelayMessage
+	for _, msg := range q.messages {
+		if !msg.Next.After(now) {
+			relayMsg := *msg
+			relayMsg.Contents = append([]byte(nil), msg.Contents...)
+			result = append(result, &relayMsg)
+		}
+	}
+	return result, nil
+}
+
+// Retry implements storage.RelayQueue.
+func (q *relayQueue) Retry(router string, ids []string, next time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, id := range ids {
+		if i := q.find(router, id); i >= 0 {
+			q.messages[i].Attempts++
+			q.messages[i].Next = next
+		}
+	}
+	return nil
+}
+
+// Remove implements storage.RelayQueue.
+func (q *relayQueue) Remove(router string, ids []string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, id := range ids {
+		if i := q.find(router, id); i >= 0 {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+		}
+	}
+	return nil
+}
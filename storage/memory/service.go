@@ -0,0 +1,257 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+// Package memory provides implementations of the storage interfaces which
+// are kept in memory, for embedding, testing and ephemeral routers. Nothing
+// is persisted; all storage is lost when the process exits.
+//
+// All implementations are safe for concurrent use.
+package memory
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/storage"
+)
+
+// storedMessage is a message in a recipient's mailbox, and the time its
+// lease expires if it has been fetched.
+type storedMessage struct {
+	storage.AddressedMessage
+	leaseExpires time.Time
+}
+
+func (m *storedMessage) expired(now time.Time) bool {
+	return !m.Expires.IsZero() && !m.Expires.After(now)
+}
+
+func (m *storedMessage) leased(now time.Time) bool {
+	return m.leaseExpires.After(now)
+}
+
+// copy returns a copy of the message which does not share its contents.
+func (m *storedMessage) copy() *storage.AddressedMessage {
+	msg := m.AddressedMessage
+	msg.Contents = append([]byte(nil), m.Contents...)
+	return &msg
+}
+
+type service struct {
+	mu          sync.Mutex
+	mailboxes   map[string][]*storedMessage
+	maxMessages int
+	maxBytes    int64
+	maxLease    int64
+	notifier    *storage.Notifier
+}
+
+// NewService returns a new storage.Service kept in memory.
+func NewService() *service {
+	return &service{mailboxes: make(map[string][]*storedMessage)}
+}
+
+// SetLimits sets the maximum number of messages and total bytes of message
+// contents stored for each recipient. Zero means no limit.
+func (s *service) SetLimits(maxMessages int, maxBytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxMessages = maxMessages
+	s.maxBytes = maxBytes
+}
+
+// SetMaxLeaseBytes sets the most message bytes leased by a single Fetch.
+// Messages beyond the limit are left for later fetches, though at least one
+// message is always leased if available. If zero, all available messages are
+// leased.
+func (s *service) SetMaxLeaseBytes(maxLease int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxLease = maxLease
+}
+
+// SetNotifier sets a notifier which is signalled when messages are pushed.
+func (s *service) SetNotifier(notifier *storage.Notifier) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notifier = notifier
+}
+
+// Push implements storage.Service.
+func (s *service) Push(msg *storage.AddressedMessage) error {
+	rcptKey, err := sf.DecodePublicKey(msg.Recipient)
+	if err != nil {
+		return errgo.Notef(err, "invalid recipient %q", msg.Recipient)
+	}
+	if msg.Sender != "" {
+		_, err := sf.DecodePublicKey(msg.Sender)
+		if err != nil {
+			return errgo.Notef(err, "invalid sender %q", msg.Sender)
+		}
+	}
+	_, err = sf.DecodeNonce(msg.ID)
+	if err != nil {
+		return errgo.Notef(err, "invalid nonce %q", msg.ID)
+	}
+	stored := &storedMessage{AddressedMessage: *msg}
+	stored.Contents = append([]byte(nil), msg.Contents...)
+	if stored.Received.IsZero() {
+		stored.Received = time.Now()
+	}
+	recipient := rcptKey.Encode()
+
+	s.mu.Lock()
+	mailbox := s.mailboxes[recipient]
+	// A message with the same ID from the same sender replaces the original.
+	for i, prev := range mailbox {
+		if prev.ID == msg.ID && prev.Sender == msg.Sender {
+			mailbox = append(mailbox[:i:i], mailbox[i+1:]...)
+			break
+		}
+	}
+	err = s.checkLimits(mailbox, len(msg.Contents))
+	if err != nil {
+		s.mu.Unlock()
+		return errgo.Mask(err, errgo.Is(storage.ErrMailboxFull))
+	}
+	s.mailboxes[recipient] = append(mailbox, stored)
+	notifier := s.notifier
+	s.mu.Unlock()
+
+	if notifier != nil {
+		notifier.Notify(recipient)
+	}
+	return nil
+}
+
+// checkLimits returns an error with cause storage.ErrMailboxFull if storing a
+// message of the given size would exceed the recipient's limits.
+func (s *service) checkLimits(mailbox []*storedMessage, size int) error {
+	if s.maxMessages <= 0 && s.maxBytes <= 0 {
+		return nil
+	}
+	if s.maxBytes > 0 && int64(size) > s.maxBytes {
+		return errgo.WithCausef(nil, storage.ErrMailboxFull, "message exceeds %d bytes", s.maxBytes)
+	}
+	total := int64(size)
+	for _, msg := range mailbox {
+		total += int64(len(msg.Contents))
+	}
+	if s.maxMessages > 0 && len(mailbox) >= s.maxMessages {
+		return errgo.WithCausef(nil, storage.ErrMailboxFull, "mailbox has %d messages", len(mailbox))
+	}
+	if s.maxBytes > 0 && total > s.maxBytes {
+		return errgo.WithCausef(nil, storage.ErrMailboxFull, "mailbox would exceed %d bytes", s.maxBytes)
+	}
+	return nil
+}
+
+// Pop implements storage.Service.
+func (s *service) Pop(recipient string) ([]*storage.AddressedMessage, error) {
+	rcptKey, err := sf.DecodePublicKey(recipient)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid recipient %q", recipient)
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []*storage.AddressedMessage
+	for _, msg := range s.mailboxes[rcptKey.Encode()] {
+		if !msg.expired(now) {
+			result = append(result, msg.copy())
+		}
+	}
+	delete(s.mailboxes, rcptKey.Encode())
+	return result, nil
+}
+
+// Fetch implements storage.Service.
+func (s *service) Fetch(recipient string, leaseTime time.Duration) (*storage.Lease, error) {
+	rcptKey, err := sf.DecodePublicKey(recipient)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid recipient %q", recipient)
+	}
+
+	now := time.Now()
+	lease := &storage.Lease{Expires: now.Add(leaseTime)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var leasedBytes int64
+	for _, msg := range s.mailboxes[rcptKey.Encode()] {
+		if msg.leased(now) || msg.expired(now) {
+			continue
+		}
+		size := int64(len(msg.Contents))
+		if s.maxLease > 0 && len(lease.Messages) > 0 && leasedBytes+size > s.maxLease {
+			break
+		}
+		msg.leaseExpires = lease.Expires
+		lease.Messages = append(lease.Messages, msg.copy())
+		leasedBytes += size
+	}
+	return lease, nil
+}
+
+// Ack implements storage.Service.
+func (s *service) Ack(recipient string, ids []string) error {
+	rcptKey, err := sf.DecodePublicKey(recipient)
+	if err != nil {
+		return errgo.Notef(err, "invalid recipient %q", recipient)
+	}
+	acked := make(map[string]bool)
+	for _, id := range ids {
+		_, err := sf.DecodeNonce(id)
+		if err != nil {
+			return errgo.Notef(err, "invalid nonce %q", id)
+		}
+		acked[id] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(rcptKey.Encode(), func(msg *storedMessage) bool {
+		return acked[msg.ID]
+	})
+	return nil
+}
+
+// Expire implements storage.Service.
+func (s *service) Expire() (int, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	for recipient := range s.mailboxes {
+		n += s.remove(recipient, func(msg *storedMessage) bool {
+			return msg.expired(now)
+		})
+	}
+	return n, nil
+}
+
+// remove removes the messages addressed to a recipient for which f returns
+// true, returning the number removed.
+func (s *service) remove(recipient string, f func(msg *storedMessage) bool) int {
+	mailbox := s.mailboxes[recipient]
+	var kept []*storedMessage
+	for _, msg := range mailbox {
+		if !f(msg) {
+			kept = append(kept, msg)
+		}
+	}
+	if len(kept) == 0 {
+		delete(s.mailboxes, recipient)
+	} else {
+		s.mailboxes[recipient] = kept
+	}
+	return len(mailbox) - len(kept)
+}
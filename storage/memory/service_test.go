@@ -0,0 +1,124 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package memory_test
+
+import (
+	"sync"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/cmars/shadowfax/storage"
+	"github.com/cmars/shadowfax/storage/memory"
+	sftesting "github.com/cmars/shadowfax/testing"
+)
+
+type serviceSuite struct{}
+
+var _ = gc.Suite(&serviceSuite{})
+
+func push(service storage.Service, sender, recipient string, contents []byte) (string, error) {
+	id := sftesting.MustNewNonce().Encode()
+	return id, service.Push(&storage.AddressedMessage{
+		Sender:    sender,
+		Recipient: recipient,
+		Message: storage.Message{
+			ID:       id,
+			Contents: contents,
+		},
+	})
+}
+
+func (s *serviceSuite) TestFetchAck(c *gc.C) {
+	alice := sftesting.MustNewKeyPair().PublicKey.Encode()
+	bob := sftesting.MustNewKeyPair().PublicKey.Encode()
+	service := memory.NewService()
+
+	id1, err := push(service, alice, bob, []byte("one"))
+	c.Assert(err, gc.IsNil)
+	id2, err := push(service, "", bob, []byte("two"))
+	c.Assert(err, gc.IsNil)
+
+	lease, err := service.Fetch(bob, time.Minute)
+	c.Assert(err, gc.IsNil)
+	c.Assert(lease.Messages, gc.HasLen, 2)
+	c.Assert(lease.Messages[0].Sender, gc.Equals, alice)
+	c.Assert(lease.Messages[1].Sender, gc.Equals, "")
+	// Contents returned are not shared with those stored.
+	lease.Messages[1].Contents[0] = 'x'
+
+	lease, err = service.Fetch(bob, time.Minute)
+	c.Assert(err, gc.IsNil)
+	c.Assert(lease.Messages, gc.HasLen, 0)
+
+	err = service.Ack(bob, []string{id1})
+	c.Assert(err, gc.IsNil)
+	msgs, err := service.Pop(bob)
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	c.Assert(msgs[0].ID, gc.Equals, id2)
+	c.Assert(msgs[0].Contents, gc.DeepEquals, []byte("two"))
+	msgs, err = service.Pop(bob)
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 0)
+}
+
+func (s *serviceSuite) TestLimits(c *gc.C) {
+	alice := sftesting.MustNewKeyPair().PublicKey.Encode()
+	bob := sftesting.MustNewKeyPair().PublicKey.Encode()
+	service := memory.NewService()
+	service.SetLimits(2, 10)
+
+	_, err := push(service, alice, bob, make([]byte, 11))
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrMailboxFull)
+	_, err = push(service, alice, bob, make([]byte, 6))
+	c.Assert(err, gc.IsNil)
+	_, err = push(service, alice, bob, make([]byte, 5))
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrMailboxFull)
+	_, err = push(service, alice, bob, make([]byte, 4))
+	c.Assert(err, gc.IsNil)
+	_, err = push(service, alice, bob, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrMailboxFull)
+}
+
+func (s *serviceSuite) TestConcurrent(c *gc.C) {
+	bob := sftesting.MustNewKeyPair().PublicKey.Encode()
+	service := memory.NewService()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			alice := sftesting.MustNewKeyPair().PublicKey.Encode()
+			for j := 0; j < 10; j++ {
+				_, err := push(service, alice, bob, []byte("hello"))
+				c.Check(err, gc.IsNil)
+			}
+		}()
+	}
+	var popped int
+	var mu sync.Mutex
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msgs, err := service.Pop(bob)
+			c.Check(err, gc.IsNil)
+			mu.Lock()
+			popped += len(msgs)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	msgs, err := service.Pop(bob)
+	c.Assert(err, gc.IsNil)
+	c.Assert(popped+len(msgs), gc.Equals, 100)
+}
@@ -0,0 +1,85 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package memory_test
+
+import (
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/shadowfax/storage"
+	"github.com/cmars/shadowfax/storage/memory"
+	sftesting "github.com/cmars/shadowfax/testing"
+)
+
+type memoryServiceSuite struct {
+	*sftesting.ServiceSuite
+}
+
+var _ = gc.Suite(&memoryServiceSuite{&sftesting.ServiceSuite{}})
+
+func (s *memoryServiceSuite) SetUpTest(c *gc.C) {
+	s.ServiceSuite.SetService(memory.NewService())
+	s.ServiceSuite.SetUpTest(c)
+}
+
+type memoryVaultSuite struct {
+	*sftesting.VaultSuite
+}
+
+var _ = gc.Suite(&memoryVaultSuite{&sftesting.VaultSuite{}})
+
+func (s *memoryVaultSuite) SetUpTest(c *gc.C) {
+	s.VaultSuite.SetVault(memory.NewVault())
+	s.VaultSuite.SetUpTest(c)
+}
+
+type memoryContactsSuite struct {
+	*sftesting.ContactsSuite
+}
+
+var _ = gc.Suite(&memoryContactsSuite{&sftesting.ContactsSuite{}})
+
+func (s *memoryContactsSuite) SetUpTest(c *gc.C) {
+	s.ContactsSuite.SetContacts(memory.NewContacts())
+	s.ContactsSuite.SetUpTest(c)
+}
+
+type memoryRelayQueueSuite struct {
+	*sftesting.RelayQueueSuite
+}
+
+var _ = gc.Suite(&memoryRelayQueueSuite{&sftesting.RelayQueueSuite{}})
+
+func (s *memoryRelayQueueSuite) SetUpTest(c *gc.C) {
+	s.RelayQueueSuite.SetRelayQueue(memory.NewRelayQueue())
+	s.RelayQueueSuite.SetUpTest(c)
+}
+
+type memoryOutboxSuite struct {
+	*sftesting.OutboxSuite
+}
+
+var _ = gc.Suite(&memoryOutboxSuite{&sftesting.OutboxSuite{}})
+
+func (s *memoryOutboxSuite) SetUpTest(c *gc.C) {
+	s.OutboxSuite.SetOutbox(memory.NewOutbox())
+	s.OutboxSuite.SetUpTest(c)
+}
+
+type memoryNonceCacheSuite struct {
+	*sftesting.NonceCacheSuite
+}
+
+var _ = gc.Suite(&memoryNonceCacheSuite{&sftesting.NonceCacheSuite{}})
+
+func (s *memoryNonceCacheSuite) SetUpTest(c *gc.C) {
+	s.NonceCacheSuite.SetNewNonceCache(func(capacity int) storage.NonceCache {
+		return memory.NewNonceCache(capacity)
+	})
+	s.NonceCacheSuite.SetUpTest(c)
+}
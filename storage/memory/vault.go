@@ -0,0 +1,205 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package memory
+
+import (
+	"sync"
+
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/storage"
+)
+
+// vaultEntry is a key pair in the vault, with its metadata.
+type vaultEntry struct {
+	keyPair sf.KeyPair
+	label   string
+	retired bool
+}
+
+type vault struct {
+	mu         sync.Mutex
+	entries    []*vaultEntry
+	keys       map[sf.PublicKey]*vaultEntry
+	defaultKey *sf.PublicKey
+}
+
+// NewVault returns a new storage.Vault kept in memory. Key pairs are not
+// encrypted, so the vault should not be used where process memory may be
+// exposed.
+func NewVault() *vault {
+	return &vault{keys: make(map[sf.PublicKey]*vaultEntry)}
+}
+
+func copyKeyPair(keyPair *sf.KeyPair) *sf.KeyPair {
+	publicKey, privateKey := *keyPair.PublicKey, *keyPair.PrivateKey
+	return &sf.KeyPair{PublicKey: &publicKey, PrivateKey: &privateKey}
+}
+
+// current returns the entry of the current key pair, or nil if there is none.
+func (v *vault) current() *vaultEntry {
+	if v.defaultKey != nil {
+		return v.keys[*v.defaultKey]
+	}
+	for i := len(v.entries) - 1; i >= 0; i-- {
+		if !v.entries[i].retired {
+			return v.entries[i]
+		}
+	}
+	return nil
+}
+
+// Current implements storage.Vault.
+func (v *vault) Current() (*sf.KeyPair, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.entries) == 0 {
+		return nil, errgo.New("empty vault")
+	}
+	entry := v.current()
+	if entry == nil {
+		return nil, errgo.New("all key pairs retired")
+	}
+	return copyKeyPair(&entry.keyPair), nil
+}
+
+// Get implements storage.Vault.
+func (v *vault) Get(key *sf.PublicKey) (*sf.KeyPair, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	entry, err := v.entry(key)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(storage.ErrNotFound))
+	}
+	return copyKeyPair(&entry.keyPair), nil
+}
+
+func (v *vault) entry(key *sf.PublicKey) (*vaultEntry, error) {
+	entry, ok := v.keys[*key]
+	if !ok {
+		return nil, errgo.WithCausef(nil, storage.ErrNotFound, "key pair not found for %q", key.Encode())
+	}
+	return entry, nil
+}
+
+// Put implements storage.Vault.
+func (v *vault) Put(keyPair *sf.KeyPair) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	entry := &vaultEntry{keyPair: *copyKeyPair(keyPair)}
+	v.entries = append(v.entries, entry)
+	v.keys[*keyPair.PublicKey] = entry
+	return nil
+}
+
+// Each implements storage.Vault.
+func (v *vault) Each(kpf func(keyPair *sf.KeyPair) error) error {
+	v.mu.Lock()
+	if len(v.entries) == 0 {
+		v.mu.Unlock()
+		return errgo.New("empty vault")
+	}
+	var keyPairs []*sf.KeyPair
+	for _, entry := range v.entries {
+		keyPairs = append(keyPairs, copyKeyPair(&entry.keyPair))
+	}
+	v.mu.Unlock()
+
+	for _, keyPair := range keyPairs {
+		err := kpf(keyPair)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// Rekey implements storage.Vault. Key pairs kept in memory are not
+// encrypted, so there is nothing to re-encrypt.
+func (v *vault) Rekey(secretKey *sf.SecretKey) error {
+	return nil
+}
+
+func (v *vault) keyInfo(entry, current *vaultEntry) *storage.KeyInfo {
+	address := *entry.keyPair.PublicKey
+	return &storage.KeyInfo{
+		Address: &address,
+		Label:   entry.label,
+		Default: current != nil && *current.keyPair.PublicKey == address,
+		Retired: entry.retired,
+	}
+}
+
+// Info implements storage.Vault.
+func (v *vault) Info(key *sf.PublicKey) (*storage.KeyInfo, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	entry, err := v.entry(key)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(storage.ErrNotFound))
+	}
+	return v.keyInfo(entry, v.current()), nil
+}
+
+// Infos implements storage.Vault.
+func (v *vault) Infos() ([]*storage.KeyInfo, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	current := v.current()
+	var infos []*storage.KeyInfo
+	for _, entry := range v.entries {
+		infos = append(infos, v.keyInfo(entry, current))
+	}
+	return infos, nil
+}
+
+// SetLabel implements storage.Vault.
+func (v *vault) SetLabel(key *sf.PublicKey, label string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	entry, err := v.entry(key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(storage.ErrNotFound))
+	}
+	entry.label = label
+	return nil
+}
+
+// SetDefault implements storage.Vault.
+func (v *vault) SetDefault(key *sf.PublicKey) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	entry, err := v.entry(key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(storage.ErrNotFound))
+	}
+	if entry.retired {
+		return errgo.Newf("key pair %q is retired", key.Encode())
+	}
+	defaultKey := *key
+	v.defaultKey = &defaultKey
+	return nil
+}
+
+// Retire implements storage.Vault. If the key pair had been chosen as the
+// default, the latest key pair which is not retired becomes current.
+func (v *vault) Retire(key *sf.PublicKey) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	entry, err := v.entry(key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(storage.ErrNotFound))
+	}
+	entry.retired = true
+	if v.defaultKey != nil && *v.defaultKey == *key {
+		v.defaultKey = nil
+	}
+	return nil
+}
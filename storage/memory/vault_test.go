@@ -0,0 +1,34 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package memory_test
+
+import (
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/shadowfax/storage/memory"
+	sftesting "github.com/cmars/shadowfax/testing"
+)
+
+type vaultSuite struct{}
+
+var _ = gc.Suite(&vaultSuite{})
+
+func (s *vaultSuite) TestCopies(c *gc.C) {
+	v := memory.NewVault()
+	kp1 := sftesting.MustNewKeyPair()
+	c.Assert(v.Put(kp1), gc.IsNil)
+
+	// Key pairs returned are not shared with those stored.
+	kp, err := v.Get(kp1.PublicKey)
+	c.Assert(err, gc.IsNil)
+	kp.PrivateKey[0]++
+	kp, err = v.Get(kp1.PublicKey)
+	c.Assert(err, gc.IsNil)
+	c.Assert(kp, gc.DeepEquals, kp1)
+}
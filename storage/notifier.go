@@ -0,0 +1,64 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package storage
+
+import (
+	"sync"
+)
+
+// Notifier signals waiters when messages are pushed to a recipient. It is
+// safe for concurrent use.
+type Notifier struct {
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]bool
+}
+
+// NewNotifier returns a new Notifier.
+func NewNotifier() *Notifier {
+	return &Notifier{
+		waiters: make(map[string]map[chan struct{}]bool),
+	}
+}
+
+// Wait returns a channel which is closed when a message is next pushed to
+// the recipient, and a function which must be called to stop waiting.
+func (n *Notifier) Wait(recipient string) (<-chan struct{}, func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	ch := make(chan struct{})
+	rcptWaiters, ok := n.waiters[recipient]
+	if !ok {
+		rcptWaiters = make(map[chan struct{}]bool)
+		n.waiters[recipient] = rcptWaiters
+	}
+	rcptWaiters[ch] = true
+	return ch, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		rcptWaiters := n.waiters[recipient]
+		if rcptWaiters[ch] {
+			delete(rcptWaiters, ch)
+			if len(rcptWaiters) == 0 {
+				delete(n.waiters, recipient)
+			}
+		}
+	}
+}
+
+// Notify wakes all waiters for the recipient.
+func (n *Notifier) Notify(recipient string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for ch := range n.waiters[recipient] {
+		close(ch)
+	}
+	delete(n.waiters, recipient)
+}
@@ -0,0 +1,72 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package storage_test
+
+import (
+	"testing"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/shadowfax/storage"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type notifierSuite struct{}
+
+var _ = gc.Suite(&notifierSuite{})
+
+func closed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *notifierSuite) TestNotify(c *gc.C) {
+	n := storage.NewNotifier()
+	bob1, stop1 := n.Wait("bob")
+	defer stop1()
+	bob2, stop2 := n.Wait("bob")
+	defer stop2()
+	carol, stop3 := n.Wait("carol")
+	defer stop3()
+
+	n.Notify("bob")
+	c.Assert(closed(bob1), gc.Equals, true)
+	c.Assert(closed(bob2), gc.Equals, true)
+	c.Assert(closed(carol), gc.Equals, false)
+
+	// Waiters are only notified once.
+	bob3, stop4 := n.Wait("bob")
+	defer stop4()
+	c.Assert(closed(bob3), gc.Equals, false)
+	n.Notify("bob")
+	c.Assert(closed(bob3), gc.Equals, true)
+}
+
+func (s *notifierSuite) TestStop(c *gc.C) {
+	n := storage.NewNotifier()
+	bob1, stop1 := n.Wait("bob")
+	stop1()
+	bob2, stop2 := n.Wait("bob")
+	defer stop2()
+
+	// Stopping after notification does not affect later waiters.
+	n.Notify("bob")
+	bob3, stop3 := n.Wait("bob")
+	defer stop3()
+	stop2()
+	n.Notify("bob")
+	c.Assert(closed(bob1), gc.Equals, false)
+	c.Assert(closed(bob2), gc.Equals, true)
+	c.Assert(closed(bob3), gc.Equals, true)
+}
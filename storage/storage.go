@@ -9,13 +9,25 @@
 package storage
 
 import (
+	"time"
+
+	"gopkg.in/errgo.v1"
+
 	sf "github.com/cmars/shadowfax"
 )
 
+// ErrMailboxFull is the cause of a failure to push a message because the
+// recipient has reached their storage limit.
+var ErrMailboxFull = errgo.New("mailbox full")
+
+// ErrNotFound is the cause of a failure to find a stored item.
+var ErrNotFound = errgo.New("not found")
+
 // Contacts organizes public keys by a locally assigned name.
 type Contacts interface {
 
-	// Key returns the latest public key for the given name.
+	// Key returns the latest public key for the given name. The cause of the
+	// error returned is ErrNotFound if there is no such name.
 	Key(name string) (*sf.PublicKey, error)
 
 	// Name returns the latest name given to the public key.
@@ -27,12 +39,32 @@ type Contacts interface {
 
 	// Current returns the current name assignments.
 	Current() (ContactInfos, error)
+
+	// Group returns the contact names which are members of a group.
+	Group(group string) ([]string, error)
+
+	// PutGroup sets the contact names which are members of a group,
+	// replacing any prior members. A group with no members is removed.
+	PutGroup(group string, names []string) error
+
+	// Router returns the home router of the contact with the given name, or
+	// an empty string if it is not known. The cause of the error returned is
+	// ErrNotFound if there is no such name.
+	Router(name string) (string, error)
+
+	// SetRouter sets the home router of the contact with the given name, or
+	// forgets it if empty. The cause of the error returned is ErrNotFound if
+	// there is no such name.
+	SetRouter(name string, router string) error
 }
 
 // ContactInfo represents the local name for an address.
 type ContactInfo struct {
 	Name    string
 	Address *sf.PublicKey
+
+	// Router is the home router of the contact, if known.
+	Router string
 }
 
 // ContactInfos is a sortable slice of contact information.
@@ -50,29 +82,261 @@ func (c ContactInfos) Less(i, j int) bool { return c[i].Name < c[j].Name }
 // Vault stores public-private key pairs.
 type Vault interface {
 
-	// Current returns the latest key pair.
+	// Current returns the default key pair: the one chosen with SetDefault,
+	// or if none has been chosen, the latest key pair which is not retired.
 	Current() (*sf.KeyPair, error)
 
-	// Get returns the key pair for the given public key.
+	// Get returns the key pair for the given public key. The cause of the
+	// error returned is ErrNotFound if there is no such key pair.
 	Get(key *sf.PublicKey) (*sf.KeyPair, error)
 
-	// Put adds a new key pair, which becomes the latest, current key pair.
+	// Put adds a new key pair. It becomes the current key pair unless a
+	// default has been chosen with SetDefault.
 	Put(keyPair *sf.KeyPair) error
 
+	// Info returns the metadata for the given public key. The cause of the
+	// error returned is ErrNotFound if there is no such key pair.
+	Info(key *sf.PublicKey) (*KeyInfo, error)
+
+	// Infos returns the metadata of all key pairs, in the order they were
+	// added.
+	Infos() ([]*KeyInfo, error)
+
+	// SetLabel gives the key pair for the given public key a label, or
+	// removes its label if empty.
+	SetLabel(key *sf.PublicKey, label string) error
+
+	// SetDefault chooses the key pair for the given public key as the
+	// current key pair. Retired key pairs cannot be chosen.
+	SetDefault(key *sf.PublicKey) error
+
+	// Retire marks the key pair for the given public key as retired. A
+	// retired key pair is kept so that messages sent to it can still be
+	// opened, but it is never the current key pair.
+	Retire(key *sf.PublicKey) error
+
 	// Each calls the given function with each key pair in the vault.
 	//
 	// Iteration stops if the function returns an error.
 	Each(func(key *sf.KeyPair) error) error
+
+	// Rekey re-encrypts all key pairs, and any other secrets stored with
+	// them, with a new secret key. Either all are re-encrypted or none are.
+	Rekey(secretKey *sf.SecretKey) error
+}
+
+// KeyInfo is the metadata of a key pair in a Vault.
+type KeyInfo struct {
+	Address *sf.PublicKey
+	Label   string
+
+	// Default is whether the key pair is the current key pair.
+	Default bool
+
+	// Retired is whether the key pair has been retired.
+	Retired bool
+}
+
+// Sessions stores the private state of forward-secret sessions: one-time
+// prekeys, and the chain keys of each session. Like the key pairs in a Vault,
+// this state is secret and must be stored encrypted.
+type Sessions interface {
+
+	// PutPrekey stores a one-time prekey pair.
+	PutPrekey(keyPair *sf.KeyPair) error
+
+	// PutLastResortPrekey stores a last-resort prekey pair, which may start
+	// any number of sessions, and is never removed.
+	PutLastResortPrekey(keyPair *sf.KeyPair) error
+
+	// GetPrekey returns the prekey pair for the given public key. A one-time
+	// prekey is removed by UpdatePrekey once a session has been established
+	// with it.
+	// The cause of the error returned is ErrNotFound if there is no such
+	// prekey.
+	GetPrekey(key *sf.PublicKey) (*sf.KeyPair, error)
+
+	// Get returns the state of the session with the given ID. The cause of
+	// the error returned is ErrNotFound if there is no such session.
+	Get(id string) ([]byte, error)
+
+	// Update replaces the state of the session with the given ID with the
+	// result of f, which is given the current state, or nil if the session
+	// does not exist. The state is unchanged if f returns an error.
+	Update(id string, f func(state []byte) ([]byte, error)) error
+
+	// UpdatePrekey is like Update for a session started with the given
+	// prekey. A one-time prekey is removed in the same transaction as the
+	// state is stored, so that it can only be used once, and only once the
+	// session is established. The cause of the error returned is
+	// ErrNotFound if the session does not exist and the prekey has already
+	// been removed.
+	UpdatePrekey(id string, prekey *sf.PublicKey, f func(state []byte) ([]byte, error)) error
+}
+
+// Prekey is a public prekey published by a recipient, signed by the
+// recipient's key so that senders can check that it is genuine.
+type Prekey struct {
+	Key       *sf.PublicKey
+	Signature []byte
+}
+
+// Prekeys stores the public prekeys published by recipients on a shadowfax
+// server, for senders to claim when starting sessions.
+type Prekeys interface {
+
+	// PutPrekeys adds one-time prekeys published by a recipient.
+	PutPrekeys(recipient string, prekeys []*Prekey) error
+
+	// ClaimPrekey returns one of a recipient's one-time prekeys and removes
+	// it, so that it is given to only one sender. The cause of the error
+	// returned is ErrNotFound if the recipient has no prekeys left.
+	ClaimPrekey(recipient string) (*Prekey, error)
+
+	// CountPrekeys returns how many one-time prekeys a recipient has left.
+	CountPrekeys(recipient string) (int, error)
+
+	// PutLastResortPrekey replaces a recipient's last-resort prekey.
+	PutLastResortPrekey(recipient string, prekey *Prekey) error
+
+	// LastResortPrekey returns a recipient's last-resort prekey, which is
+	// given to senders when no one-time prekey is, and is never removed.
+	// The cause of the error returned is ErrNotFound if the recipient has
+	// not published one.
+	LastResortPrekey(recipient string) (*Prekey, error)
 }
 
 // Service stores messages for a shadowfax server.
 type Service interface {
 
-	// Push queues a message to a recipient.
+	// Push queues a message to a recipient. If the recipient cannot store any
+	// more messages, the cause of the error returned is ErrMailboxFull.
 	Push(msg *AddressedMessage) error
 
-	// Pop retrieves messages addressed to a recipient and removes them.
+	// Pop retrieves messages addressed to a recipient and removes them. The
+	// messages are returned in no particular order, each only once.
 	Pop(recipient string) ([]*AddressedMessage, error)
+
+	// Fetch retrieves messages addressed to a recipient without removing
+	// them. Fetched messages are leased for the given duration, during which
+	// they are not returned by subsequent fetches. Messages not acknowledged
+	// before the lease expires become available again. As with Pop, the
+	// messages are returned in no particular order.
+	Fetch(recipient string, leaseTime time.Duration) (*Lease, error)
+
+	// Ack removes the messages with the given IDs addressed to a recipient.
+	Ack(recipient string, ids []string) error
+
+	// Expire removes all messages which have expired, returning the number
+	// of messages removed.
+	Expire() (int, error)
+}
+
+// RelayQueue holds messages waiting to be relayed to the home routers of
+// their recipients, so that delivery can be retried while a router cannot be
+// reached.
+type RelayQueue interface {
+
+	// Enqueue adds a message to be relayed to a router. A message already
+	// queued for the router with the same ID is replaced. If the sender
+	// already has the most messages allowed queued, the cause of the error
+	// returned is ErrMailboxFull.
+	Enqueue(router string, msg *AddressedMessage) error
+
+	// Due returns the queued messages whose next delivery attempt is due at
+	// the given time, in the order they were queued.
+	Due(now time.Time) ([]*RelayMessage, error)
+
+	// Retry counts a failed attempt to deliver messages queued for a router,
+	// and defers their next attempt until the given time.
+	Retry(router string, ids []string, next time.Time) error
+
+	// Remove removes messages queued for a router, once they are delivered
+	// or abandoned.
+	Remove(router string, ids []string) error
+
+	// SetMaxPerSender sets the most messages each sender may have queued, so
+	// that no sender can fill the queue. Messages from anonymous senders
+	// share a single limit. If 0 or less, there is no limit.
+	SetMaxPerSender(maxMessages int)
+}
+
+// RelayMessage is a message queued for relay to another router.
+type RelayMessage struct {
+	AddressedMessage
+	Router string
+
+	// Attempts is how many times delivery has failed.
+	Attempts int
+
+	// Next is when delivery is next due. A zero time is due immediately.
+	Next time.Time
+}
+
+// Outbox tracks the delivery of messages a client has sent, from the
+// server's receipt through to delivery receipts returned by recipients.
+// Recipients are identified by their encoded public keys.
+type Outbox interface {
+
+	// Sent records a message pushed to a recipient, and whether the server
+	// stored it. Recording the same message and recipient again replaces
+	// the earlier record.
+	Sent(id, recipient string, stored bool, at time.Time) error
+
+	// Delivered records a delivery receipt from a recipient. The cause of the
+	// error returned is ErrNotFound if the message was not sent to that
+	// recipient, so that receipts cannot be forged by others.
+	Delivered(id, recipient string, at time.Time) error
+
+	// Status returns the delivery status of a message for each recipient it
+	// was sent to, ordered by recipient. The cause of the error returned is
+	// ErrNotFound if there is no such message.
+	Status(id string) ([]*DeliveryStatus, error)
+}
+
+// Delivery states of a sent message.
+const (
+	// StatusSent is a message which was pushed, but not stored by the
+	// server.
+	StatusSent = "sent"
+
+	// StatusStored is a message stored by the server for the recipient.
+	StatusStored = "stored"
+
+	// StatusDelivered is a message the recipient has acknowledged.
+	StatusDelivered = "delivered"
+)
+
+// DeliveryStatus is the delivery state of a message sent to a recipient.
+type DeliveryStatus struct {
+	ID        string
+	Recipient string
+	Status    string
+
+	// Sent is when the message was pushed.
+	Sent time.Time
+
+	// Delivered is when the recipient acknowledged the message, if it has.
+	Delivered time.Time
+}
+
+// Lease is a set of fetched messages reserved for a recipient until they are
+// acknowledged or the lease expires.
+type Lease struct {
+	Messages []*AddressedMessage
+	Expires  time.Time
+}
+
+// NonceCache remembers nonces which have already been used, so that replayed
+// requests can be detected.
+type NonceCache interface {
+
+	// Seen records a nonce, which should be remembered until the given
+	// expiration time. It returns true if the nonce was already recorded and
+	// has not yet expired. A cache which forgets nonces before they expire
+	// must fail closed, returning true for any nonce which might have been
+	// forgotten.
+	Seen(nonce *sf.Nonce, expires time.Time) (bool, error)
 }
 
 // Message is some content with a unique identifier.
@@ -85,5 +349,15 @@ type Message struct {
 type AddressedMessage struct {
 	Message
 	Recipient string
-	Sender    string
+
+	// Sender is empty if the message was pushed with a sealed sender, known
+	// only to the recipient.
+	Sender string
+
+	// Received is when the message was received by the server.
+	Received time.Time
+
+	// Expires is when the message will be discarded if not yet delivered.
+	// Messages with a zero expiration time do not expire.
+	Expires time.Time
 }
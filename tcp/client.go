@@ -0,0 +1,243 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package tcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/transport"
+	"github.com/cmars/shadowfax/wire"
+)
+
+// Client pushes and pops messages in the shadowfax messaging system over a
+// TCP connection. Requests are made one at a time; the connection is opened
+// on the first request and reopened if it fails.
+type Client struct {
+	keyPair      *sf.KeyPair
+	addr         string
+	serverKey    *sf.PublicKey
+	ttl          time.Duration
+	maxFrameSize int
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewClient returns a new shadowfax client for the server at the TCP address
+// addr. The server's public key must be known in advance.
+func NewClient(keyPair *sf.KeyPair, addr string, serverKey *sf.PublicKey) *Client {
+	return &Client{
+		keyPair:      keyPair,
+		addr:         addr,
+		serverKey:    serverKey,
+		maxFrameSize: DefaultMaxFrameSize,
+	}
+}
+
+// SetTTL sets the time-to-live requested for pushed messages. The server may
+// expire messages sooner. If zero, the server's maximum is used. The TTL is
+// sent in whole seconds, rounded up.
+func (c *Client) SetTTL(ttl time.Duration) {
+	c.ttl = ttl
+}
+
+// ttlSeconds returns a time-to-live in whole seconds, rounded up so that a
+// TTL of less than a second is not mistaken for the server's maximum.
+func ttlSeconds(ttl time.Duration) int64 {
+	return int64((ttl + time.Second - 1) / time.Second)
+}
+
+// Close closes the connection to the server, if open.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return errgo.Mask(err)
+}
+
+// PublicKey returns the public key identity of the client.
+func (c *Client) PublicKey() *sf.PublicKey {
+	return c.keyPair.PublicKey
+}
+
+type serverError struct {
+	code    int
+	message string
+}
+
+// Error implements the error interface.
+func (err *serverError) Error() string {
+	return fmt.Sprintf("server response: %d %q", err.code, err.message)
+}
+
+// Request encrypts a request to the server and decrypts the response.
+func (c *Client) Request(op string, contents []byte) ([]byte, error) {
+	reqMessage, nonce, err := transport.SealRequest(c.keyPair, c.serverKey, contents)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	req := RequestFrame{
+		Op:      op,
+		Key:     c.keyPair.PublicKey.Encode(),
+		Message: *reqMessage,
+	}
+
+	resp, err := c.roundTrip(&req)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if resp.Error != nil {
+		return nil, errgo.Mask(&serverError{code: resp.Error.Code, message: resp.Error.Message})
+	}
+	if resp.Message == nil {
+		return nil, errgo.New("empty response from server")
+	}
+	return transport.OpenResponse(c.keyPair, c.serverKey, resp.Message, nonce)
+}
+
+func (c *Client) roundTrip(req *RequestFrame) (*ResponseFrame, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		conn, err := net.Dial("tcp", c.addr)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		c.conn = conn
+	}
+	var resp ResponseFrame
+	err := writeFrame(c.conn, req)
+	if err == nil {
+		err = readFrame(c.conn, c.maxFrameSize, &resp)
+	}
+	if err != nil {
+		// The connection is in an unknown state, so start over with the
+		// next request.
+		c.conn.Close()
+		c.conn = nil
+		return nil, errgo.Mask(err)
+	}
+	return &resp, nil
+}
+
+// Push pushes a message to a recipient.
+func (c *Client) Push(recipient string, contents []byte) error {
+	nonce, err := sf.NewNonce()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	addr, err := sf.ParseAddress(recipient)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	encMsg := box.Seal(nil, contents, (*[24]byte)(nonce), (*[32]byte)(addr.Key), (*[32]byte)(c.keyPair.PrivateKey))
+	pushWire := []wire.PushMessage{{
+		Message: wire.Message{
+			ID:       nonce.Encode(),
+			Contents: encMsg,
+		},
+		Recipient: recipient,
+		TTL:       ttlSeconds(c.ttl),
+	}}
+	reqContents, err := json.Marshal(&pushWire)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+
+	respContents, err := c.Request(OpPush, reqContents)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var pushReceipts []wire.PushReceipt
+	err = json.Unmarshal(respContents, &pushReceipts)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var receipt *wire.PushReceipt
+	for i := range pushReceipts {
+		if pushReceipts[i].ID == nonce.Encode() {
+			receipt = &pushReceipts[i]
+		}
+	}
+	return errgo.Mask(transport.ReceiptError(recipient, receipt), errgo.Is(transport.ErrMailboxFull), errgo.Is(transport.ErrNoRoute))
+}
+
+// Pop retrieves messages addressed to the client and removes them from the
+// server.
+func (c *Client) Pop() ([]*transport.PopMessage, error) {
+	respContents, err := c.Request(OpPop, nil)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var wireMessages []wire.PopMessage
+	err = json.Unmarshal(respContents, &wireMessages)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return c.openMessages(wireMessages)
+}
+
+// Fetch retrieves messages addressed to the client without removing them
+// from the server. The messages are leased to the client until the returned
+// expiration time. Messages which are not acknowledged with Ack before then
+// will be returned again by a later Fetch. If some messages could not be
+// opened, the others are returned along with a *transport.OpenError.
+func (c *Client) Fetch() ([]*transport.PopMessage, time.Time, error) {
+	var fail time.Time
+	respContents, err := c.Request(OpFetch, nil)
+	if err != nil {
+		return nil, fail, errgo.Mask(err)
+	}
+	var fetchResp wire.FetchResponse
+	err = json.Unmarshal(respContents, &fetchResp)
+	if err != nil {
+		return nil, fail, errgo.Mask(err)
+	}
+	popMessages, err := c.openMessages(fetchResp.Messages)
+	return popMessages, fetchResp.Expires, err
+}
+
+// Ack acknowledges receipt of fetched messages, removing them from the
+// server.
+func (c *Client) Ack(ids []string) error {
+	reqContents, err := json.Marshal(&wire.AckRequest{IDs: ids})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	respContents, err := c.Request(OpAck, reqContents)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var ackResp wire.Error
+	err = json.Unmarshal(respContents, &ackResp)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if !ackResp.OK {
+		return errgo.New("not acknowledged")
+	}
+	return nil
+}
+
+func (c *Client) openMessages(wireMessages []wire.PopMessage) ([]*transport.PopMessage, error) {
+	return transport.OpenMessages(c.keyPair, nil, wireMessages)
+}
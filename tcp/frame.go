@@ -0,0 +1,86 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package tcp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/cmars/shadowfax/wire"
+)
+
+// DefaultMaxFrameSize is the largest frame accepted by default, in bytes.
+const DefaultMaxFrameSize = 16 << 20
+
+// Request operations.
+const (
+	OpPush  = "push"
+	OpPop   = "pop"
+	OpFetch = "fetch"
+	OpAck   = "ack"
+)
+
+// RequestFrame is sent by a client to make a request. Key is the client's
+// public key, which identifies the sender of a push, or the recipient of a
+// pop, fetch or ack. Message is the request, sealed to the server as with
+// the HTTP transport.
+type RequestFrame struct {
+	Op      string       `json:"op"`
+	Key     string       `json:"key"`
+	Message wire.Message `json:"message"`
+}
+
+// ResponseFrame is sent by the server in reply to each request. It contains
+// either an error or the response, sealed to the client.
+type ResponseFrame struct {
+	Error   *wire.Error   `json:"error,omitempty"`
+	Message *wire.Message `json:"message,omitempty"`
+}
+
+// writeFrame writes v as a frame: a 4-byte big-endian length followed by that
+// many bytes of JSON.
+func writeFrame(w io.Writer, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	buf := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	copy(buf[4:], body)
+	_, err = w.Write(buf)
+	return errgo.Mask(err, errgo.Any)
+}
+
+// readFrame reads a frame into v. Frames larger than maxSize are rejected
+// without being read. Since frames are read before the request is
+// authenticated, the body is buffered as it arrives rather than allocated
+// from the length header.
+func readFrame(r io.Reader, maxSize int, v interface{}) error {
+	var header [4]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if int64(size) > int64(maxSize) {
+		return errgo.Newf("frame size %d exceeds maximum %d", size, maxSize)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r, int64(size)))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if len(body) < int(size) {
+		return errgo.Mask(io.ErrUnexpectedEOF)
+	}
+	return errgo.Mask(json.Unmarshal(body, v))
+}
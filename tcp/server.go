@@ -0,0 +1,282 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+// Package tcp provides a shadowfax server and client which exchange
+// length-prefixed frames over a plain TCP connection, for environments where
+// an HTTP stack is unwanted.
+package tcp
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/storage"
+	"github.com/cmars/shadowfax/transport"
+	"github.com/cmars/shadowfax/wire"
+)
+
+// DefaultIdleTimeout is how long a connection may be idle between requests
+// before the server closes it.
+const DefaultIdleTimeout = 5 * time.Minute
+
+// Response error codes follow their HTTP equivalents.
+const (
+	codeBadRequest      = 400
+	codeTooManyRequests = 429
+	codeInternalError   = 500
+)
+
+var errBadRequest = errgo.New("bad request")
+
+// Server serves shadowfax requests from TCP connections.
+type Server struct {
+	service       storage.Service
+	authenticator *transport.Authenticator
+	leaseTime     time.Duration
+	maxTTL        time.Duration
+	addrLimit     *transport.RateLimiter
+	routerName    string
+	maxFrameSize  int
+	idleTimeout   time.Duration
+}
+
+// NewServer returns a new Server with public key pair and service backend.
+// Lease time, maximum TTL and clock skew default to the same values as the
+// HTTP handler.
+func NewServer(keyPair *sf.KeyPair, service storage.Service) *Server {
+	return &Server{
+		service:       service,
+		authenticator: transport.NewAuthenticator(keyPair),
+		leaseTime:     transport.DefaultLeaseTime,
+		maxTTL:        transport.DefaultMaxTTL,
+		maxFrameSize:  DefaultMaxFrameSize,
+		idleTimeout:   DefaultIdleTimeout,
+	}
+}
+
+// SetLeaseTime sets how long fetched messages are reserved before they may be
+// fetched again if not acknowledged.
+func (s *Server) SetLeaseTime(leaseTime time.Duration) {
+	s.leaseTime = leaseTime
+}
+
+// SetMaxTTL sets the longest time a message is kept before it expires. If
+// zero, messages only expire when requested by the sender.
+func (s *Server) SetMaxTTL(maxTTL time.Duration) {
+	s.maxTTL = maxTTL
+}
+
+// SetMaxSkew sets how far the timestamp of a request may differ from the
+// server's clock before the request is rejected.
+func (s *Server) SetMaxSkew(maxSkew time.Duration) {
+	s.authenticator.SetMaxSkew(maxSkew)
+}
+
+// SetNonceCache sets the cache used to reject requests which reuse the nonce
+// of a prior request.
+func (s *Server) SetNonceCache(nonceCache storage.NonceCache) {
+	s.authenticator.SetNonceCache(nonceCache)
+}
+
+// SetKeyRateLimit sets the rate limiter applied to each authenticated client
+// public key. If not set, authenticated requests are not rate limited.
+func (s *Server) SetKeyRateLimit(l *transport.RateLimiter) {
+	s.authenticator.SetKeyRateLimit(l)
+}
+
+// SetAddrRateLimit sets the rate limiter applied to the remote IP address of
+// each request, before authentication. If not set, requests are not limited
+// by address.
+func (s *Server) SetAddrRateLimit(l *transport.RateLimiter) {
+	s.addrLimit = l
+}
+
+// SetRouterName sets the name by which addresses refer to this server as
+// their home router, as for the HTTP handler. Messages pushed to an address
+// naming another router are rejected, since they are not relayed over this
+// transport.
+func (s *Server) SetRouterName(name string) {
+	s.routerName = name
+}
+
+// SetMaxFrameSize sets the largest request frame accepted, in bytes.
+func (s *Server) SetMaxFrameSize(maxFrameSize int) {
+	s.maxFrameSize = maxFrameSize
+}
+
+// SetIdleTimeout sets how long a connection may be idle between requests.
+func (s *Server) SetIdleTimeout(idleTimeout time.Duration) {
+	s.idleTimeout = idleTimeout
+}
+
+func logError(err error) {
+	log.Println(errgo.Details(err))
+}
+
+// Serve accepts connections from the listener and serves requests on each,
+// until the listener fails or is closed.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				logError(errgo.Mask(err))
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return errgo.Mask(err)
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// ListenAndServe listens on the TCP address and serves requests.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return s.Serve(l)
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		if s.idleTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(s.idleTimeout))
+		}
+		var req RequestFrame
+		err := readFrame(conn, s.maxFrameSize, &req)
+		if errgo.Cause(err) == io.EOF {
+			return
+		} else if err != nil {
+			logError(err)
+			return
+		}
+
+		var resp ResponseFrame
+		msg, err := s.handle(conn.RemoteAddr().String(), &req)
+		if err != nil {
+			resp.Error = errorResponse(err)
+			logError(err)
+		} else {
+			resp.Message = msg
+		}
+		err = writeFrame(conn, &resp)
+		if err != nil {
+			logError(err)
+			return
+		}
+	}
+}
+
+// errorResponse returns the error sent in response to a failed request.
+func errorResponse(err error) *wire.Error {
+	cause := errgo.Cause(err)
+	switch {
+	case isRateLimited(cause):
+		return &wire.Error{Code: codeTooManyRequests, Message: "rate limit exceeded"}
+	case cause == errBadRequest:
+		return &wire.Error{Code: codeBadRequest}
+	default:
+		return &wire.Error{Code: codeInternalError}
+	}
+}
+
+func isRateLimited(err error) bool {
+	_, ok := err.(*transport.RateLimitError)
+	return ok
+}
+
+func (s *Server) handle(remoteAddr string, req *RequestFrame) (*wire.Message, error) {
+	err := transport.AllowAddr(s.addrLimit, remoteAddr)
+	if err != nil {
+		return nil, errgo.Mask(err, isRateLimited)
+	}
+	auth, err := s.authenticator.Open(&req.Message, req.Key)
+	if isRateLimited(errgo.Cause(err)) {
+		return nil, errgo.Mask(err, isRateLimited)
+	} else if err != nil {
+		return nil, errgo.WithCausef(err, errBadRequest, "authentication failed")
+	}
+
+	var data interface{}
+	switch req.Op {
+	case OpPush:
+		data, err = s.push(auth)
+	case OpPop:
+		data, err = s.pop(auth)
+	case OpFetch:
+		data, err = s.fetch(auth)
+	case OpAck:
+		data, err = s.ack(auth)
+	default:
+		err = errgo.WithCausef(nil, errBadRequest, "unknown operation %q", req.Op)
+	}
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(errBadRequest))
+	}
+	return auth.Seal(data)
+}
+
+func (s *Server) pop(auth *transport.Request) (interface{}, error) {
+	messages, err := s.service.Pop(auth.ClientKey.Encode())
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return transport.PopMessages(messages), nil
+}
+
+func (s *Server) fetch(auth *transport.Request) (interface{}, error) {
+	lease, err := s.service.Fetch(auth.ClientKey.Encode(), s.leaseTime)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return wire.FetchResponse{
+		Messages: transport.PopMessages(lease.Messages),
+		Expires:  lease.Expires,
+	}, nil
+}
+
+func (s *Server) ack(auth *transport.Request) (interface{}, error) {
+	var ackRequest wire.AckRequest
+	err := json.Unmarshal(auth.Contents, &ackRequest)
+	if err != nil {
+		return nil, errgo.WithCausef(err, errBadRequest, "invalid ack request")
+	}
+	err = s.service.Ack(auth.ClientKey.Encode(), ackRequest.IDs)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return wire.Error{OK: true}, nil
+}
+
+func (s *Server) push(auth *transport.Request) (interface{}, error) {
+	var wireMessages []wire.PushMessage
+	err := json.Unmarshal(auth.Contents, &wireMessages)
+	if err != nil {
+		return nil, errgo.WithCausef(err, errBadRequest, "invalid push request")
+	}
+
+	return auth.Push(wireMessages, s.maxTTL, func(msg *storage.AddressedMessage) error {
+		recipient, router := transport.Route(msg.Recipient, s.routerName)
+		if router != "" {
+			// Messages are not relayed over this transport.
+			return errgo.WithCausef(nil, transport.ErrNoRoute, "cannot relay to %q", router)
+		}
+		msg.Recipient = recipient
+		return s.service.Push(msg)
+	}), nil
+}
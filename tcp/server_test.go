@@ -0,0 +1,276 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package tcp_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/nacl/box"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	sfbolt "github.com/cmars/shadowfax/storage/bolt"
+	"github.com/cmars/shadowfax/tcp"
+	sftesting "github.com/cmars/shadowfax/testing"
+	"github.com/cmars/shadowfax/transport"
+	"github.com/cmars/shadowfax/wire"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type serverSuite struct {
+	db       *bolt.DB
+	keyPair  *sf.KeyPair
+	server   *tcp.Server
+	listener net.Listener
+	done     chan error
+}
+
+var _ = gc.Suite(&serverSuite{})
+
+func (s *serverSuite) SetUpTest(c *gc.C) {
+	var err error
+	s.db, err = bolt.Open(filepath.Join(c.MkDir(), "testdb"), 0600, nil)
+	c.Assert(err, gc.IsNil)
+
+	s.keyPair = sftesting.MustNewKeyPair()
+	service := sfbolt.NewService(s.db)
+	service.SetLimits(3, 0)
+	s.server = tcp.NewServer(s.keyPair, service)
+	s.server.SetNonceCache(sfbolt.NewNonceCache(s.db, 1024))
+	s.server.SetMaxFrameSize(4096)
+
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+	s.done = make(chan error, 1)
+	go func() {
+		s.done <- s.server.Serve(s.listener)
+	}()
+}
+
+func (s *serverSuite) TearDownTest(c *gc.C) {
+	s.listener.Close()
+	<-s.done
+	s.db.Close()
+}
+
+func (s *serverSuite) newClient(c *gc.C) *tcp.Client {
+	return tcp.NewClient(sftesting.MustNewKeyPair(), s.listener.Addr().String(), s.keyPair.PublicKey)
+}
+
+func (s *serverSuite) TestPushPop(c *gc.C) {
+	alice := s.newClient(c)
+	defer alice.Close()
+	bob := s.newClient(c)
+	defer bob.Close()
+
+	err := alice.Push(bob.PublicKey().Encode(), []byte("hello world"))
+	c.Assert(err, gc.IsNil)
+
+	msgs, err := bob.Pop()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	c.Assert(msgs[0].Contents, gc.DeepEquals, []byte("hello world"))
+	c.Assert(msgs[0].Sender, gc.Equals, alice.PublicKey().Encode())
+
+	msgs, err = bob.Pop()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 0)
+}
+
+func (s *serverSuite) TestFetchAck(c *gc.C) {
+	alice := s.newClient(c)
+	defer alice.Close()
+	bob := s.newClient(c)
+	defer bob.Close()
+
+	err := alice.Push(bob.PublicKey().Encode(), []byte("hello world"))
+	c.Assert(err, gc.IsNil)
+
+	msgs, expires, err := bob.Fetch()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	c.Assert(expires.After(time.Now()), gc.Equals, true)
+
+	err = bob.Ack([]string{msgs[0].ID})
+	c.Assert(err, gc.IsNil)
+	msgs, err = bob.Pop()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 0)
+}
+
+func (s *serverSuite) TestMailboxFull(c *gc.C) {
+	alice := s.newClient(c)
+	defer alice.Close()
+	bob := s.newClient(c)
+
+	for i := 0; i < 3; i++ {
+		c.Assert(alice.Push(bob.PublicKey().Encode(), []byte("hello")), gc.IsNil)
+	}
+	err := alice.Push(bob.PublicKey().Encode(), []byte("hello"))
+	c.Assert(errgo.Cause(err), gc.Equals, transport.ErrMailboxFull)
+}
+
+func (s *serverSuite) TestPushRouterName(c *gc.C) {
+	s.server.SetRouterName("sf.example.com")
+	alice := s.newClient(c)
+	defer alice.Close()
+	bob := s.newClient(c)
+	defer bob.Close()
+
+	// An address naming this server is kept here.
+	addr := &sf.Address{Key: bob.PublicKey(), Router: "sf.example.com"}
+	err := alice.Push(addr.Encode(), []byte("hello"))
+	c.Assert(err, gc.IsNil)
+	msgs, err := bob.Pop()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	c.Assert(msgs[0].Contents, gc.DeepEquals, []byte("hello"))
+
+	// Messages for other routers are not relayed.
+	addr.Router = "elsewhere.example.com"
+	err = alice.Push(addr.Encode(), []byte("hello"))
+	c.Assert(errgo.Cause(err), gc.Equals, transport.ErrNoRoute)
+}
+
+func (s *serverSuite) TestWrongServerKey(c *gc.C) {
+	mallory := tcp.NewClient(sftesting.MustNewKeyPair(), s.listener.Addr().String(), sftesting.MustNewKeyPair().PublicKey)
+	defer mallory.Close()
+
+	_, err := mallory.Pop()
+	c.Assert(err, gc.ErrorMatches, `.*server response: 400.*`)
+}
+
+func (s *serverSuite) TestKeyRateLimit(c *gc.C) {
+	s.server.SetKeyRateLimit(transport.NewRateLimiter(0.001, 2))
+	alice := s.newClient(c)
+	defer alice.Close()
+	bob := s.newClient(c)
+	defer bob.Close()
+
+	for i := 0; i < 2; i++ {
+		_, err := alice.Pop()
+		c.Assert(err, gc.IsNil)
+	}
+	_, err := alice.Pop()
+	c.Assert(err, gc.ErrorMatches, `.*server response: 429 "rate limit exceeded".*`)
+
+	// Other keys are limited separately.
+	_, err = bob.Pop()
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *serverSuite) TestAddrRateLimit(c *gc.C) {
+	s.server.SetAddrRateLimit(transport.NewRateLimiter(0.001, 1))
+	alice := s.newClient(c)
+	defer alice.Close()
+	bob := s.newClient(c)
+	defer bob.Close()
+
+	_, err := alice.Pop()
+	c.Assert(err, gc.IsNil)
+
+	// Limited by address, whichever key is used.
+	_, err = bob.Pop()
+	c.Assert(err, gc.ErrorMatches, `.*server response: 429 "rate limit exceeded".*`)
+}
+
+func (s *serverSuite) writeFrame(c *gc.C, conn net.Conn, v interface{}) {
+	body, err := json.Marshal(v)
+	c.Assert(err, gc.IsNil)
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(body)))
+	_, err = conn.Write(append(header[:], body...))
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *serverSuite) readFrame(c *gc.C, conn net.Conn) *tcp.ResponseFrame {
+	var header [4]byte
+	_, err := io.ReadFull(conn, header[:])
+	c.Assert(err, gc.IsNil)
+	body := make([]byte, binary.BigEndian.Uint32(header[:]))
+	_, err = io.ReadFull(conn, body)
+	c.Assert(err, gc.IsNil)
+	var resp tcp.ResponseFrame
+	c.Assert(json.Unmarshal(body, &resp), gc.IsNil)
+	return &resp
+}
+
+func (s *serverSuite) TestReplay(c *gc.C) {
+	kp := sftesting.MustNewKeyPair()
+	nonce := sftesting.MustNewNonce()
+	wireReq, err := json.Marshal(&wire.Request{Time: time.Now()})
+	c.Assert(err, gc.IsNil)
+	req := tcp.RequestFrame{
+		Op:  tcp.OpPop,
+		Key: kp.PublicKey.Encode(),
+		Message: wire.Message{
+			Version:  wire.Version2,
+			ID:       nonce.Encode(),
+			Contents: box.Seal(nil, wireReq, (*[24]byte)(nonce), (*[32]byte)(s.keyPair.PublicKey), (*[32]byte)(kp.PrivateKey)),
+		},
+	}
+
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	c.Assert(err, gc.IsNil)
+	defer conn.Close()
+
+	s.writeFrame(c, conn, &req)
+	resp := s.readFrame(c, conn)
+	c.Assert(resp.Error, gc.IsNil)
+	c.Assert(resp.Message, gc.NotNil)
+
+	s.writeFrame(c, conn, &req)
+	resp = s.readFrame(c, conn)
+	c.Assert(resp.Error, gc.NotNil)
+	c.Assert(resp.Error.Code, gc.Equals, 400)
+	c.Assert(resp.Message, gc.IsNil)
+}
+
+func (s *serverSuite) TestFrameTooLarge(c *gc.C) {
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	c.Assert(err, gc.IsNil)
+	defer conn.Close()
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], 4097)
+	_, err = conn.Write(header[:])
+	c.Assert(err, gc.IsNil)
+
+	// The server closes the connection without reading the frame.
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, gc.Equals, io.EOF)
+}
+
+func (s *serverSuite) TestFrameTruncated(c *gc.C) {
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	c.Assert(err, gc.IsNil)
+	defer conn.Close()
+
+	// A frame shorter than its header claims is rejected once the client
+	// stops sending.
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], 4096)
+	_, err = conn.Write(append(header[:], "{}"...))
+	c.Assert(err, gc.IsNil)
+	c.Assert(conn.(*net.TCPConn).CloseWrite(), gc.IsNil)
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, gc.Equals, io.EOF)
+}
@@ -0,0 +1,178 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package testing
+
+import (
+	"fmt"
+	"sync"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/cmars/shadowfax/storage"
+)
+
+// ContactsSuite checks that a storage.Contacts implementation behaves as
+// expected. A backend embeds it, and sets new, empty Contacts with
+// SetContacts before calling its SetUpTest.
+type ContactsSuite struct {
+	contacts storage.Contacts
+}
+
+func (s *ContactsSuite) SetContacts(contacts storage.Contacts) {
+	s.contacts = contacts
+}
+
+func (s *ContactsSuite) SetUpTest(c *gc.C) {
+	c.Assert(s.contacts, gc.NotNil)
+}
+
+func (s *ContactsSuite) TearDownTest(c *gc.C) {
+	s.contacts = nil
+}
+
+func (s *ContactsSuite) TestContactsEmpty(c *gc.C) {
+	_, err := s.contacts.Key("bob")
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrNotFound)
+	_, err = s.contacts.Name(MustNewKeyPair().PublicKey)
+	c.Assert(err, gc.NotNil)
+	cinfos, err := s.contacts.Current()
+	c.Assert(err, gc.IsNil)
+	c.Assert(cinfos, gc.HasLen, 0)
+	_, err = s.contacts.Group("friends")
+	c.Assert(err, gc.ErrorMatches, `group "friends" not found`)
+}
+
+func (s *ContactsSuite) TestContactsPut(c *gc.C) {
+	bob, bob2, carol := MustNewKeyPair(), MustNewKeyPair(), MustNewKeyPair()
+	c.Assert(s.contacts.Put("carol", carol.PublicKey), gc.IsNil)
+	c.Assert(s.contacts.Put("bob", bob.PublicKey), gc.IsNil)
+	c.Assert(s.contacts.Put("", bob.PublicKey), gc.ErrorMatches, "empty key name")
+
+	key, err := s.contacts.Key("bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(key, gc.DeepEquals, bob.PublicKey)
+	name, err := s.contacts.Name(carol.PublicKey)
+	c.Assert(err, gc.IsNil)
+	c.Assert(name, gc.Equals, "carol")
+
+	// A new key for a name supersedes the old, which keeps the name.
+	c.Assert(s.contacts.Put("bob", bob2.PublicKey), gc.IsNil)
+	key, err = s.contacts.Key("bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(key, gc.DeepEquals, bob2.PublicKey)
+	name, err = s.contacts.Name(bob.PublicKey)
+	c.Assert(err, gc.IsNil)
+	c.Assert(name, gc.Equals, "bob")
+
+	// A new name for a key supersedes the old, which keeps the key.
+	c.Assert(s.contacts.Put("robert", bob2.PublicKey), gc.IsNil)
+	name, err = s.contacts.Name(bob2.PublicKey)
+	c.Assert(err, gc.IsNil)
+	c.Assert(name, gc.Equals, "robert")
+	key, err = s.contacts.Key("bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(key, gc.DeepEquals, bob2.PublicKey)
+}
+
+func (s *ContactsSuite) TestContactsOrder(c *gc.C) {
+	keys := make(map[string]*storage.ContactInfo)
+	for _, name := range []string{"dave", "alice", "carol", "bob"} {
+		key := MustNewKeyPair().PublicKey
+		c.Assert(s.contacts.Put(name, key), gc.IsNil)
+		keys[name] = &storage.ContactInfo{Name: name, Address: key}
+	}
+
+	// Current names are listed in order.
+	cinfos, err := s.contacts.Current()
+	c.Assert(err, gc.IsNil)
+	c.Assert(cinfos, gc.DeepEquals, storage.ContactInfos{
+		*keys["alice"], *keys["bob"], *keys["carol"], *keys["dave"],
+	})
+}
+
+func (s *ContactsSuite) TestContactsGroups(c *gc.C) {
+	err := s.contacts.PutGroup("friends", []string{"carol", "bob", "carol"})
+	c.Assert(err, gc.IsNil)
+	names, err := s.contacts.Group("friends")
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, gc.DeepEquals, []string{"bob", "carol"})
+
+	// Members are replaced.
+	err = s.contacts.PutGroup("friends", []string{"dave"})
+	c.Assert(err, gc.IsNil)
+	names, err = s.contacts.Group("friends")
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, gc.DeepEquals, []string{"dave"})
+
+	// Invalid members leave the group unchanged.
+	err = s.contacts.PutGroup("friends", []string{"eve", ""})
+	c.Assert(err, gc.ErrorMatches, "empty key name")
+	names, err = s.contacts.Group("friends")
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, gc.DeepEquals, []string{"dave"})
+
+	// Groups without members are removed.
+	err = s.contacts.PutGroup("friends", nil)
+	c.Assert(err, gc.IsNil)
+	_, err = s.contacts.Group("friends")
+	c.Assert(err, gc.ErrorMatches, `group "friends" not found`)
+	err = s.contacts.PutGroup("", []string{"bob"})
+	c.Assert(err, gc.ErrorMatches, "empty group name")
+}
+
+func (s *ContactsSuite) TestContactsRouter(c *gc.C) {
+	_, err := s.contacts.Router("bob")
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrNotFound)
+	err = s.contacts.SetRouter("bob", "example.com")
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrNotFound)
+
+	bob := MustNewKeyPair().PublicKey
+	c.Assert(s.contacts.Put("bob", bob), gc.IsNil)
+	router, err := s.contacts.Router("bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(router, gc.Equals, "")
+	c.Assert(s.contacts.SetRouter("bob", "example.com"), gc.IsNil)
+	router, err = s.contacts.Router("bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(router, gc.Equals, "example.com")
+
+	// The router is kept when the name is given a new key.
+	bob = MustNewKeyPair().PublicKey
+	c.Assert(s.contacts.Put("bob", bob), gc.IsNil)
+	cinfos, err := s.contacts.Current()
+	c.Assert(err, gc.IsNil)
+	c.Assert(cinfos, gc.DeepEquals, storage.ContactInfos{{Name: "bob", Address: bob, Router: "example.com"}})
+
+	c.Assert(s.contacts.SetRouter("bob", ""), gc.IsNil)
+	router, err = s.contacts.Router("bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(router, gc.Equals, "")
+}
+
+func (s *ContactsSuite) TestContactsConcurrent(c *gc.C) {
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("contact%02d", i)
+			key := MustNewKeyPair().PublicKey
+			c.Check(s.contacts.Put(name, key), gc.IsNil)
+			got, err := s.contacts.Key(name)
+			c.Check(err, gc.IsNil)
+			c.Check(got, gc.DeepEquals, key)
+		}(i)
+	}
+	wg.Wait()
+	cinfos, err := s.contacts.Current()
+	c.Assert(err, gc.IsNil)
+	c.Assert(cinfos, gc.HasLen, n)
+}
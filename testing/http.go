@@ -9,34 +9,69 @@
 package testing
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/nacl/box"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
 
 	sf "github.com/cmars/shadowfax"
 	sfhttp "github.com/cmars/shadowfax/http"
 	"github.com/cmars/shadowfax/storage"
+	"github.com/cmars/shadowfax/transport"
+	"github.com/cmars/shadowfax/wire"
 )
 
 type HTTPHandlerSuite struct {
-	service   storage.Service
-	keyPair   *sf.KeyPair
-	handler   *sfhttp.Handler
-	server    *httptest.Server
-	tlsServer *httptest.Server
+	service    storage.Service
+	nonceCache storage.NonceCache
+	notifier   *storage.Notifier
+	prekeys    storage.Prekeys
+	keyPair    *sf.KeyPair
+	handler    *sfhttp.Handler
+	server     *httptest.Server
+	tlsServer  *httptest.Server
 }
 
 func (s *HTTPHandlerSuite) SetStorage(st storage.Service) {
 	s.service = st
 }
 
+func (s *HTTPHandlerSuite) SetNonceCache(nc storage.NonceCache) {
+	s.nonceCache = nc
+}
+
+func (s *HTTPHandlerSuite) SetNotifier(n *storage.Notifier) {
+	s.notifier = n
+}
+
+func (s *HTTPHandlerSuite) SetPrekeys(p storage.Prekeys) {
+	s.prekeys = p
+}
+
 func (s *HTTPHandlerSuite) Storage() storage.Service {
 	return s.service
 }
 
+func (s *HTTPHandlerSuite) Prekeys() storage.Prekeys {
+	return s.prekeys
+}
+
+func (s *HTTPHandlerSuite) Handler() *sfhttp.Handler {
+	return s.handler
+}
+
 func (s *HTTPHandlerSuite) PublicKey() *sf.PublicKey {
 	return s.keyPair.PublicKey
 }
@@ -47,6 +82,15 @@ func (s *HTTPHandlerSuite) SetUpTest(c *gc.C) {
 	r := httprouter.New()
 	s.keyPair = MustNewKeyPair()
 	s.handler = sfhttp.NewHandler(s.keyPair, s.service)
+	if s.nonceCache != nil {
+		s.handler.SetNonceCache(s.nonceCache)
+	}
+	if s.notifier != nil {
+		s.handler.SetNotifier(s.notifier)
+	}
+	if s.prekeys != nil {
+		s.handler.SetPrekeys(s.prekeys)
+	}
 	s.handler.Register(r)
 	s.server = httptest.NewServer(r)
 	s.tlsServer = httptest.NewTLSServer(r)
@@ -58,7 +102,10 @@ func (s *HTTPHandlerSuite) TearDownTest(c *gc.C) {
 }
 
 func (s *HTTPHandlerSuite) NewClient(c *gc.C) *sfhttp.Client {
-	kp := MustNewKeyPair()
+	return s.NewClientWithKey(c, MustNewKeyPair())
+}
+
+func (s *HTTPHandlerSuite) NewClientWithKey(c *gc.C, kp *sf.KeyPair) *sfhttp.Client {
 	return sfhttp.NewClient(kp, s.server.URL, s.keyPair.PublicKey, nil)
 }
 
@@ -109,3 +156,789 @@ func (s *HTTPHandlerSuite) TestPushPop(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 	c.Assert(msgs, gc.HasLen, 0)
 }
+
+func (s *HTTPHandlerSuite) TestFetchAck(c *gc.C) {
+	alice := s.NewClient(c)
+	bob := s.NewClient(c)
+
+	err := alice.Push(bob.PublicKey().Encode(), []byte("hello world"))
+	c.Assert(err, gc.IsNil)
+	err = alice.Push(bob.PublicKey().Encode(), []byte("goodbye world"))
+	c.Assert(err, gc.IsNil)
+
+	msgs, expires, err := bob.Fetch()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 2)
+	c.Assert(expires.After(time.Now()), gc.Equals, true)
+	contents := []string{string(msgs[0].Contents), string(msgs[1].Contents)}
+	sort.Strings(contents)
+	c.Assert(contents, gc.DeepEquals, []string{"goodbye world", "hello world"})
+
+	err = bob.Ack([]string{msgs[0].ID, msgs[1].ID})
+	c.Assert(err, gc.IsNil)
+
+	msgs, err = bob.Pop()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 0)
+}
+
+func (s *HTTPHandlerSuite) TestFetchInvalid(c *gc.C) {
+	alice := s.NewClient(c)
+	bob := s.NewClient(c)
+
+	err := alice.Push(bob.PublicKey().Encode(), []byte("hello world"))
+	c.Assert(err, gc.IsNil)
+	id := MustNewNonce().Encode()
+	err = s.service.Push(&storage.AddressedMessage{
+		Message: storage.Message{
+			ID:       id,
+			Contents: []byte("not sealed"),
+		},
+		Recipient: bob.PublicKey().Encode(),
+		Sender:    alice.PublicKey().Encode(),
+	})
+	c.Assert(err, gc.IsNil)
+
+	msgs, _, err := bob.Fetch()
+	c.Assert(msgs, gc.HasLen, 1)
+	c.Assert(string(msgs[0].Contents), gc.Equals, "hello world")
+	openErr, ok := err.(*transport.OpenError)
+	c.Assert(ok, gc.Equals, true, gc.Commentf("%v", err))
+	c.Assert(openErr.IDs, gc.DeepEquals, []string{id})
+	c.Assert(openErr.Errs, gc.HasLen, 1)
+
+	// Invalid messages are removed once acknowledged.
+	err = bob.Ack(append(openErr.IDs, msgs[0].ID))
+	c.Assert(err, gc.IsNil)
+	msgs, err = bob.Pop()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 0)
+}
+
+// sealRequest returns an authenticated request body as a client would send
+// it, with the given protocol version and timestamp.
+func (s *HTTPHandlerSuite) sealRequest(c *gc.C, kp *sf.KeyPair, version int, t time.Time, contents []byte) ([]byte, *sf.Nonce) {
+	nonce := MustNewNonce()
+	wireReq, err := json.Marshal(&wire.Request{Time: t, Contents: contents})
+	c.Assert(err, gc.IsNil)
+	body, err := json.Marshal(&wire.Message{
+		Version:  version,
+		ID:       nonce.Encode(),
+		Contents: box.Seal(nil, wireReq, (*[24]byte)(nonce), (*[32]byte)(s.keyPair.PublicKey), (*[32]byte)(kp.PrivateKey)),
+	})
+	c.Assert(err, gc.IsNil)
+	return body, nonce
+}
+
+// sealV1Request returns a request body as a protocol version 1 client sends
+// it: the contents alone, sealed without a timestamp or version.
+func (s *HTTPHandlerSuite) sealV1Request(c *gc.C, kp *sf.KeyPair, contents []byte) ([]byte, *sf.Nonce) {
+	nonce := MustNewNonce()
+	body, err := json.Marshal(&wire.Message{
+		ID:       nonce.Encode(),
+		Contents: box.Seal(nil, contents, (*[24]byte)(nonce), (*[32]byte)(s.keyPair.PublicKey), (*[32]byte)(kp.PrivateKey)),
+	})
+	c.Assert(err, gc.IsNil)
+	return body, nonce
+}
+
+func (s *HTTPHandlerSuite) post(c *gc.C, path string, body []byte) (int, []byte) {
+	resp, err := http.Post(s.server.URL+path, "application/json", bytes.NewBuffer(body))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.IsNil)
+	return resp.StatusCode, respBody
+}
+
+func (s *HTTPHandlerSuite) postStatus(c *gc.C, path string, body []byte) int {
+	code, _ := s.post(c, path, body)
+	return code
+}
+
+func (s *HTTPHandlerSuite) TestRequestSkew(c *gc.C) {
+	kp := MustNewKeyPair()
+	path := "/inbox/" + kp.PublicKey.Encode() + "/fetch"
+
+	body, _ := s.sealRequest(c, kp, wire.Version2, time.Now().Add(-time.Hour), nil)
+	c.Assert(s.postStatus(c, path, body), gc.Equals, http.StatusBadRequest)
+	body, _ = s.sealRequest(c, kp, wire.Version2, time.Now().Add(time.Hour), nil)
+	c.Assert(s.postStatus(c, path, body), gc.Equals, http.StatusBadRequest)
+	body, _ = s.sealRequest(c, kp, wire.Version2, time.Now(), nil)
+	c.Assert(s.postStatus(c, path, body), gc.Equals, http.StatusOK)
+}
+
+func (s *HTTPHandlerSuite) TestReplay(c *gc.C) {
+	if s.nonceCache == nil {
+		c.Skip("no nonce cache")
+	}
+	kp := MustNewKeyPair()
+	path := "/inbox/" + kp.PublicKey.Encode() + "/fetch"
+
+	body, _ := s.sealRequest(c, kp, wire.Version2, time.Now(), nil)
+	c.Assert(s.postStatus(c, path, body), gc.Equals, http.StatusOK)
+	c.Assert(s.postStatus(c, path, body), gc.Equals, http.StatusBadRequest)
+}
+
+func (s *HTTPHandlerSuite) TestProtocolVersions(c *gc.C) {
+	kp := MustNewKeyPair()
+	path := "/inbox/" + kp.PublicKey.Encode() + "/fetch"
+
+	// Version 2 responses are sealed with a fresh nonce.
+	body, nonce := s.sealRequest(c, kp, wire.Version2, time.Now(), nil)
+	code, respBody := s.post(c, path, body)
+	c.Assert(code, gc.Equals, http.StatusOK)
+	var respMessage wire.Message
+	err := json.Unmarshal(respBody, &respMessage)
+	c.Assert(err, gc.IsNil)
+	c.Assert(respMessage.Version, gc.Equals, wire.Version2)
+	c.Assert(respMessage.ID, gc.Not(gc.Equals), nonce.Encode())
+	respNonce, err := sf.DecodeNonce(respMessage.ID)
+	c.Assert(err, gc.IsNil)
+	_, ok := box.Open(nil, respMessage.Contents, (*[24]byte)(respNonce), (*[32]byte)(s.keyPair.PublicKey), (*[32]byte)(kp.PrivateKey))
+	c.Assert(ok, gc.Equals, true)
+
+	// Version 1 and unknown versions are rejected by default.
+	body, _ = s.sealV1Request(c, kp, nil)
+	c.Assert(s.postStatus(c, path, body), gc.Equals, http.StatusBadRequest)
+	body, _ = s.sealRequest(c, kp, 3, time.Now(), nil)
+	c.Assert(s.postStatus(c, path, body), gc.Equals, http.StatusBadRequest)
+
+	// Version 1 is accepted when allowed, and its response is sealed with
+	// the request nonce.
+	s.handler.SetAllowV1(true)
+	body, nonce = s.sealV1Request(c, kp, nil)
+	code, respBody = s.post(c, path, body)
+	c.Assert(code, gc.Equals, http.StatusOK)
+	_, ok = box.Open(nil, respBody, (*[24]byte)(nonce), (*[32]byte)(s.keyPair.PublicKey), (*[32]byte)(kp.PrivateKey))
+	c.Assert(ok, gc.Equals, true)
+
+	// Version 1 requests are checked for replay too.
+	if s.nonceCache != nil {
+		c.Assert(s.postStatus(c, path, body), gc.Equals, http.StatusBadRequest)
+	}
+
+	// A version 1 push carries its contents as sent.
+	bob := MustNewKeyPair()
+	pushContents, err := json.Marshal([]wire.PushMessage{{
+		Message: wire.Message{
+			ID:       MustNewNonce().Encode(),
+			Contents: []byte("hello"),
+		},
+		Recipient: bob.PublicKey.Encode(),
+	}})
+	c.Assert(err, gc.IsNil)
+	body, _ = s.sealV1Request(c, kp, pushContents)
+	c.Assert(s.postStatus(c, "/outbox/"+kp.PublicKey.Encode(), body), gc.Equals, http.StatusOK)
+	msgs, err := s.service.Pop(bob.PublicKey.Encode())
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	c.Assert(string(msgs[0].Contents), gc.Equals, "hello")
+}
+
+func (s *HTTPHandlerSuite) TestKeyRateLimit(c *gc.C) {
+	s.handler.SetKeyRateLimit(transport.NewRateLimiter(0.001, 2))
+	alice, bob := MustNewKeyPair(), MustNewKeyPair()
+	alicePath := "/inbox/" + alice.PublicKey.Encode() + "/fetch"
+	bobPath := "/inbox/" + bob.PublicKey.Encode() + "/fetch"
+
+	for i := 0; i < 2; i++ {
+		body, _ := s.sealRequest(c, alice, wire.Version2, time.Now(), nil)
+		c.Assert(s.postStatus(c, alicePath, body), gc.Equals, http.StatusOK)
+	}
+	body, _ := s.sealRequest(c, alice, wire.Version2, time.Now(), nil)
+	resp, err := http.Post(s.server.URL+alicePath, "application/json", bytes.NewBuffer(body))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, 429)
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(retryAfter > 0, gc.Equals, true)
+	var wireErr wire.Error
+	err = json.NewDecoder(resp.Body).Decode(&wireErr)
+	c.Assert(err, gc.IsNil)
+	c.Assert(wireErr, gc.DeepEquals, wire.Error{Code: 429, Message: "rate limit exceeded"})
+
+	// Other keys are limited separately.
+	body, _ = s.sealRequest(c, bob, wire.Version2, time.Now(), nil)
+	c.Assert(s.postStatus(c, bobPath, body), gc.Equals, http.StatusOK)
+
+	// Requests which fail authentication do not count against the key.
+	body, _ = s.sealRequest(c, alice, wire.Version2, time.Now(), nil)
+	c.Assert(s.postStatus(c, bobPath, body), gc.Equals, http.StatusBadRequest)
+	body, _ = s.sealRequest(c, bob, wire.Version2, time.Now(), nil)
+	c.Assert(s.postStatus(c, bobPath, body), gc.Equals, http.StatusOK)
+
+	// Neither do stale or replayed requests.
+	carol := MustNewKeyPair()
+	carolPath := "/inbox/" + carol.PublicKey.Encode() + "/fetch"
+	body, _ = s.sealRequest(c, carol, wire.Version2, time.Now().Add(-time.Hour), nil)
+	c.Assert(s.postStatus(c, carolPath, body), gc.Equals, http.StatusBadRequest)
+	body, _ = s.sealRequest(c, carol, wire.Version2, time.Now(), nil)
+	c.Assert(s.postStatus(c, carolPath, body), gc.Equals, http.StatusOK)
+	if s.nonceCache != nil {
+		c.Assert(s.postStatus(c, carolPath, body), gc.Equals, http.StatusBadRequest)
+	}
+	body, _ = s.sealRequest(c, carol, wire.Version2, time.Now(), nil)
+	c.Assert(s.postStatus(c, carolPath, body), gc.Equals, http.StatusOK)
+}
+
+func (s *HTTPHandlerSuite) TestAddrRateLimit(c *gc.C) {
+	s.handler.SetAddrRateLimit(transport.NewRateLimiter(0.001, 1))
+	kp := MustNewKeyPair()
+	path := "/inbox/" + kp.PublicKey.Encode() + "/fetch"
+
+	body, _ := s.sealRequest(c, kp, wire.Version2, time.Now(), nil)
+	c.Assert(s.postStatus(c, path, body), gc.Equals, http.StatusOK)
+
+	// Limited before authentication.
+	c.Assert(s.postStatus(c, path, []byte("garbage")), gc.Equals, 429)
+}
+
+func (s *HTTPHandlerSuite) TestWait(c *gc.C) {
+	if s.notifier == nil {
+		c.Skip("no notifier")
+	}
+	alice := s.NewClient(c)
+	bob := s.NewClient(c)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		err := alice.Push(bob.PublicKey().Encode(), []byte("hello world"))
+		c.Check(err, gc.IsNil)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	msgs, _, err := bob.Wait(ctx)
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	c.Assert(msgs[0].Contents, gc.DeepEquals, []byte("hello world"))
+	c.Assert(time.Since(start) < 5*time.Second, gc.Equals, true)
+}
+
+func (s *HTTPHandlerSuite) TestWaitCancel(c *gc.C) {
+	bob := s.NewClient(c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	msgs, _, err := bob.Wait(ctx)
+	c.Assert(err, gc.Equals, context.DeadlineExceeded)
+	c.Assert(msgs, gc.HasLen, 0)
+
+	// The cancelled request stops waiting, so a message pushed afterwards is
+	// not leased to it.
+	time.Sleep(100 * time.Millisecond)
+	alice := s.NewClient(c)
+	err = alice.Push(bob.PublicKey().Encode(), []byte("hello world"))
+	c.Assert(err, gc.IsNil)
+	msgs, _, err = bob.Fetch()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+}
+
+func (s *HTTPHandlerSuite) TestStream(c *gc.C) {
+	// Unacknowledged messages are redelivered quickly, so that the test
+	// fails if acknowledgements are lost.
+	s.handler.SetLeaseTime(100 * time.Millisecond)
+	alice := s.NewClient(c)
+	bob := s.NewClient(c)
+
+	stream, err := bob.Stream()
+	c.Assert(err, gc.IsNil)
+	defer stream.Close()
+
+	err = alice.Push(bob.PublicKey().Encode(), []byte("one"))
+	c.Assert(err, gc.IsNil)
+	invalidID := MustNewNonce().Encode()
+	err = s.service.Push(&storage.AddressedMessage{
+		Message: storage.Message{
+			ID:       invalidID,
+			Contents: []byte("not sealed"),
+		},
+		Recipient: bob.PublicKey().Encode(),
+		Sender:    alice.PublicKey().Encode(),
+	})
+	c.Assert(err, gc.IsNil)
+	err = alice.Push(bob.PublicKey().Encode(), []byte("two"))
+	c.Assert(err, gc.IsNil)
+
+	received := make(map[string]bool)
+	timeout := time.After(10 * time.Second)
+	for len(received) < 2 || stream.Err() == nil {
+		select {
+		case msg, ok := <-stream.Messages():
+			c.Assert(ok, gc.Equals, true, gc.Commentf("stream ended: %v", stream.Err()))
+			c.Assert(msg.Sender, gc.Equals, alice.PublicKey().Encode())
+			received[string(msg.Contents)] = true
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			c.Fatalf("timed out waiting for messages, received %v, error %v", received, stream.Err())
+		}
+	}
+	c.Assert(received, gc.DeepEquals, map[string]bool{"one": true, "two": true})
+	c.Assert(stream.Close(), gc.IsNil)
+
+	// A message which could not be opened is reported, but does not end
+	// the stream.
+	openErr, ok := stream.Err().(*transport.OpenError)
+	c.Assert(ok, gc.Equals, true, gc.Commentf("%v", stream.Err()))
+	c.Assert(openErr.IDs, gc.DeepEquals, []string{invalidID})
+
+	// Delivered messages and the one which could not be opened were
+	// acknowledged, so they are not returned once their lease expires.
+	time.Sleep(300 * time.Millisecond)
+	msgs, _, err := bob.Fetch()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 0)
+}
+
+func (s *HTTPHandlerSuite) TestStreamCloseAcks(c *gc.C) {
+	s.handler.SetLeaseTime(100 * time.Millisecond)
+	alice := s.NewClient(c)
+	bob := s.NewClient(c)
+
+	err := alice.Push(bob.PublicKey().Encode(), []byte("one"))
+	c.Assert(err, gc.IsNil)
+	err = alice.Push(bob.PublicKey().Encode(), []byte("two"))
+	c.Assert(err, gc.IsNil)
+
+	stream, err := bob.Stream()
+	c.Assert(err, gc.IsNil)
+	var delivered *transport.PopMessage
+	select {
+	case msg, ok := <-stream.Messages():
+		c.Assert(ok, gc.Equals, true, gc.Commentf("stream ended: %v", stream.Err()))
+		delivered = msg
+	case <-time.After(10 * time.Second):
+		c.Fatalf("timed out waiting for messages")
+	}
+	c.Assert(stream.Close(), gc.IsNil)
+
+	// Only the message delivered before closing was acknowledged.
+	time.Sleep(300 * time.Millisecond)
+	msgs, _, err := bob.Fetch()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	c.Assert(msgs[0].ID, gc.Not(gc.Equals), delivered.ID)
+}
+
+func (s *HTTPHandlerSuite) TestStreamAuth(c *gc.C) {
+	bob := s.NewClient(c)
+	mallory := sfhttp.NewClient(MustNewKeyPair(), s.server.URL, MustNewKeyPair().PublicKey, nil)
+
+	// A client sealing requests to the wrong server key is disconnected.
+	stream, err := mallory.Stream()
+	c.Assert(err, gc.IsNil)
+	select {
+	case _, ok := <-stream.Messages():
+		c.Assert(ok, gc.Equals, false)
+	case <-time.After(10 * time.Second):
+		c.Fatalf("timed out waiting for stream to end")
+	}
+	c.Assert(stream.Err(), gc.NotNil)
+
+	stream, err = bob.Stream()
+	c.Assert(err, gc.IsNil)
+	c.Assert(stream.Close(), gc.IsNil)
+}
+
+func (s *HTTPHandlerSuite) TestPushMany(c *gc.C) {
+	alice := s.NewClient(c)
+	bob := s.NewClient(c)
+	carol := s.NewClient(c)
+
+	receipts, err := alice.PushMany([]string{bob.PublicKey().Encode(), carol.PublicKey().Encode()}, []byte("hello world"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(receipts, gc.HasLen, 2)
+	c.Assert(receipts[0].Recipient, gc.Equals, bob.PublicKey().Encode())
+	c.Assert(receipts[1].Recipient, gc.Equals, carol.PublicKey().Encode())
+	c.Assert(receipts[0].ID, gc.Not(gc.Equals), receipts[1].ID)
+	for _, receipt := range receipts {
+		c.Assert(receipt.Err, gc.IsNil)
+	}
+
+	for i, rcpt := range []*sfhttp.Client{bob, carol} {
+		msgs, _, err := rcpt.Fetch()
+		c.Assert(err, gc.IsNil)
+		var found bool
+		for _, msg := range msgs {
+			if msg.ID == receipts[i].ID {
+				c.Assert(msg.Contents, gc.DeepEquals, []byte("hello world"))
+				c.Assert(msg.Sender, gc.Equals, alice.PublicKey().Encode())
+				found = true
+			}
+		}
+		c.Assert(found, gc.Equals, true)
+	}
+}
+
+func (s *HTTPHandlerSuite) TestPushLarge(c *gc.C) {
+	alice := s.NewClient(c)
+	alice.SetChunkSize(1000)
+	bob := s.NewClient(c)
+	carol := s.NewClient(c)
+	recipients := []string{bob.PublicKey().Encode(), carol.PublicKey().Encode()}
+
+	payload := make([]byte, 4500)
+	_, err := rand.Read(payload)
+	c.Assert(err, gc.IsNil)
+	receipts, err := alice.PushLarge(recipients, bytes.NewReader(payload))
+	c.Assert(err, gc.IsNil)
+	c.Assert(receipts, gc.HasLen, 2)
+	for _, receipt := range receipts {
+		c.Assert(receipt.Err, gc.IsNil)
+	}
+
+	// Payloads within the chunk size are sent as ordinary messages.
+	_, err = alice.PushLarge(recipients[:1], bytes.NewReader([]byte("hello world")))
+	c.Assert(err, gc.IsNil)
+
+	msgs, _, err := bob.Fetch()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 7)
+
+	r := sfhttp.NewReassembler(c.MkDir())
+	var transfer *sfhttp.Transfer
+	var plain []*transport.PopMessage
+	// Chunks may arrive in any order.
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if !sfhttp.IsChunk(msgs[i]) {
+			plain = append(plain, msgs[i])
+			continue
+		}
+		t, err := r.Add(msgs[i])
+		c.Assert(err, gc.IsNil)
+		if t != nil {
+			c.Assert(transfer, gc.IsNil)
+			transfer = t
+		}
+	}
+	c.Assert(plain, gc.HasLen, 1)
+	c.Assert(plain[0].Contents, gc.DeepEquals, []byte("hello world"))
+	c.Assert(transfer, gc.NotNil)
+	c.Assert(transfer.ID, gc.Equals, receipts[0].ID)
+	c.Assert(transfer.Sender, gc.Equals, alice.PublicKey().Encode())
+	c.Assert(transfer.Size, gc.Equals, int64(len(payload)))
+	contents, err := ioutil.ReadFile(transfer.Path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(contents, gc.DeepEquals, payload)
+
+	// Redelivered chunks of a completed transfer are ignored.
+	for _, msg := range msgs {
+		if sfhttp.IsChunk(msg) {
+			t, err := r.Add(msg)
+			c.Assert(err, gc.IsNil)
+			c.Assert(t, gc.IsNil)
+		}
+	}
+}
+
+func (s *HTTPHandlerSuite) TestPushLargeSameTransfer(c *gc.C) {
+	alice := s.NewClient(c)
+	alice.SetChunkSize(1000)
+	carol := s.NewClient(c)
+	carol.SetChunkSize(1000)
+	bob := s.NewClient(c)
+	recipients := []string{bob.PublicKey().Encode()}
+
+	alicePayload := bytes.Repeat([]byte("a"), 2500)
+	receipts, err := alice.PushLarge(recipients, bytes.NewReader(alicePayload))
+	c.Assert(err, gc.IsNil)
+	c.Assert(receipts[0].Err, gc.IsNil)
+	transferID, err := sf.DecodeNonce(receipts[0].ID)
+	c.Assert(err, gc.IsNil)
+	carolPayload := bytes.Repeat([]byte("c"), 2500)
+	_, err = carol.PushLarge(recipients, bytes.NewReader(carolPayload))
+	c.Assert(err, gc.IsNil)
+
+	msgs, err := bob.Pop()
+	c.Assert(err, gc.IsNil)
+	r := sfhttp.NewReassembler(c.MkDir())
+	transfers := make(map[string]*sfhttp.Transfer)
+	for _, msg := range msgs {
+		c.Assert(sfhttp.IsChunk(msg), gc.Equals, true)
+		if msg.Sender == carol.PublicKey().Encode() {
+			// Carol reuses the transfer ID of Alice's payload, which
+			// follows the chunk magic and kind.
+			copy(msg.Contents[9:33], transferID[:])
+		}
+		t, err := r.Add(msg)
+		c.Assert(err, gc.IsNil)
+		if t != nil {
+			transfers[t.Sender] = t
+		}
+	}
+	c.Assert(transfers, gc.HasLen, 2)
+
+	// Each sender's payload is kept, whichever completes first.
+	for sender, payload := range map[string][]byte{
+		alice.PublicKey().Encode(): alicePayload,
+		carol.PublicKey().Encode(): carolPayload,
+	} {
+		transfer := transfers[sender]
+		c.Assert(transfer, gc.NotNil)
+		c.Assert(transfer.ID, gc.Equals, receipts[0].ID)
+		contents, err := ioutil.ReadFile(transfer.Path)
+		c.Assert(err, gc.IsNil)
+		c.Assert(contents, gc.DeepEquals, payload)
+	}
+}
+
+func (s *HTTPHandlerSuite) TestSealedSender(c *gc.C) {
+	alice := s.NewClient(c)
+	alice.SetSealedSender(true)
+	bob := s.NewClient(c)
+	carol := s.NewClient(c)
+
+	receipts, err := alice.PushMany([]string{bob.PublicKey().Encode(), carol.PublicKey().Encode()}, []byte("hello world"))
+	c.Assert(err, gc.IsNil)
+	for _, receipt := range receipts {
+		c.Assert(receipt.Err, gc.IsNil)
+	}
+
+	msgs, _, err := bob.Fetch()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	c.Assert(msgs[0].Contents, gc.DeepEquals, []byte("hello world"))
+	c.Assert(msgs[0].Sender, gc.Equals, alice.PublicKey().Encode())
+	c.Assert(msgs[0].SealedSender, gc.Equals, true)
+
+	// The server does not know who sent the message.
+	stored, err := s.Storage().Pop(carol.PublicKey().Encode())
+	c.Assert(err, gc.IsNil)
+	c.Assert(stored, gc.HasLen, 1)
+	c.Assert(stored[0].Sender, gc.Equals, "")
+	c.Assert(bytes.Contains(stored[0].Contents, alice.PublicKey()[:]), gc.Equals, false)
+}
+
+func (s *HTTPHandlerSuite) TestPrekeys(c *gc.C) {
+	alice := s.NewClient(c)
+	bob := s.NewClient(c)
+
+	if s.prekeys == nil {
+		_, err := alice.ClaimPrekey(bob.PublicKey().Encode())
+		c.Assert(errgo.Cause(err), gc.Equals, sfhttp.ErrNoPrekeys)
+		_, err = bob.PublishPrekeys(nil, nil)
+		c.Assert(err, gc.ErrorMatches, ".*501 Not Implemented.*")
+		return
+	}
+	s.handler.SetMaxPrekeys(4)
+
+	published := make(map[sf.PublicKey]bool)
+	var prekeys []*sf.PublicKey
+	for i := 0; i < 3; i++ {
+		prekey := MustNewKeyPair().PublicKey
+		published[*prekey] = true
+		prekeys = append(prekeys, prekey)
+	}
+	n, err := bob.PublishPrekeys(prekeys, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.DeepEquals, &sfhttp.PrekeyCount{Count: 3})
+	n, err = bob.PublishPrekeys(nil, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.DeepEquals, &sfhttp.PrekeyCount{Count: 3})
+
+	// Uploads beyond the limit are rejected.
+	_, err = bob.PublishPrekeys([]*sf.PublicKey{MustNewKeyPair().PublicKey, MustNewKeyPair().PublicKey}, nil)
+	c.Assert(err, gc.ErrorMatches, ".*too many prekeys.*")
+
+	// Prekeys are only stored for their owner, who must sign them.
+	n, err = alice.PublishPrekeys(nil, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.DeepEquals, &sfhttp.PrekeyCount{})
+	batch, err := json.Marshal(&wire.PrekeyBatch{Prekeys: []wire.SignedPrekey{{
+		Prekey:    MustNewKeyPair().PublicKey.Encode(),
+		Signature: make([]byte, sf.SignatureSize),
+	}}})
+	c.Assert(err, gc.IsNil)
+	_, err = bob.Request("POST", "/prekeys/"+bob.PublicKey().Encode(), batch)
+	c.Assert(err, gc.ErrorMatches, ".*400 Bad Request.*")
+
+	// Each sender may only claim one of the recipient's one-time prekeys at
+	// a time, so that no sender can use them all up.
+	claim := func(sender *sfhttp.Client) *sf.PublicKey {
+		prekey, err := sender.ClaimPrekey(bob.PublicKey().Encode())
+		c.Assert(err, gc.IsNil)
+		return prekey
+	}
+	prekey := claim(alice)
+	c.Assert(published[*prekey], gc.Equals, true)
+	delete(published, *prekey)
+	_, err = alice.ClaimPrekey(bob.PublicKey().Encode())
+	c.Assert(errgo.Cause(err), gc.Equals, sfhttp.ErrNoPrekeys)
+
+	// Once published, the last-resort prekey is given when no one-time
+	// prekey may be.
+	lastResort := MustNewKeyPair().PublicKey
+	n, err = bob.PublishPrekeys(nil, lastResort)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.DeepEquals, &sfhttp.PrekeyCount{Count: 2, LastResort: true})
+	c.Assert(claim(alice), gc.DeepEquals, lastResort)
+	for i := 0; i < 2; i++ {
+		prekey := claim(s.NewClient(c))
+		c.Assert(published[*prekey], gc.Equals, true)
+		delete(published, *prekey)
+	}
+	c.Assert(claim(s.NewClient(c)), gc.DeepEquals, lastResort)
+	n, err = bob.PublishPrekeys(nil, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.DeepEquals, &sfhttp.PrekeyCount{Count: 0, LastResort: true})
+
+	// Prekeys not signed by the recipient are refused by the sender.
+	err = s.prekeys.PutLastResortPrekey(bob.PublicKey().Encode(), &storage.Prekey{
+		Key:       MustNewKeyPair().PublicKey,
+		Signature: make([]byte, sf.SignatureSize),
+	})
+	c.Assert(err, gc.IsNil)
+	_, err = alice.ClaimPrekey(bob.PublicKey().Encode())
+	c.Assert(err, gc.ErrorMatches, "invalid signature on prekey .*")
+}
+
+func (s *HTTPHandlerSuite) TestRotation(c *gc.C) {
+	alice := s.NewClient(c)
+	bob := s.NewClient(c)
+	carol := s.NewClient(c)
+	newKey := MustNewKeyPair()
+
+	receipts, err := alice.PushRotation(newKey, []string{bob.PublicKey().Encode(), carol.PublicKey().Encode()})
+	c.Assert(err, gc.IsNil)
+	c.Assert(receipts, gc.HasLen, 2)
+	for _, receipt := range receipts {
+		c.Assert(receipt.Err, gc.IsNil)
+	}
+
+	msgs, err := bob.Pop()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	c.Assert(sfhttp.IsRotation(msgs[0]), gc.Equals, true)
+	rotated, err := bob.OpenRotation(msgs[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(rotated, gc.DeepEquals, newKey.PublicKey)
+
+	// The proof is sealed for its recipient only.
+	msgs[0].Sender = alice.PublicKey().Encode()
+	_, err = carol.OpenRotation(msgs[0])
+	c.Assert(err, gc.ErrorMatches, "key rotation .* failed verification")
+
+	// A rotation relayed by another sender does not verify.
+	msgs[0].Sender = carol.PublicKey().Encode()
+	_, err = bob.OpenRotation(msgs[0])
+	c.Assert(err, gc.ErrorMatches, "key rotation .* failed verification")
+
+	msgs, err = carol.Pop()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	rotated, err = carol.OpenRotation(msgs[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(rotated, gc.DeepEquals, newKey.PublicKey)
+
+	_, err = carol.OpenRotation(&transport.PopMessage{ID: "foo", Contents: []byte("hello")})
+	c.Assert(err, gc.ErrorMatches, `message "foo" is not a key rotation`)
+}
+
+func (s *HTTPHandlerSuite) TestDeliveryReceipt(c *gc.C) {
+	alice := s.NewClient(c)
+	bob := s.NewClient(c)
+
+	receipts, err := alice.PushMany([]string{bob.PublicKey().Encode()}, []byte("hello"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(receipts[0].Err, gc.IsNil)
+	msgs, err := bob.Pop()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	c.Assert(sfhttp.IsDeliveryReceipt(msgs[0]), gc.Equals, false)
+	c.Assert(msgs[0].ID, gc.Equals, receipts[0].ID)
+
+	err = bob.PushDeliveryReceipt(msgs[0].Sender, []string{msgs[0].ID})
+	c.Assert(err, gc.IsNil)
+	msgs, err = alice.Pop()
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	c.Assert(sfhttp.IsDeliveryReceipt(msgs[0]), gc.Equals, true)
+	c.Assert(msgs[0].Sender, gc.Equals, bob.PublicKey().Encode())
+	receipt, err := sfhttp.ParseDeliveryReceipt(msgs[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(receipt.IDs, gc.DeepEquals, []string{receipts[0].ID})
+	c.Assert(receipt.Time.IsZero(), gc.Equals, false)
+
+	_, err = sfhttp.ParseDeliveryReceipt(&transport.PopMessage{ID: "foo", Contents: []byte("hello")})
+	c.Assert(err, gc.ErrorMatches, `message "foo" is not a delivery receipt`)
+}
+
+func (s *HTTPHandlerSuite) TestEnvelope(c *gc.C) {
+	alice := s.NewClient(c)
+	alice.SetChunkSize(1000)
+	bob := s.NewClient(c)
+	recipients := []string{bob.PublicKey().Encode()}
+
+	env := sfhttp.NewEnvelope("text/plain; charset=utf-8")
+	env.Time = env.Time.Round(time.Second)
+	env.Subject = "greetings"
+	env.InReplyTo = MustNewNonce().Encode()
+	env.Headers = map[string]string{"X-Mood": "cheerful"}
+	contents, err := sfhttp.WrapEnvelope(env, []byte("hello"))
+	c.Assert(err, gc.IsNil)
+	_, err = alice.PushMany(recipients, contents)
+	c.Assert(err, gc.IsNil)
+
+	payload := make([]byte, 2500)
+	_, err = rand.Read(payload)
+	c.Assert(err, gc.IsNil)
+	receipts, err := alice.PushEnvelope(recipients, sfhttp.NewEnvelope("application/octet-stream"), bytes.NewReader(payload))
+	c.Assert(err, gc.IsNil)
+	c.Assert(receipts[0].Err, gc.IsNil)
+
+	msgs, err := bob.Pop()
+	c.Assert(err, gc.IsNil)
+	r := sfhttp.NewReassembler(c.MkDir())
+	var transfer *sfhttp.Transfer
+	var plain []*transport.PopMessage
+	for _, msg := range msgs {
+		if !sfhttp.IsChunk(msg) {
+			plain = append(plain, msg)
+			continue
+		}
+		t, err := r.Add(msg)
+		c.Assert(err, gc.IsNil)
+		if t != nil {
+			transfer = t
+		}
+	}
+
+	c.Assert(plain, gc.HasLen, 1)
+	opened, body, err := sfhttp.OpenEnvelope(plain[0].Contents)
+	c.Assert(err, gc.IsNil)
+	c.Assert(opened.Time.Equal(env.Time), gc.Equals, true)
+	opened.Time = env.Time
+	c.Assert(opened, gc.DeepEquals, env)
+	c.Assert(body, gc.DeepEquals, []byte("hello"))
+
+	c.Assert(transfer, gc.NotNil)
+	contents, err = ioutil.ReadFile(transfer.Path)
+	c.Assert(err, gc.IsNil)
+	opened, br, err := sfhttp.ReadEnvelope(bytes.NewReader(contents))
+	c.Assert(err, gc.IsNil)
+	c.Assert(opened.ContentType, gc.Equals, "application/octet-stream")
+	body, err = ioutil.ReadAll(br)
+	c.Assert(err, gc.IsNil)
+	c.Assert(body, gc.DeepEquals, payload)
+
+	// Raw payloads from older clients have no envelope.
+	opened, body, err = sfhttp.OpenEnvelope([]byte("hello"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(opened, gc.IsNil)
+	c.Assert(body, gc.DeepEquals, []byte("hello"))
+
+	contents, err = sfhttp.WrapEnvelope(env, []byte("hello"))
+	c.Assert(err, gc.IsNil)
+	contents[6] = 2
+	_, _, err = sfhttp.OpenEnvelope(contents)
+	c.Assert(err, gc.ErrorMatches, "unsupported envelope version 2")
+	_, _, err = sfhttp.OpenEnvelope(contents[:20])
+	c.Assert(err, gc.ErrorMatches, "unsupported envelope version 2")
+	contents[6] = wire.EnvelopeVersion1
+	_, _, err = sfhttp.OpenEnvelope(contents[:20])
+	c.Assert(err, gc.ErrorMatches, "truncated envelope.*")
+}
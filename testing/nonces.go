@@ -0,0 +1,114 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package testing
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/storage"
+)
+
+// NonceCacheSuite checks that a storage.NonceCache implementation behaves as
+// expected. A backend embeds it, and sets a function returning new, empty
+// caches of a given capacity with SetNewNonceCache before calling its
+// SetUpTest.
+type NonceCacheSuite struct {
+	newCache func(capacity int) storage.NonceCache
+}
+
+func (s *NonceCacheSuite) SetNewNonceCache(newCache func(capacity int) storage.NonceCache) {
+	s.newCache = newCache
+}
+
+func (s *NonceCacheSuite) SetUpTest(c *gc.C) {
+	c.Assert(s.newCache, gc.NotNil)
+}
+
+func (s *NonceCacheSuite) TearDownTest(c *gc.C) {
+	s.newCache = nil
+}
+
+func (s *NonceCacheSuite) TestNonceCacheSeen(c *gc.C) {
+	nc := s.newCache(10)
+	expires := time.Now().Add(time.Minute)
+	n1, n2 := MustNewNonce(), MustNewNonce()
+
+	for _, t := range []struct {
+		nonce *sf.Nonce
+		seen  bool
+	}{{n1, false}, {n1, true}, {n2, false}, {n1, true}, {n2, true}} {
+		seen, err := nc.Seen(t.nonce, expires)
+		c.Assert(err, gc.IsNil)
+		c.Assert(seen, gc.Equals, t.seen)
+	}
+}
+
+func (s *NonceCacheSuite) TestNonceCacheExpired(c *gc.C) {
+	nc := s.newCache(10)
+	n := MustNewNonce()
+	seen, err := nc.Seen(n, time.Now().Add(-time.Second))
+	c.Assert(err, gc.IsNil)
+	c.Assert(seen, gc.Equals, false)
+	seen, err = nc.Seen(n, time.Now().Add(time.Minute))
+	c.Assert(err, gc.IsNil)
+	c.Assert(seen, gc.Equals, false)
+	seen, err = nc.Seen(n, time.Now().Add(time.Minute))
+	c.Assert(err, gc.IsNil)
+	c.Assert(seen, gc.Equals, true)
+}
+
+func (s *NonceCacheSuite) TestNonceCacheCapacity(c *gc.C) {
+	nc := s.newCache(3)
+	now := time.Now()
+	var nonces []*sf.Nonce
+	for i := 0; i < 5; i++ {
+		n := MustNewNonce()
+		nonces = append(nonces, n)
+		seen, err := nc.Seen(n, now.Add(time.Duration(i+1)*time.Minute))
+		c.Assert(err, gc.IsNil)
+		c.Assert(seen, gc.Equals, false)
+	}
+
+	// The nonces furthest from expiring are remembered. Those evicted are
+	// still reported as seen, as is any other nonce expiring no later.
+	for i := len(nonces) - 1; i >= 0; i-- {
+		seen, err := nc.Seen(nonces[i], now.Add(time.Duration(i+1)*time.Minute))
+		c.Assert(err, gc.IsNil)
+		c.Assert(seen, gc.Equals, true, gc.Commentf("nonce #%d", i))
+	}
+	seen, err := nc.Seen(MustNewNonce(), now.Add(2*time.Minute))
+	c.Assert(err, gc.IsNil)
+	c.Assert(seen, gc.Equals, true)
+	seen, err = nc.Seen(MustNewNonce(), now.Add(time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(seen, gc.Equals, false)
+}
+
+func (s *NonceCacheSuite) TestNonceCacheReplayWhenFull(c *gc.C) {
+	nc := s.newCache(10)
+	expires := time.Now().Add(5 * time.Minute)
+	captured := MustNewNonce()
+	seen, err := nc.Seen(captured, expires)
+	c.Assert(err, gc.IsNil)
+	c.Assert(seen, gc.Equals, false)
+
+	// Flooding the cache with fresh requests evicts the captured nonce, but
+	// does not let it be replayed.
+	for i := 0; i < 20; i++ {
+		seen, err = nc.Seen(MustNewNonce(), expires.Add(time.Duration(i+1)*time.Millisecond))
+		c.Assert(err, gc.IsNil)
+		c.Assert(seen, gc.Equals, false)
+	}
+	seen, err = nc.Seen(captured, expires)
+	c.Assert(err, gc.IsNil)
+	c.Assert(seen, gc.Equals, true)
+}
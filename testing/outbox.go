@@ -0,0 +1,94 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package testing
+
+import (
+	"sort"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/cmars/shadowfax/storage"
+)
+
+// OutboxSuite checks that a storage.Outbox implementation behaves as
+// expected. A backend embeds it, and sets a new, empty Outbox with SetOutbox
+// before calling its SetUpTest.
+type OutboxSuite struct {
+	outbox storage.Outbox
+}
+
+func (s *OutboxSuite) SetOutbox(outbox storage.Outbox) {
+	s.outbox = outbox
+}
+
+func (s *OutboxSuite) SetUpTest(c *gc.C) {
+	c.Assert(s.outbox, gc.NotNil)
+}
+
+func (s *OutboxSuite) TearDownTest(c *gc.C) {
+	s.outbox = nil
+}
+
+func (s *OutboxSuite) TestOutboxNotFound(c *gc.C) {
+	id := MustNewNonce().Encode()
+	rcpt := MustNewKeyPair().PublicKey.Encode()
+	_, err := s.outbox.Status(id)
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrNotFound)
+	err = s.outbox.Delivered(id, rcpt, time.Now())
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrNotFound)
+
+	// A receipt from someone the message was not sent to is rejected.
+	c.Assert(s.outbox.Sent(id, rcpt, true, time.Now()), gc.IsNil)
+	err = s.outbox.Delivered(id, MustNewKeyPair().PublicKey.Encode(), time.Now())
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrNotFound)
+	_, err = s.outbox.Status(MustNewNonce().Encode())
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrNotFound)
+}
+
+func (s *OutboxSuite) TestOutboxStatus(c *gc.C) {
+	id := MustNewNonce().Encode()
+	rcpts := []string{MustNewKeyPair().PublicKey.Encode(), MustNewKeyPair().PublicKey.Encode()}
+	sort.Strings(rcpts)
+	sent := time.Now().Round(time.Second)
+	c.Assert(s.outbox.Sent(id, rcpts[0], true, sent), gc.IsNil)
+	c.Assert(s.outbox.Sent(id, rcpts[1], false, sent), gc.IsNil)
+	c.Assert(s.outbox.Sent(MustNewNonce().Encode(), rcpts[0], true, sent), gc.IsNil)
+
+	statuses, err := s.outbox.Status(id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(statuses, gc.HasLen, 2)
+	for i, status := range statuses {
+		c.Assert(status.ID, gc.Equals, id)
+		c.Assert(status.Recipient, gc.Equals, rcpts[i])
+		c.Assert(status.Sent.Equal(sent), gc.Equals, true)
+		c.Assert(status.Delivered.IsZero(), gc.Equals, true)
+	}
+	c.Assert(statuses[0].Status, gc.Equals, storage.StatusStored)
+	c.Assert(statuses[1].Status, gc.Equals, storage.StatusSent)
+
+	delivered := sent.Add(time.Minute)
+	c.Assert(s.outbox.Delivered(id, rcpts[0], delivered), gc.IsNil)
+	// A repeated receipt does not change when the message was delivered.
+	c.Assert(s.outbox.Delivered(id, rcpts[0], delivered.Add(time.Minute)), gc.IsNil)
+	statuses, err = s.outbox.Status(id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(statuses, gc.HasLen, 2)
+	c.Assert(statuses[0].Status, gc.Equals, storage.StatusDelivered)
+	c.Assert(statuses[0].Delivered.Equal(delivered), gc.Equals, true)
+	c.Assert(statuses[1].Status, gc.Equals, storage.StatusSent)
+
+	// Sending again replaces the record.
+	c.Assert(s.outbox.Sent(id, rcpts[1], true, delivered), gc.IsNil)
+	statuses, err = s.outbox.Status(id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(statuses[1].Status, gc.Equals, storage.StatusStored)
+	c.Assert(statuses[1].Sent.Equal(delivered), gc.Equals, true)
+}
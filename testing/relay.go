@@ -0,0 +1,192 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package testing
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/cmars/shadowfax/storage"
+)
+
+// RelayQueueSuite checks that a storage.RelayQueue implementation behaves as
+// expected. A backend embeds it, and sets a new, empty RelayQueue with
+// SetRelayQueue before calling its SetUpTest.
+type RelayQueueSuite struct {
+	queue storage.RelayQueue
+}
+
+func (s *RelayQueueSuite) SetRelayQueue(queue storage.RelayQueue) {
+	s.queue = queue
+}
+
+func (s *RelayQueueSuite) SetUpTest(c *gc.C) {
+	c.Assert(s.queue, gc.NotNil)
+}
+
+func (s *RelayQueueSuite) TearDownTest(c *gc.C) {
+	s.queue = nil
+}
+
+func (s *RelayQueueSuite) enqueue(c *gc.C, router, contents string) *storage.AddressedMessage {
+	now := time.Now().Round(time.Second)
+	msg := &storage.AddressedMessage{
+		Message: storage.Message{
+			ID:       MustNewNonce().Encode(),
+			Contents: []byte(contents),
+		},
+		Recipient: MustNewKeyPair().PublicKey.Encode(),
+		Sender:    MustNewKeyPair().PublicKey.Encode(),
+		Received:  now,
+		Expires:   now.Add(time.Hour),
+	}
+	c.Assert(s.queue.Enqueue(router, msg), gc.IsNil)
+	return msg
+}
+
+// relayContents returns the contents of relay messages.
+func relayContents(msgs []*storage.RelayMessage) []string {
+	var result []string
+	for _, msg := range msgs {
+		result = append(result, string(msg.Contents))
+	}
+	return result
+}
+
+func (s *RelayQueueSuite) TestRelayQueueEmpty(c *gc.C) {
+	msgs, err := s.queue.Due(time.Now())
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 0)
+	id := MustNewNonce().Encode()
+	c.Assert(s.queue.Retry("example.com", []string{id}, time.Now()), gc.IsNil)
+	c.Assert(s.queue.Remove("example.com", []string{id}), gc.IsNil)
+}
+
+func (s *RelayQueueSuite) TestRelayQueueRoundTrip(c *gc.C) {
+	msg := s.enqueue(c, "example.com", "hello")
+	msgs, err := s.queue.Due(time.Now())
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	c.Assert(msgs[0].Router, gc.Equals, "example.com")
+	c.Assert(msgs[0].Attempts, gc.Equals, 0)
+	c.Assert(msgs[0].ID, gc.Equals, msg.ID)
+	c.Assert(msgs[0].Recipient, gc.Equals, msg.Recipient)
+	c.Assert(msgs[0].Sender, gc.Equals, msg.Sender)
+	c.Assert(string(msgs[0].Contents), gc.Equals, "hello")
+	c.Assert(msgs[0].Received.Equal(msg.Received), gc.Equals, true)
+	c.Assert(msgs[0].Expires.Equal(msg.Expires), gc.Equals, true)
+
+	// The same message queued again replaces the first.
+	msg.Contents = []byte("hello again")
+	c.Assert(s.queue.Enqueue("example.com", msg), gc.IsNil)
+	msgs, err = s.queue.Due(time.Now())
+	c.Assert(err, gc.IsNil)
+	c.Assert(relayContents(msgs), gc.DeepEquals, []string{"hello again"})
+}
+
+func (s *RelayQueueSuite) TestRelayQueueOrder(c *gc.C) {
+	s.enqueue(c, "a.example.com", "one")
+	s.enqueue(c, "b.example.com", "two")
+	s.enqueue(c, "a.example.com", "three")
+	msgs, err := s.queue.Due(time.Now())
+	c.Assert(err, gc.IsNil)
+	c.Assert(relayContents(msgs), gc.DeepEquals, []string{"one", "two", "three"})
+}
+
+func (s *RelayQueueSuite) TestRelayQueueRetry(c *gc.C) {
+	one := s.enqueue(c, "a.example.com", "one")
+	two := s.enqueue(c, "b.example.com", "two")
+	now := time.Now()
+	next := now.Add(time.Minute)
+
+	// Messages are only retried for the router they are queued for.
+	c.Assert(s.queue.Retry("b.example.com", []string{one.ID}, next), gc.IsNil)
+	c.Assert(s.queue.Retry("a.example.com", []string{one.ID}, next), gc.IsNil)
+	msgs, err := s.queue.Due(now)
+	c.Assert(err, gc.IsNil)
+	c.Assert(relayContents(msgs), gc.DeepEquals, []string{"two"})
+
+	c.Assert(s.queue.Retry("a.example.com", []string{one.ID}, next), gc.IsNil)
+	msgs, err = s.queue.Due(next)
+	c.Assert(err, gc.IsNil)
+	c.Assert(relayContents(msgs), gc.DeepEquals, []string{"one", "two"})
+	c.Assert(msgs[0].Attempts, gc.Equals, 2)
+	c.Assert(msgs[0].Next.Equal(next), gc.Equals, true)
+
+	c.Assert(s.queue.Remove("a.example.com", []string{two.ID}), gc.IsNil)
+	c.Assert(s.queue.Remove("b.example.com", []string{two.ID}), gc.IsNil)
+	msgs, err = s.queue.Due(next)
+	c.Assert(err, gc.IsNil)
+	c.Assert(relayContents(msgs), gc.DeepEquals, []string{"one"})
+	c.Assert(s.queue.Remove("a.example.com", []string{one.ID}), gc.IsNil)
+	msgs, err = s.queue.Due(next)
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 0)
+
+	// A removed message may be queued again.
+	c.Assert(s.queue.Enqueue("a.example.com", one), gc.IsNil)
+	msgs, err = s.queue.Due(now)
+	c.Assert(err, gc.IsNil)
+	c.Assert(relayContents(msgs), gc.DeepEquals, []string{"one"})
+	c.Assert(msgs[0].Attempts, gc.Equals, 0)
+}
+
+func (s *RelayQueueSuite) TestRelayQueueMaxPerSender(c *gc.C) {
+	s.queue.SetMaxPerSender(2)
+	alice := MustNewKeyPair().PublicKey.Encode()
+	bob := MustNewKeyPair().PublicKey.Encode()
+	enqueue := func(router, sender, contents string) (*storage.AddressedMessage, error) {
+		msg := &storage.AddressedMessage{
+			Message: storage.Message{
+				ID:       MustNewNonce().Encode(),
+				Contents: []byte(contents),
+			},
+			Recipient: MustNewKeyPair().PublicKey.Encode(),
+			Sender:    sender,
+		}
+		return msg, s.queue.Enqueue(router, msg)
+	}
+
+	one, err := enqueue("a.example.com", alice, "one")
+	c.Assert(err, gc.IsNil)
+	_, err = enqueue("b.example.com", alice, "two")
+	c.Assert(err, gc.IsNil)
+
+	// Each sender is limited across all routers.
+	_, err = enqueue("a.example.com", alice, "three")
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrMailboxFull)
+	_, err = enqueue("c.example.com", alice, "three")
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrMailboxFull)
+	_, err = enqueue("a.example.com", bob, "four")
+	c.Assert(err, gc.IsNil)
+	_, err = enqueue("a.example.com", "", "five")
+	c.Assert(err, gc.IsNil)
+	_, err = enqueue("a.example.com", "", "six")
+	c.Assert(err, gc.IsNil)
+	_, err = enqueue("a.example.com", "", "seven")
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrMailboxFull)
+
+	// Replacing a queued message does not count against the limit.
+	one.Contents = []byte("one again")
+	c.Assert(s.queue.Enqueue("a.example.com", one), gc.IsNil)
+
+	// Retried messages still count, but removed messages do not.
+	c.Assert(s.queue.Retry("a.example.com", []string{one.ID}, time.Now()), gc.IsNil)
+	_, err = enqueue("a.example.com", alice, "three")
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrMailboxFull)
+	c.Assert(s.queue.Remove("a.example.com", []string{one.ID}), gc.IsNil)
+	_, err = enqueue("a.example.com", alice, "three")
+	c.Assert(err, gc.IsNil)
+
+	msgs, err := s.queue.Due(time.Now())
+	c.Assert(err, gc.IsNil)
+	c.Assert(relayContents(msgs), gc.DeepEquals, []string{"two", "four", "five", "six", "three"})
+}
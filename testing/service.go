@@ -0,0 +1,309 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package testing
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/shadowfax/storage"
+)
+
+// ServiceSuite checks that a storage.Service implementation behaves as
+// expected. A backend embeds it, and sets a new, empty Service with
+// SetService before calling its SetUpTest.
+type ServiceSuite struct {
+	service storage.Service
+}
+
+func (s *ServiceSuite) SetService(service storage.Service) {
+	s.service = service
+}
+
+func (s *ServiceSuite) SetUpTest(c *gc.C) {
+	c.Assert(s.service, gc.NotNil)
+}
+
+func (s *ServiceSuite) TearDownTest(c *gc.C) {
+	s.service = nil
+}
+
+func (s *ServiceSuite) push(c *gc.C, sender, recipient string, contents string, expires time.Time) string {
+	id := MustNewNonce().Encode()
+	err := s.service.Push(&storage.AddressedMessage{
+		Sender:    sender,
+		Recipient: recipient,
+		Message: storage.Message{
+			ID:       id,
+			Contents: []byte(contents),
+		},
+		Expires: expires,
+	})
+	c.Assert(err, gc.IsNil)
+	return id
+}
+
+// messageIDs returns the messages by ID. Messages are returned in no
+// particular order, but none may be returned twice.
+func messageIDs(c *gc.C, msgs []*storage.AddressedMessage) map[string]*storage.AddressedMessage {
+	result := make(map[string]*storage.AddressedMessage)
+	for _, msg := range msgs {
+		_, ok := result[msg.ID]
+		c.Assert(ok, gc.Equals, false, gc.Commentf("message %q returned twice", msg.ID))
+		result[msg.ID] = msg
+	}
+	return result
+}
+
+// sortedIDs returns the IDs of the messages, sorted.
+func sortedIDs(msgs []*storage.AddressedMessage) []string {
+	var ids []string
+	for _, msg := range msgs {
+		ids = append(ids, msg.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *ServiceSuite) TestServiceEmpty(c *gc.C) {
+	bob := MustNewKeyPair().PublicKey.Encode()
+
+	msgs, err := s.service.Pop(bob)
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 0)
+	lease, err := s.service.Fetch(bob, time.Minute)
+	c.Assert(err, gc.IsNil)
+	c.Assert(lease.Messages, gc.HasLen, 0)
+	err = s.service.Ack(bob, nil)
+	c.Assert(err, gc.IsNil)
+	err = s.service.Ack(bob, []string{MustNewNonce().Encode()})
+	c.Assert(err, gc.IsNil)
+	n, err := s.service.Expire()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+}
+
+func (s *ServiceSuite) TestServiceInvalid(c *gc.C) {
+	alice := MustNewKeyPair().PublicKey.Encode()
+	bob := MustNewKeyPair().PublicKey.Encode()
+	id := MustNewNonce().Encode()
+	for _, msg := range []*storage.AddressedMessage{
+		{Sender: alice, Recipient: "n0pe", Message: storage.Message{ID: id}},
+		{Sender: "n0pe", Recipient: bob, Message: storage.Message{ID: id}},
+		{Sender: alice, Recipient: bob, Message: storage.Message{ID: "n0pe"}},
+	} {
+		err := s.service.Push(msg)
+		c.Assert(err, gc.ErrorMatches, `invalid (recipient|sender|nonce) "n0pe".*`)
+	}
+	_, err := s.service.Pop("n0pe")
+	c.Assert(err, gc.ErrorMatches, `invalid recipient "n0pe".*`)
+	_, err = s.service.Fetch("n0pe", time.Minute)
+	c.Assert(err, gc.ErrorMatches, `invalid recipient "n0pe".*`)
+	err = s.service.Ack(bob, []string{"n0pe"})
+	c.Assert(err, gc.ErrorMatches, `invalid nonce "n0pe".*`)
+}
+
+func (s *ServiceSuite) TestServicePushPop(c *gc.C) {
+	alice := MustNewKeyPair().PublicKey.Encode()
+	bob := MustNewKeyPair().PublicKey.Encode()
+	carol := MustNewKeyPair().PublicKey.Encode()
+
+	before := time.Now()
+	id1 := s.push(c, alice, bob, "one", time.Time{})
+	id2 := s.push(c, carol, bob, "two", before.Add(time.Hour))
+	id3 := s.push(c, "", bob, "three", time.Time{})
+	s.push(c, bob, carol, "four", time.Time{})
+
+	msgs, err := s.service.Pop(bob)
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 3)
+	byID := messageIDs(c, msgs)
+	for _, t := range []struct {
+		id, sender, contents string
+	}{{id1, alice, "one"}, {id2, carol, "two"}, {id3, "", "three"}} {
+		msg, ok := byID[t.id]
+		c.Assert(ok, gc.Equals, true)
+		c.Assert(msg.Sender, gc.Equals, t.sender)
+		c.Assert(msg.Recipient, gc.Equals, bob)
+		c.Assert(string(msg.Contents), gc.Equals, t.contents)
+		c.Assert(msg.Received.Before(before.Add(-time.Second)), gc.Equals, false)
+	}
+	c.Assert(byID[id1].Expires.IsZero(), gc.Equals, true)
+	c.Assert(byID[id2].Expires.Unix(), gc.Equals, before.Add(time.Hour).Unix())
+
+	// Popped messages are removed; others' are not.
+	msgs, err = s.service.Pop(bob)
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 0)
+	msgs, err = s.service.Pop(carol)
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+}
+
+func (s *ServiceSuite) TestServiceManySenders(c *gc.C) {
+	bob := MustNewKeyPair().PublicKey.Encode()
+	senders := []string{
+		MustNewKeyPair().PublicKey.Encode(),
+		MustNewKeyPair().PublicKey.Encode(),
+		MustNewKeyPair().PublicKey.Encode(),
+	}
+
+	// Messages from several senders are pushed interleaved. They may be
+	// returned in any order, but each exactly once.
+	var popped, fetched []string
+	for i := 0; i < 20; i++ {
+		popped = append(popped, s.push(c, senders[i%len(senders)], bob, fmt.Sprintf("pop %d", i), time.Time{}))
+	}
+	msgs, err := s.service.Pop(bob)
+	c.Assert(err, gc.IsNil)
+	sort.Strings(popped)
+	c.Assert(sortedIDs(msgs), gc.DeepEquals, popped)
+
+	for i := 0; i < 20; i++ {
+		fetched = append(fetched, s.push(c, senders[i%len(senders)], bob, fmt.Sprintf("fetch %d", i), time.Time{}))
+	}
+	lease, err := s.service.Fetch(bob, time.Minute)
+	c.Assert(err, gc.IsNil)
+	sort.Strings(fetched)
+	c.Assert(sortedIDs(lease.Messages), gc.DeepEquals, fetched)
+}
+
+func (s *ServiceSuite) TestServiceFetchAck(c *gc.C) {
+	alice := MustNewKeyPair().PublicKey.Encode()
+	bob := MustNewKeyPair().PublicKey.Encode()
+
+	id1 := s.push(c, alice, bob, "one", time.Time{})
+	id2 := s.push(c, alice, bob, "two", time.Time{})
+
+	lease, err := s.service.Fetch(bob, time.Minute)
+	c.Assert(err, gc.IsNil)
+	c.Assert(lease.Messages, gc.HasLen, 2)
+	c.Assert(lease.Expires.After(time.Now()), gc.Equals, true)
+
+	// Leased messages are not fetched again, but newly pushed messages are.
+	id3 := s.push(c, alice, bob, "three", time.Time{})
+	lease, err = s.service.Fetch(bob, time.Minute)
+	c.Assert(err, gc.IsNil)
+	c.Assert(lease.Messages, gc.HasLen, 1)
+	c.Assert(lease.Messages[0].ID, gc.Equals, id3)
+
+	err = s.service.Ack(bob, []string{id1, id3})
+	c.Assert(err, gc.IsNil)
+	msgs, err := s.service.Pop(bob)
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.HasLen, 1)
+	c.Assert(msgs[0].ID, gc.Equals, id2)
+}
+
+func (s *ServiceSuite) TestServiceLeaseExpires(c *gc.C) {
+	alice := MustNewKeyPair().PublicKey.Encode()
+	bob := MustNewKeyPair().PublicKey.Encode()
+
+	id := s.push(c, alice, bob, "hello", time.Time{})
+	lease, err := s.service.Fetch(bob, time.Millisecond)
+	c.Assert(err, gc.IsNil)
+	c.Assert(lease.Messages, gc.HasLen, 1)
+	time.Sleep(10 * time.Millisecond)
+
+	// Messages not acknowledged are fetched again once the lease expires.
+	lease, err = s.service.Fetch(bob, time.Minute)
+	c.Assert(err, gc.IsNil)
+	c.Assert(lease.Messages, gc.HasLen, 1)
+	c.Assert(lease.Messages[0].ID, gc.Equals, id)
+	c.Assert(lease.Messages[0].Sender, gc.Equals, alice)
+	c.Assert(string(lease.Messages[0].Contents), gc.Equals, "hello")
+}
+
+func (s *ServiceSuite) TestServiceExpire(c *gc.C) {
+	alice := MustNewKeyPair().PublicKey.Encode()
+	bob := MustNewKeyPair().PublicKey.Encode()
+	carol := MustNewKeyPair().PublicKey.Encode()
+
+	now := time.Now()
+	s.push(c, alice, bob, "expired", now.Add(-time.Second))
+	s.push(c, alice, carol, "expired", now.Add(-time.Second))
+	id1 := s.push(c, alice, bob, "later", now.Add(time.Hour))
+	id2 := s.push(c, carol, bob, "never", time.Time{})
+
+	// Expired messages are not delivered, even before they are removed.
+	lease, err := s.service.Fetch(bob, time.Minute)
+	c.Assert(err, gc.IsNil)
+	c.Assert(lease.Messages, gc.HasLen, 2)
+
+	n, err := s.service.Expire()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 2)
+	n, err = s.service.Expire()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+
+	msgs, err := s.service.Pop(bob)
+	c.Assert(err, gc.IsNil)
+	byID := messageIDs(c, msgs)
+	c.Assert(byID, gc.HasLen, 2)
+	c.Assert(byID[id1], gc.NotNil)
+	c.Assert(byID[id2], gc.NotNil)
+}
+
+func (s *ServiceSuite) TestServiceConcurrent(c *gc.C) {
+	bob := MustNewKeyPair().PublicKey.Encode()
+
+	const senders, perSender = 8, 10
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			alice := MustNewKeyPair().PublicKey.Encode()
+			for j := 0; j < perSender; j++ {
+				err := s.service.Push(&storage.AddressedMessage{
+					Sender:    alice,
+					Recipient: bob,
+					Message: storage.Message{
+						ID:       MustNewNonce().Encode(),
+						Contents: []byte(fmt.Sprintf("%d-%d", i, j)),
+					},
+				})
+				c.Check(err, gc.IsNil)
+			}
+		}(i)
+	}
+
+	// Every message is delivered exactly once, while pushes are in progress.
+	var mu sync.Mutex
+	received := make(map[string]bool)
+	receive := func(msgs []*storage.AddressedMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, msg := range msgs {
+			c.Check(received[string(msg.Contents)], gc.Equals, false)
+			received[string(msg.Contents)] = true
+		}
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				msgs, err := s.service.Pop(bob)
+				c.Check(err, gc.IsNil)
+				receive(msgs)
+			}
+		}()
+	}
+	wg.Wait()
+	msgs, err := s.service.Pop(bob)
+	c.Assert(err, gc.IsNil)
+	receive(msgs)
+	c.Assert(received, gc.HasLen, senders*perSender)
+}
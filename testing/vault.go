@@ -0,0 +1,212 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package testing
+
+import (
+	"sync"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/storage"
+)
+
+// VaultSuite checks that a storage.Vault implementation behaves as expected.
+// A backend embeds it, and sets a new, empty Vault with SetVault before
+// calling its SetUpTest.
+type VaultSuite struct {
+	vault storage.Vault
+}
+
+func (s *VaultSuite) SetVault(vault storage.Vault) {
+	s.vault = vault
+}
+
+func (s *VaultSuite) SetUpTest(c *gc.C) {
+	c.Assert(s.vault, gc.NotNil)
+}
+
+func (s *VaultSuite) TearDownTest(c *gc.C) {
+	s.vault = nil
+}
+
+func (s *VaultSuite) putKeyPairs(c *gc.C, n int) []*sf.KeyPair {
+	var keyPairs []*sf.KeyPair
+	for i := 0; i < n; i++ {
+		kp := MustNewKeyPair()
+		c.Assert(s.vault.Put(kp), gc.IsNil)
+		keyPairs = append(keyPairs, kp)
+	}
+	return keyPairs
+}
+
+func (s *VaultSuite) TestVaultEmpty(c *gc.C) {
+	_, err := s.vault.Current()
+	c.Assert(err, gc.ErrorMatches, "empty vault")
+	key := MustNewKeyPair().PublicKey
+	_, err = s.vault.Get(key)
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrNotFound)
+	_, err = s.vault.Info(key)
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrNotFound)
+	infos, err := s.vault.Infos()
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos, gc.HasLen, 0)
+	for _, f := range []func(*sf.PublicKey) error{
+		func(key *sf.PublicKey) error { return s.vault.SetLabel(key, "foo") },
+		s.vault.SetDefault,
+		s.vault.Retire,
+	} {
+		c.Assert(errgo.Cause(f(key)), gc.Equals, storage.ErrNotFound)
+	}
+}
+
+func (s *VaultSuite) TestVaultPutGet(c *gc.C) {
+	keyPairs := s.putKeyPairs(c, 3)
+	for _, want := range keyPairs {
+		kp, err := s.vault.Get(want.PublicKey)
+		c.Assert(err, gc.IsNil)
+		c.Assert(kp, gc.DeepEquals, want)
+	}
+	_, err := s.vault.Get(MustNewKeyPair().PublicKey)
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrNotFound)
+
+	// The latest key pair is current.
+	kp, err := s.vault.Current()
+	c.Assert(err, gc.IsNil)
+	c.Assert(kp, gc.DeepEquals, keyPairs[2])
+}
+
+func (s *VaultSuite) TestVaultOrder(c *gc.C) {
+	keyPairs := s.putKeyPairs(c, 5)
+
+	// Key pairs are iterated in the order they were added.
+	var got []*sf.KeyPair
+	err := s.vault.Each(func(kp *sf.KeyPair) error {
+		got = append(got, kp)
+		return nil
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(got, gc.DeepEquals, keyPairs)
+	infos, err := s.vault.Infos()
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos, gc.HasLen, len(keyPairs))
+	for i, info := range infos {
+		c.Assert(info.Address, gc.DeepEquals, keyPairs[i].PublicKey)
+		c.Assert(info.Default, gc.Equals, i == len(keyPairs)-1)
+	}
+
+	// Iteration stops at the first error.
+	var n int
+	err = s.vault.Each(func(kp *sf.KeyPair) error {
+		n++
+		return errgo.New("stop")
+	})
+	c.Assert(err, gc.ErrorMatches, "stop")
+	c.Assert(n, gc.Equals, 1)
+}
+
+func (s *VaultSuite) TestVaultMetadata(c *gc.C) {
+	keyPairs := s.putKeyPairs(c, 3)
+
+	err := s.vault.SetLabel(keyPairs[0].PublicKey, "work")
+	c.Assert(err, gc.IsNil)
+	info, err := s.vault.Info(keyPairs[0].PublicKey)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info, gc.DeepEquals, &storage.KeyInfo{Address: keyPairs[0].PublicKey, Label: "work"})
+
+	// An explicit default stays current when key pairs are added.
+	err = s.vault.SetDefault(keyPairs[0].PublicKey)
+	c.Assert(err, gc.IsNil)
+	keyPairs = append(keyPairs, s.putKeyPairs(c, 1)...)
+	kp, err := s.vault.Current()
+	c.Assert(err, gc.IsNil)
+	c.Assert(kp, gc.DeepEquals, keyPairs[0])
+
+	// Retiring the default falls back to the latest key pair not retired.
+	c.Assert(s.vault.Retire(keyPairs[3].PublicKey), gc.IsNil)
+	c.Assert(s.vault.Retire(keyPairs[0].PublicKey), gc.IsNil)
+	kp, err = s.vault.Current()
+	c.Assert(err, gc.IsNil)
+	c.Assert(kp, gc.DeepEquals, keyPairs[2])
+	err = s.vault.SetDefault(keyPairs[0].PublicKey)
+	c.Assert(err, gc.ErrorMatches, "key pair .* is retired")
+	infos, err := s.vault.Infos()
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos, gc.DeepEquals, []*storage.KeyInfo{
+		{Address: keyPairs[0].PublicKey, Label: "work", Retired: true},
+		{Address: keyPairs[1].PublicKey},
+		{Address: keyPairs[2].PublicKey, Default: true},
+		{Address: keyPairs[3].PublicKey, Retired: true},
+	})
+
+	// Retired key pairs can still be found.
+	kp, err = s.vault.Get(keyPairs[0].PublicKey)
+	c.Assert(err, gc.IsNil)
+	c.Assert(kp, gc.DeepEquals, keyPairs[0])
+
+	c.Assert(s.vault.Retire(keyPairs[1].PublicKey), gc.IsNil)
+	c.Assert(s.vault.Retire(keyPairs[2].PublicKey), gc.IsNil)
+	_, err = s.vault.Current()
+	c.Assert(err, gc.ErrorMatches, "all key pairs retired")
+}
+
+func (s *VaultSuite) TestVaultRekey(c *gc.C) {
+	keyPairs := s.putKeyPairs(c, 3)
+	c.Assert(s.vault.SetLabel(keyPairs[1].PublicKey, "work"), gc.IsNil)
+	secretKey, err := sf.NewSecretKey()
+	c.Assert(err, gc.IsNil)
+	err = s.vault.Rekey(secretKey)
+	c.Assert(err, gc.IsNil)
+
+	// The vault is unchanged, and keeps working.
+	for _, want := range keyPairs {
+		kp, err := s.vault.Get(want.PublicKey)
+		c.Assert(err, gc.IsNil)
+		c.Assert(kp, gc.DeepEquals, want)
+	}
+	info, err := s.vault.Info(keyPairs[1].PublicKey)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Label, gc.Equals, "work")
+	keyPairs = append(keyPairs, s.putKeyPairs(c, 1)...)
+	kp, err := s.vault.Current()
+	c.Assert(err, gc.IsNil)
+	c.Assert(kp, gc.DeepEquals, keyPairs[3])
+}
+
+func (s *VaultSuite) TestVaultConcurrent(c *gc.C) {
+	const n = 20
+	keyPairs := make([]*sf.KeyPair, n)
+	var wg sync.WaitGroup
+	for i := range keyPairs {
+		keyPairs[i] = MustNewKeyPair()
+		wg.Add(1)
+		go func(kp *sf.KeyPair) {
+			defer wg.Done()
+			c.Check(s.vault.Put(kp), gc.IsNil)
+			got, err := s.vault.Get(kp.PublicKey)
+			c.Check(err, gc.IsNil)
+			c.Check(got, gc.DeepEquals, kp)
+			_, err = s.vault.Current()
+			c.Check(err, gc.IsNil)
+		}(keyPairs[i])
+	}
+	wg.Wait()
+
+	infos, err := s.vault.Infos()
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos, gc.HasLen, n)
+	seen := make(map[sf.PublicKey]bool)
+	for _, info := range infos {
+		seen[*info.Address] = true
+	}
+	for _, kp := range keyPairs {
+		c.Assert(seen[*kp.PublicKey], gc.Equals, true)
+	}
+}
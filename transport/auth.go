@@ -0,0 +1,192 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package transport
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/storage"
+	"github.com/cmars/shadowfax/wire"
+)
+
+// Authenticator authenticates requests sealed to a server's key pair.
+type Authenticator struct {
+	keyPair    *sf.KeyPair
+	maxSkew    time.Duration
+	nonceCache storage.NonceCache
+	allowV1    bool
+	keyLimit   *RateLimiter
+}
+
+// NewAuthenticator returns a new Authenticator of requests sealed to the
+// server key pair.
+func NewAuthenticator(keyPair *sf.KeyPair) *Authenticator {
+	return &Authenticator{
+		keyPair: keyPair,
+		maxSkew: DefaultMaxSkew,
+	}
+}
+
+// SetMaxSkew sets how far the timestamp of a request may differ from the
+// server's clock before the request is rejected.
+func (a *Authenticator) SetMaxSkew(maxSkew time.Duration) {
+	a.maxSkew = maxSkew
+}
+
+// SetNonceCache sets the cache used to reject requests which reuse the nonce
+// of a prior request. If not set, requests are only checked for timestamp
+// skew.
+func (a *Authenticator) SetNonceCache(nonceCache storage.NonceCache) {
+	a.nonceCache = nonceCache
+}
+
+// SetAllowV1 sets whether requests using protocol version 1 are accepted.
+// Version 1 seals responses with the request nonce, and should only be
+// allowed while migrating older clients.
+func (a *Authenticator) SetAllowV1(allowV1 bool) {
+	a.allowV1 = allowV1
+}
+
+// SetKeyRateLimit sets the rate limiter applied to each authenticated client
+// public key. If not set, authenticated requests are not rate limited.
+func (a *Authenticator) SetKeyRateLimit(l *RateLimiter) {
+	a.keyLimit = l
+}
+
+// Request is an authenticated request.
+type Request struct {
+	keyPair *sf.KeyPair
+
+	// Version is the protocol version of the request.
+	Version int
+
+	// ClientKey is the public key which sealed the request.
+	ClientKey *sf.PublicKey
+
+	// Nonce is the nonce with which the request was sealed.
+	Nonce *sf.Nonce
+
+	// Contents are the contents of the request.
+	Contents []byte
+}
+
+// Open authenticates a request message sealed by the client with the given
+// encoded public key. The cause of the error returned is a *RateLimitError if
+// the client has exceeded its rate limit.
+func (a *Authenticator) Open(msg *wire.Message, client string) (*Request, error) {
+	version := msg.Version
+	if version == 0 {
+		version = wire.Version1
+	}
+	switch version {
+	case wire.Version1:
+		if !a.allowV1 {
+			return nil, errgo.New("protocol version 1 not allowed")
+		}
+	case wire.Version2:
+	default:
+		return nil, errgo.Newf("unsupported protocol version %d", version)
+	}
+
+	clientKey, err := sf.DecodePublicKey(client)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	nonce, err := sf.DecodeNonce(msg.ID)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	out, ok := box.Open(nil, msg.Contents, (*[24]byte)(nonce), (*[32]byte)(clientKey), (*[32]byte)(a.keyPair.PrivateKey))
+	if !ok {
+		return nil, errgo.New("authentication failed")
+	}
+
+	var req wire.Request
+	if version == wire.Version1 {
+		// Version 1 requests seal the contents alone, with no timestamp. Their
+		// nonces are remembered for the skew window from when they arrive, so
+		// they can only be replayed after that; which is why version 1 must
+		// be allowed explicitly.
+		req.Time = time.Now()
+		req.Contents = out
+	} else {
+		err = json.Unmarshal(out, &req)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		skew := time.Now().Sub(req.Time)
+		if skew > a.maxSkew || skew < -a.maxSkew {
+			return nil, errgo.Newf("request time %v outside allowed skew", req.Time)
+		}
+	}
+	if a.nonceCache != nil {
+		seen, err := a.nonceCache.Seen(nonce, req.Time.Add(a.maxSkew))
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if seen {
+			return nil, errgo.New("replayed request")
+		}
+	}
+
+	// Only fresh requests count against the client's rate limit, so that
+	// replays of its requests cannot use it up.
+	err = a.keyLimit.allow(clientKey.Encode(), "client")
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+
+	return &Request{
+		keyPair:   a.keyPair,
+		Version:   version,
+		ClientKey: clientKey,
+		Nonce:     nonce,
+		Contents:  req.Contents,
+	}, nil
+}
+
+// Seal encodes and encrypts a response to the request. The response to a
+// version 1 request is sealed with the request nonce, and only its contents
+// are sent to the client.
+func (r *Request) Seal(data interface{}) (*wire.Message, error) {
+	var msg bytes.Buffer
+	enc := json.NewEncoder(&msg)
+	err := enc.Encode(data)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if r.Version == wire.Version1 {
+		return &wire.Message{
+			Version:  wire.Version1,
+			ID:       r.Nonce.Encode(),
+			Contents: box.Seal(nil, msg.Bytes(), (*[24]byte)(r.Nonce), (*[32]byte)(r.ClientKey), (*[32]byte)(r.keyPair.PrivateKey)),
+		}, nil
+	}
+
+	// Seal the response with a fresh nonce; the request nonce must not be
+	// reused under the same shared key.
+	nonce, err := sf.NewNonce()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &wire.Message{
+		Version:  wire.Version2,
+		ID:       nonce.Encode(),
+		Contents: box.Seal(nil, msg.Bytes(), (*[24]byte)(nonce), (*[32]byte)(r.ClientKey), (*[32]byte)(r.keyPair.PrivateKey)),
+	}, nil
+}
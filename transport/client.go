@@ -0,0 +1,221 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package transport
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/session"
+	"github.com/cmars/shadowfax/wire"
+)
+
+// SealRequest timestamps and encrypts request contents from the client key
+// pair to the server, so that the server can reject stale or replayed
+// requests. It returns the request message and the nonce it was sealed with.
+func SealRequest(keyPair *sf.KeyPair, serverKey *sf.PublicKey, contents []byte) (*wire.Message, *sf.Nonce, error) {
+	nonce, err := sf.NewNonce()
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	wireReq, err := json.Marshal(&wire.Request{
+		Time:     time.Now(),
+		Contents: contents,
+	})
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	encReq := box.Seal(nil, wireReq, (*[24]byte)(nonce), (*[32]byte)(serverKey), (*[32]byte)(keyPair.PrivateKey))
+	return &wire.Message{
+		Version:  wire.Version2,
+		ID:       nonce.Encode(),
+		Contents: encReq,
+	}, nonce, nil
+}
+
+// OpenResponse decrypts and authenticates a response from the server to a
+// request sealed with reqNonce.
+func OpenResponse(keyPair *sf.KeyPair, serverKey *sf.PublicKey, respMessage *wire.Message, reqNonce *sf.Nonce) ([]byte, error) {
+	if respMessage.Version != wire.Version2 {
+		return nil, errgo.Newf("unsupported response protocol version %d", respMessage.Version)
+	}
+	respNonce, err := sf.DecodeNonce(respMessage.ID)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if *respNonce == *reqNonce {
+		return nil, errgo.New("server reused request nonce in response")
+	}
+	decResp, ok := box.Open(nil, respMessage.Contents, (*[24]byte)(respNonce), (*[32]byte)(serverKey), (*[32]byte)(keyPair.PrivateKey))
+	if !ok {
+		return nil, errgo.New("failed to authenticate response from server")
+	}
+	return decResp, nil
+}
+
+// ReceiptError returns the error pushing a message to a recipient, given the
+// receipt returned by the server, or nil if there was none. It is nil if the
+// server accepted the message, and its cause is ErrMailboxFull if the
+// recipient's mailbox is full.
+func ReceiptError(recipient string, receipt *wire.PushReceipt) error {
+	switch {
+	case receipt == nil:
+		return errgo.New("not acknowledged")
+	case receipt.OK:
+		return nil
+	case receipt.Failure == wire.PushMailboxFull:
+		return errgo.WithCausef(nil, ErrMailboxFull, "cannot push to %q", recipient)
+	case receipt.Failure == wire.PushNoRoute:
+		return errgo.WithCausef(nil, ErrNoRoute, "server does not relay to %q", recipient)
+	default:
+		return errgo.New("not acknowledged")
+	}
+}
+
+// PopMessage contains a message received.
+type PopMessage struct {
+	ID       string
+	Sender   string
+	Contents []byte
+	Received time.Time
+
+	// SealedSender is set if the sender was hidden from the server.
+	SealedSender bool
+
+	// Session is set if the message was sealed in a forward-secret session.
+	Session bool
+}
+
+// SealSender seals a message to the recipient such that only the recipient
+// learns the sender. The message is sealed from the sender key pair as usual,
+// then sealed again, along with the sender public key, from an ephemeral key
+// which is prepended to the result.
+func SealSender(sender *sf.KeyPair, ephemeral *sf.KeyPair, nonce *sf.Nonce, rcptKey *sf.PublicKey, contents []byte) ([]byte, error) {
+	innerNonce, err := sf.NewNonce()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	envelope := make([]byte, 0, 32+24+box.Overhead+len(contents))
+	envelope = append(envelope, sender.PublicKey[:]...)
+	envelope = append(envelope, innerNonce[:]...)
+	envelope = box.Seal(envelope, contents, (*[24]byte)(innerNonce), (*[32]byte)(rcptKey), (*[32]byte)(sender.PrivateKey))
+
+	sealed := append([]byte(nil), ephemeral.PublicKey[:]...)
+	return box.Seal(sealed, envelope, (*[24]byte)(nonce), (*[32]byte)(rcptKey), (*[32]byte)(ephemeral.PrivateKey)), nil
+}
+
+// openSender opens a message sealed with SealSender, returning the sender and
+// contents.
+func openSender(keyPair *sf.KeyPair, nonce *sf.Nonce, sealed []byte) (*sf.PublicKey, []byte, bool) {
+	if len(sealed) < 32 {
+		return nil, nil, false
+	}
+	var ephemeralKey sf.PublicKey
+	copy(ephemeralKey[:], sealed[:32])
+	envelope, ok := box.Open(nil, sealed[32:], (*[24]byte)(nonce), (*[32]byte)(&ephemeralKey), (*[32]byte)(keyPair.PrivateKey))
+	if !ok || len(envelope) < 32+24 {
+		return nil, nil, false
+	}
+	var senderKey sf.PublicKey
+	var innerNonce sf.Nonce
+	copy(senderKey[:], envelope[:32])
+	copy(innerNonce[:], envelope[32:56])
+	contents, ok := box.Open(nil, envelope[56:], (*[24]byte)(&innerNonce), (*[32]byte)(&senderKey), (*[32]byte)(keyPair.PrivateKey))
+	if !ok {
+		return nil, nil, false
+	}
+	return &senderKey, contents, true
+}
+
+// OpenError reports messages which were received but could not be opened.
+// They will never open, so they should be acknowledged, or they are returned
+// again by every fetch until their lease expires.
+type OpenError struct {
+	// IDs are the IDs of the messages which could not be opened.
+	IDs []string
+
+	// Errs are the reasons each could not be opened.
+	Errs []error
+}
+
+func (e *OpenError) add(id string, err error) {
+	e.IDs = append(e.IDs, id)
+	e.Errs = append(e.Errs, err)
+}
+
+// Error implements the error interface.
+func (e *OpenError) Error() string {
+	var errmsgs []string
+	for _, err := range e.Errs {
+		errmsgs = append(errmsgs, errgo.Details(err))
+	}
+	return strings.Join(errmsgs, "\n")
+}
+
+// OpenMessages opens messages addressed to the key pair. Messages sealed in
+// a forward-secret session are opened with sessions, if not nil. If some
+// messages could not be opened, the others are returned along with an
+// *OpenError.
+func OpenMessages(keyPair *sf.KeyPair, sessions *session.Manager, wireMessages []wire.PopMessage) ([]*PopMessage, error) {
+	var popMessages []*PopMessage
+	openErr := &OpenError{}
+	for _, msg := range wireMessages {
+		nonce, err := sf.DecodeNonce(msg.ID)
+		if err != nil {
+			openErr.add(msg.ID, errgo.Notef(err, "ID=%q Sender=%q", msg.ID, msg.Sender))
+			continue
+		}
+		popMessage := &PopMessage{
+			ID:       msg.ID,
+			Sender:   msg.Sender,
+			Received: msg.Received,
+		}
+		var senderKey *sf.PublicKey
+		if msg.Sender == "" {
+			var ok bool
+			senderKey, popMessage.Contents, ok = openSender(keyPair, nonce, msg.Contents)
+			if !ok {
+				openErr.add(msg.ID, errgo.Newf("invalid sealed sender message: ID=%q", msg.ID))
+				continue
+			}
+			popMessage.Sender = senderKey.Encode()
+			popMessage.SealedSender = true
+		} else {
+			senderKey, err = sf.DecodePublicKey(msg.Sender)
+			if err != nil {
+				openErr.add(msg.ID, errgo.Notef(err, "ID=%q Sender=%q", msg.ID, msg.Sender))
+				continue
+			}
+			var ok bool
+			popMessage.Contents, ok = box.Open(nil, msg.Contents, (*[24]byte)(nonce), (*[32]byte)(senderKey), (*[32]byte)(keyPair.PrivateKey))
+			if !ok {
+				openErr.add(msg.ID, errgo.Newf("invalid message contents: ID=%q Sender=%q", msg.ID, msg.Sender))
+				continue
+			}
+		}
+		if sessions != nil && session.IsSealed(popMessage.Contents) {
+			popMessage.Contents, err = sessions.Open(senderKey, popMessage.Contents)
+			if err != nil {
+				openErr.add(msg.ID, errgo.Notef(err, "ID=%q Sender=%q", msg.ID, popMessage.Sender))
+				continue
+			}
+			popMessage.Session = true
+		}
+		popMessages = append(popMessages, popMessage)
+	}
+	if len(openErr.IDs) > 0 {
+		return popMessages, openErr
+	}
+	return popMessages, nil
+}
@@ -0,0 +1,130 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package transport
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// maxIdleBuckets is the number of token buckets tracked before buckets which
+// have completely refilled are discarded.
+const maxIdleBuckets = 4096
+
+// RateLimiter limits the rate of requests for each key, using a token bucket
+// per key. It is safe for concurrent use.
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a new RateLimiter which allows rate requests per
+// second for each key on average, and at most burst requests at once.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes a token for the given key if one is available. Otherwise, it
+// returns false and how long until a token will be available.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.sweep(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if l.rate <= 0 {
+		return false, time.Duration(math.MaxInt64)
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+func (l *RateLimiter) refill(b *tokenBucket, now time.Time) {
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+}
+
+// sweep discards buckets which have refilled, since they are equivalent to
+// new buckets.
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RateLimitError is the cause of a failure to authenticate a request which
+// exceeds a rate limit.
+type RateLimitError struct {
+	// RetryAfter is how long until the request would be allowed.
+	RetryAfter time.Duration
+}
+
+// Error implements the error interface.
+func (err *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded, retry after %v", err.RetryAfter)
+}
+
+// allow takes a token for the given key, returning an error with a
+// *RateLimitError cause if there is none. A nil limiter allows every key.
+func (l *RateLimiter) allow(key string, what string) error {
+	if l == nil {
+		return nil
+	}
+	if ok, retryAfter := l.Allow(key); !ok {
+		return errgo.WithCausef(nil, &RateLimitError{retryAfter}, "%s %q", what, key)
+	}
+	return nil
+}
+
+// AllowAddr applies a per-address rate limit to the remote address of a
+// request or connection, before it is authenticated. Addresses are limited
+// by host, so that every port of a host shares a limit. A nil limiter allows
+// every address. The cause of the error returned is a *RateLimitError if the
+// address has exceeded its limit.
+func AllowAddr(l *RateLimiter, remoteAddr string) error {
+	addr, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		addr = remoteAddr
+	}
+	return errgo.Mask(l.allow(addr, "address"), errgo.Any)
+}
@@ -0,0 +1,64 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package transport_test
+
+import (
+	"testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/cmars/shadowfax/transport"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type rateLimiterSuite struct{}
+
+var _ = gc.Suite(&rateLimiterSuite{})
+
+func (s *rateLimiterSuite) TestBurst(c *gc.C) {
+	l := transport.NewRateLimiter(1, 3)
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("a")
+		c.Assert(ok, gc.Equals, true)
+	}
+	ok, wait := l.Allow("a")
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(wait > 0 && wait <= time.Second, gc.Equals, true, gc.Commentf("wait %v", wait))
+
+	ok, _ = l.Allow("b")
+	c.Assert(ok, gc.Equals, true)
+}
+
+func (s *rateLimiterSuite) TestRefill(c *gc.C) {
+	l := transport.NewRateLimiter(100, 1)
+	ok, _ := l.Allow("a")
+	c.Assert(ok, gc.Equals, true)
+	ok, wait := l.Allow("a")
+	c.Assert(ok, gc.Equals, false)
+	time.Sleep(wait + 5*time.Millisecond)
+	ok, _ = l.Allow("a")
+	c.Assert(ok, gc.Equals, true)
+}
+
+func (s *rateLimiterSuite) TestAllowAddr(c *gc.C) {
+	c.Assert(transport.AllowAddr(nil, "10.0.0.1:1234"), gc.IsNil)
+
+	l := transport.NewRateLimiter(0.001, 1)
+	c.Assert(transport.AllowAddr(l, "10.0.0.1:1234"), gc.IsNil)
+
+	// Addresses are limited by host, regardless of port.
+	err := transport.AllowAddr(l, "10.0.0.1:5678")
+	rlErr, ok := errgo.Cause(err).(*transport.RateLimitError)
+	c.Assert(ok, gc.Equals, true, gc.Commentf("%v", err))
+	c.Assert(rlErr.RetryAfter > 0, gc.Equals, true)
+	c.Assert(transport.AllowAddr(l, "10.0.0.2:1234"), gc.IsNil)
+}
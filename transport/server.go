@@ -0,0 +1,127 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package transport
+
+import (
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	sf "github.com/cmars/shadowfax"
+	"github.com/cmars/shadowfax/storage"
+	"github.com/cmars/shadowfax/wire"
+)
+
+// PopMessages returns stored messages as they are sent to their recipient.
+func PopMessages(messages []*storage.AddressedMessage) []wire.PopMessage {
+	var wireMessages []wire.PopMessage
+	for _, entityMessage := range messages {
+		wireMessages = append(wireMessages, wire.PopMessage{
+			Message: wire.Message{
+				ID:       entityMessage.ID,
+				Contents: entityMessage.Contents,
+			},
+			Sender:   entityMessage.Sender,
+			Received: entityMessage.Received,
+		})
+	}
+	return wireMessages
+}
+
+// Expires returns the expiration time of a message received now, given the
+// sender's requested time-to-live in seconds and the longest time the server
+// keeps messages. If maxTTL is zero, the message only expires when requested
+// by the sender; a zero time is returned if it never expires.
+func Expires(now time.Time, ttlSeconds int64, maxTTL time.Duration) time.Time {
+	ttl := time.Duration(ttlSeconds) * time.Second
+	if ttl <= 0 || (maxTTL > 0 && ttl > maxTTL) {
+		ttl = maxTTL
+	}
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// Route returns the recipient key of a message pushed to an address, and the
+// home router to relay it to, which is empty if the address names no router
+// or names routerName.
+func Route(recipient, routerName string) (string, string) {
+	addr, err := sf.ParseAddress(recipient)
+	if err != nil {
+		// Left for the service to reject.
+		return recipient, ""
+	}
+	if addr.Router == "" || addr.Router == routerName {
+		return addr.Key.Encode(), ""
+	}
+	return addr.Key.Encode(), addr.Router
+}
+
+// PushFunc stores a pushed message, or forwards it towards the recipient's
+// home router. The recipient of the message is the address to which it was
+// pushed.
+type PushFunc func(msg *storage.AddressedMessage) error
+
+// Push passes each message of a push request to push, and returns a receipt
+// for each message ID. The sender of each message is the client, unless the
+// sender is sealed. Messages expire as requested by the sender, up to maxTTL.
+// A message pushed more than once in a request is only pushed again if it
+// failed.
+func (r *Request) Push(wireMessages []wire.PushMessage, maxTTL time.Duration, push PushFunc) []wire.PushReceipt {
+	now := time.Now()
+	receipts := make(map[string]wire.PushReceipt)
+	for _, wireMessage := range wireMessages {
+		if wireMessage.Recipient == "" {
+			continue
+		}
+		if receipt, ok := receipts[wireMessage.ID]; ok && receipt.OK {
+			continue
+		}
+		sender := r.ClientKey.Encode()
+		if wireMessage.SealedSender {
+			// The client key is ephemeral, and not worth keeping.
+			sender = ""
+		}
+		err := push(&storage.AddressedMessage{
+			Recipient: wireMessage.Recipient,
+			Sender:    sender,
+			Message: storage.Message{
+				ID:       wireMessage.ID,
+				Contents: wireMessage.Contents,
+			},
+			Received: now,
+			Expires:  Expires(now, wireMessage.TTL, maxTTL),
+		})
+		receipts[wireMessage.ID] = PushReceipt(wireMessage.ID, err)
+	}
+
+	var pushReceipts []wire.PushReceipt
+	for _, receipt := range receipts {
+		pushReceipts = append(pushReceipts, receipt)
+	}
+	return pushReceipts
+}
+
+// PushReceipt returns the receipt for a message, given the error storing or
+// relaying it.
+func PushReceipt(id string, err error) wire.PushReceipt {
+	if err == nil {
+		return wire.PushReceipt{ID: id, OK: true}
+	}
+	logError(err)
+	failure := wire.PushFailed
+	switch errgo.Cause(err) {
+	case storage.ErrMailboxFull:
+		failure = wire.PushMailboxFull
+	case ErrNoRoute:
+		failure = wire.PushNoRoute
+	}
+	return wire.PushReceipt{ID: id, OK: false, Failure: failure}
+}
@@ -0,0 +1,43 @@
+/*
+  Copyright 2015 Casey Marshall.
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+// Package transport provides what the shadowfax HTTP and TCP transports have
+// in common: sealing and authenticating requests and responses, storing
+// pushed messages, and opening the messages received.
+package transport
+
+import (
+	"log"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// DefaultLeaseTime is how long fetched messages are reserved for a
+// recipient before they become available to fetch again.
+const DefaultLeaseTime = 5 * time.Minute
+
+// DefaultMaxSkew is how far the timestamp of a request may differ from the
+// server's clock before the request is rejected.
+const DefaultMaxSkew = 5 * time.Minute
+
+// DefaultMaxTTL is the longest time a message is kept before it expires, if
+// not delivered.
+const DefaultMaxTTL = 7 * 24 * time.Hour
+
+// ErrMailboxFull is the cause of a failure to push a message because the
+// recipient's mailbox on the server is full.
+var ErrMailboxFull = errgo.New("recipient mailbox full")
+
+// ErrNoRoute is the cause of a failure to push a message to a recipient whose
+// home router is elsewhere, when the server does not relay messages there.
+var ErrNoRoute = errgo.New("no route to home router")
+
+func logError(err error) {
+	log.Println(errgo.Details(err))
+}
@@ -8,6 +8,21 @@
 
 package wire
 
+import (
+	"time"
+)
+
+const (
+	// Version1 is the original protocol, in which the response to a request
+	// is sealed with the request nonce. It is only accepted by servers which
+	// allow it during migration.
+	Version1 = 1
+
+	// Version2 responses are sealed with a freshly generated nonce, which is
+	// sent alongside the response in a Message.
+	Version2 = 2
+)
+
 type Error struct {
 	Code    int    `json:"code,omitempty"`
 	Message string `json:"message,omitempty"`
@@ -18,7 +33,13 @@ type PublicKeyResponse struct {
 	PublicKey string `json:"public-key"`
 }
 
+type Request struct {
+	Time     time.Time `json:"time"`
+	Contents []byte    `json:"contents,omitempty"`
+}
+
 type Message struct {
+	Version  int    `json:"version,omitempty"`
 	ID       string `json:"id"`
 	Contents []byte `json:"contents"`
 }
@@ -26,14 +47,133 @@ type Message struct {
 type PushMessage struct {
 	Message
 	Recipient string `json:"recipient,omitempty"`
+	TTL       int64  `json:"ttl,omitempty"`
+
+	// SealedSender is set when the request is authenticated with an
+	// ephemeral key, and the sender is known only to the recipient. The
+	// server stores the message without a sender.
+	SealedSender bool `json:"sealed-sender,omitempty"`
 }
 
 type PopMessage struct {
 	Message
-	Sender string `json:"sender,omitempty"`
+	Sender   string    `json:"sender,omitempty"`
+	Received time.Time `json:"received"`
 }
 
+// Reasons a pushed message was not accepted.
+const (
+	PushFailed      = "failed"
+	PushMailboxFull = "mailbox-full"
+
+	// PushNoRoute is the failure of a message to a recipient whose home
+	// router is elsewhere, when the server does not relay messages.
+	PushNoRoute = "no-route"
+)
+
 type PushReceipt struct {
-	ID string `json:"id"`
-	OK bool   `json:"ok"`
+	ID      string `json:"id"`
+	OK      bool   `json:"ok"`
+	Failure string `json:"failure,omitempty"`
+}
+
+// RelayMessage is a message relayed by the sender's router to the home
+// router of the recipient, in a request authenticated by the key of the
+// relaying router. The response is a PushReceipt for each message.
+type RelayMessage struct {
+	Message
+	Recipient string `json:"recipient"`
+	Sender    string `json:"sender,omitempty"`
+	TTL       int64  `json:"ttl,omitempty"`
+}
+
+type FetchRequest struct {
+	Wait int64 `json:"wait,omitempty"`
+}
+
+type FetchResponse struct {
+	Messages []PopMessage `json:"messages"`
+	Expires  time.Time    `json:"expires"`
+}
+
+type AckRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// ChunkManifest describes a payload sent as a sequence of chunks. It is
+// sealed to the recipient and sent after the last chunk.
+type ChunkManifest struct {
+	Size   int64  `json:"size"`
+	Chunks int    `json:"chunks"`
+	SHA256 []byte `json:"sha256"`
+}
+
+// PrekeyBatch is a batch of public prekeys uploaded by a recipient, in a
+// request authenticated by the recipient's key.
+type PrekeyBatch struct {
+	// Prekeys are one-time prekeys to add to those left to be claimed.
+	Prekeys []SignedPrekey `json:"prekeys"`
+
+	// LastResort, if set, replaces the recipient's last-resort prekey.
+	LastResort *SignedPrekey `json:"last-resort,omitempty"`
+}
+
+// SignedPrekey is a public prekey, signed by the key of the recipient who
+// published it.
+type SignedPrekey struct {
+	Prekey    string `json:"prekey"`
+	Signature []byte `json:"signature"`
+}
+
+// PrekeyCount is how many prekeys a recipient has left to be claimed.
+type PrekeyCount struct {
+	Count int `json:"count"`
+
+	// LastResort is whether the recipient has a last-resort prekey.
+	LastResort bool `json:"last-resort"`
+}
+
+// PrekeyClaimRequest asks for one of a recipient's prekeys, with which the
+// sender may start a session.
+type PrekeyClaimRequest struct {
+	Recipient string `json:"recipient"`
+}
+
+// PrekeyClaim is a prekey claimed by a sender. The sender should check its
+// signature by the recipient before starting a session with it.
+type PrekeyClaim struct {
+	SignedPrekey
+}
+
+// KeyRotation announces that the sender has moved to a new public key. It is
+// sent from the old key, with proof from the new key for the recipient.
+type KeyRotation struct {
+	NewKey string    `json:"new-key"`
+	Time   time.Time `json:"time"`
+	Nonce  string    `json:"nonce"`
+	Proof  []byte    `json:"proof"`
+}
+
+// DeliveryReceipt acknowledges to the sender of messages that they were
+// delivered to the recipient.
+type DeliveryReceipt struct {
+	IDs  []string  `json:"ids"`
+	Time time.Time `json:"time"`
+}
+
+// EnvelopeVersion1 is the first version of the message envelope.
+const EnvelopeVersion1 = 1
+
+// Envelope describes the contents of a message, which follow it inside the
+// sealed message. It is known only to the sender and recipient.
+type Envelope struct {
+	ContentType string    `json:"content-type"`
+	Time        time.Time `json:"time"`
+	Subject     string    `json:"subject,omitempty"`
+
+	// InReplyTo is the ID of the message this one replies to.
+	InReplyTo string `json:"in-reply-to,omitempty"`
+
+	// Headers are any further fields, for extensions.
+	Headers map[string]string `json:"headers,omitempty"`
 }